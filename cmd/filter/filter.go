@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/objectiveryan/irsal/internal/common"
+	"github.com/objectiveryan/irsal/internal/db"
+)
+
+func flagError(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	fmt.Fprintln(os.Stderr, "Usage: filter [flags] list | add RULE | rm ID")
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func main() {
+	group := flag.String("group", "", "Hypothesis group")
+	chatID := flag.Int64("chat", 0, "Telegram chat ID")
+	dbpath := flag.String("db", "", "Path to database file")
+	flag.Parse()
+
+	if *group == "" {
+		flagError("No Hypothesis group given")
+	}
+	if *dbpath == "" {
+		flagError("No db path given")
+	}
+	if *chatID == 0 {
+		flagError("No chat ID given")
+	}
+	if len(flag.Args()) == 0 {
+		flagError("No command given")
+	}
+
+	storage, err := db.NewSqliteStorage(*dbpath)
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	key := common.SubKey{HypGroup: *group, ChatID: *chatID}
+	if _, err := storage.Subscription(key.ChatID, key.HypGroup); err != nil {
+		log.Fatalf("Failed to look up subscription: %v", err)
+	}
+
+	switch cmd, args := flag.Arg(0), flag.Args()[1:]; {
+	case cmd == "list" && len(args) == 0:
+		rules, err := storage.Filters(key)
+		if err != nil {
+			log.Fatalf("Failed to get filters: %v", err)
+		}
+		for _, rule := range rules {
+			fmt.Printf("%d\t%v\n", rule.ID, rule)
+		}
+	case cmd == "add" && len(args) == 1:
+		rule, err := common.ParseFilterRule(args[0])
+		if err != nil {
+			flagError("Invalid rule: %v", err)
+		}
+		if err := storage.AddFilter(key, rule); err != nil {
+			log.Fatalf("Failed to add filter: %v", err)
+		}
+		fmt.Printf("%d\t%v\n", rule.ID, rule)
+	case cmd == "rm" && len(args) == 1:
+		id, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			flagError("Invalid rule ID: %q", args[0])
+		}
+		if err := storage.RemoveFilter(key, id); err != nil {
+			log.Fatalf("Failed to remove filter: %v", err)
+		}
+	default:
+		flagError("Unexpected arguments: %q", flag.Args())
+	}
+}
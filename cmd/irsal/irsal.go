@@ -5,12 +5,17 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
+	"strings"
 
 	"github.com/carlmjohnson/flowmatic"
 
+	"github.com/objectiveryan/irsal/internal/crypt"
 	"github.com/objectiveryan/irsal/internal/db"
 	"github.com/objectiveryan/irsal/internal/hyp"
+	"github.com/objectiveryan/irsal/internal/media"
+	"github.com/objectiveryan/irsal/internal/oauth"
 	"github.com/objectiveryan/irsal/internal/poller"
 	"github.com/objectiveryan/irsal/internal/tbot"
 )
@@ -21,9 +26,30 @@ func flagError(format string, args ...interface{}) {
 	os.Exit(2)
 }
 
+// serveHTTP runs srv until ctxt is done.
+func serveHTTP(ctxt context.Context, srv *http.Server) error {
+	go func() {
+		<-ctxt.Done()
+		log.Println("Stopping HTTP server")
+		srv.Close()
+	}()
+	log.Printf("Serving HTTP on %s", srv.Addr)
+	if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+		return err
+	}
+	return ctxt.Err()
+}
+
 func main() {
 	token := flag.String("token", "", "Telegram bot token")
 	dbpath := flag.String("db", "", "Path to database file")
+	keyFile := flag.String("key_file", "", "File containing a hex-encoded 32-byte key for encrypting users' and subscriptions' Hypothesis tokens; without one, users can't /login")
+	oauthClientID := flag.String("oauth_client_id", "", "Hypothesis OAuth client ID; if given, users log in with Hypothesis instead of sending API tokens")
+	oauthClientSecret := flag.String("oauth_client_secret", "", "Hypothesis OAuth client secret, for confidential clients")
+	httpAddr := flag.String("http_addr", ":8080", "Address to serve the OAuth callback and media on")
+	publicURL := flag.String("public_url", "", "URL at which the HTTP server is reachable from browsers, e.g. https://irsal.example.com")
+	mediaDir := flag.String("media_dir", "", "Directory to store photos and files sent in replies in; without one, only their captions are posted")
+	mediaURL := flag.String("media_url", "", "URL at which -media_dir is reachable from browsers, if it's served by another web server; otherwise it's served at /media/ under -public_url")
 	flag.Parse()
 
 	if *token == "" {
@@ -32,6 +58,17 @@ func main() {
 	if *dbpath == "" {
 		flagError("No db path given")
 	}
+	if *oauthClientID != "" {
+		if *keyFile == "" {
+			flagError("OAuth login needs a -key_file")
+		}
+		if *publicURL == "" {
+			flagError("OAuth login needs a -public_url")
+		}
+	}
+	if *mediaDir != "" && *mediaURL == "" && *publicURL == "" {
+		flagError("Storing media needs a -public_url or -media_url")
+	}
 	if len(flag.Args()) > 0 {
 		flagError("Unexpected argument: %q", flag.Arg(0))
 	}
@@ -43,9 +80,22 @@ func main() {
 	}
 	hypFactory := hyp.NewClientFactory()
 	b := &tbot.Bot{
-		*token,
-		storage,
-		hypFactory,
+		Token:   *token,
+		Storage: storage,
+		Hyp:     hypFactory,
+	}
+	if *keyFile != "" {
+		key, err := crypt.ReadKeyFile(*keyFile)
+		if err != nil {
+			log.Fatalf("Failed to read key: %v", err)
+		}
+		b.Cipher, err = crypt.NewCipher(key)
+		if err != nil {
+			log.Fatalf("Invalid key: %v", err)
+		}
+		if err := storage.SetCipher(b.Cipher); err != nil {
+			log.Fatalf("Failed to encrypt subscription tokens: %v", err)
+		}
 	}
 	br := tbot.NewBotRunner(b)
 	p := &poller.Poller{
@@ -53,7 +103,40 @@ func main() {
 		storage,
 		br,
 	}
-	err = flowmatic.All(context.Background(), p.Run, br.Run)
+	tasks := []func(context.Context) error{p.Run, br.Run}
+	mux := http.NewServeMux()
+	serve := false
+	if *oauthClientID != "" {
+		redirectURL := strings.TrimSuffix(*publicURL, "/") + "/oauth/callback"
+		b.OAuth = &oauth.Linker{
+			Config:  oauth.HypothesisConfig(*oauthClientID, *oauthClientSecret, redirectURL),
+			Storage: storage,
+			Cipher:  b.Cipher,
+			Hyp:     hypFactory,
+		}
+		mux.Handle("/oauth/callback", b.OAuth)
+		tasks = append(tasks, b.OAuth.Run)
+		serve = true
+	}
+	if *mediaDir != "" {
+		if err := os.MkdirAll(*mediaDir, 0755); err != nil {
+			log.Fatalf("Failed to create media directory: %v", err)
+		}
+		store := &media.DirStore{Dir: *mediaDir, BaseURL: *mediaURL}
+		if *mediaURL == "" {
+			store.BaseURL = strings.TrimSuffix(*publicURL, "/") + "/media/"
+			mux.Handle("/media/", store)
+			serve = true
+		}
+		b.Media = store
+	}
+	if serve {
+		srv := &http.Server{Addr: *httpAddr, Handler: mux}
+		tasks = append(tasks, func(ctxt context.Context) error {
+			return serveHTTP(ctxt, srv)
+		})
+	}
+	err = flowmatic.All(context.Background(), tasks...)
 	if err != nil {
 		log.Fatal(err)
 	}
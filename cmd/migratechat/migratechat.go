@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/objectiveryan/irsal/internal/db"
+)
+
+func flagError(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func main() {
+	from := flag.Int64("from", 0, "Old Telegram chat ID")
+	to := flag.Int64("to", 0, "New Telegram chat ID")
+	dbpath := flag.String("db", "", "Path to database file")
+	flag.Parse()
+
+	if *dbpath == "" {
+		flagError("No db path given")
+	}
+	if *from == 0 {
+		flagError("No old chat ID given")
+	}
+	if *to == 0 {
+		flagError("No new chat ID given")
+	}
+	if *from == *to {
+		flagError("Old and new chat IDs are the same")
+	}
+	if len(flag.Args()) > 0 {
+		flagError("Unexpected argument: %q", flag.Arg(0))
+	}
+
+	storage, err := db.NewSqliteStorage(*dbpath)
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	if err := storage.MigrateChat(*from, *to); err != nil {
+		log.Fatalf("Failed to migrate chat: %v", err)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/objectiveryan/irsal/internal/common"
+	"github.com/objectiveryan/irsal/internal/db"
+	"github.com/objectiveryan/irsal/internal/poller"
+)
+
+func flagError(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	fmt.Fprintln(os.Stderr, "Usage: subopt [flags] [NAME [VALUE]]")
+	fmt.Fprintf(os.Stderr, "Options: %s\n", strings.Join(poller.OptionNames(), ", "))
+	flag.PrintDefaults()
+	os.Exit(2)
+}
+
+func main() {
+	group := flag.String("group", "", "Hypothesis group")
+	chatID := flag.Int64("chat", 0, "Telegram chat ID")
+	dbpath := flag.String("db", "", "Path to database file")
+	flag.Parse()
+
+	if *group == "" {
+		flagError("No Hypothesis group given")
+	}
+	if *dbpath == "" {
+		flagError("No db path given")
+	}
+	if *chatID == 0 {
+		flagError("No chat ID given")
+	}
+	if len(flag.Args()) > 2 {
+		flagError("Unexpected argument: %q", flag.Arg(2))
+	}
+
+	storage, err := db.NewSqliteStorage(*dbpath)
+	if err != nil {
+		log.Fatalf("Failed to open database: %v", err)
+	}
+	key := common.SubKey{HypGroup: *group, ChatID: *chatID}
+	if _, err := storage.Subscription(key.ChatID, key.HypGroup); err != nil {
+		log.Fatalf("Failed to look up subscription: %v", err)
+	}
+
+	if len(flag.Args()) == 2 {
+		name, value := flag.Arg(0), flag.Arg(1)
+		if err := poller.ValidateOption(name, value); err != nil {
+			flagError("Invalid option: %v", err)
+		}
+		if err := storage.SetSubscriptionOption(key, name, value); err != nil {
+			log.Fatalf("Failed to set option: %v", err)
+		}
+		return
+	}
+
+	opts, err := storage.SubscriptionOptions(key)
+	if err != nil {
+		log.Fatalf("Failed to get options: %v", err)
+	}
+	for _, name := range poller.OptionNames() {
+		if flag.NArg() == 0 || flag.Arg(0) == name {
+			fmt.Printf("%s=%q\n", name, opts[name])
+		}
+	}
+}
@@ -34,18 +34,327 @@ type AnnotationMetadata struct {
 	URI        string
 }
 
+// A Message is a chat message to send.
+type Message struct {
+	Text string
+	// Whether Text uses Telegram's HTML formatting, rather than plain text
+	HTML bool
+	// Whether to disable link previews
+	NoPreview bool
+	// Forum topic to send the message in, or 0 for the chat's main timeline
+	ThreadID int
+	// Buttons to show under the message
+	Buttons []Button
+}
+
+// Actions buttons can ask the bot to do to the annotation a message is about
+const (
+	// Mute or unmute notifications about its thread for whoever presses it
+	ActionMute = "mute"
+	// Post its whole thread
+	ActionThread = "thread"
+)
+
+// A Button is shown under a message. It opens URL if set, or else asks the
+// bot to do Action.
+type Button struct {
+	Text   string
+	URL    string `json:",omitempty"`
+	Action string `json:",omitempty"`
+}
+
+// A DocumentHeader is a message introducing a document's annotations in a
+// chat, which root annotations are posted as replies to.
+type DocumentHeader struct {
+	ChatID    int64
+	URI       string
+	MessageID int
+	Title     string
+	// Number of annotations the message says there are
+	Count int
+	// Whether the message has been sent. A header is recorded before it's
+	// sent, like an OutboxEntry.
+	State OutboxState
+}
+
+// A MessagePart continues a message which was too long to send as one. Parts
+// are recorded before they're sent, like OutboxEntries, and removed by
+// CompleteMessagePart.
+type MessagePart struct {
+	ChatID           int64
+	PrimaryMessageID int
+	// Position of the part, counting the primary message as 0
+	Index   int
+	Message Message
+	State   OutboxState
+}
+
+// A Topic is a forum topic for a document's annotations in a chat.
+type Topic struct {
+	ChatID int64
+	URI    string
+	Name   string
+	// Telegram's ID for the topic, once it's created
+	ThreadID int
+	// Whether the topic has been created. A topic is recorded before it's
+	// created, like an OutboxEntry.
+	State OutboxState
+}
+
+// A UserToken is the Hypothesis token a Telegram user posts with.
+type UserToken struct {
+	// Telegram user ID
+	UserID int64
+	// Hypothesis account, e.g. "acct:alice@hypothes.is"
+	HypUser string
+	// The token, encrypted
+	Token []byte
+	// The encrypted OAuth refresh token, if the token came from logging in
+	// with OAuth rather than being pasted
+	RefreshToken []byte
+	// When the token expires, or zero if it doesn't
+	Expiry time.Time
+}
+
+// An AnnotationOrigin records the Telegram message an annotation was posted
+// from.
+type AnnotationOrigin struct {
+	AnnotID   string
+	ChatID    int64
+	MessageID int
+	// The message's sender
+	UserID int64
+	Name   string
+	// The annotation's text as posted, which may say who it's from
+	Text string
+	// The message's text, as Markdown
+	Body string
+}
+
+// A UserLink pairs a Hypothesis account with the Telegram user who logged in
+// with it, so that messages about their annotations can mention them.
+type UserLink struct {
+	// Hypothesis account, e.g. "acct:alice@hypothes.is"
+	HypUser string
+	// Telegram user ID
+	UserID int64
+	// The Telegram user's name, as of their last message
+	Name string
+}
+
+// A SubscriptionToken is an OAuth token for a subscription, which replaces
+// the subscription's HypToken.
+type SubscriptionToken struct {
+	Key          SubKey
+	AccessToken  string
+	RefreshToken string
+	Expiry       time.Time
+}
+
+type OutboxState int
+
+const (
+	// The message has been recorded but no attempt has been made to send it.
+	OutboxPending OutboxState = iota
+	// An attempt to send the message has started. If we find an entry in this
+	// state after a restart, we can't know whether it reached the chat.
+	OutboxSending
+	// The message was sent, but it may not have been recorded in
+	// AnnotationMessages yet.
+	OutboxSent
+)
+
+func (st OutboxState) String() string {
+	switch st {
+	case OutboxPending:
+		return "pending"
+	case OutboxSending:
+		return "sending"
+	case OutboxSent:
+		return "sent"
+	}
+	return fmt.Sprintf("OutboxState(%d)", int(st))
+}
+
+// An OutboxEntry is a chat message we intend to send for an annotation.
+// It is recorded before the message is sent and removed once the message ID
+// has been recorded with SetMessageID.
+type OutboxEntry struct {
+	ID              int64
+	AnnotID         string
+	Meta            AnnotationMetadata
+	ChatID          int64
+	ParentMessageID int
+	Message         Message
+	State           OutboxState
+	MessageID       int
+}
+
+// A DigestItem is an annotation waiting to be posted as part of a digest
+// message. Items returned by DigestMessageItems only have AnnotID and Meta.
+type DigestItem struct {
+	AnnotID string
+	Meta    AnnotationMetadata
+	User    string
+	Quote   string
+	Text    string
+	Queued  time.Time
+}
+
+// A DigestOutboxEntry is a digest message we intend to send. It is recorded
+// before the message is sent and removed by CompleteDigest.
+type DigestOutboxEntry struct {
+	Key SubKey
+	// The items in the digest, in the order they're numbered in
+	AnnotIDs  []string
+	Message   Message
+	State     OutboxState
+	MessageID int
+}
+
+// A Notification is a private message to a Telegram user about an annotation
+// which replies to or mentions them. It is recorded before it's sent, like an
+// OutboxEntry, and kept afterwards so it isn't sent again.
+type Notification struct {
+	AnnotID string
+	UserID  int64
+	// The annotation which starts the thread, which replying with /mute mutes
+	RootID    string
+	Message   Message
+	State     OutboxState
+	MessageID int
+}
+
 type Storage interface {
 	Close() error
 
+	// MessageID returns the message an annotation was posted as, including
+	// digest messages.
 	MessageID(annotID string, chatID int64) (int, error)
 	SetMessageID(annotID string, meta AnnotationMetadata, chatID int64, messageID int) error
 	AnnotationID(chatID int64, messageID int) (string, AnnotationMetadata, error)
+	// AnnotationBridged returns whether an annotation was posted, or is about
+	// to be, in any chat, including as part of a digest.
+	AnnotationBridged(annotID string) (bool, error)
+	// AddMessagePart records that messageID continues primaryMessageID, which
+	// was too long to send as one message. AnnotationID and DigestMessageItems
+	// treat the parts as the primary message.
+	AddMessagePart(chatID int64, primaryMessageID, messageID int) error
+	// AddPendingMessageParts records parts about to be sent, all at once.
+	AddPendingMessageParts(parts []*MessagePart) error
+	PendingMessageParts() ([]*MessagePart, error)
+	SetMessagePartState(part *MessagePart) error
+	// CompleteMessagePart atomically records a sent part as AddMessagePart
+	// would, and removes it from the pending parts.
+	CompleteMessagePart(part *MessagePart, messageID int) error
+
+	// Topic returns the forum topic for a document in a chat.
+	Topic(chatID int64, uri string) (*Topic, error)
+	// SetTopic adds or replaces a document's forum topic.
+	SetTopic(t *Topic) error
+	// PendingTopics returns the topics which may not have been created.
+	PendingTopics() ([]*Topic, error)
+
+	DocumentHeader(chatID int64, uri string) (*DocumentHeader, error)
+	// SetDocumentHeader adds or replaces the header for a document in a chat.
+	SetDocumentHeader(h *DocumentHeader) error
+	// AnnotationCount returns how many annotations on a document have been
+	// posted in a chat, not counting digests.
+	AnnotationCount(chatID int64, uri string) (int, error)
+
+	UserToken(userID int64) (*UserToken, error)
+	// SetUserToken adds or replaces a user's token.
+	SetUserToken(t *UserToken) error
+	DeleteUserToken(userID int64) error
+	// ExpiringUserTokens returns the tokens which expire before t.
+	ExpiringUserTokens(t time.Time) ([]*UserToken, error)
+	// UserLink returns the Telegram user linked to a Hypothesis account.
+	UserLink(hypUser string) (*UserLink, error)
+	// SetUserLink links two accounts, replacing any other link of either.
+	SetUserLink(l *UserLink) error
+	DeleteUserLink(userID int64) error
+
+	AddAnnotationOrigin(o *AnnotationOrigin) error
+	// AnnotationOrigin returns the message an annotation was posted from.
+	AnnotationOrigin(annotID string) (*AnnotationOrigin, error)
+
+	// LinkedChannel returns the channel whose discussion group chatID is.
+	LinkedChannel(chatID int64) (int64, error)
+	// SetLinkedChannel records that chatID is channelID's discussion group.
+	SetLinkedChannel(chatID, channelID int64) error
+
+	// MigrateChat moves everything stored about a chat to its new ID, as
+	// when Telegram upgrades a group to a supergroup.
+	MigrateChat(oldChatID, newChatID int64) error
+
+	// NotificationsEnabled returns whether a Telegram user wants private
+	// messages about replies to and mentions of them.
+	NotificationsEnabled(userID int64) (bool, error)
+	SetNotificationsEnabled(userID int64, enabled bool) error
+	// AnyNotificationsEnabled returns whether any Telegram user linked to a
+	// Hypothesis account wants notifications.
+	AnyNotificationsEnabled() (bool, error)
+	// ThreadMuted returns whether a user muted notifications about the thread
+	// starting with the annotation rootID.
+	ThreadMuted(userID int64, rootID string) (bool, error)
+	MuteThread(userID int64, rootID string) error
+	UnmuteThread(userID int64, rootID string) error
+	// AddNotification records a notification about to be sent. A user is
+	// only notified once about each annotation.
+	AddNotification(n *Notification) error
+	Notification(annotID string, userID int64) (*Notification, error)
+	PendingNotifications() ([]*Notification, error)
+	SetNotificationState(annotID string, userID int64, state OutboxState, messageID int) error
+	// NotificationThread returns the RootID of the notification sent to a
+	// user as messageID.
+	NotificationThread(userID int64, messageID int) (string, error)
+
+	// SetSubscriptionToken adds or replaces a subscription's OAuth token,
+	// which Subscription and Subscriptions return as its HypToken.
+	SetSubscriptionToken(t *SubscriptionToken) error
+	// ExpiringSubscriptionTokens returns the tokens which expire before t.
+	ExpiringSubscriptionTokens(t time.Time) ([]*SubscriptionToken, error)
+
+	// AddOutboxEntry records a new entry and sets its ID.
+	AddOutboxEntry(e *OutboxEntry) error
+	OutboxEntry(annotID string, chatID int64) (*OutboxEntry, error)
+	PendingOutboxEntries() ([]*OutboxEntry, error)
+	SetOutboxState(id int64, state OutboxState, messageID int) error
+	// CompleteOutboxEntry atomically records the entry's message ID, as
+	// SetMessageID would, and removes the entry from the outbox.
+	CompleteOutboxEntry(id int64) error
 
 	AddSubscription(*Subscription) error
 	Subscriptions() ([]*Subscription, error)
 	UpdateSubscription(sub *Subscription) error
 	Subscription(chatID int64, hypGroup string) (*Subscription, error)
 
+	// SubscriptionOptions returns the options set for a subscription by name.
+	SubscriptionOptions(key SubKey) (map[string]string, error)
+	// SetSubscriptionOption sets an option, or unsets it if value is empty.
+	SetSubscriptionOption(key SubKey, name, value string) error
+
+	// AddDigestItem queues an item for the subscription's next digest. Items
+	// already queued are ignored.
+	AddDigestItem(key SubKey, item *DigestItem) error
+	DigestItems(key SubKey) ([]*DigestItem, error)
+	// AddDigestOutboxEntry records a digest about to be sent. A subscription
+	// has at most one.
+	AddDigestOutboxEntry(e *DigestOutboxEntry) error
+	DigestOutboxEntry(key SubKey) (*DigestOutboxEntry, error)
+	SetDigestOutboxState(key SubKey, state OutboxState, messageID int) error
+	// CompleteDigest records that items were posted as messageID, in order,
+	// and removes them from the queue along with the subscription's digest
+	// outbox entry.
+	CompleteDigest(key SubKey, messageID int, items []*DigestItem) error
+	// DigestMessageItems returns the items posted as a digest message, in order.
+	DigestMessageItems(chatID int64, messageID int) ([]*DigestItem, error)
+
+	Filters(key SubKey) ([]*FilterRule, error)
+	// AddFilter records a new rule and sets its ID.
+	AddFilter(key SubKey, rule *FilterRule) error
+	RemoveFilter(key SubKey, id int64) error
+
 	Lock()
 	Unlock()
 }
@@ -0,0 +1,85 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+)
+
+type FilterField string
+
+const (
+	// Hypothesis account, e.g. "acct:alice@hypothes.is", or just "alice"
+	FilterUser FilterField = "user"
+	FilterTag  FilterField = "tag"
+	// Pattern for the whole URI, where "*" matches any sequence of characters
+	FilterURI FilterField = "uri"
+	// Host name of the URI, which also matches subdomains
+	FilterDomain FilterField = "domain"
+	// Case-insensitive text to look for in the annotation or its quote
+	FilterKeyword FilterField = "keyword"
+	// Annotations without text. Takes no pattern.
+	FilterHighlight FilterField = "highlight"
+	// Replies, as opposed to top-level annotations. Takes no pattern.
+	FilterReply FilterField = "reply"
+)
+
+// HasPattern reports whether rules for the field take a pattern.
+func (f FilterField) HasPattern() bool {
+	return f != FilterHighlight && f != FilterReply
+}
+
+func (f FilterField) valid() bool {
+	switch f {
+	case FilterUser, FilterTag, FilterURI, FilterDomain, FilterKeyword, FilterHighlight, FilterReply:
+		return true
+	}
+	return false
+}
+
+// A FilterRule decides which annotations are posted for a subscription.
+// An annotation is posted if it matches no exclude rules and, for each field
+// that has include rules, at least one of those.
+type FilterRule struct {
+	ID      int64
+	Exclude bool
+	Field   FilterField
+	Pattern string
+}
+
+// ParseFilterRule parses rules of the form "[+|-]field[:pattern]", e.g.
+// "-user:acct:bob@hypothes.is" or "+reply". Rules are include rules unless
+// they start with "-".
+func ParseFilterRule(s string) (*FilterRule, error) {
+	var rule FilterRule
+	switch {
+	case strings.HasPrefix(s, "-"):
+		rule.Exclude = true
+		s = s[1:]
+	case strings.HasPrefix(s, "+"):
+		s = s[1:]
+	}
+	field, pattern, hasPattern := strings.Cut(s, ":")
+	rule.Field = FilterField(field)
+	rule.Pattern = pattern
+	if !rule.Field.valid() {
+		return nil, fmt.Errorf("unknown filter field %q", field)
+	}
+	if rule.Field.HasPattern() && pattern == "" {
+		return nil, fmt.Errorf("filter field %q needs a pattern", field)
+	}
+	if !rule.Field.HasPattern() && hasPattern {
+		return nil, fmt.Errorf("filter field %q takes no pattern", field)
+	}
+	return &rule, nil
+}
+
+func (r *FilterRule) String() string {
+	sign := "+"
+	if r.Exclude {
+		sign = "-"
+	}
+	if !r.Field.HasPattern() {
+		return sign + string(r.Field)
+	}
+	return sign + string(r.Field) + ":" + r.Pattern
+}
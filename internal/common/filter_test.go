@@ -0,0 +1,53 @@
+package common
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseFilterRule(t *testing.T) {
+	tests := []struct {
+		in   string
+		want *FilterRule
+	}{
+		{"user:alice", &FilterRule{Field: FilterUser, Pattern: "alice"}},
+		{"+tag:foo", &FilterRule{Field: FilterTag, Pattern: "foo"}},
+		{"-user:acct:bob@hypothes.is", &FilterRule{Exclude: true, Field: FilterUser, Pattern: "acct:bob@hypothes.is"}},
+		{"uri:https://example.test/*", &FilterRule{Field: FilterURI, Pattern: "https://example.test/*"}},
+		{"-highlight", &FilterRule{Exclude: true, Field: FilterHighlight}},
+		{"+reply", &FilterRule{Field: FilterReply}},
+		{"color:red", nil},
+		{"keyword", nil},
+		{"keyword:", nil},
+		{"reply:yes", nil},
+		{"", nil},
+	}
+	for _, tt := range tests {
+		got, err := ParseFilterRule(tt.in)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("ParseFilterRule(%q) returned %+v; want error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("ParseFilterRule(%q) returned err=%v", tt.in, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseFilterRule(%q)=%+v; want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestFilterRuleString(t *testing.T) {
+	for _, s := range []string{"+user:alice", "-tag:foo", "+uri:https://example.test/*", "-highlight", "+reply"} {
+		rule, err := ParseFilterRule(s)
+		if err != nil {
+			t.Fatalf("ParseFilterRule(%q) returned err=%v", s, err)
+		}
+		if got := rule.String(); got != s {
+			t.Errorf("String()=%q; want %q", got, s)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+// Package crypt encrypts secrets, such as users' Hypothesis tokens, before
+// they are stored.
+package crypt
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// KeySize is the size of keys in bytes, for AES-256.
+const KeySize = 32
+
+// A Cipher encrypts and authenticates data with AES-GCM.
+type Cipher struct {
+	aead cipher.AEAD
+}
+
+func NewCipher(key []byte) (*Cipher, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("key is %d bytes; want %d", len(key), KeySize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Cipher{aead}, nil
+}
+
+// ReadKeyFile reads a hex-encoded key, such as one generated by
+// "openssl rand -hex 32".
+func ReadKeyFile(filename string) ([]byte, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode key: %v", err)
+	}
+	return key, nil
+}
+
+// Encrypt encrypts plaintext. The same additional data, which isn't
+// encrypted, must be given to decrypt it, so it can tie the ciphertext to
+// e.g. the user it belongs to.
+func (c *Cipher) Encrypt(plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, c.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	return c.aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+var ErrDecrypt = errors.New("failed to decrypt")
+
+// Decrypt decrypts what Encrypt returned, or returns ErrDecrypt if it was
+// encrypted with another key or additional data, or has been tampered with.
+func (c *Cipher) Decrypt(ciphertext, additionalData []byte) ([]byte, error) {
+	n := c.aead.NonceSize()
+	if len(ciphertext) < n {
+		return nil, ErrDecrypt
+	}
+	plaintext, err := c.aead.Open(nil, ciphertext[:n], ciphertext[n:], additionalData)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return plaintext, nil
+}
+
+// UserAdditionalData ties a Telegram user's encrypted tokens to their ID, so
+// they can't be used for another user.
+func UserAdditionalData(userID int64) []byte {
+	return []byte("user:" + strconv.FormatInt(userID, 10))
+}
+
+// SubscriptionAdditionalData ties a subscription's encrypted tokens to its
+// Hypothesis group. They aren't tied to its chat, whose ID changes when a
+// group becomes a supergroup, so they can be moved without the key.
+func SubscriptionAdditionalData(hypGroup string) []byte {
+	return []byte("sub:" + hypGroup)
+}
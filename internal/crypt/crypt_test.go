@@ -0,0 +1,93 @@
+package crypt
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, KeySize)
+}
+
+func TestEncryptDecrypt(t *testing.T) {
+	c, err := NewCipher(testKey(1))
+	if err != nil {
+		t.Fatalf("NewCipher() returned err=%v", err)
+	}
+	plaintext := []byte("secret token")
+	ciphertext, err := c.Encrypt(plaintext, []byte("user 1"))
+	if err != nil {
+		t.Fatalf("Encrypt() returned err=%v", err)
+	}
+	if bytes.Contains(ciphertext, plaintext) {
+		t.Fatalf("Ciphertext %q contains the plaintext", ciphertext)
+	}
+	got, err := c.Decrypt(ciphertext, []byte("user 1"))
+	if err != nil {
+		t.Fatalf("Decrypt() returned err=%v", err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Errorf("Decrypt() returned %q; want %q", got, plaintext)
+	}
+
+	// Encrypting the same thing twice gives different results.
+	again, err := c.Encrypt(plaintext, []byte("user 1"))
+	if err != nil {
+		t.Fatalf("Encrypt() returned err=%v", err)
+	}
+	if bytes.Equal(again, ciphertext) {
+		t.Errorf("Encrypt() returned the same ciphertext twice")
+	}
+
+	other, err := NewCipher(testKey(2))
+	if err != nil {
+		t.Fatalf("NewCipher() returned err=%v", err)
+	}
+	tampered := append([]byte(nil), ciphertext...)
+	tampered[len(tampered)-1] ^= 1
+	for _, tt := range []struct {
+		name           string
+		c              *Cipher
+		ciphertext     []byte
+		additionalData string
+	}{
+		{"other key", other, ciphertext, "user 1"},
+		{"other additional data", c, ciphertext, "user 2"},
+		{"tampered", c, tampered, "user 1"},
+		{"truncated", c, ciphertext[:4], "user 1"},
+	} {
+		if _, err := tt.c.Decrypt(tt.ciphertext, []byte(tt.additionalData)); err != ErrDecrypt {
+			t.Errorf("Decrypt() with %s returned err=%v; want ErrDecrypt", tt.name, err)
+		}
+	}
+}
+
+func TestNewCipher_KeySize(t *testing.T) {
+	if _, err := NewCipher([]byte("short")); err == nil {
+		t.Errorf("NewCipher() accepted a 5-byte key")
+	}
+}
+
+func TestReadKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "key")
+	if err := os.WriteFile(filename, []byte("0101010101010101010101010101010101010101010101010101010101010101\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	key, err := ReadKeyFile(filename)
+	if err != nil {
+		t.Fatalf("ReadKeyFile() returned err=%v", err)
+	}
+	if !bytes.Equal(key, testKey(1)) {
+		t.Errorf("ReadKeyFile() returned %x; want %x", key, testKey(1))
+	}
+
+	if err := os.WriteFile(filename, []byte("not hex"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadKeyFile(filename); err == nil {
+		t.Errorf("ReadKeyFile() accepted a key which isn't hex")
+	}
+}
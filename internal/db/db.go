@@ -2,6 +2,8 @@ package db
 
 import (
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -12,11 +14,22 @@ import (
 	"github.com/google/uuid"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/objectiveryan/irsal/internal/common"
+	"github.com/objectiveryan/irsal/internal/crypt"
 )
 
+// querier is implemented by both *sql.DB and *sql.Tx.
+type querier interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	Prepare(query string) (*sql.Stmt, error)
+	Query(query string, args ...any) (*sql.Rows, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
 type DbStorage struct {
 	db  *sql.DB
 	mut sync.Mutex
+	// Encrypts subscriptions' OAuth tokens, if set
+	cipher *crypt.Cipher
 }
 
 func NewInMemoryStorage() common.Storage {
@@ -54,6 +67,75 @@ func NewSqliteStorage(filename string) (*DbStorage, error) {
 		unique (annot_id, chat_id),
 		unique (chat_id, message_id)
 	);
+	create table if not exists DocumentHeaders (
+		chat_id int64 not null,
+		uri_id int64 not null,
+		message_id int64 not null,
+		title text not null,
+		count int not null,
+		state int not null,
+		unique (chat_id, uri_id)
+	);
+	create table if not exists UserTokens (
+		user_id int64 not null unique,
+		hyp_user text not null,
+		token blob not null,
+		refresh_token blob,
+		expiry int64 not null default 0
+	);
+	create table if not exists UserLinks (
+		hyp_user text not null unique,
+		user_id int64 not null unique,
+		name text not null
+	);
+	create table if not exists AnnotationOrigins (
+		annot_id text not null unique,
+		chat_id int64 not null,
+		message_id int64 not null,
+		user_id int64 not null,
+		name text not null,
+		text text not null,
+		body text not null
+	);
+	create table if not exists LinkedChannels (
+		chat_id int64 not null unique,
+		channel_id int64 not null
+	);
+	create table if not exists NotifiedUsers (
+		user_id int64 not null unique
+	);
+	create table if not exists MutedThreads (
+		user_id int64 not null,
+		root_annot_id text not null,
+		unique (user_id, root_annot_id)
+	);
+	create table if not exists Notifications (
+		annot_id text not null,
+		user_id int64 not null,
+		root_annot_id text not null,
+		text text not null,
+		html bool not null,
+		no_preview bool not null,
+		state int not null,
+		message_id int64 not null,
+		unique (annot_id, user_id)
+	);
+	create table if not exists SubscriptionTokens (
+		hyp_group text not null,
+		chat_id int64 not null,
+		access_token text not null,
+		refresh_token text not null,
+		expiry int64 not null,
+		unique (hyp_group, chat_id)
+	);
+	create table if not exists Topics (
+		chat_id int64 not null,
+		uri_id int64 not null,
+		thread_id int64 not null,
+		name text not null,
+		state int not null,
+		unique (chat_id, uri_id)
+	);
 	create table if not exists Subscriptions (
 		hyp_token text not null,
 		hyp_group text not null,
@@ -65,8 +147,94 @@ func NewSqliteStorage(filename string) (*DbStorage, error) {
 		uri text not null,
 		unique (uri)
 	);
+	create table if not exists Outbox (
+		annot_id text not null,
+		refs text,
+		hyp_group text not null,
+		uri_id int64 not null,
+		chat_id int64 not null,
+		parent_message_id int64 not null,
+		text text not null,
+		state int not null,
+		message_id int64 not null,
+		html bool not null default false,
+		no_preview bool not null default false,
+		thread_id int64 not null default 0,
+		buttons text not null default '',
+		unique (annot_id, chat_id)
+	);
+	create table if not exists SubscriptionOptions (
+		hyp_group text not null,
+		chat_id int64 not null,
+		name text not null,
+		value text not null,
+		unique (hyp_group, chat_id, name)
+	);
+	create table if not exists DigestItems (
+		annot_id text not null,
+		refs text,
+		hyp_group text not null,
+		uri_id int64 not null,
+		chat_id int64 not null,
+		user text not null,
+		quote text not null,
+		text text not null,
+		queued int64 not null,
+		unique (annot_id, chat_id)
+	);
+	create table if not exists DigestMessages (
+		annot_id text not null,
+		refs text,
+		hyp_group text not null,
+		uri_id int64 not null,
+		chat_id int64 not null,
+		message_id int64 not null,
+		idx int not null,
+		unique (annot_id, chat_id),
+		unique (chat_id, message_id, idx)
+	);
+	create table if not exists DigestOutbox (
+		hyp_group text not null,
+		chat_id int64 not null,
+		annot_ids text not null,
+		text text not null,
+		html bool not null,
+		no_preview bool not null,
+		state int not null,
+		message_id int64 not null,
+		unique (hyp_group, chat_id)
+	);
+	create table if not exists Filters (
+		hyp_group text not null,
+		chat_id int64 not null,
+		exclude bool not null,
+		field text not null,
+		pattern text not null
+	);
+	create table if not exists MessageParts (
+		chat_id int64 not null,
+		message_id int64 not null,
+		primary_message_id int64 not null,
+		unique (chat_id, message_id)
+	);
+	create table if not exists MessagePartOutbox (
+		chat_id int64 not null,
+		primary_message_id int64 not null,
+		idx int not null,
+		text text not null,
+		html bool not null,
+		no_preview bool not null,
+		thread_id int64 not null,
+		buttons text not null,
+		state int not null,
+		unique (chat_id, primary_message_id, idx)
+	);
 	`)
 
+	if err == nil {
+		err = migrate(db)
+	}
+
 	if err != nil {
 		if closeErr := db.Close(); closeErr != nil {
 			log.Println(closeErr)
@@ -77,6 +245,37 @@ func NewSqliteStorage(filename string) (*DbStorage, error) {
 	return &DbStorage{db: db}, nil
 }
 
+// migrate updates tables created by earlier versions.
+func migrate(db *sql.DB) error {
+	for _, c := range []struct{ table, column, def string }{
+		{"Outbox", "html", "bool not null default false"},
+		{"Outbox", "no_preview", "bool not null default false"},
+		{"Outbox", "thread_id", "int64 not null default 0"},
+		{"Outbox", "buttons", "text not null default ''"},
+		// Headers from before there was a state were all sent.
+		{"DocumentHeaders", "state", fmt.Sprintf("int not null default %d", common.OutboxSent)},
+		// Likewise topics, whose names are only needed to create them.
+		{"Topics", "name", "text not null default ''"},
+		{"Topics", "state", fmt.Sprintf("int not null default %d", common.OutboxSent)},
+		{"UserTokens", "refresh_token", "blob"},
+		{"UserTokens", "expiry", "int64 not null default 0"},
+	} {
+		if err := addColumn(db, c.table, c.column, c.def); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addColumn adds a column to a table unless it already has it.
+func addColumn(db *sql.DB, table, column, def string) error {
+	_, err := db.Exec(fmt.Sprintf("alter table %s add column %s %s", table, column, def))
+	if err != nil && strings.Contains(err.Error(), "duplicate column name") {
+		return nil
+	}
+	return err
+}
+
 func (s *DbStorage) Close() error {
 	return s.db.Close()
 }
@@ -85,7 +284,10 @@ func (s *DbStorage) MessageID(annotID string, chatID int64) (int, error) {
 	s.Lock()
 	defer s.Unlock()
 
-	stmt, err := s.db.Prepare("select message_id from AnnotationMessages where annot_id = ? and chat_id = ?")
+	stmt, err := s.db.Prepare(`
+		select message_id from AnnotationMessages where annot_id = ?1 and chat_id = ?2
+		union all
+		select message_id from DigestMessages where annot_id = ?1 and chat_id = ?2`)
 	if err != nil {
 		return -1, err
 	}
@@ -101,8 +303,18 @@ func (s *DbStorage) MessageID(annotID string, chatID int64) (int, error) {
 	return messageID, nil
 }
 
-func (s *DbStorage) uriID(uri string) (int64, error) {
-	stmt, err := s.db.Prepare("insert into URIs values(?) on conflict do update set uri=uri returning rowid")
+func (s *DbStorage) AnnotationBridged(annotID string) (bool, error) {
+	var bridged bool
+	err := s.db.QueryRow(`
+		select exists (select 1 from AnnotationMessages where annot_id = ?1)
+			or exists (select 1 from Outbox where annot_id = ?1)
+			or exists (select 1 from DigestItems where annot_id = ?1)
+			or exists (select 1 from DigestMessages where annot_id = ?1)`, annotID).Scan(&bridged)
+	return bridged, err
+}
+
+func uriID(q querier, uri string) (int64, error) {
+	stmt, err := q.Prepare("insert into URIs values(?) on conflict do update set uri=uri returning rowid")
 	if err != nil {
 		return -1, err
 	}
@@ -116,26 +328,46 @@ func (s *DbStorage) uriID(uri string) (int64, error) {
 }
 
 func (s *DbStorage) SetMessageID(annotID string, meta common.AnnotationMetadata, chatID int64, messageID int) error {
-	uriID, err := s.uriID(meta.URI)
+	return setMessageID(s.db, annotID, meta, chatID, messageID)
+}
+
+func setMessageID(q querier, annotID string, meta common.AnnotationMetadata, chatID int64, messageID int) error {
+	uriID, err := uriID(q, meta.URI)
 	if err != nil {
 		return fmt.Errorf("failed to get ID for URI: %v", err)
 	}
-	stmt, err := s.db.Prepare("insert into AnnotationMessages values(?, ?, ?, ?, ?, ?)")
+	stmt, err := q.Prepare("insert into AnnotationMessages values(?, ?, ?, ?, ?, ?)")
 	if err != nil {
 		return fmt.Errorf("DB.Prepare failed: %v", err)
 	}
 	defer stmt.Close()
 
+	_, err = stmt.Exec(annotID, joinRefs(meta.References), meta.HypGroup, uriID, chatID, messageID)
+	return err
+}
+
+func joinRefs(refs []string) interface{} {
 	var refs_str interface{} // does this need to be sql.NullString?
-	if len(meta.References) > 0 {
-		refs_str = strings.Join(meta.References, "|")
+	if len(refs) > 0 {
+		refs_str = strings.Join(refs, "|")
 	}
-	_, err = stmt.Exec(annotID, refs_str, meta.HypGroup, uriID, chatID, messageID)
-	return err
+	return refs_str
+}
+
+func splitRefs(refs_str sql.NullString) []string {
+	var refs []string
+	if refs_str.Valid {
+		refs = strings.Split(refs_str.String, "|")
+	}
+	return refs
 }
 
 func (s *DbStorage) AnnotationID(chatID int64, messageID int) (string, common.AnnotationMetadata, error) {
 	var noMeta common.AnnotationMetadata
+	messageID, err := primaryMessageID(s.db, chatID, messageID)
+	if err != nil {
+		return "", noMeta, err
+	}
 	stmt, err := s.db.Prepare("select annot_id, refs, hyp_group, uri from AnnotationMessages am left join URIs u ON am.uri_id = u.rowid where chat_id = ? and message_id = ?")
 	if err != nil {
 		return "", noMeta, err
@@ -151,95 +383,946 @@ func (s *DbStorage) AnnotationID(chatID int64, messageID int) (string, common.An
 	} else if err != nil {
 		return "", noMeta, err
 	}
-	var refs []string
-	if refs_str.Valid {
-		refs = strings.Split(refs_str.String, "|")
+	return annotID, common.AnnotationMetadata{splitRefs(refs_str), group, uri}, nil
+}
+
+func (s *DbStorage) AddMessagePart(chatID int64, primaryMessageID, messageID int) error {
+	_, err := s.db.Exec("insert into MessageParts values(?, ?, ?)", chatID, messageID, primaryMessageID)
+	return err
+}
+
+func (s *DbStorage) AddPendingMessageParts(parts []*common.MessagePart) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
 	}
-	return annotID, common.AnnotationMetadata{refs, group, uri}, nil
+	defer tx.Rollback()
+	for _, p := range parts {
+		_, err := tx.Exec("insert into MessagePartOutbox values(?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			p.ChatID, p.PrimaryMessageID, p.Index, p.Message.Text, p.Message.HTML, p.Message.NoPreview, p.Message.ThreadID, joinButtons(p.Message.Buttons), p.State)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
 }
 
-func (s *DbStorage) AddSubscription(sub *common.Subscription) error {
-	stmt, err := s.db.Prepare("insert into Subscriptions values(?, ?, ?, ?)")
+func (s *DbStorage) PendingMessageParts() ([]*common.MessagePart, error) {
+	rows, err := s.db.Query("select chat_id, primary_message_id, idx, text, html, no_preview, thread_id, buttons, state from MessagePartOutbox order by chat_id, primary_message_id, idx")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var parts []*common.MessagePart
+	for rows.Next() {
+		var p common.MessagePart
+		var buttons string
+		if err := rows.Scan(&p.ChatID, &p.PrimaryMessageID, &p.Index, &p.Message.Text, &p.Message.HTML, &p.Message.NoPreview, &p.Message.ThreadID, &buttons, &p.State); err != nil {
+			return nil, err
+		}
+		if p.Message.Buttons, err = splitButtons(buttons); err != nil {
+			return nil, fmt.Errorf("failed to decode buttons of part %d of message %d: %v", p.Index, p.PrimaryMessageID, err)
+		}
+		parts = append(parts, &p)
+	}
+	return parts, rows.Err()
+}
+
+func (s *DbStorage) SetMessagePartState(p *common.MessagePart) error {
+	result, err := s.db.Exec("update MessagePartOutbox set state = ? where chat_id = ? and primary_message_id = ? and idx = ?", p.State, p.ChatID, p.PrimaryMessageID, p.Index)
 	if err != nil {
 		return err
 	}
-	defer stmt.Close()
-	searchAfter := sub.SearchAfter.UnixMicro()
-	result, err := stmt.Exec(sub.HypToken, sub.HypGroup, searchAfter, sub.ChatID)
+	return expectOneRow(result)
+}
+
+func (s *DbStorage) CompleteMessagePart(p *common.MessagePart, messageID int) error {
+	tx, err := s.db.Begin()
 	if err != nil {
 		return err
 	}
-	nrows, err := result.RowsAffected()
+	defer tx.Rollback()
+	result, err := tx.Exec("delete from MessagePartOutbox where chat_id = ? and primary_message_id = ? and idx = ?", p.ChatID, p.PrimaryMessageID, p.Index)
 	if err != nil {
 		return err
 	}
-	if nrows != 1 {
-		return fmt.Errorf("%d subs added; want 1", nrows)
+	if err := expectOneRow(result); err != nil {
+		return err
 	}
-	return nil
+	if _, err := tx.Exec("insert into MessageParts values(?, ?, ?)", p.ChatID, messageID, p.PrimaryMessageID); err != nil {
+		return err
+	}
+	return tx.Commit()
 }
 
-func (s *DbStorage) Subscription(chatID int64, group string) (*common.Subscription, error) {
-	stmt, err := s.db.Prepare("select hyp_token, search_after from Subscriptions where hyp_group = ? and chat_id = ?")
+// primaryMessageID returns the first part of the message which messageID is
+// part of, which is usually messageID itself.
+func primaryMessageID(q querier, chatID int64, messageID int) (int, error) {
+	var primary int
+	err := q.QueryRow("select primary_message_id from MessageParts where chat_id = ? and message_id = ?", chatID, messageID).Scan(&primary)
+	if err == sql.ErrNoRows {
+		return messageID, nil
+	}
+	return primary, err
+}
+
+func (s *DbStorage) Topic(chatID int64, uri string) (*common.Topic, error) {
+	t := common.Topic{ChatID: chatID, URI: uri}
+	err := s.db.QueryRow("select name, thread_id, state from Topics t join URIs u on t.uri_id = u.rowid where chat_id = ? and uri = ?", chatID, uri).Scan(&t.Name, &t.ThreadID, &t.State)
+	if err == sql.ErrNoRows {
+		return nil, common.ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+func (s *DbStorage) SetTopic(t *common.Topic) error {
+	uriID, err := uriID(s.db, t.URI)
+	if err != nil {
+		return fmt.Errorf("failed to get ID for URI: %v", err)
+	}
+	_, err = s.db.Exec(`
+		insert into Topics values(?, ?, ?, ?, ?)
+		on conflict do update set thread_id = excluded.thread_id, name = excluded.name, state = excluded.state`,
+		t.ChatID, uriID, t.ThreadID, t.Name, t.State)
+	return err
+}
+
+func (s *DbStorage) PendingTopics() ([]*common.Topic, error) {
+	rows, err := s.db.Query("select chat_id, uri, name, thread_id, state from Topics t join URIs u on t.uri_id = u.rowid where state != ? order by t.rowid", common.OutboxSent)
 	if err != nil {
 		return nil, err
 	}
-	defer stmt.Close()
-	var token string
-	var searchAfter int64
-	err = stmt.QueryRow(group, chatID).Scan(&token, &searchAfter)
+	defer rows.Close()
+	var topics []*common.Topic
+	for rows.Next() {
+		var t common.Topic
+		if err := rows.Scan(&t.ChatID, &t.URI, &t.Name, &t.ThreadID, &t.State); err != nil {
+			return nil, err
+		}
+		topics = append(topics, &t)
+	}
+	return topics, rows.Err()
+}
+
+func (s *DbStorage) DocumentHeader(chatID int64, uri string) (*common.DocumentHeader, error) {
+	h := common.DocumentHeader{ChatID: chatID, URI: uri}
+	err := s.db.QueryRow("select message_id, title, count, state from DocumentHeaders d join URIs u on d.uri_id = u.rowid where chat_id = ? and uri = ?", chatID, uri).Scan(&h.MessageID, &h.Title, &h.Count, &h.State)
 	if err == sql.ErrNoRows {
 		return nil, common.ErrNotFound
 	} else if err != nil {
 		return nil, err
 	}
-	return &common.Subscription{token, group, time.UnixMicro(searchAfter), chatID}, nil
+	return &h, nil
 }
 
-func (s *DbStorage) Subscriptions() ([]*common.Subscription, error) {
-	rows, err := s.db.Query("select hyp_token, hyp_group, search_after, chat_id from Subscriptions")
+func (s *DbStorage) SetDocumentHeader(h *common.DocumentHeader) error {
+	uriID, err := uriID(s.db, h.URI)
+	if err != nil {
+		return fmt.Errorf("failed to get ID for URI: %v", err)
+	}
+	_, err = s.db.Exec(`
+		insert into DocumentHeaders values(?, ?, ?, ?, ?, ?)
+		on conflict do update set message_id = excluded.message_id, title = excluded.title, count = excluded.count, state = excluded.state`,
+		h.ChatID, uriID, h.MessageID, h.Title, h.Count, h.State)
+	return err
+}
+
+func (s *DbStorage) AnnotationCount(chatID int64, uri string) (int, error) {
+	var count int
+	err := s.db.QueryRow("select count(*) from AnnotationMessages am join URIs u on am.uri_id = u.rowid where chat_id = ? and uri = ?", chatID, uri).Scan(&count)
+	return count, err
+}
+
+const userTokenColumns = "user_id, hyp_user, token, refresh_token, expiry"
+
+func scanUserToken(row scanner) (*common.UserToken, error) {
+	var t common.UserToken
+	var expiry int64
+	if err := row.Scan(&t.UserID, &t.HypUser, &t.Token, &t.RefreshToken, &expiry); err != nil {
+		return nil, err
+	}
+	t.Expiry = fromUnixMicro(expiry)
+	return &t, nil
+}
+
+// unixMicro and fromUnixMicro store optional times, using 0 for none.
+func unixMicro(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMicro()
+}
+
+func fromUnixMicro(us int64) time.Time {
+	if us == 0 {
+		return time.Time{}
+	}
+	return time.UnixMicro(us)
+}
+
+func (s *DbStorage) UserToken(userID int64) (*common.UserToken, error) {
+	t, err := scanUserToken(s.db.QueryRow("select "+userTokenColumns+" from UserTokens where user_id = ?", userID))
+	if err == sql.ErrNoRows {
+		return nil, common.ErrNotFound
+	}
+	return t, err
+}
+
+func (s *DbStorage) SetUserToken(t *common.UserToken) error {
+	_, err := s.db.Exec(`
+		insert into UserTokens values(?, ?, ?, ?, ?)
+		on conflict do update set hyp_user = excluded.hyp_user, token = excluded.token, refresh_token = excluded.refresh_token, expiry = excluded.expiry`,
+		t.UserID, t.HypUser, t.Token, t.RefreshToken, unixMicro(t.Expiry))
+	return err
+}
+
+func (s *DbStorage) ExpiringUserTokens(t time.Time) ([]*common.UserToken, error) {
+	rows, err := s.db.Query("select "+userTokenColumns+" from UserTokens where expiry != 0 and expiry < ? order by expiry", t.UnixMicro())
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
-	var subs []*common.Subscription
+	var tokens []*common.UserToken
 	for rows.Next() {
-		var sub common.Subscription
-		var searchAfter int64
-		err = rows.Scan(&sub.HypToken, &sub.HypGroup, &searchAfter, &sub.ChatID)
+		token, err := scanUserToken(rows)
 		if err != nil {
 			return nil, err
 		}
-		sub.SearchAfter = time.UnixMicro(searchAfter)
-		subs = append(subs, &sub)
+		tokens = append(tokens, token)
 	}
-	return subs, nil
+	return tokens, rows.Err()
 }
 
-func (s *DbStorage) UpdateSubscription(sub *common.Subscription) error {
-	stmt, err := s.db.Prepare("update Subscriptions set hyp_token = ?, search_after = ? where hyp_group = ? and chat_id = ?")
+func (s *DbStorage) UserLink(hypUser string) (*common.UserLink, error) {
+	l := common.UserLink{HypUser: hypUser}
+	err := s.db.QueryRow("select user_id, name from UserLinks where hyp_user = ?", hypUser).Scan(&l.UserID, &l.Name)
+	if err == sql.ErrNoRows {
+		return nil, common.ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &l, nil
+}
+
+func (s *DbStorage) SetUserLink(l *common.UserLink) error {
+	// Replacing deletes rows which conflict on either unique column.
+	_, err := s.db.Exec("insert or replace into UserLinks values(?, ?, ?)", l.HypUser, l.UserID, l.Name)
+	return err
+}
+
+func (s *DbStorage) DeleteUserLink(userID int64) error {
+	result, err := s.db.Exec("delete from UserLinks where user_id = ?", userID)
 	if err != nil {
 		return err
 	}
-	defer stmt.Close()
-	searchAfter := sub.SearchAfter.UnixMicro()
-	result, err := stmt.Exec(sub.HypToken, searchAfter, sub.HypGroup, sub.ChatID)
+	return expectOneRow(result)
+}
+
+func (s *DbStorage) AddAnnotationOrigin(o *common.AnnotationOrigin) error {
+	_, err := s.db.Exec("insert into AnnotationOrigins values(?, ?, ?, ?, ?, ?, ?)", o.AnnotID, o.ChatID, o.MessageID, o.UserID, o.Name, o.Text, o.Body)
+	return err
+}
+
+func (s *DbStorage) AnnotationOrigin(annotID string) (*common.AnnotationOrigin, error) {
+	o := common.AnnotationOrigin{AnnotID: annotID}
+	err := s.db.QueryRow("select chat_id, message_id, user_id, name, text, body from AnnotationOrigins where annot_id = ?", annotID).Scan(&o.ChatID, &o.MessageID, &o.UserID, &o.Name, &o.Text, &o.Body)
+	if err == sql.ErrNoRows {
+		return nil, common.ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
+
+func (s *DbStorage) LinkedChannel(chatID int64) (int64, error) {
+	var channelID int64
+	err := s.db.QueryRow("select channel_id from LinkedChannels where chat_id = ?", chatID).Scan(&channelID)
+	if err == sql.ErrNoRows {
+		return 0, common.ErrNotFound
+	}
+	return channelID, err
+}
+
+func (s *DbStorage) SetLinkedChannel(chatID, channelID int64) error {
+	_, err := s.db.Exec("insert into LinkedChannels values(?, ?) on conflict do update set channel_id = excluded.channel_id", chatID, channelID)
+	return err
+}
+
+// chatTables are the tables with a chat_id column. Telegram keeps message IDs
+// when a group becomes a supergroup, so records of messages move too.
+var chatTables = []string{
+	"AnnotationMessages",
+	"DocumentHeaders",
+	"AnnotationOrigins",
+	"LinkedChannels",
+	"SubscriptionTokens",
+	"Topics",
+	"Subscriptions",
+	"Outbox",
+	"SubscriptionOptions",
+	"DigestItems",
+	"DigestMessages",
+	"DigestOutbox",
+	"Filters",
+	"MessageParts",
+	"MessagePartOutbox",
+}
+
+func (s *DbStorage) MigrateChat(oldChatID, newChatID int64) error {
+	tx, err := s.db.Begin()
 	if err != nil {
 		return err
 	}
-	nrows, err := result.RowsAffected()
+	defer tx.Rollback()
+	for _, table := range chatTables {
+		_, err := tx.Exec(fmt.Sprintf("update %s set chat_id = ? where chat_id = ?", table), newChatID, oldChatID)
+		if err != nil {
+			return fmt.Errorf("failed to update %s: %v", table, err)
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *DbStorage) NotificationsEnabled(userID int64) (bool, error) {
+	var count int
+	err := s.db.QueryRow("select count(*) from NotifiedUsers where user_id = ?", userID).Scan(&count)
+	return count > 0, err
+}
+
+func (s *DbStorage) SetNotificationsEnabled(userID int64, enabled bool) error {
+	var err error
+	if enabled {
+		_, err = s.db.Exec("insert or ignore into NotifiedUsers values(?)", userID)
+	} else {
+		_, err = s.db.Exec("delete from NotifiedUsers where user_id = ?", userID)
+	}
+	return err
+}
+
+func (s *DbStorage) AnyNotificationsEnabled() (bool, error) {
+	var enabled bool
+	err := s.db.QueryRow("select exists (select 1 from NotifiedUsers n join UserLinks l on n.user_id = l.user_id)").Scan(&enabled)
+	return enabled, err
+}
+
+func (s *DbStorage) ThreadMuted(userID int64, rootID string) (bool, error) {
+	var count int
+	err := s.db.QueryRow("select count(*) from MutedThreads where user_id = ? and root_annot_id = ?", userID, rootID).Scan(&count)
+	return count > 0, err
+}
+
+func (s *DbStorage) MuteThread(userID int64, rootID string) error {
+	_, err := s.db.Exec("insert or ignore into MutedThreads values(?, ?)", userID, rootID)
+	return err
+}
+
+func (s *DbStorage) UnmuteThread(userID int64, rootID string) error {
+	result, err := s.db.Exec("delete from MutedThreads where user_id = ? and root_annot_id = ?", userID, rootID)
 	if err != nil {
 		return err
 	}
-	if nrows == 0 {
-		return common.ErrNotFound
+	return expectOneRow(result)
+}
+
+func (s *DbStorage) AddNotification(n *common.Notification) error {
+	_, err := s.db.Exec("insert into Notifications values(?, ?, ?, ?, ?, ?, ?, ?)",
+		n.AnnotID, n.UserID, n.RootID, n.Message.Text, n.Message.HTML, n.Message.NoPreview, n.State, n.MessageID)
+	return err
+}
+
+const notificationColumns = "annot_id, user_id, root_annot_id, text, html, no_preview, state, message_id"
+
+func scanNotification(row scanner) (*common.Notification, error) {
+	var n common.Notification
+	err := row.Scan(&n.AnnotID, &n.UserID, &n.RootID, &n.Message.Text, &n.Message.HTML, &n.Message.NoPreview, &n.State, &n.MessageID)
+	if err != nil {
+		return nil, err
 	}
-	if nrows > 1 {
-		return fmt.Errorf("%d subs updated; want 1", nrows)
+	return &n, nil
+}
+
+func (s *DbStorage) Notification(annotID string, userID int64) (*common.Notification, error) {
+	n, err := scanNotification(s.db.QueryRow("select "+notificationColumns+" from Notifications where annot_id = ? and user_id = ?", annotID, userID))
+	if err == sql.ErrNoRows {
+		return nil, common.ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+func (s *DbStorage) PendingNotifications() ([]*common.Notification, error) {
+	rows, err := s.db.Query("select "+notificationColumns+" from Notifications where state != ? order by rowid", common.OutboxSent)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var notifications []*common.Notification
+	for rows.Next() {
+		n, err := scanNotification(rows)
+		if err != nil {
+			return nil, err
+		}
+		notifications = append(notifications, n)
+	}
+	return notifications, rows.Err()
+}
+
+func (s *DbStorage) SetNotificationState(annotID string, userID int64, state common.OutboxState, messageID int) error {
+	result, err := s.db.Exec("update Notifications set state = ?, message_id = ? where annot_id = ? and user_id = ?", state, messageID, annotID, userID)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(result)
+}
+
+func (s *DbStorage) NotificationThread(userID int64, messageID int) (string, error) {
+	var rootID string
+	err := s.db.QueryRow("select root_annot_id from Notifications where user_id = ? and message_id = ? and state = ?", userID, messageID, common.OutboxSent).Scan(&rootID)
+	if err == sql.ErrNoRows {
+		return "", common.ErrNotFound
+	}
+	return rootID, err
+}
+
+// SetCipher makes the storage encrypt subscriptions' OAuth tokens with c,
+// and encrypts any which were stored without one.
+func (s *DbStorage) SetCipher(c *crypt.Cipher) error {
+	s.cipher = c
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	tokens, err := s.subscriptionTokens(tx, "where typeof(access_token) = 'text'")
+	if err != nil {
+		return err
+	}
+	for _, t := range tokens {
+		if err := s.setSubscriptionToken(tx, t); err != nil {
+			return err
+		}
+	}
+	if len(tokens) > 0 {
+		log.Printf("Encrypted %d subscription tokens", len(tokens))
+	}
+	return tx.Commit()
+}
+
+// errNoCipher is returned for encrypted tokens when the storage has no cipher.
+var errNoCipher = errors.New("no key to decrypt token")
+
+// encryptToken encrypts a subscription's token, unless the storage has no
+// cipher, as in tools which don't handle OAuth.
+func (s *DbStorage) encryptToken(key common.SubKey, token string) (any, error) {
+	if s.cipher == nil {
+		return token, nil
+	}
+	return s.cipher.Encrypt([]byte(token), crypt.SubscriptionAdditionalData(key.HypGroup))
+}
+
+// decryptToken returns a token stored by encryptToken, which is text if it
+// wasn't encrypted.
+func (s *DbStorage) decryptToken(key common.SubKey, stored any) (string, error) {
+	switch v := stored.(type) {
+	case string:
+		return v, nil
+	case []byte:
+		if s.cipher == nil {
+			return "", errNoCipher
+		}
+		token, err := s.cipher.Decrypt(v, crypt.SubscriptionAdditionalData(key.HypGroup))
+		return string(token), err
+	}
+	return "", fmt.Errorf("unexpected token of type %T", stored)
+}
+
+func (s *DbStorage) SetSubscriptionToken(t *common.SubscriptionToken) error {
+	return s.setSubscriptionToken(s.db, t)
+}
+
+func (s *DbStorage) setSubscriptionToken(q querier, t *common.SubscriptionToken) error {
+	accessToken, err := s.encryptToken(t.Key, t.AccessToken)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt token: %v", err)
+	}
+	refreshToken, err := s.encryptToken(t.Key, t.RefreshToken)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt refresh token: %v", err)
+	}
+	_, err = q.Exec(`
+		insert into SubscriptionTokens values(?, ?, ?, ?, ?)
+		on conflict do update set access_token = excluded.access_token, refresh_token = excluded.refresh_token, expiry = excluded.expiry`,
+		t.Key.HypGroup, t.Key.ChatID, accessToken, refreshToken, unixMicro(t.Expiry))
+	return err
+}
+
+func (s *DbStorage) ExpiringSubscriptionTokens(t time.Time) ([]*common.SubscriptionToken, error) {
+	return s.subscriptionTokens(s.db, "where expiry != 0 and expiry < ? order by expiry", t.UnixMicro())
+}
+
+// subscriptionTokens returns the decrypted tokens selected by where.
+func (s *DbStorage) subscriptionTokens(q querier, where string, args ...any) ([]*common.SubscriptionToken, error) {
+	rows, err := q.Query("select hyp_group, chat_id, access_token, refresh_token, expiry from SubscriptionTokens "+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var tokens []*common.SubscriptionToken
+	for rows.Next() {
+		var token common.SubscriptionToken
+		var accessToken, refreshToken any
+		var expiry int64
+		if err := rows.Scan(&token.Key.HypGroup, &token.Key.ChatID, &accessToken, &refreshToken, &expiry); err != nil {
+			return nil, err
+		}
+		if token.AccessToken, err = s.decryptToken(token.Key, accessToken); err != nil {
+			return nil, fmt.Errorf("failed to decrypt token of subscription %v: %v", token.Key, err)
+		}
+		if token.RefreshToken, err = s.decryptToken(token.Key, refreshToken); err != nil {
+			return nil, fmt.Errorf("failed to decrypt refresh token of subscription %v: %v", token.Key, err)
+		}
+		token.Expiry = fromUnixMicro(expiry)
+		tokens = append(tokens, &token)
+	}
+	return tokens, rows.Err()
+}
+
+func (s *DbStorage) DeleteUserToken(userID int64) error {
+	result, err := s.db.Exec("delete from UserTokens where user_id = ?", userID)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(result)
+}
+
+func (s *DbStorage) AddOutboxEntry(e *common.OutboxEntry) error {
+	uriID, err := uriID(s.db, e.Meta.URI)
+	if err != nil {
+		return fmt.Errorf("failed to get ID for URI: %v", err)
+	}
+	stmt, err := s.db.Prepare("insert into Outbox values(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	result, err := stmt.Exec(e.AnnotID, joinRefs(e.Meta.References), e.Meta.HypGroup, uriID, e.ChatID, e.ParentMessageID, e.Message.Text, e.State, e.MessageID, e.Message.HTML, e.Message.NoPreview, e.Message.ThreadID, joinButtons(e.Message.Buttons))
+	if err != nil {
+		return err
+	}
+	e.ID, err = result.LastInsertId()
+	return err
+}
+
+const outboxColumns = "o.rowid, annot_id, refs, hyp_group, uri, chat_id, parent_message_id, text, state, message_id, html, no_preview, thread_id, buttons"
+
+type scanner interface {
+	Scan(dest ...any) error
+}
+
+func scanOutboxEntry(row scanner) (*common.OutboxEntry, error) {
+	var e common.OutboxEntry
+	var refs_str sql.NullString
+	var buttons string
+	err := row.Scan(&e.ID, &e.AnnotID, &refs_str, &e.Meta.HypGroup, &e.Meta.URI, &e.ChatID, &e.ParentMessageID, &e.Message.Text, &e.State, &e.MessageID, &e.Message.HTML, &e.Message.NoPreview, &e.Message.ThreadID, &buttons)
+	if err != nil {
+		return nil, err
+	}
+	e.Meta.References = splitRefs(refs_str)
+	if e.Message.Buttons, err = splitButtons(buttons); err != nil {
+		return nil, fmt.Errorf("failed to decode buttons of outbox entry %d: %v", e.ID, err)
+	}
+	return &e, nil
+}
+
+// joinButtons encodes buttons as JSON, or the empty string if there are none.
+func joinButtons(buttons []common.Button) string {
+	if len(buttons) == 0 {
+		return ""
+	}
+	data, err := json.Marshal(buttons)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to encode buttons: %v", err))
+	}
+	return string(data)
+}
+
+func splitButtons(s string) ([]common.Button, error) {
+	if s == "" {
+		return nil, nil
+	}
+	var buttons []common.Button
+	err := json.Unmarshal([]byte(s), &buttons)
+	return buttons, err
+}
+
+func (s *DbStorage) OutboxEntry(annotID string, chatID int64) (*common.OutboxEntry, error) {
+	row := s.db.QueryRow("select "+outboxColumns+" from Outbox o left join URIs u on o.uri_id = u.rowid where annot_id = ? and chat_id = ?", annotID, chatID)
+	e, err := scanOutboxEntry(row)
+	if err == sql.ErrNoRows {
+		return nil, common.ErrNotFound
+	}
+	return e, err
+}
+
+func (s *DbStorage) PendingOutboxEntries() ([]*common.OutboxEntry, error) {
+	rows, err := s.db.Query("select " + outboxColumns + " from Outbox o left join URIs u on o.uri_id = u.rowid order by o.rowid")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []*common.OutboxEntry
+	for rows.Next() {
+		e, err := scanOutboxEntry(rows)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func (s *DbStorage) SetOutboxState(id int64, state common.OutboxState, messageID int) error {
+	result, err := s.db.Exec("update Outbox set state = ?, message_id = ? where rowid = ?", state, messageID, id)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(result)
+}
+
+func (s *DbStorage) CompleteOutboxEntry(id int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	e, err := scanOutboxEntry(tx.QueryRow("select "+outboxColumns+" from Outbox o left join URIs u on o.uri_id = u.rowid where o.rowid = ?", id))
+	if err == sql.ErrNoRows {
+		return common.ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	if e.State != common.OutboxSent {
+		return fmt.Errorf("outbox entry %d is %v; want %v", id, e.State, common.OutboxSent)
+	}
+	if err := setMessageID(tx, e.AnnotID, e.Meta, e.ChatID, e.MessageID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("delete from Outbox where rowid = ?", id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// expectOneRow returns ErrNotFound if no rows were affected.
+func expectOneRow(result sql.Result) error {
+	nrows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if nrows == 0 {
+		return common.ErrNotFound
+	}
+	if nrows > 1 {
+		return fmt.Errorf("%d rows affected; want 1", nrows)
 	}
 	return nil
 }
 
+func (s *DbStorage) AddSubscription(sub *common.Subscription) error {
+	stmt, err := s.db.Prepare("insert into Subscriptions values(?, ?, ?, ?)")
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	searchAfter := sub.SearchAfter.UnixMicro()
+	result, err := stmt.Exec(sub.HypToken, sub.HypGroup, searchAfter, sub.ChatID)
+	if err != nil {
+		return err
+	}
+	nrows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if nrows != 1 {
+		return fmt.Errorf("%d subs added; want 1", nrows)
+	}
+	return nil
+}
+
+// A subscription's OAuth token, if it has one, replaces the token it was
+// added with. UpdateSubscription can't overwrite it with a stale token.
+const (
+	subTokenColumns = "s.hyp_token, t.access_token"
+	subTokenJoin    = "left join SubscriptionTokens t on s.hyp_group = t.hyp_group and s.chat_id = t.chat_id"
+)
+
+// subToken returns the token a subscription uses, given the columns selected
+// by subTokenColumns. Without a cipher, encrypted OAuth tokens can't be used,
+// and the subscription has no token.
+func (s *DbStorage) subToken(key common.SubKey, hypToken string, oauthToken any) (string, error) {
+	if oauthToken == nil {
+		return hypToken, nil
+	}
+	token, err := s.decryptToken(key, oauthToken)
+	if err == errNoCipher {
+		log.Printf("Not using OAuth token of subscription %v: %v", key, err)
+		return "", nil
+	} else if err != nil {
+		return "", fmt.Errorf("failed to decrypt token of subscription %v: %v", key, err)
+	}
+	return token, nil
+}
+
+func (s *DbStorage) Subscription(chatID int64, group string) (*common.Subscription, error) {
+	stmt, err := s.db.Prepare("select " + subTokenColumns + ", search_after from Subscriptions s " + subTokenJoin + " where s.hyp_group = ? and s.chat_id = ?")
+	if err != nil {
+		return nil, err
+	}
+	defer stmt.Close()
+	var hypToken string
+	var oauthToken any
+	var searchAfter int64
+	err = stmt.QueryRow(group, chatID).Scan(&hypToken, &oauthToken, &searchAfter)
+	if err == sql.ErrNoRows {
+		return nil, common.ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	token, err := s.subToken(common.SubKey{HypGroup: group, ChatID: chatID}, hypToken, oauthToken)
+	if err != nil {
+		return nil, err
+	}
+	return &common.Subscription{token, group, time.UnixMicro(searchAfter), chatID}, nil
+}
+
+func (s *DbStorage) Subscriptions() ([]*common.Subscription, error) {
+	rows, err := s.db.Query("select " + subTokenColumns + ", s.hyp_group, search_after, s.chat_id from Subscriptions s " + subTokenJoin)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var subs []*common.Subscription
+	for rows.Next() {
+		var sub common.Subscription
+		var hypToken string
+		var oauthToken any
+		var searchAfter int64
+		err = rows.Scan(&hypToken, &oauthToken, &sub.HypGroup, &searchAfter, &sub.ChatID)
+		if err != nil {
+			return nil, err
+		}
+		if sub.HypToken, err = s.subToken(sub.Key(), hypToken, oauthToken); err != nil {
+			return nil, err
+		}
+		sub.SearchAfter = time.UnixMicro(searchAfter)
+		subs = append(subs, &sub)
+	}
+	return subs, nil
+}
+
+func (s *DbStorage) UpdateSubscription(sub *common.Subscription) error {
+	// A subscription with an OAuth token keeps the token it was added with,
+	// so the OAuth token isn't copied there unencrypted.
+	stmt, err := s.db.Prepare(`
+		update Subscriptions set
+			hyp_token = iif(exists (select 1 from SubscriptionTokens t where t.hyp_group = Subscriptions.hyp_group and t.chat_id = Subscriptions.chat_id), hyp_token, ?),
+			search_after = ?
+		where hyp_group = ? and chat_id = ?`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	searchAfter := sub.SearchAfter.UnixMicro()
+	result, err := stmt.Exec(sub.HypToken, searchAfter, sub.HypGroup, sub.ChatID)
+	if err != nil {
+		return err
+	}
+	nrows, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if nrows == 0 {
+		return common.ErrNotFound
+	}
+	if nrows > 1 {
+		return fmt.Errorf("%d subs updated; want 1", nrows)
+	}
+	return nil
+}
+
+func (s *DbStorage) SubscriptionOptions(key common.SubKey) (map[string]string, error) {
+	rows, err := s.db.Query("select name, value from SubscriptionOptions where hyp_group = ? and chat_id = ?", key.HypGroup, key.ChatID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	opts := make(map[string]string)
+	for rows.Next() {
+		var name, value string
+		if err := rows.Scan(&name, &value); err != nil {
+			return nil, err
+		}
+		opts[name] = value
+	}
+	return opts, rows.Err()
+}
+
+func (s *DbStorage) SetSubscriptionOption(key common.SubKey, name, value string) error {
+	var err error
+	if value == "" {
+		_, err = s.db.Exec("delete from SubscriptionOptions where hyp_group = ? and chat_id = ? and name = ?", key.HypGroup, key.ChatID, name)
+	} else {
+		_, err = s.db.Exec("insert into SubscriptionOptions values(?, ?, ?, ?) on conflict do update set value = excluded.value", key.HypGroup, key.ChatID, name, value)
+	}
+	return err
+}
+
+func (s *DbStorage) AddDigestItem(key common.SubKey, item *common.DigestItem) error {
+	uriID, err := uriID(s.db, item.Meta.URI)
+	if err != nil {
+		return fmt.Errorf("failed to get ID for URI: %v", err)
+	}
+	_, err = s.db.Exec("insert into DigestItems values(?, ?, ?, ?, ?, ?, ?, ?, ?) on conflict do nothing",
+		item.AnnotID, joinRefs(item.Meta.References), key.HypGroup, uriID, key.ChatID, item.User, item.Quote, item.Text, item.Queued.UnixMicro())
+	return err
+}
+
+func (s *DbStorage) DigestItems(key common.SubKey) ([]*common.DigestItem, error) {
+	rows, err := s.db.Query("select annot_id, refs, hyp_group, uri, user, quote, text, queued from DigestItems d left join URIs u on d.uri_id = u.rowid where hyp_group = ? and chat_id = ? order by d.rowid", key.HypGroup, key.ChatID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []*common.DigestItem
+	for rows.Next() {
+		var item common.DigestItem
+		var refs_str sql.NullString
+		var queued int64
+		if err := rows.Scan(&item.AnnotID, &refs_str, &item.Meta.HypGroup, &item.Meta.URI, &item.User, &item.Quote, &item.Text, &queued); err != nil {
+			return nil, err
+		}
+		item.Meta.References = splitRefs(refs_str)
+		item.Queued = time.UnixMicro(queued)
+		items = append(items, &item)
+	}
+	return items, rows.Err()
+}
+
+func (s *DbStorage) AddDigestOutboxEntry(e *common.DigestOutboxEntry) error {
+	_, err := s.db.Exec("insert into DigestOutbox values(?, ?, ?, ?, ?, ?, ?, ?)",
+		e.Key.HypGroup, e.Key.ChatID, strings.Join(e.AnnotIDs, "|"), e.Message.Text, e.Message.HTML, e.Message.NoPreview, e.State, e.MessageID)
+	return err
+}
+
+func (s *DbStorage) DigestOutboxEntry(key common.SubKey) (*common.DigestOutboxEntry, error) {
+	e := common.DigestOutboxEntry{Key: key}
+	var annotIDs string
+	err := s.db.QueryRow("select annot_ids, text, html, no_preview, state, message_id from DigestOutbox where hyp_group = ? and chat_id = ?", key.HypGroup, key.ChatID).Scan(
+		&annotIDs, &e.Message.Text, &e.Message.HTML, &e.Message.NoPreview, &e.State, &e.MessageID)
+	if err == sql.ErrNoRows {
+		return nil, common.ErrNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	e.AnnotIDs = strings.Split(annotIDs, "|")
+	return &e, nil
+}
+
+func (s *DbStorage) SetDigestOutboxState(key common.SubKey, state common.OutboxState, messageID int) error {
+	result, err := s.db.Exec("update DigestOutbox set state = ?, message_id = ? where hyp_group = ? and chat_id = ?", state, messageID, key.HypGroup, key.ChatID)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(result)
+}
+
+func (s *DbStorage) CompleteDigest(key common.SubKey, messageID int, items []*common.DigestItem) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for i, item := range items {
+		uriID, err := uriID(tx, item.Meta.URI)
+		if err != nil {
+			return fmt.Errorf("failed to get ID for URI: %v", err)
+		}
+		_, err = tx.Exec("insert into DigestMessages values(?, ?, ?, ?, ?, ?, ?)", item.AnnotID, joinRefs(item.Meta.References), key.HypGroup, uriID, key.ChatID, messageID, i)
+		if err != nil {
+			return err
+		}
+		_, err = tx.Exec("delete from DigestItems where annot_id = ? and chat_id = ?", item.AnnotID, key.ChatID)
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("delete from DigestOutbox where hyp_group = ? and chat_id = ?", key.HypGroup, key.ChatID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *DbStorage) DigestMessageItems(chatID int64, messageID int) ([]*common.DigestItem, error) {
+	messageID, err := primaryMessageID(s.db, chatID, messageID)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query("select annot_id, refs, hyp_group, uri from DigestMessages d left join URIs u on d.uri_id = u.rowid where chat_id = ? and message_id = ? order by idx", chatID, messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []*common.DigestItem
+	for rows.Next() {
+		var item common.DigestItem
+		var refs_str sql.NullString
+		if err := rows.Scan(&item.AnnotID, &refs_str, &item.Meta.HypGroup, &item.Meta.URI); err != nil {
+			return nil, err
+		}
+		item.Meta.References = splitRefs(refs_str)
+		items = append(items, &item)
+	}
+	return items, rows.Err()
+}
+
+func (s *DbStorage) Filters(key common.SubKey) ([]*common.FilterRule, error) {
+	rows, err := s.db.Query("select rowid, exclude, field, pattern from Filters where hyp_group = ? and chat_id = ? order by rowid", key.HypGroup, key.ChatID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var rules []*common.FilterRule
+	for rows.Next() {
+		var rule common.FilterRule
+		if err := rows.Scan(&rule.ID, &rule.Exclude, &rule.Field, &rule.Pattern); err != nil {
+			return nil, err
+		}
+		rules = append(rules, &rule)
+	}
+	return rules, rows.Err()
+}
+
+func (s *DbStorage) AddFilter(key common.SubKey, rule *common.FilterRule) error {
+	result, err := s.db.Exec("insert into Filters values(?, ?, ?, ?, ?)", key.HypGroup, key.ChatID, rule.Exclude, rule.Field, rule.Pattern)
+	if err != nil {
+		return err
+	}
+	rule.ID, err = result.LastInsertId()
+	return err
+}
+
+func (s *DbStorage) RemoveFilter(key common.SubKey, id int64) error {
+	result, err := s.db.Exec("delete from Filters where rowid = ? and hyp_group = ? and chat_id = ?", id, key.HypGroup, key.ChatID)
+	if err != nil {
+		return err
+	}
+	return expectOneRow(result)
+}
+
 func (s *DbStorage) Lock() {
 	s.mut.Lock()
 }
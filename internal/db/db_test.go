@@ -1,12 +1,16 @@
 package db
 
 import (
+	"bytes"
 	"reflect"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/google/uuid"
+	"github.com/objectiveryan/irsal/internal/check"
 	"github.com/objectiveryan/irsal/internal/common"
+	"github.com/objectiveryan/irsal/internal/crypt"
 )
 
 type StorageFactory func() common.Storage
@@ -128,6 +132,575 @@ func DoTestAnnotationID(newStorage StorageFactory, t *testing.T) {
 	})
 }
 
+func DoTestAnnotationBridged(newStorage StorageFactory, t *testing.T) {
+	s := newStorage()
+	meta := common.AnnotationMetadata{HypGroup: "g"}
+	if err := s.SetMessageID("a1", meta, 1, 2); err != nil {
+		t.Fatalf("SetMessageID() returned err=%v", err)
+	}
+	if err := s.AddOutboxEntry(&common.OutboxEntry{AnnotID: "a2", Meta: meta, ChatID: 1}); err != nil {
+		t.Fatalf("AddOutboxEntry() returned err=%v", err)
+	}
+	if err := s.AddDigestItem(common.SubKey{HypGroup: "g", ChatID: 1}, &common.DigestItem{AnnotID: "a3", Meta: meta}); err != nil {
+		t.Fatalf("AddDigestItem() returned err=%v", err)
+	}
+	for _, tt := range []struct {
+		annotID string
+		want    bool
+	}{{"a1", true}, {"a2", true}, {"a3", true}, {"a4", false}} {
+		if got, err := s.AnnotationBridged(tt.annotID); err != nil || got != tt.want {
+			t.Errorf("AnnotationBridged(%q) returned %v, err=%v; want %v", tt.annotID, got, err, tt.want)
+		}
+	}
+}
+
+func DoTestMessageParts(newStorage StorageFactory, t *testing.T) {
+	s := newStorage()
+	meta := common.AnnotationMetadata{HypGroup: "g", URI: "u"}
+	if err := s.SetMessageID("a", meta, 1, 10); err != nil {
+		t.Fatalf("SetMessageID() returned err=%v", err)
+	}
+	if err := s.AddMessagePart(1, 10, 11); err != nil {
+		t.Fatalf("AddMessagePart() returned err=%v", err)
+	}
+	if err := s.CompleteDigest(common.SubKey{HypGroup: "g", ChatID: 1}, 20, []*common.DigestItem{{AnnotID: "b", Meta: meta}}); err != nil {
+		t.Fatalf("CompleteDigest() returned err=%v", err)
+	}
+	if err := s.AddMessagePart(1, 20, 21); err != nil {
+		t.Fatalf("AddMessagePart() returned err=%v", err)
+	}
+
+	annotID, _, err := s.AnnotationID(1, 11)
+	if err != nil || annotID != "a" {
+		t.Errorf("AnnotationID(1, 11) returned %q, err=%v; want \"a\"", annotID, err)
+	}
+	if _, _, err := s.AnnotationID(2, 11); err != common.ErrNotFound {
+		t.Errorf("AnnotationID(2, 11) returned err=%v; want ErrNotFound", err)
+	}
+	items, err := s.DigestMessageItems(1, 21)
+	if err != nil || len(items) != 1 || items[0].AnnotID != "b" {
+		t.Errorf("DigestMessageItems(1, 21) returned %+v, err=%v; want item b", items, err)
+	}
+	// Replies are threaded under the primary message.
+	if messageID, err := s.MessageID("a", 1); err != nil || messageID != 10 {
+		t.Errorf("MessageID(\"a\", 1) returned %d, err=%v; want 10", messageID, err)
+	}
+
+	// Parts are recorded before they're sent.
+	parts := []*common.MessagePart{
+		{ChatID: 1, PrimaryMessageID: 10, Index: 2, Message: common.Message{Text: "c", HTML: true, Buttons: []common.Button{{Text: "b", Action: common.ActionThread}}}},
+		{ChatID: 1, PrimaryMessageID: 10, Index: 3, Message: common.Message{Text: "d"}},
+	}
+	if err := s.AddPendingMessageParts(parts); err != nil {
+		t.Fatalf("AddPendingMessageParts() returned err=%v", err)
+	}
+	parts[0].State = common.OutboxSending
+	if err := s.SetMessagePartState(parts[0]); err != nil {
+		t.Fatalf("SetMessagePartState() returned err=%v", err)
+	}
+	if got, err := s.PendingMessageParts(); err != nil || !reflect.DeepEqual(got, parts) {
+		t.Errorf("PendingMessageParts() returned %+v, err=%v; want %+v", got, err, parts)
+	}
+	if err := s.CompleteMessagePart(parts[0], 12); err != nil {
+		t.Fatalf("CompleteMessagePart() returned err=%v", err)
+	}
+	if got, err := s.PendingMessageParts(); err != nil || len(got) != 1 || got[0].Index != 3 {
+		t.Errorf("PendingMessageParts() returned %+v, err=%v; want just part 3", got, err)
+	}
+	if annotID, _, err := s.AnnotationID(1, 12); err != nil || annotID != "a" {
+		t.Errorf("AnnotationID(1, 12) returned %q, err=%v; want \"a\"", annotID, err)
+	}
+	if err := s.CompleteMessagePart(parts[0], 12); err != common.ErrNotFound {
+		t.Errorf("CompleteMessagePart() of completed part returned err=%v; want ErrNotFound", err)
+	}
+}
+
+func DoTestTopics(newStorage StorageFactory, t *testing.T) {
+	s := newStorage()
+	if _, err := s.Topic(1, "u"); err != common.ErrNotFound {
+		t.Fatalf("Topic() returned err=%v; want ErrNotFound", err)
+	}
+	pending := &common.Topic{ChatID: 1, URI: "u", Name: "U", State: common.OutboxPending}
+	if err := s.SetTopic(pending); err != nil {
+		t.Fatalf("SetTopic() returned err=%v", err)
+	}
+	if err := s.SetTopic(&common.Topic{ChatID: 2, URI: "u", Name: "U", ThreadID: 6, State: common.OutboxSent}); err != nil {
+		t.Fatalf("SetTopic() returned err=%v", err)
+	}
+	if got, err := s.PendingTopics(); err != nil || len(got) != 1 || !reflect.DeepEqual(got[0], pending) {
+		t.Errorf("PendingTopics() returned %+v, err=%v; want [%+v]", got, err, pending)
+	}
+	created := &common.Topic{ChatID: 1, URI: "u", Name: "U", ThreadID: 5, State: common.OutboxSent}
+	if err := s.SetTopic(created); err != nil {
+		t.Fatalf("SetTopic() returned err=%v", err)
+	}
+	if got, err := s.Topic(1, "u"); err != nil || !reflect.DeepEqual(got, created) {
+		t.Errorf("Topic(1, \"u\") returned %+v, err=%v; want %+v", got, err, created)
+	}
+	if got, err := s.PendingTopics(); err != nil || len(got) != 0 {
+		t.Errorf("PendingTopics() returned %+v, err=%v; want none", got, err)
+	}
+	if _, err := s.Topic(1, "v"); err != common.ErrNotFound {
+		t.Errorf("Topic(1, \"v\") returned err=%v; want ErrNotFound", err)
+	}
+
+	// A topic which was deleted can be replaced.
+	created.ThreadID = 7
+	if err := s.SetTopic(created); err != nil {
+		t.Fatalf("SetTopic() returned err=%v", err)
+	}
+	if got, err := s.Topic(1, "u"); err != nil || got.ThreadID != 7 {
+		t.Errorf("Topic(1, \"u\") returned %+v, err=%v; want thread 7", got, err)
+	}
+}
+
+func DoTestDocumentHeaders(newStorage StorageFactory, t *testing.T) {
+	s := newStorage()
+	if _, err := s.DocumentHeader(1, "u"); err != common.ErrNotFound {
+		t.Fatalf("DocumentHeader() returned err=%v; want ErrNotFound", err)
+	}
+	h := &common.DocumentHeader{ChatID: 1, URI: "u", Title: "T", Count: 1}
+	if err := s.SetDocumentHeader(h); err != nil {
+		t.Fatalf("SetDocumentHeader() returned err=%v", err)
+	}
+	h.MessageID, h.State = 5, common.OutboxSent
+	if err := s.SetDocumentHeader(h); err != nil {
+		t.Fatalf("SetDocumentHeader() returned err=%v", err)
+	}
+	h.Count = 2
+	if err := s.SetDocumentHeader(h); err != nil {
+		t.Fatalf("SetDocumentHeader() returned err=%v", err)
+	}
+	got, err := s.DocumentHeader(1, "u")
+	if err != nil {
+		t.Fatalf("DocumentHeader() returned err=%v", err)
+	}
+	if !reflect.DeepEqual(got, h) {
+		t.Errorf("DocumentHeader() returned %+v; want %+v", got, h)
+	}
+	if _, err := s.DocumentHeader(2, "u"); err != common.ErrNotFound {
+		t.Errorf("DocumentHeader(2, \"u\") returned err=%v; want ErrNotFound", err)
+	}
+
+	for i, annotID := range []string{"a", "b"} {
+		if err := s.SetMessageID(annotID, common.AnnotationMetadata{HypGroup: "g", URI: "u"}, 1, 10+i); err != nil {
+			t.Fatalf("SetMessageID() returned err=%v", err)
+		}
+	}
+	if err := s.SetMessageID("c", common.AnnotationMetadata{HypGroup: "g", URI: "v"}, 1, 12); err != nil {
+		t.Fatalf("SetMessageID() returned err=%v", err)
+	}
+	if count, err := s.AnnotationCount(1, "u"); err != nil || count != 2 {
+		t.Errorf("AnnotationCount(1, \"u\") returned %d, err=%v; want 2", count, err)
+	}
+	if count, err := s.AnnotationCount(2, "u"); err != nil || count != 0 {
+		t.Errorf("AnnotationCount(2, \"u\") returned %d, err=%v; want 0", count, err)
+	}
+}
+
+func DoTestUserTokens(newStorage StorageFactory, t *testing.T) {
+	s := newStorage()
+	if _, err := s.UserToken(1); err != common.ErrNotFound {
+		t.Fatalf("UserToken() returned err=%v; want ErrNotFound", err)
+	}
+	token := &common.UserToken{UserID: 1, HypUser: "acct:alice@hypothes.is", Token: []byte{0, 1, 2}}
+	if err := s.SetUserToken(&common.UserToken{UserID: 1, HypUser: "acct:old@hypothes.is", Token: []byte{9}}); err != nil {
+		t.Fatalf("SetUserToken() returned err=%v", err)
+	}
+	if err := s.SetUserToken(token); err != nil {
+		t.Fatalf("SetUserToken() returned err=%v", err)
+	}
+	got, err := s.UserToken(1)
+	if err != nil {
+		t.Fatalf("UserToken() returned err=%v", err)
+	}
+	if !reflect.DeepEqual(got, token) {
+		t.Errorf("UserToken() returned %+v; want %+v", got, token)
+	}
+
+	if err := s.DeleteUserToken(1); err != nil {
+		t.Fatalf("DeleteUserToken() returned err=%v", err)
+	}
+	if _, err := s.UserToken(1); err != common.ErrNotFound {
+		t.Errorf("UserToken() after DeleteUserToken() returned err=%v; want ErrNotFound", err)
+	}
+	if err := s.DeleteUserToken(1); err != common.ErrNotFound {
+		t.Errorf("DeleteUserToken() of missing token returned err=%v; want ErrNotFound", err)
+	}
+}
+
+func DoTestUserLinks(newStorage StorageFactory, t *testing.T) {
+	s := newStorage()
+	if _, err := s.UserLink("acct:alice@hypothes.is"); err != common.ErrNotFound {
+		t.Fatalf("UserLink() returned err=%v; want ErrNotFound", err)
+	}
+	alice := &common.UserLink{HypUser: "acct:alice@hypothes.is", UserID: 1, Name: "Alice"}
+	for _, l := range []*common.UserLink{
+		{HypUser: "acct:alice@hypothes.is", UserID: 2, Name: "Bob"},
+		{HypUser: "acct:old@hypothes.is", UserID: 1, Name: "Alice"},
+		alice,
+	} {
+		if err := s.SetUserLink(l); err != nil {
+			t.Fatalf("SetUserLink(%+v) returned err=%v", l, err)
+		}
+	}
+	got, err := s.UserLink("acct:alice@hypothes.is")
+	if err != nil {
+		t.Fatalf("UserLink() returned err=%v", err)
+	}
+	if !reflect.DeepEqual(got, alice) {
+		t.Errorf("UserLink() returned %+v; want %+v", got, alice)
+	}
+	// Each account is linked to at most one other.
+	if _, err := s.UserLink("acct:old@hypothes.is"); err != common.ErrNotFound {
+		t.Errorf("UserLink() of replaced link returned err=%v; want ErrNotFound", err)
+	}
+	if err := s.DeleteUserLink(2); err != common.ErrNotFound {
+		t.Errorf("DeleteUserLink() of replaced link returned err=%v; want ErrNotFound", err)
+	}
+
+	if err := s.DeleteUserLink(1); err != nil {
+		t.Fatalf("DeleteUserLink() returned err=%v", err)
+	}
+	if _, err := s.UserLink("acct:alice@hypothes.is"); err != common.ErrNotFound {
+		t.Errorf("UserLink() after DeleteUserLink() returned err=%v; want ErrNotFound", err)
+	}
+}
+
+func DoTestAnnotationOrigins(newStorage StorageFactory, t *testing.T) {
+	s := newStorage()
+	if _, err := s.AnnotationOrigin("a1"); err != common.ErrNotFound {
+		t.Fatalf("AnnotationOrigin() returned err=%v; want ErrNotFound", err)
+	}
+	o := &common.AnnotationOrigin{AnnotID: "a1", ChatID: -1, MessageID: 2, UserID: 3, Name: "Alice", Text: "Alice wrote \"hi\"", Body: "hi"}
+	if err := s.AddAnnotationOrigin(o); err != nil {
+		t.Fatalf("AddAnnotationOrigin() returned err=%v", err)
+	}
+	got, err := s.AnnotationOrigin("a1")
+	if err != nil {
+		t.Fatalf("AnnotationOrigin() returned err=%v", err)
+	}
+	if !reflect.DeepEqual(got, o) {
+		t.Errorf("AnnotationOrigin() returned %+v; want %+v", got, o)
+	}
+}
+
+func DoTestLinkedChannels(newStorage StorageFactory, t *testing.T) {
+	s := newStorage()
+	if _, err := s.LinkedChannel(-1); err != common.ErrNotFound {
+		t.Fatalf("LinkedChannel() returned err=%v; want ErrNotFound", err)
+	}
+	for _, channelID := range []int64{-100, -200} {
+		if err := s.SetLinkedChannel(-1, channelID); err != nil {
+			t.Fatalf("SetLinkedChannel() returned err=%v", err)
+		}
+		if got, err := s.LinkedChannel(-1); err != nil || got != channelID {
+			t.Errorf("LinkedChannel() returned %d, err=%v; want %d", got, err, channelID)
+		}
+	}
+}
+
+func DoTestMigrateChat(newStorage StorageFactory, t *testing.T) {
+	const OLD, NEW = -1, -1001
+	meta := common.AnnotationMetadata{HypGroup: "g"}
+	oldKey, newKey := common.SubKey{HypGroup: "g", ChatID: OLD}, common.SubKey{HypGroup: "g", ChatID: NEW}
+	setup := func(t *testing.T) common.Storage {
+		s := newStorage()
+		if err := s.AddSubscription(&common.Subscription{"ht", "g", time.Unix(100, 0), OLD}); err != nil {
+			t.Fatalf("AddSubscription() returned err=%v", err)
+		}
+		if err := s.SetSubscriptionOption(oldKey, "a", "1"); err != nil {
+			t.Fatalf("SetSubscriptionOption() returned err=%v", err)
+		}
+		if err := s.SetMessageID("a0", meta, OLD, 5); err != nil {
+			t.Fatalf("SetMessageID() returned err=%v", err)
+		}
+		if err := s.SetLinkedChannel(OLD, -100); err != nil {
+			t.Fatalf("SetLinkedChannel() returned err=%v", err)
+		}
+		if err := s.AddAnnotationOrigin(&common.AnnotationOrigin{AnnotID: "a1", ChatID: OLD, MessageID: 6}); err != nil {
+			t.Fatalf("AddAnnotationOrigin() returned err=%v", err)
+		}
+		return s
+	}
+
+	t.Run("Moves everything", func(t *testing.T) {
+		s := setup(t)
+		if err := s.MigrateChat(OLD, NEW); err != nil {
+			t.Fatalf("MigrateChat() returned err=%v", err)
+		}
+		if _, err := s.Subscription(OLD, "g"); err != common.ErrNotFound {
+			t.Errorf("Subscription(OLD) returned err=%v; want ErrNotFound", err)
+		}
+		if sub, err := s.Subscription(NEW, "g"); err != nil || sub.ChatID != NEW {
+			t.Errorf("Subscription(NEW) returned %+v, err=%v; want the moved subscription", sub, err)
+		}
+		if opts, err := s.SubscriptionOptions(newKey); err != nil || opts["a"] != "1" {
+			t.Errorf("SubscriptionOptions(NEW) returned %v, err=%v; want a=1", opts, err)
+		}
+		check.AnnotationMessage(t, s, "a0", meta, NEW, 5)
+		if _, err := s.MessageID("a0", OLD); err != common.ErrNotFound {
+			t.Errorf("MessageID(OLD) returned err=%v; want ErrNotFound", err)
+		}
+		if channelID, err := s.LinkedChannel(NEW); err != nil || channelID != -100 {
+			t.Errorf("LinkedChannel(NEW) returned %d, err=%v; want -100", channelID, err)
+		}
+		if o, err := s.AnnotationOrigin("a1"); err != nil || o.ChatID != NEW || o.MessageID != 6 {
+			t.Errorf("AnnotationOrigin() returned %+v, err=%v; want message 6 in chat NEW", o, err)
+		}
+	})
+
+	t.Run("Atomic", func(t *testing.T) {
+		s := setup(t)
+		// The new chat already has a message about a0, so a0's can't move.
+		if err := s.SetMessageID("a0", meta, NEW, 6); err != nil {
+			t.Fatalf("SetMessageID() returned err=%v", err)
+		}
+		if err := s.MigrateChat(OLD, NEW); err == nil {
+			t.Fatalf("MigrateChat() returned no error; want conflict")
+		}
+		if _, err := s.Subscription(OLD, "g"); err != nil {
+			t.Errorf("Subscription(OLD) returned err=%v; want it left in place", err)
+		}
+		check.AnnotationMessage(t, s, "a0", meta, OLD, 5)
+	})
+}
+
+func DoTestNotificationSettings(newStorage StorageFactory, t *testing.T) {
+	s := newStorage()
+	for _, enabled := range []bool{false, true, true, false} {
+		if err := s.SetNotificationsEnabled(1, enabled); err != nil {
+			t.Fatalf("SetNotificationsEnabled(%v) returned err=%v", enabled, err)
+		}
+		if got, err := s.NotificationsEnabled(1); err != nil || got != enabled {
+			t.Errorf("NotificationsEnabled() returned %v, err=%v; want %v", got, err, enabled)
+		}
+	}
+
+	// Only users linked to a Hypothesis account can be notified.
+	if err := s.SetNotificationsEnabled(1, true); err != nil {
+		t.Fatalf("SetNotificationsEnabled() returned err=%v", err)
+	}
+	if got, err := s.AnyNotificationsEnabled(); err != nil || got {
+		t.Errorf("AnyNotificationsEnabled() without links returned %v, err=%v; want false", got, err)
+	}
+	if err := s.SetUserLink(&common.UserLink{HypUser: "acct:a@h", UserID: 1}); err != nil {
+		t.Fatalf("SetUserLink() returned err=%v", err)
+	}
+	if got, err := s.AnyNotificationsEnabled(); err != nil || !got {
+		t.Errorf("AnyNotificationsEnabled() returned %v, err=%v; want true", got, err)
+	}
+
+	if err := s.MuteThread(1, "a1"); err != nil {
+		t.Fatalf("MuteThread() returned err=%v", err)
+	}
+	if err := s.MuteThread(1, "a1"); err != nil {
+		t.Fatalf("MuteThread() of muted thread returned err=%v", err)
+	}
+	for _, tt := range []struct {
+		userID int64
+		rootID string
+		want   bool
+	}{{1, "a1", true}, {1, "a2", false}, {2, "a1", false}} {
+		if got, err := s.ThreadMuted(tt.userID, tt.rootID); err != nil || got != tt.want {
+			t.Errorf("ThreadMuted(%d, %q) returned %v, err=%v; want %v", tt.userID, tt.rootID, got, err, tt.want)
+		}
+	}
+	if err := s.UnmuteThread(1, "a1"); err != nil {
+		t.Fatalf("UnmuteThread() returned err=%v", err)
+	}
+	if muted, err := s.ThreadMuted(1, "a1"); err != nil || muted {
+		t.Errorf("ThreadMuted() after UnmuteThread() returned %v, err=%v; want false", muted, err)
+	}
+	if err := s.UnmuteThread(1, "a1"); err != common.ErrNotFound {
+		t.Errorf("UnmuteThread() of unmuted thread returned err=%v; want ErrNotFound", err)
+	}
+}
+
+func DoTestNotifications(newStorage StorageFactory, t *testing.T) {
+	s := newStorage()
+	if _, err := s.Notification("a2", 1); err != common.ErrNotFound {
+		t.Fatalf("Notification() returned err=%v; want ErrNotFound", err)
+	}
+	n := &common.Notification{AnnotID: "a2", UserID: 1, RootID: "a1", Message: common.Message{Text: "hi", HTML: true}, State: common.OutboxPending}
+	if err := s.AddNotification(n); err != nil {
+		t.Fatalf("AddNotification() returned err=%v", err)
+	}
+	if err := s.AddNotification(n); err == nil {
+		t.Errorf("AddNotification() of duplicate returned no error")
+	}
+	if got, err := s.Notification("a2", 1); err != nil || !reflect.DeepEqual(got, n) {
+		t.Errorf("Notification() returned %+v, err=%v; want %+v", got, err, n)
+	}
+	if pending, err := s.PendingNotifications(); err != nil || len(pending) != 1 {
+		t.Errorf("PendingNotifications() returned %d, err=%v; want 1", len(pending), err)
+	}
+	// Only sent notifications can be replied to.
+	if _, err := s.NotificationThread(1, 0); err != common.ErrNotFound {
+		t.Errorf("NotificationThread() of unsent notification returned err=%v; want ErrNotFound", err)
+	}
+
+	if err := s.SetNotificationState("a2", 1, common.OutboxSent, 5); err != nil {
+		t.Fatalf("SetNotificationState() returned err=%v", err)
+	}
+	if pending, err := s.PendingNotifications(); err != nil || len(pending) != 0 {
+		t.Errorf("PendingNotifications() returned %d, err=%v; want none", len(pending), err)
+	}
+	if rootID, err := s.NotificationThread(1, 5); err != nil || rootID != "a1" {
+		t.Errorf("NotificationThread() returned %q, err=%v; want \"a1\"", rootID, err)
+	}
+	if err := s.SetNotificationState("a3", 1, common.OutboxSent, 6); err != common.ErrNotFound {
+		t.Errorf("SetNotificationState() of missing notification returned err=%v; want ErrNotFound", err)
+	}
+}
+
+func DoTestExpiringTokens(newStorage StorageFactory, t *testing.T) {
+	s := newStorage()
+	now := time.UnixMicro(time.Now().UnixMicro())
+	soon := &common.UserToken{UserID: 1, HypUser: "acct:a@h", Token: []byte{1}, RefreshToken: []byte{2}, Expiry: now.Add(time.Minute)}
+	for _, token := range []*common.UserToken{
+		soon,
+		{UserID: 2, HypUser: "acct:b@h", Token: []byte{3}, RefreshToken: []byte{4}, Expiry: now.Add(time.Hour)},
+		// Pasted tokens don't expire.
+		{UserID: 3, HypUser: "acct:c@h", Token: []byte{5}},
+	} {
+		if err := s.SetUserToken(token); err != nil {
+			t.Fatalf("SetUserToken() returned err=%v", err)
+		}
+	}
+	tokens, err := s.ExpiringUserTokens(now.Add(10 * time.Minute))
+	if err != nil {
+		t.Fatalf("ExpiringUserTokens() returned err=%v", err)
+	}
+	if len(tokens) != 1 || !reflect.DeepEqual(tokens[0], soon) {
+		t.Errorf("ExpiringUserTokens() returned %+v; want %+v", tokens, soon)
+	}
+	pasted, err := s.UserToken(3)
+	if err != nil {
+		t.Fatalf("UserToken() returned err=%v", err)
+	}
+	if !pasted.Expiry.IsZero() || pasted.RefreshToken != nil {
+		t.Errorf("UserToken() returned %+v; want no expiry or refresh token", pasted)
+	}
+
+	sub := &common.Subscription{"ht", "g", time.Unix(1, 0), 1}
+	if err := s.AddSubscription(sub); err != nil {
+		t.Fatalf("AddSubscription() returned err=%v", err)
+	}
+	subToken := &common.SubscriptionToken{Key: sub.Key(), AccessToken: "access", RefreshToken: "refresh", Expiry: now.Add(time.Minute)}
+	if err := s.SetSubscriptionToken(subToken); err != nil {
+		t.Fatalf("SetSubscriptionToken() returned err=%v", err)
+	}
+	subTokens, err := s.ExpiringSubscriptionTokens(now.Add(10 * time.Minute))
+	if err != nil {
+		t.Fatalf("ExpiringSubscriptionTokens() returned err=%v", err)
+	}
+	if len(subTokens) != 1 || !reflect.DeepEqual(subTokens[0], subToken) {
+		t.Errorf("ExpiringSubscriptionTokens() returned %+v; want %+v", subTokens, subToken)
+	}
+
+	// The OAuth token replaces the subscription's own, even after it's updated.
+	sub.SearchAfter = time.Unix(2, 0)
+	if err := s.UpdateSubscription(sub); err != nil {
+		t.Fatalf("UpdateSubscription() returned err=%v", err)
+	}
+	got, err := s.Subscription(1, "g")
+	if err != nil {
+		t.Fatalf("Subscription() returned err=%v", err)
+	}
+	if got.HypToken != "access" {
+		t.Errorf("Subscription() returned HypToken=%q; want \"access\"", got.HypToken)
+	}
+	subs, err := s.Subscriptions()
+	if err != nil {
+		t.Fatalf("Subscriptions() returned err=%v", err)
+	}
+	if len(subs) != 1 || subs[0].HypToken != "access" {
+		t.Errorf("Subscriptions() returned %+v; want one with HypToken \"access\"", subs)
+	}
+}
+
+func DoTestOutbox(newStorage StorageFactory, t *testing.T) {
+	t.Run("Not found", func(t *testing.T) {
+		s := newStorage()
+		_, err := s.OutboxEntry("a", 1)
+		if err != common.ErrNotFound {
+			t.Fatalf("OutboxEntry() returned err=%v; want ErrNotFound", err)
+		}
+	})
+
+	t.Run("Add and look up", func(t *testing.T) {
+		s := newStorage()
+		e := &common.OutboxEntry{AnnotID: "a", Meta: common.AnnotationMetadata{References: []string{"p"}, HypGroup: "g", URI: "u"}, ChatID: 1, ParentMessageID: 2, Message: common.Message{Text: "hi", HTML: true, ThreadID: 5, Buttons: []common.Button{{Text: "Open", URL: "https://example.test"}, {Text: "Mute", Action: common.ActionMute}}}}
+		if err := s.AddOutboxEntry(e); err != nil {
+			t.Fatalf("AddOutboxEntry() returned err=%v", err)
+		}
+		got, err := s.OutboxEntry("a", 1)
+		if err != nil {
+			t.Fatalf("OutboxEntry() returned err=%v", err)
+		}
+		if !reflect.DeepEqual(got, e) {
+			t.Fatalf("OutboxEntry() returned %+v; want %+v", got, e)
+		}
+		entries, err := s.PendingOutboxEntries()
+		if err != nil {
+			t.Fatalf("PendingOutboxEntries() returned err=%v", err)
+		}
+		if len(entries) != 1 || !reflect.DeepEqual(entries[0], e) {
+			t.Fatalf("PendingOutboxEntries() returned %+v; want [%+v]", entries, e)
+		}
+	})
+
+	t.Run("Duplicates prohibited", func(t *testing.T) {
+		s := newStorage()
+		if err := s.AddOutboxEntry(&common.OutboxEntry{AnnotID: "a", ChatID: 1}); err != nil {
+			t.Fatalf("AddOutboxEntry() returned err=%v", err)
+		}
+		if err := s.AddOutboxEntry(&common.OutboxEntry{AnnotID: "a", ChatID: 1}); err == nil {
+			t.Fatalf("AddOutboxEntry() successfully added duplicate")
+		}
+	})
+
+	t.Run("Complete", func(t *testing.T) {
+		s := newStorage()
+		e := &common.OutboxEntry{AnnotID: "a", Meta: common.AnnotationMetadata{References: []string{"p"}, HypGroup: "g"}, ChatID: 1}
+		if err := s.AddOutboxEntry(e); err != nil {
+			t.Fatalf("AddOutboxEntry() returned err=%v", err)
+		}
+		if err := s.CompleteOutboxEntry(e.ID); err == nil {
+			t.Fatalf("CompleteOutboxEntry() succeeded for unsent entry")
+		}
+		if err := s.SetOutboxState(e.ID, common.OutboxSent, 7); err != nil {
+			t.Fatalf("SetOutboxState() returned err=%v", err)
+		}
+		if err := s.CompleteOutboxEntry(e.ID); err != nil {
+			t.Fatalf("CompleteOutboxEntry() returned err=%v", err)
+		}
+		check.AnnotationMessage(t, s, "a", e.Meta, 1, 7)
+		if _, err := s.OutboxEntry("a", 1); err != common.ErrNotFound {
+			t.Fatalf("OutboxEntry() returned err=%v; want ErrNotFound", err)
+		}
+	})
+
+	t.Run("Complete is atomic", func(t *testing.T) {
+		s := newStorage()
+		// Message 1:7 is already taken, so completing the entry must fail.
+		if err := s.SetMessageID("x", common.AnnotationMetadata{HypGroup: "g"}, 1, 7); err != nil {
+			t.Fatalf("SetMessageID() returned err=%v", err)
+		}
+		e := &common.OutboxEntry{AnnotID: "a", Meta: common.AnnotationMetadata{HypGroup: "g"}, ChatID: 1, State: common.OutboxSent, MessageID: 7}
+		if err := s.AddOutboxEntry(e); err != nil {
+			t.Fatalf("AddOutboxEntry() returned err=%v", err)
+		}
+		if err := s.CompleteOutboxEntry(e.ID); err == nil {
+			t.Fatalf("CompleteOutboxEntry() succeeded with conflicting message")
+		}
+		if _, err := s.OutboxEntry("a", 1); err != nil {
+			t.Fatalf("OutboxEntry() returned err=%v; want entry to remain", err)
+		}
+	})
+}
+
 func DoTestSubscription(newStorage StorageFactory, t *testing.T) {
 	t.Run("Not found", func(t *testing.T) {
 		s := newStorage()
@@ -320,6 +893,165 @@ func DoTestUpdateSubscription(newStorage StorageFactory, t *testing.T) {
 	})
 }
 
+func DoTestSubscriptionOptions(newStorage StorageFactory, t *testing.T) {
+	key := common.SubKey{HypGroup: "g", ChatID: 1}
+	s := newStorage()
+	opts, err := s.SubscriptionOptions(key)
+	if err != nil {
+		t.Fatalf("SubscriptionOptions() returned err=%v", err)
+	}
+	if len(opts) != 0 {
+		t.Fatalf("SubscriptionOptions() returned %v; want none", opts)
+	}
+
+	for _, kv := range [][2]string{{"a", "1"}, {"b", "2"}, {"a", "3"}} {
+		if err := s.SetSubscriptionOption(key, kv[0], kv[1]); err != nil {
+			t.Fatalf("SetSubscriptionOption() returned err=%v", err)
+		}
+	}
+	if err := s.SetSubscriptionOption(common.SubKey{HypGroup: "g", ChatID: 2}, "c", "4"); err != nil {
+		t.Fatalf("SetSubscriptionOption() returned err=%v", err)
+	}
+	opts, err = s.SubscriptionOptions(key)
+	if err != nil {
+		t.Fatalf("SubscriptionOptions() returned err=%v", err)
+	}
+	if want := map[string]string{"a": "3", "b": "2"}; !reflect.DeepEqual(opts, want) {
+		t.Fatalf("SubscriptionOptions() returned %v; want %v", opts, want)
+	}
+
+	// Empty values unset options
+	if err := s.SetSubscriptionOption(key, "a", ""); err != nil {
+		t.Fatalf("SetSubscriptionOption() returned err=%v", err)
+	}
+	opts, err = s.SubscriptionOptions(key)
+	if err != nil {
+		t.Fatalf("SubscriptionOptions() returned err=%v", err)
+	}
+	if want := map[string]string{"b": "2"}; !reflect.DeepEqual(opts, want) {
+		t.Fatalf("SubscriptionOptions() returned %v; want %v", opts, want)
+	}
+}
+
+func DoTestDigest(newStorage StorageFactory, t *testing.T) {
+	key := common.SubKey{HypGroup: "g", ChatID: 1}
+	queued := time.UnixMicro(time.Now().UnixMicro())
+	items := []*common.DigestItem{
+		{AnnotID: "a", Meta: common.AnnotationMetadata{HypGroup: "g", URI: "u1"}, User: "alice", Quote: "q", Text: "t", Queued: queued},
+		{AnnotID: "b", Meta: common.AnnotationMetadata{References: []string{"a"}, HypGroup: "g", URI: "u1"}, User: "bob", Queued: queued},
+	}
+	s := newStorage()
+	for _, item := range append(items, items[0]) {
+		if err := s.AddDigestItem(key, item); err != nil {
+			t.Fatalf("AddDigestItem() returned err=%v", err)
+		}
+	}
+	got, err := s.DigestItems(key)
+	if err != nil {
+		t.Fatalf("DigestItems() returned err=%v", err)
+	}
+	if !reflect.DeepEqual(got, items) {
+		t.Fatalf("DigestItems() returned %+v; want %+v", got, items)
+	}
+
+	if _, err := s.DigestOutboxEntry(key); err != common.ErrNotFound {
+		t.Fatalf("DigestOutboxEntry() returned err=%v; want ErrNotFound", err)
+	}
+	entry := &common.DigestOutboxEntry{Key: key, AnnotIDs: []string{"a", "b"}, Message: common.Message{Text: "digest", HTML: true}, State: common.OutboxPending}
+	if err := s.AddDigestOutboxEntry(entry); err != nil {
+		t.Fatalf("AddDigestOutboxEntry() returned err=%v", err)
+	}
+	if err := s.SetDigestOutboxState(key, common.OutboxSent, 7); err != nil {
+		t.Fatalf("SetDigestOutboxState() returned err=%v", err)
+	}
+	entry.State, entry.MessageID = common.OutboxSent, 7
+	if e, err := s.DigestOutboxEntry(key); err != nil || !reflect.DeepEqual(e, entry) {
+		t.Fatalf("DigestOutboxEntry() returned %+v, err=%v; want %+v", e, err, entry)
+	}
+
+	if err := s.CompleteDigest(key, 7, got); err != nil {
+		t.Fatalf("CompleteDigest() returned err=%v", err)
+	}
+	if _, err := s.DigestOutboxEntry(key); err != common.ErrNotFound {
+		t.Errorf("DigestOutboxEntry() after CompleteDigest returned err=%v; want ErrNotFound", err)
+	}
+	got, err = s.DigestItems(key)
+	if err != nil {
+		t.Fatalf("DigestItems() returned err=%v", err)
+	}
+	if len(got) != 0 {
+		t.Fatalf("DigestItems() returned %+v after CompleteDigest; want none", got)
+	}
+	posted, err := s.DigestMessageItems(1, 7)
+	if err != nil {
+		t.Fatalf("DigestMessageItems() returned err=%v", err)
+	}
+	if len(posted) != 2 || posted[0].AnnotID != "a" || posted[1].AnnotID != "b" || !reflect.DeepEqual(posted[1].Meta, items[1].Meta) {
+		t.Fatalf("DigestMessageItems() returned %+v; want items a and b", posted)
+	}
+	for _, annotID := range []string{"a", "b"} {
+		messageID, err := s.MessageID(annotID, 1)
+		if err != nil {
+			t.Fatalf("MessageID(%q) returned err=%v", annotID, err)
+		}
+		if messageID != 7 {
+			t.Errorf("MessageID(%q)=%d; want 7", annotID, messageID)
+		}
+	}
+}
+
+func DoTestFilters(newStorage StorageFactory, t *testing.T) {
+	key := common.SubKey{HypGroup: "g", ChatID: 1}
+	otherKey := common.SubKey{HypGroup: "g", ChatID: 2}
+
+	t.Run("Default empty", func(t *testing.T) {
+		s := newStorage()
+		rules, err := s.Filters(key)
+		if err != nil {
+			t.Fatalf("Filters() returned err=%v", err)
+		}
+		if len(rules) != 0 {
+			t.Fatalf("Filters() returned %+v; want []", rules)
+		}
+	})
+
+	t.Run("Add and remove", func(t *testing.T) {
+		s := newStorage()
+		r1 := &common.FilterRule{Field: common.FilterTag, Pattern: "t"}
+		r2 := &common.FilterRule{Exclude: true, Field: common.FilterReply}
+		for _, r := range []*common.FilterRule{r1, r2} {
+			if err := s.AddFilter(key, r); err != nil {
+				t.Fatalf("AddFilter() returned err=%v", err)
+			}
+		}
+		if err := s.AddFilter(otherKey, &common.FilterRule{Field: common.FilterHighlight}); err != nil {
+			t.Fatalf("AddFilter() returned err=%v", err)
+		}
+		rules, err := s.Filters(key)
+		if err != nil {
+			t.Fatalf("Filters() returned err=%v", err)
+		}
+		if want := []*common.FilterRule{r1, r2}; !reflect.DeepEqual(rules, want) {
+			t.Fatalf("Filters() returned %+v; want %+v", rules, want)
+		}
+
+		// Can't remove another subscription's rule
+		if err := s.RemoveFilter(otherKey, r1.ID); err != common.ErrNotFound {
+			t.Fatalf("RemoveFilter() returned err=%v; want ErrNotFound", err)
+		}
+		if err := s.RemoveFilter(key, r1.ID); err != nil {
+			t.Fatalf("RemoveFilter() returned err=%v", err)
+		}
+		rules, err = s.Filters(key)
+		if err != nil {
+			t.Fatalf("Filters() returned err=%v", err)
+		}
+		if want := []*common.FilterRule{r2}; !reflect.DeepEqual(rules, want) {
+			t.Fatalf("Filters() returned %+v; want %+v", rules, want)
+		}
+	})
+}
+
 func DoTestLock(newStorage StorageFactory, t *testing.T) {
 	s := newStorage()
 	var i int
@@ -345,12 +1077,88 @@ func DoTests(newStorage StorageFactory, t *testing.T) {
 	t.Run("SetMessageID", func(t *testing.T) { DoTestSetMessageID(newStorage, t) })
 	t.Run("MessageID", func(t *testing.T) { DoTestMessageID(newStorage, t) })
 	t.Run("AnnotationID", func(t *testing.T) { DoTestAnnotationID(newStorage, t) })
+	t.Run("AnnotationBridged", func(t *testing.T) { DoTestAnnotationBridged(newStorage, t) })
+	t.Run("MessageParts", func(t *testing.T) { DoTestMessageParts(newStorage, t) })
+	t.Run("Topics", func(t *testing.T) { DoTestTopics(newStorage, t) })
+	t.Run("DocumentHeaders", func(t *testing.T) { DoTestDocumentHeaders(newStorage, t) })
+	t.Run("UserTokens", func(t *testing.T) { DoTestUserTokens(newStorage, t) })
+	t.Run("UserLinks", func(t *testing.T) { DoTestUserLinks(newStorage, t) })
+	t.Run("AnnotationOrigins", func(t *testing.T) { DoTestAnnotationOrigins(newStorage, t) })
+	t.Run("LinkedChannels", func(t *testing.T) { DoTestLinkedChannels(newStorage, t) })
+	t.Run("MigrateChat", func(t *testing.T) { DoTestMigrateChat(newStorage, t) })
+	t.Run("NotificationSettings", func(t *testing.T) { DoTestNotificationSettings(newStorage, t) })
+	t.Run("Notifications", func(t *testing.T) { DoTestNotifications(newStorage, t) })
+	t.Run("ExpiringTokens", func(t *testing.T) { DoTestExpiringTokens(newStorage, t) })
+	t.Run("Outbox", func(t *testing.T) { DoTestOutbox(newStorage, t) })
 	t.Run("Subscriptions", func(t *testing.T) { DoTestSubscriptions(newStorage, t) })
 	t.Run("AddSubscription", func(t *testing.T) { DoTestAddSubscription(newStorage, t) })
 	t.Run("UpdateSubscription", func(t *testing.T) { DoTestUpdateSubscription(newStorage, t) })
+	t.Run("SubscriptionOptions", func(t *testing.T) { DoTestSubscriptionOptions(newStorage, t) })
+	t.Run("Digest", func(t *testing.T) { DoTestDigest(newStorage, t) })
+	t.Run("Filters", func(t *testing.T) { DoTestFilters(newStorage, t) })
 	t.Run("Lock", func(t *testing.T) { DoTestLock(newStorage, t) })
 }
 
 func TestDbStorage(t *testing.T) {
 	DoTests(NewInMemoryStorage, t)
 }
+
+func TestDbStorage_EncryptedTokens(t *testing.T) {
+	filename := "file:" + uuid.NewString() + "?mode=memory&cache=shared"
+	s, err := NewSqliteStorage(filename)
+	if err != nil {
+		t.Fatalf("NewSqliteStorage() returned err=%v", err)
+	}
+	defer s.Close()
+	sub := &common.Subscription{"ht", "g", time.Unix(1, 0), 1}
+	if err := s.AddSubscription(sub); err != nil {
+		t.Fatalf("AddSubscription() returned err=%v", err)
+	}
+	// A token stored before there was a key is encrypted once there is one.
+	if err := s.SetSubscriptionToken(&common.SubscriptionToken{Key: sub.Key(), AccessToken: "access", RefreshToken: "refresh"}); err != nil {
+		t.Fatalf("SetSubscriptionToken() returned err=%v", err)
+	}
+	c, err := crypt.NewCipher(bytes.Repeat([]byte{1}, crypt.KeySize))
+	if err != nil {
+		t.Fatalf("NewCipher() returned err=%v", err)
+	}
+	if err := s.SetCipher(c); err != nil {
+		t.Fatalf("SetCipher() returned err=%v", err)
+	}
+	var n int
+	err = s.db.QueryRow("select count(*) from SubscriptionTokens where typeof(access_token) = 'blob' and typeof(refresh_token) = 'blob'").Scan(&n)
+	if err != nil || n != 1 {
+		t.Errorf("%d encrypted tokens, err=%v; want 1", n, err)
+	}
+
+	// The OAuth token isn't copied to the subscription when it's updated.
+	got, err := s.Subscription(1, "g")
+	if err != nil || got.HypToken != "access" {
+		t.Fatalf("Subscription() returned %+v, err=%v; want HypToken \"access\"", got, err)
+	}
+	got.SearchAfter = time.Unix(2, 0)
+	if err := s.UpdateSubscription(got); err != nil {
+		t.Fatalf("UpdateSubscription() returned err=%v", err)
+	}
+	var hypToken string
+	if err := s.db.QueryRow("select hyp_token from Subscriptions").Scan(&hypToken); err != nil || hypToken != "ht" {
+		t.Errorf("hyp_token=%q, err=%v; want \"ht\"", hypToken, err)
+	}
+
+	// Without the key, the token can't be used, but it can still be moved
+	// to a migrated chat.
+	noKey, err := NewSqliteStorage(filename)
+	if err != nil {
+		t.Fatalf("NewSqliteStorage() returned err=%v", err)
+	}
+	defer noKey.Close()
+	if got, err := noKey.Subscription(1, "g"); err != nil || got.HypToken != "" {
+		t.Errorf("Subscription() without key returned %+v, err=%v; want no HypToken", got, err)
+	}
+	if err := noKey.MigrateChat(1, 2); err != nil {
+		t.Fatalf("MigrateChat() without key returned err=%v", err)
+	}
+	if got, err := s.Subscription(2, "g"); err != nil || got.HypToken != "access" {
+		t.Errorf("Subscription() after MigrateChat() returned %+v, err=%v; want HypToken \"access\"", got, err)
+	}
+}
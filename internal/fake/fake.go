@@ -4,6 +4,9 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"slices"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/objectiveryan/irsal/internal/common"
@@ -11,12 +14,17 @@ import (
 )
 
 type HypFactory struct {
-	Annots    []*hyp.Annotation
+	Annots []*hyp.Annotation
+	// Hypothesis users by token. Annotations posted with other tokens have
+	// no user.
+	Users     map[string]string
 	observers []func()
+	// IDs of annotations posted are unique across clients.
+	nextID int
 }
 
 func NewHypFactory(annots []*hyp.Annotation) *HypFactory {
-	return &HypFactory{annots, nil /*observers*/}
+	return &HypFactory{Annots: annots}
 }
 
 func (f *HypFactory) Observe(fn func()) {
@@ -30,11 +38,10 @@ func (f *HypFactory) notify() {
 }
 
 func (f *HypFactory) NewClient(token, group string) hyp.Client {
-	return &Hyp{0, token, group, f}
+	return &Hyp{token, group, f}
 }
 
 type Hyp struct {
-	nextID int
 	token  string
 	group  string
 	parent *HypFactory
@@ -60,13 +67,95 @@ func (h *Hyp) AnnotationsAfter(ctxt context.Context, t time.Time) ([]*hyp.Annota
 	return res, nil
 }
 
-func (h *Hyp) Reply(ctxt context.Context, text string, references []string, uri string) (annotID string, err error) {
-	h.nextID++
-	annot := hyp.NewAnnotationTemplate(text, h.group, references, uri)
-	annot.ID = fmt.Sprintf("a%d", h.nextID)
-	annot.Updated = hyp.ToTimestamp(time.Now())
+func (h *Hyp) Reply(ctxt context.Context, text string, references []string, uri string, tags []string) (annotID string, err error) {
+	h.parent.nextID++
+	annot := hyp.NewAnnotationTemplate(text, h.group, references, uri, tags)
+	annot.ID = fmt.Sprintf("a%d", h.parent.nextID)
+	annot.User = h.parent.Users[h.token]
+	annot.Created = hyp.ToTimestamp(time.Now())
+	annot.Updated = annot.Created
 	h.parent.Annots = append(h.parent.Annots, annot)
 	log.Printf("FakeHyp: Posted new annotation %q", annot.ID)
 	h.parent.notify()
 	return annot.ID, nil
 }
+
+func (h *Hyp) Profile(ctxt context.Context) (*hyp.Profile, error) {
+	return &hyp.Profile{UserID: h.parent.Users[h.token]}, nil
+}
+
+// Search matches text as a substring of annotations' text, and users by
+// account or username.
+func (h *Hyp) Search(ctxt context.Context, q *hyp.SearchQuery) (*hyp.SearchResult, error) {
+	var matches []*hyp.Annotation
+	for _, a := range h.parent.Annots {
+		if a.Group != h.group ||
+			!strings.Contains(strings.ToLower(a.Text), strings.ToLower(q.Text)) ||
+			q.User != "" && a.User != q.User && !strings.HasPrefix(a.User, "acct:"+q.User+"@") ||
+			q.Tag != "" && !slices.Contains(a.Tags, q.Tag) ||
+			q.URI != "" && a.URI != q.URI ||
+			q.References != "" && !slices.Contains(a.References, q.References) {
+			continue
+		}
+		matches = append(matches, a)
+	}
+	sort.SliceStable(matches, func(i, j int) bool {
+		return time.Time(*matches[i].Updated).After(time.Time(*matches[j].Updated))
+	})
+	res := &hyp.SearchResult{Total: len(matches)}
+	matches = matches[min(q.Offset, len(matches)):]
+	if q.Limit > 0 {
+		matches = matches[:min(q.Limit, len(matches))]
+	}
+	res.Annotations = matches
+	return res, nil
+}
+
+type SentMessage struct {
+	ChatID          int64
+	MessageID       int
+	ParentMessageID int
+	common.Message
+}
+
+// Tg records messages instead of sending them to Telegram.
+type Tg struct {
+	NextMessageID int
+	SentMessages  []*SentMessage
+	// Names of topics created, by thread ID
+	Topics map[int]string
+}
+
+func (tg *Tg) Send(chatID int64, parentMessageID int, msg *common.Message) (int, error) {
+	tg.NextMessageID++
+	log.Printf("Sending messageID=%d in chatID=%d with parent %d: %q", tg.NextMessageID, chatID, parentMessageID, msg.Text)
+	sent := &SentMessage{chatID, tg.NextMessageID, parentMessageID, *msg}
+	tg.SentMessages = append(tg.SentMessages, sent)
+	return sent.MessageID, nil
+}
+
+func (tg *Tg) CreateTopic(chatID int64, name string) (int, error) {
+	// Like Telegram, give the topic the ID of the message announcing it.
+	tg.NextMessageID++
+	log.Printf("Creating topic %d in chatID=%d: %q", tg.NextMessageID, chatID, name)
+	if tg.Topics == nil {
+		tg.Topics = make(map[int]string)
+	}
+	tg.Topics[tg.NextMessageID] = name
+	return tg.NextMessageID, nil
+}
+
+// Edit replaces the message recorded in SentMessages.
+func (tg *Tg) Edit(chatID int64, messageID int, msg *common.Message) error {
+	log.Printf("Editing messageID=%d in chatID=%d: %q", messageID, chatID, msg.Text)
+	for _, sent := range tg.SentMessages {
+		if sent.ChatID == chatID && sent.MessageID == messageID {
+			// Editing doesn't move a message to another topic.
+			threadID := sent.ThreadID
+			sent.Message = *msg
+			sent.ThreadID = threadID
+			return nil
+		}
+	}
+	return fmt.Errorf("no message %d in chat %d", messageID, chatID)
+}
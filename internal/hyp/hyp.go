@@ -8,6 +8,7 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"strconv"
 	"time"
 )
 
@@ -20,6 +21,7 @@ type searchResponse struct {
 
 type Annotation struct {
 	ID          string       `json:"id,omitempty"`
+	Created     *Timestamp   `json:"created,omitempty"`
 	Updated     *Timestamp   `json:"updated,omitempty"`
 	User        string       `json:"user,omitempty"`
 	URI         string       `json:"uri"`
@@ -28,6 +30,39 @@ type Annotation struct {
 	Permissions *Permissions `json:"permissions"`
 	Targets     []*Target    `json:"target,omitempty"`
 	References  []string     `json:"references,omitempty"`
+	Tags        []string     `json:"tags,omitempty"`
+	Document    *Document    `json:"document,omitempty"`
+	UserInfo    *UserInfo    `json:"user_info,omitempty"`
+	Links       *Links       `json:"links,omitempty"`
+}
+
+type Document struct {
+	Title []string `json:"title,omitempty"`
+}
+
+type UserInfo struct {
+	DisplayName string `json:"display_name,omitempty"`
+}
+
+type Links struct {
+	HTML      string `json:"html,omitempty"`
+	InContext string `json:"incontext,omitempty"`
+}
+
+// Title returns the title of the annotated document, if known.
+func (a *Annotation) Title() string {
+	if a.Document != nil && len(a.Document.Title) > 0 {
+		return a.Document.Title[0]
+	}
+	return ""
+}
+
+// Quote returns the text selected by the annotation, if any.
+func (a *Annotation) Quote() string {
+	if len(a.Targets) > 0 && a.Targets[0].Selectors.TextQuote != nil {
+		return *a.Targets[0].Selectors.TextQuote
+	}
+	return ""
 }
 
 type Permissions struct {
@@ -113,7 +148,39 @@ func (f *clientFactory) NewClient(token, group string) Client {
 type Client interface {
 	Annotation(ctxt context.Context, ID string) (*Annotation, error)
 	AnnotationsAfter(ctxt context.Context, t time.Time) ([]*Annotation, error)
-	Reply(ctxt context.Context, text string, references []string, uri string) (annotID string, err error)
+	Reply(ctxt context.Context, text string, references []string, uri string, tags []string) (annotID string, err error)
+	// Profile describes the user whose token the client uses.
+	Profile(ctxt context.Context) (*Profile, error)
+	// Search returns the group's annotations matching q, most recently
+	// updated first.
+	Search(ctxt context.Context, q *SearchQuery) (*SearchResult, error)
+}
+
+// A SearchQuery narrows a search. Empty fields match any annotation.
+type SearchQuery struct {
+	// Words in the annotation's text
+	Text string
+	// Username or account, e.g. "alice" or "acct:alice@hypothes.is"
+	User string
+	Tag  string
+	URI  string
+	// The ID of an annotation whose replies, direct or not, to find
+	References string
+	// The number of annotations to skip, and the most to return
+	Offset int
+	Limit  int
+}
+
+type SearchResult struct {
+	Annotations []*Annotation
+	// How many annotations match, including those not returned
+	Total int
+}
+
+type Profile struct {
+	// e.g. "acct:alice@hypothes.is", or empty if the token isn't valid
+	UserID   string    `json:"userid"`
+	UserInfo *UserInfo `json:"user_info,omitempty"`
 }
 
 type client struct {
@@ -179,11 +246,51 @@ func (c *client) AnnotationsAfter(ctxt context.Context, t time.Time) ([]*Annotat
 	return resp.Rows, nil
 }
 
-func (c *client) Reply(ctxt context.Context, text string, references []string, uri string) (annotID string, err error) {
+func (c *client) Search(ctxt context.Context, q *SearchQuery) (*SearchResult, error) {
+	query := url.Values{
+		"sort":  {"updated"},
+		"order": {"desc"},
+		"group": {c.Group},
+	}
+	for name, value := range map[string]string{"text": q.Text, "user": q.User, "tag": q.Tag, "uri": q.URI, "references": q.References} {
+		if value != "" {
+			query.Set(name, value)
+		}
+	}
+	if q.Offset > 0 {
+		query.Set("offset", strconv.Itoa(q.Offset))
+	}
+	if q.Limit > 0 {
+		query.Set("limit", strconv.Itoa(q.Limit))
+	}
+	req, err := http.NewRequestWithContext(ctxt, "GET", "https://api.hypothes.is/api/search?"+query.Encode(), nil)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to create http request for search: %v", err))
+	}
+	req.Header = map[string][]string{
+		"Authorization": {"Bearer " + c.Token},
+	}
+	httpResp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to perform search: %v", err)
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != 200 {
+		return nil, fmt.Errorf("failed to perform search: status=%v; want 200", httpResp.StatusCode)
+	}
+	decoder := json.NewDecoder(httpResp.Body)
+	var resp searchResponse
+	if err := decoder.Decode(&resp); err != nil {
+		return nil, fmt.Errorf("failed to decode search response: %v", err)
+	}
+	return &SearchResult{resp.Rows, resp.Total}, nil
+}
+
+func (c *client) Reply(ctxt context.Context, text string, references []string, uri string, tags []string) (annotID string, err error) {
 	if len(references) == 0 {
 		panic("hyp.client.Reply: no references")
 	}
-	annot := NewAnnotationTemplate(text, c.Group, references, uri)
+	annot := NewAnnotationTemplate(text, c.Group, references, uri, tags)
 	var buf bytes.Buffer
 	enc := json.NewEncoder(&buf)
 	err = enc.Encode(annot)
@@ -213,13 +320,38 @@ func (c *client) Reply(ctxt context.Context, text string, references []string, u
 	return newAnnot.ID, nil
 }
 
+func (c *client) Profile(ctxt context.Context) (*Profile, error) {
+	req, err := http.NewRequestWithContext(ctxt, "GET", "https://api.hypothes.is/api/profile", nil)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to create http request for profile: %v", err))
+	}
+	req.Header = map[string][]string{
+		"Authorization": {"Bearer " + c.Token},
+	}
+	httpResp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch profile: %v", err)
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != 200 {
+		return nil, fmt.Errorf("failed to fetch profile: status=%v; want 200", httpResp.StatusCode)
+	}
+	decoder := json.NewDecoder(httpResp.Body)
+	var profile Profile
+	if err := decoder.Decode(&profile); err != nil {
+		return nil, fmt.Errorf("failed to decode profile: %v", err)
+	}
+	return &profile, nil
+}
+
 // The fields required to create an Annotation
-func NewAnnotationTemplate(text, group string, references []string, uri string) *Annotation {
+func NewAnnotationTemplate(text, group string, references []string, uri string, tags []string) *Annotation {
 	return &Annotation{
 		URI:         uri,
 		Text:        text,
 		Group:       group,
 		Permissions: &Permissions{Read: []string{"group:" + group}},
 		References:  references,
+		Tags:        tags,
 	}
 }
@@ -57,6 +57,24 @@ func TestParseAnnotation(t *testing.T) {
 			t.Errorf("Permissions.Read=%q; want %q", annot.Permissions.Read, want)
 		}
 	}
+	if got := annot.Title(); got != "Document Title" {
+		t.Errorf("Title()=%q; want \"Document Title\"", got)
+	}
+	if annot.Links == nil {
+		t.Error("Links=nil")
+	} else {
+		if want := "https://hypothes.is/a/fake-id"; annot.Links.HTML != want {
+			t.Errorf("Links.HTML=%q; want %q", annot.Links.HTML, want)
+		}
+		if want := "https://hyp.is/fake-id/example.test/fakeurl/"; annot.Links.InContext != want {
+			t.Errorf("Links.InContext=%q; want %q", annot.Links.InContext, want)
+		}
+	}
+	if annot.UserInfo == nil {
+		t.Error("UserInfo=nil")
+	} else if annot.UserInfo.DisplayName != "" {
+		t.Errorf("UserInfo.DisplayName=%q; want \"\"", annot.UserInfo.DisplayName)
+	}
 	if len(annot.Targets) != 1 {
 		t.Errorf("%d targets; want 1", len(annot.Targets))
 	} else {
@@ -77,20 +95,20 @@ func TestParseAnnotation(t *testing.T) {
 }
 
 func TestSerializeAnnotation(t *testing.T) {
-	data, err := json.Marshal(NewAnnotationTemplate("content", "grp", []string{"ref1", "ref2"}, "http://example.test/foo"))
+	data, err := json.Marshal(NewAnnotationTemplate("content", "grp", []string{"ref1", "ref2"}, "http://example.test/foo", []string{"tag"}))
 	if err != nil {
 		t.Fatal("Failed to marshal annotation:", err)
 	}
 	s := string(data)
 	// unwanted fields
-	for _, field := range []string{"id", "updated", "user", "target"} {
+	for _, field := range []string{"id", "updated", "user", "target", "document", "user_info", "links"} {
 		substr := "\"" + field + "\""
 		if strings.Contains(s, substr) {
 			t.Errorf("%q contains %q", s, substr)
 		}
 	}
 	// wanted fields
-	for _, field := range []string{"uri", "text", "group", "permissions", "references"} {
+	for _, field := range []string{"uri", "text", "group", "permissions", "references", "tags"} {
 		substr := "\"" + field + "\""
 		if !strings.Contains(s, substr) {
 			t.Errorf("%q doesn't contain %q", s, substr)
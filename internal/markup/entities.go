@@ -0,0 +1,265 @@
+package markup
+
+import (
+	"fmt"
+	"html"
+	"net/url"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+
+	tele "gopkg.in/telebot.v3"
+)
+
+// A formatter writes text with entities in some markup language.
+type formatter interface {
+	open(e tele.MessageEntity) string
+	close(e tele.MessageEntity) string
+	// escape escapes text inside the entities on stack.
+	escape(s string, stack []tele.MessageEntity) string
+}
+
+// render walks text, calling f to mark up where each entity starts and ends.
+// Entities which overlap without nesting are cut short at the end of the
+// enclosing entity.
+func render(text string, ents tele.Entities, f formatter) string {
+	u := utf16.Encode([]rune(text))
+	ents = append(tele.Entities(nil), ents...)
+	sort.SliceStable(ents, func(i, j int) bool {
+		if ents[i].Offset != ents[j].Offset {
+			return ents[i].Offset < ents[j].Offset
+		}
+		return ents[i].Length > ents[j].Length
+	})
+
+	var out strings.Builder
+	var stack []tele.MessageEntity
+	end := func(e tele.MessageEntity) int { return e.Offset + e.Length }
+	next := 0
+	for i := 0; i <= len(u); {
+		for len(stack) > 0 && end(stack[len(stack)-1]) <= i {
+			out.WriteString(f.close(stack[len(stack)-1]))
+			stack = stack[:len(stack)-1]
+		}
+		if i == len(u) {
+			break
+		}
+		for ; next < len(ents) && ents[next].Offset <= i; next++ {
+			e := ents[next]
+			if e.Offset < i || e.Length <= 0 {
+				continue
+			}
+			if len(stack) > 0 && end(e) > end(stack[len(stack)-1]) {
+				e.Length = end(stack[len(stack)-1]) - e.Offset
+			}
+			out.WriteString(f.open(e))
+			stack = append(stack, e)
+		}
+
+		j := len(u)
+		if len(stack) > 0 {
+			j = end(stack[len(stack)-1])
+		}
+		if next < len(ents) && ents[next].Offset < j {
+			j = ents[next].Offset
+		}
+		if j > len(u) {
+			j = len(u)
+		}
+		out.WriteString(f.escape(string(utf16.Decode(u[i:j])), stack))
+		i = j
+	}
+	return out.String()
+}
+
+func inside(stack []tele.MessageEntity, types ...tele.EntityType) bool {
+	for _, e := range stack {
+		for _, t := range types {
+			if e.Type == t {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ToHTML converts text with entities to Telegram's HTML.
+func ToHTML(text string, ents tele.Entities) string {
+	return render(text, ents, htmlFormatter{})
+}
+
+type htmlFormatter struct{}
+
+// linkSchemes are the kinds of URL which links in HTML may have. Links are
+// written by anyone in the group, so others, like javascript:, are dropped
+// and only their text is kept.
+var linkSchemes = map[string]bool{"http": true, "https": true, "tg": true, "mailto": true}
+
+func safeURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && linkSchemes[strings.ToLower(u.Scheme)]
+}
+
+func (htmlFormatter) open(e tele.MessageEntity) string {
+	switch e.Type {
+	case tele.EntityBold:
+		return "<b>"
+	case tele.EntityItalic:
+		return "<i>"
+	case tele.EntityUnderline:
+		return "<u>"
+	case tele.EntityStrikethrough:
+		return "<s>"
+	case tele.EntitySpoiler:
+		return "<tg-spoiler>"
+	case tele.EntityCode:
+		return "<code>"
+	case tele.EntityCodeBlock:
+		if e.Language != "" {
+			return fmt.Sprintf(`<pre><code class="language-%s">`, html.EscapeString(e.Language))
+		}
+		return "<pre>"
+	case tele.EntityBlockquote:
+		return "<blockquote>"
+	case tele.EntityTextLink:
+		if safeURL(e.URL) {
+			return fmt.Sprintf(`<a href="%s">`, html.EscapeString(e.URL))
+		}
+	case tele.EntityTMention:
+		if e.User != nil {
+			return fmt.Sprintf(`<a href="tg://user?id=%d">`, e.User.ID)
+		}
+	}
+	return ""
+}
+
+func (htmlFormatter) close(e tele.MessageEntity) string {
+	switch e.Type {
+	case tele.EntityBold:
+		return "</b>"
+	case tele.EntityItalic:
+		return "</i>"
+	case tele.EntityUnderline:
+		return "</u>"
+	case tele.EntityStrikethrough:
+		return "</s>"
+	case tele.EntitySpoiler:
+		return "</tg-spoiler>"
+	case tele.EntityCode:
+		return "</code>"
+	case tele.EntityCodeBlock:
+		if e.Language != "" {
+			return "</code></pre>"
+		}
+		return "</pre>"
+	case tele.EntityBlockquote:
+		return "</blockquote>"
+	case tele.EntityTextLink:
+		if safeURL(e.URL) {
+			return "</a>"
+		}
+	case tele.EntityTMention:
+		if e.User != nil {
+			return "</a>"
+		}
+	}
+	return ""
+}
+
+func (htmlFormatter) escape(s string, stack []tele.MessageEntity) string {
+	// Only <, > and & need escaping in Telegram's HTML.
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+// ToMarkdown converts text with entities to Markdown, as used by Hypothesis.
+// Formatting with no Markdown equivalent, such as underlines, is dropped.
+func ToMarkdown(text string, ents tele.Entities) string {
+	return render(text, trimEntities(text, ents), markdownFormatter{})
+}
+
+// trimEntities moves whitespace at either end of emphasis out of it, since
+// Markdown doesn't allow it there.
+func trimEntities(text string, ents tele.Entities) tele.Entities {
+	u := utf16.Encode([]rune(text))
+	space := func(i int) bool { return i < len(u) && unicode.IsSpace(rune(u[i])) }
+	trimmed := make(tele.Entities, 0, len(ents))
+	for _, e := range ents {
+		switch e.Type {
+		case tele.EntityBold, tele.EntityItalic, tele.EntityStrikethrough, tele.EntityCode, tele.EntityTextLink:
+			for e.Length > 0 && space(e.Offset) {
+				e.Offset++
+				e.Length--
+			}
+			for e.Length > 0 && space(e.Offset+e.Length-1) {
+				e.Length--
+			}
+		}
+		if e.Length > 0 {
+			trimmed = append(trimmed, e)
+		}
+	}
+	return trimmed
+}
+
+type markdownFormatter struct{}
+
+func (markdownFormatter) open(e tele.MessageEntity) string {
+	switch e.Type {
+	case tele.EntityBold:
+		return "**"
+	case tele.EntityItalic:
+		return "_"
+	case tele.EntityStrikethrough:
+		return "~~"
+	case tele.EntityCode:
+		return "`"
+	case tele.EntityCodeBlock:
+		return "```" + e.Language + "\n"
+	case tele.EntityBlockquote:
+		return "> "
+	case tele.EntityTextLink:
+		return "["
+	case tele.EntityTMention:
+		if e.User != nil {
+			return "["
+		}
+	}
+	return ""
+}
+
+func (markdownFormatter) close(e tele.MessageEntity) string {
+	switch e.Type {
+	case tele.EntityBold:
+		return "**"
+	case tele.EntityItalic:
+		return "_"
+	case tele.EntityStrikethrough:
+		return "~~"
+	case tele.EntityCode:
+		return "`"
+	case tele.EntityCodeBlock:
+		return "\n```"
+	case tele.EntityTextLink:
+		return "](" + e.URL + ")"
+	case tele.EntityTMention:
+		if e.User != nil {
+			return fmt.Sprintf("](tg://user?id=%d)", e.User.ID)
+		}
+	}
+	return ""
+}
+
+var markdownEscaper = strings.NewReplacer(
+	`\`, `\\`, "*", `\*`, "_", `\_`, "`", "\\`", "[", `\[`, "]", `\]`, "~", `\~`,
+)
+
+func (markdownFormatter) escape(s string, stack []tele.MessageEntity) string {
+	if !inside(stack, tele.EntityCode, tele.EntityCodeBlock, tele.EntityURL, tele.EntityEmail) {
+		s = markdownEscaper.Replace(s)
+	}
+	if inside(stack, tele.EntityBlockquote) {
+		s = strings.ReplaceAll(s, "\n", "\n> ")
+	}
+	return s
+}
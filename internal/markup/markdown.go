@@ -0,0 +1,280 @@
+// Package markup converts between the Markdown used in Hypothesis annotations
+// and Telegram message entities.
+package markup
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	tele "gopkg.in/telebot.v3"
+)
+
+// utf16Len returns the length of s in UTF-16 code units, which is how
+// Telegram measures entity offsets and lengths.
+func utf16Len(s string) int {
+	n := 0
+	for _, r := range s {
+		if r >= 0x10000 {
+			n += 2
+		} else {
+			n++
+		}
+	}
+	return n
+}
+
+// builder accumulates text and the entities in it.
+type builder struct {
+	text strings.Builder
+	n    int
+	ents tele.Entities
+}
+
+func (b *builder) write(s string) {
+	b.text.WriteString(s)
+	b.n += utf16Len(s)
+}
+
+// entity adds an entity covering whatever fn writes, unless that's nothing.
+func (b *builder) entity(e tele.MessageEntity, fn func()) {
+	i := len(b.ents)
+	// Reserve a place so that outer entities come before inner ones.
+	b.ents = append(b.ents, e)
+	start := b.n
+	fn()
+	if b.n == start {
+		b.ents = append(b.ents[:i], b.ents[i+1:]...)
+		return
+	}
+	b.ents[i].Offset = start
+	b.ents[i].Length = b.n - start
+}
+
+var (
+	headingRegexp  = regexp.MustCompile(`^#{1,6}\s+`)
+	listItemRegexp = regexp.MustCompile(`^(\s*)[-*+]\s+`)
+	fenceRegexp    = regexp.MustCompile("^\\s*```\\s*(\\S*)")
+)
+
+// FromMarkdown converts Markdown to plain text with Telegram entities.
+// It understands emphasis, code, links, images, block quotes, headings,
+// lists and LaTeX delimited by $$ or \( \), which is shown as code.
+func FromMarkdown(md string) (string, tele.Entities) {
+	var b builder
+	lines := strings.Split(strings.ReplaceAll(md, "\r\n", "\n"), "\n")
+	for i := 0; i < len(lines); i++ {
+		if i > 0 {
+			b.write("\n")
+		}
+		line := lines[i]
+		if m := fenceRegexp.FindStringSubmatch(line); m != nil {
+			// Fenced code block, up to the closing fence or the end of the text
+			var code []string
+			for i++; i < len(lines) && !fenceRegexp.MatchString(lines[i]); i++ {
+				code = append(code, lines[i])
+			}
+			b.entity(tele.MessageEntity{Type: tele.EntityCodeBlock, Language: m[1]}, func() {
+				b.write(strings.Join(code, "\n"))
+			})
+			continue
+		}
+		if isQuote(line) {
+			// Consecutive quoted lines form one block quote.
+			var quoted []string
+			for ; i < len(lines) && isQuote(lines[i]); i++ {
+				quoted = append(quoted, strings.TrimPrefix(strings.TrimPrefix(strings.TrimLeft(lines[i], " "), ">"), " "))
+			}
+			i--
+			b.entity(tele.MessageEntity{Type: tele.EntityBlockquote}, func() {
+				text, ents := FromMarkdown(strings.Join(quoted, "\n"))
+				b.append(text, ents)
+			})
+			continue
+		}
+		if m := headingRegexp.FindString(line); m != "" {
+			b.entity(tele.MessageEntity{Type: tele.EntityBold}, func() {
+				b.inline(line[len(m):])
+			})
+			continue
+		}
+		if m := listItemRegexp.FindStringSubmatch(line); m != nil {
+			b.write(m[1] + "• ")
+			line = line[len(m[0]):]
+		}
+		b.inline(line)
+	}
+	return b.text.String(), b.ents
+}
+
+func isQuote(line string) bool {
+	return strings.HasPrefix(strings.TrimLeft(line, " "), ">")
+}
+
+// append writes text with entities relative to its start.
+func (b *builder) append(text string, ents tele.Entities) {
+	for _, e := range ents {
+		e.Offset += b.n
+		b.ents = append(b.ents, e)
+	}
+	b.write(text)
+}
+
+// inlineDelims are the delimiters of spans whose contents are also parsed,
+// longest first.
+var inlineDelims = []struct {
+	delim string
+	typ   tele.EntityType
+}{
+	{"**", tele.EntityBold},
+	{"__", tele.EntityBold},
+	{"~~", tele.EntityStrikethrough},
+	{"*", tele.EntityItalic},
+	{"_", tele.EntityItalic},
+}
+
+// inline writes a line of Markdown, parsing spans within it.
+func (b *builder) inline(s string) {
+	for len(s) > 0 {
+		if n := b.span(s); n > 0 {
+			s = s[n:]
+			continue
+		}
+		if s[0] == '\\' && len(s) > 1 && isPunct(s[1]) {
+			b.write(s[1:2])
+			s = s[2:]
+			continue
+		}
+		_, size := utf8.DecodeRuneInString(s)
+		b.write(s[:size])
+		s = s[size:]
+	}
+}
+
+// span writes the span at the start of s, if there is one, and returns how
+// much of s it used.
+func (b *builder) span(s string) int {
+	// Code and LaTeX, whose contents are taken literally
+	for _, d := range []struct{ open, close string }{{"`", "`"}, {"$$", "$$"}, {`\(`, `\)`}} {
+		if !strings.HasPrefix(s, d.open) {
+			continue
+		}
+		end := strings.Index(s[len(d.open):], d.close)
+		if end <= 0 {
+			continue
+		}
+		b.entity(tele.MessageEntity{Type: tele.EntityCode}, func() {
+			b.write(s[len(d.open) : len(d.open)+end])
+		})
+		return len(d.open) + end + len(d.close)
+	}
+
+	// Links and images
+	if strings.HasPrefix(s, "[") || strings.HasPrefix(s, "![") {
+		image := s[0] == '!'
+		if image {
+			s = s[1:]
+		}
+		if text, url, n := parseLink(s); n > 0 {
+			b.entity(tele.MessageEntity{Type: tele.EntityTextLink, URL: url}, func() {
+				if image {
+					b.write("🖼 ")
+					if text == "" {
+						text = "image"
+					}
+				}
+				b.inline(text)
+			})
+			if image {
+				n++
+			}
+			return n
+		}
+		if image {
+			return 0
+		}
+	}
+
+	for _, d := range inlineDelims {
+		if !strings.HasPrefix(s, d.delim) {
+			continue
+		}
+		end := closingDelim(s[len(d.delim):], d.delim)
+		if end <= 0 {
+			continue
+		}
+		b.entity(tele.MessageEntity{Type: d.typ}, func() {
+			b.inline(s[len(d.delim) : len(d.delim)+end])
+		})
+		return len(d.delim) + end + len(d.delim)
+	}
+	return 0
+}
+
+// closingDelim finds the delimiter closing a span in s. The span can't start
+// or end with a space, and underscores only count outside of words.
+func closingDelim(s, delim string) int {
+	if s == "" || unicode.IsSpace(rune(s[0])) {
+		return -1
+	}
+	for i := 1; i+len(delim) <= len(s); i++ {
+		if s[i] == '\\' {
+			i++
+			continue
+		}
+		if !strings.HasPrefix(s[i:], delim) || unicode.IsSpace(rune(s[i-1])) {
+			continue
+		}
+		after := s[i+len(delim):]
+		// "**" isn't closed by the first half of a later "**"
+		if len(delim) == 1 && strings.HasPrefix(after, delim) {
+			i++
+			continue
+		}
+		if delim[0] == '_' && after != "" && isWordChar(after[0]) {
+			continue
+		}
+		return i
+	}
+	return -1
+}
+
+// parseLink parses "[text](url)" at the start of s.
+func parseLink(s string) (text, url string, n int) {
+	depth := 0
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			i++
+		case '[':
+			depth++
+		case ']':
+			depth--
+			if depth > 0 {
+				continue
+			}
+			rest := s[i+1:]
+			if !strings.HasPrefix(rest, "(") {
+				return "", "", 0
+			}
+			end := strings.IndexByte(rest, ')')
+			if end < 0 {
+				return "", "", 0
+			}
+			url = strings.TrimSpace(rest[1:end])
+			// Ignore any title, as in [text](url "title")
+			url, _, _ = strings.Cut(url, " ")
+			return s[1:i], url, i + 1 + end + 1
+		}
+	}
+	return "", "", 0
+}
+
+func isPunct(c byte) bool {
+	return c < utf8.RuneSelf && unicode.IsPunct(rune(c)) || c == '`' || c == '$' || c == '~' || c == '>' || c == '#' || c == '+'
+}
+
+func isWordChar(c byte) bool {
+	return c >= utf8.RuneSelf || unicode.IsLetter(rune(c)) || unicode.IsDigit(rune(c))
+}
@@ -0,0 +1,124 @@
+package markup
+
+import (
+	"reflect"
+	"testing"
+
+	tele "gopkg.in/telebot.v3"
+)
+
+func ent(typ tele.EntityType, offset, length int) tele.MessageEntity {
+	return tele.MessageEntity{Type: typ, Offset: offset, Length: length}
+}
+
+func link(url string, offset, length int) tele.MessageEntity {
+	return tele.MessageEntity{Type: tele.EntityTextLink, Offset: offset, Length: length, URL: url}
+}
+
+func TestFromMarkdown(t *testing.T) {
+	tests := []struct {
+		md       string
+		wantText string
+		wantEnts tele.Entities
+	}{
+		{"plain text", "plain text", nil},
+		{"some **bold** text", "some bold text", tele.Entities{ent(tele.EntityBold, 5, 4)}},
+		{"some __bold__ text", "some bold text", tele.Entities{ent(tele.EntityBold, 5, 4)}},
+		{"*a* and _b_", "a and b", tele.Entities{ent(tele.EntityItalic, 0, 1), ent(tele.EntityItalic, 6, 1)}},
+		{"~~gone~~", "gone", tele.Entities{ent(tele.EntityStrikethrough, 0, 4)}},
+		{"**bold _both_**", "bold both", tele.Entities{ent(tele.EntityBold, 0, 9), ent(tele.EntityItalic, 5, 4)}},
+		{"snake_case_name", "snake_case_name", nil},
+		{"2 * 3 * 4", "2 * 3 * 4", nil},
+		{"run `go **test**`", "run go **test**", tele.Entities{ent(tele.EntityCode, 4, 11)}},
+		{"```go\nfmt.Println()\n```\nafter", "fmt.Println()\nafter",
+			tele.Entities{{Type: tele.EntityCodeBlock, Offset: 0, Length: 13, Language: "go"}}},
+		{"see [the *docs*](https://example.test/ \"Docs\")", "see the docs",
+			tele.Entities{link("https://example.test/", 4, 8), ent(tele.EntityItalic, 8, 4)}},
+		{"![a cat](https://example.test/cat.png)", "🖼 a cat", tele.Entities{link("https://example.test/cat.png", 0, 8)}},
+		{"[not a link]", "[not a link]", nil},
+		{"$$e^{i\\pi}$$ and \\(x_1\\)", "e^{i\\pi} and x_1", tele.Entities{ent(tele.EntityCode, 0, 8), ent(tele.EntityCode, 13, 3)}},
+		{"> quoted\n> **lines**\nnot quoted", "quoted\nlines\nnot quoted",
+			tele.Entities{ent(tele.EntityBlockquote, 0, 12), ent(tele.EntityBold, 7, 5)}},
+		{"## Heading\ntext", "Heading\ntext", tele.Entities{ent(tele.EntityBold, 0, 7)}},
+		{"- one\n- two", "• one\n• two", nil},
+		{`\*not italic\*`, "*not italic*", nil},
+		// Offsets count UTF-16 code units.
+		{"😀 **bold**", "😀 bold", tele.Entities{ent(tele.EntityBold, 3, 4)}},
+	}
+	for _, test := range tests {
+		text, ents := FromMarkdown(test.md)
+		if text != test.wantText || !reflect.DeepEqual(ents, test.wantEnts) {
+			t.Errorf("FromMarkdown(%q) returned %q, %v; want %q, %v", test.md, text, ents, test.wantText, test.wantEnts)
+		}
+	}
+}
+
+func TestToMarkdown(t *testing.T) {
+	tests := []struct {
+		text string
+		ents tele.Entities
+		want string
+	}{
+		{"plain text", nil, "plain text"},
+		{"some bold text", tele.Entities{ent(tele.EntityBold, 5, 4)}, "some **bold** text"},
+		{"bold both", tele.Entities{ent(tele.EntityBold, 0, 9), ent(tele.EntityItalic, 5, 4)}, "**bold _both_**"},
+		{"some bold text", tele.Entities{ent(tele.EntityBold, 4, 6)}, "some **bold** text"},
+		{"gone", tele.Entities{ent(tele.EntityStrikethrough, 0, 4)}, "~~gone~~"},
+		{"underlined", tele.Entities{ent(tele.EntityUnderline, 0, 10)}, "underlined"},
+		{"run go test", tele.Entities{ent(tele.EntityCode, 4, 7)}, "run `go test`"},
+		{"fmt.Println()", tele.Entities{{Type: tele.EntityCodeBlock, Length: 13, Language: "go"}}, "```go\nfmt.Println()\n```"},
+		{"see the docs", tele.Entities{link("https://example.test/", 4, 8)}, "see [the docs](https://example.test/)"},
+		{"quoted\nlines\nafter", tele.Entities{ent(tele.EntityBlockquote, 0, 12)}, "> quoted\n> lines\nafter"},
+		{"2*3 [x] snake_case", nil, `2\*3 \[x\] snake\_case`},
+		{"https://example.test/a_b", tele.Entities{ent(tele.EntityURL, 0, 24)}, "https://example.test/a_b"},
+		{"😀 bold", tele.Entities{ent(tele.EntityBold, 3, 4)}, "😀 **bold**"},
+		// Overlapping entities are cut short rather than producing broken markup.
+		{"abcdef", tele.Entities{ent(tele.EntityBold, 0, 4), ent(tele.EntityItalic, 2, 4)}, "**ab_cd_**ef"},
+	}
+	for _, test := range tests {
+		if got := ToMarkdown(test.text, test.ents); got != test.want {
+			t.Errorf("ToMarkdown(%q, %v) returned %q; want %q", test.text, test.ents, got, test.want)
+		}
+	}
+}
+
+func TestToHTML(t *testing.T) {
+	tests := []struct {
+		text string
+		ents tele.Entities
+		want string
+	}{
+		{"a < b && c > d", nil, "a &lt; b &amp;&amp; c &gt; d"},
+		{"some bold text", tele.Entities{ent(tele.EntityBold, 5, 4)}, "some <b>bold</b> text"},
+		{"see the docs", tele.Entities{link(`https://example.test/?a=1&b="2"`, 4, 8)},
+			`see <a href="https://example.test/?a=1&amp;b=&#34;2&#34;">the docs</a>`},
+		{"x := 1", tele.Entities{{Type: tele.EntityCodeBlock, Length: 6, Language: "go"}},
+			`<pre><code class="language-go">x := 1</code></pre>`},
+		{"quoted", tele.Entities{ent(tele.EntityBlockquote, 0, 6)}, "<blockquote>quoted</blockquote>"},
+		{"secret", tele.Entities{ent(tele.EntitySpoiler, 0, 6)}, "<tg-spoiler>secret</tg-spoiler>"},
+		{"mail me", tele.Entities{link("mailto:a@example.test", 0, 7)}, `<a href="mailto:a@example.test">mail me</a>`},
+		{"click", tele.Entities{link("javascript:alert(1)", 0, 5)}, "click"},
+		{"click", tele.Entities{link(" JavaScript:alert(1)", 0, 5)}, "click"},
+		{"bold click", tele.Entities{ent(tele.EntityBold, 0, 10), link("data:text/html,hi", 5, 5)}, "<b>bold click</b>"},
+		{"relative", tele.Entities{link("/a/b", 0, 8)}, "relative"},
+	}
+	for _, test := range tests {
+		if got := ToHTML(test.text, test.ents); got != test.want {
+			t.Errorf("ToHTML(%q, %v) returned %q; want %q", test.text, test.ents, got, test.want)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, md := range []string{
+		"some **bold** and _italic_ text",
+		"run `go test` or see [the docs](https://example.test/)",
+		"> a quote\n> on two lines\nthen ~~not~~ this",
+		`escaped \* and \_ characters`,
+	} {
+		text, ents := FromMarkdown(md)
+		if got := ToMarkdown(text, ents); got != md {
+			t.Errorf("ToMarkdown(FromMarkdown(%q)) returned %q", md, got)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package markup
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+	"unicode/utf16"
+
+	tele "gopkg.in/telebot.v3"
+)
+
+// Length returns the length of text as Telegram counts it, in UTF-16 code
+// units.
+func Length(text string) int {
+	return utf16Len(text)
+}
+
+var (
+	tagRegexp  = regexp.MustCompile(`^<(/?)([a-zA-Z][a-zA-Z0-9-]*)([^>]*)>`)
+	attrRegexp = regexp.MustCompile(`([a-zA-Z-]+)\s*=\s*(?:"([^"]*)"|'([^']*)')`)
+)
+
+var htmlEntityTypes = map[string]tele.EntityType{
+	"b":          tele.EntityBold,
+	"strong":     tele.EntityBold,
+	"i":          tele.EntityItalic,
+	"em":         tele.EntityItalic,
+	"u":          tele.EntityUnderline,
+	"ins":        tele.EntityUnderline,
+	"s":          tele.EntityStrikethrough,
+	"strike":     tele.EntityStrikethrough,
+	"del":        tele.EntityStrikethrough,
+	"tg-spoiler": tele.EntitySpoiler,
+	"code":       tele.EntityCode,
+	"pre":        tele.EntityCodeBlock,
+	"blockquote": tele.EntityBlockquote,
+	"a":          tele.EntityTextLink,
+}
+
+// FromHTML converts Telegram's HTML to plain text with entities. It is
+// lenient: unknown tags are dropped and unclosed tags end with the text.
+func FromHTML(s string) (string, tele.Entities) {
+	var b builder
+	type open struct {
+		tag string
+		i   int // index in b.ents, or -1 if the tag has no entity
+	}
+	var stack []open
+	closeTag := func(j int) {
+		if i := stack[j].i; i >= 0 {
+			b.ents[i].Length = b.n - b.ents[i].Offset
+		}
+	}
+	for len(s) > 0 {
+		if m := tagRegexp.FindStringSubmatch(s); m != nil {
+			s = s[len(m[0]):]
+			tag := strings.ToLower(m[2])
+			if m[1] == "/" {
+				// Close the innermost matching tag, and any left open inside it.
+				for j := len(stack) - 1; j >= 0; j-- {
+					if stack[j].tag == tag {
+						for k := len(stack) - 1; k >= j; k-- {
+							closeTag(k)
+						}
+						stack = stack[:j]
+						break
+					}
+				}
+				continue
+			}
+			attrs := parseAttrs(m[3])
+			typ, ok := htmlEntityTypes[tag]
+			if tag == "span" && attrs["class"] == "tg-spoiler" {
+				typ, ok = tele.EntitySpoiler, true
+			}
+			if ok && typ == tele.EntityCode && len(stack) > 0 && stack[len(stack)-1].tag == "pre" {
+				// <pre><code class="language-go"> is one code block.
+				if i := stack[len(stack)-1].i; i >= 0 {
+					b.ents[i].Language = strings.TrimPrefix(attrs["class"], "language-")
+				}
+				ok = false
+			}
+			if strings.HasSuffix(m[3], "/") {
+				// Self-closing tags don't cover any text.
+				continue
+			}
+			i := -1
+			if ok {
+				i = len(b.ents)
+				b.ents = append(b.ents, tele.MessageEntity{Type: typ, Offset: b.n, URL: attrs["href"]})
+			}
+			stack = append(stack, open{tag, i})
+			continue
+		}
+		j := strings.IndexByte(s[1:], '<') + 1
+		if j == 0 {
+			j = len(s)
+		}
+		b.write(html.UnescapeString(s[:j]))
+		s = s[j:]
+	}
+	for j := len(stack) - 1; j >= 0; j-- {
+		closeTag(j)
+	}
+
+	// Drop entities which turned out to be empty.
+	ents := b.ents[:0]
+	for _, e := range b.ents {
+		if e.Length > 0 {
+			ents = append(ents, e)
+		}
+	}
+	if len(ents) == 0 {
+		ents = nil
+	}
+	return b.text.String(), ents
+}
+
+// CheckHTML reports markup which Telegram would reject: tags it doesn't
+// support, tags which aren't closed in order, and stray "<" characters.
+func CheckHTML(s string) error {
+	var stack []string
+	for {
+		i := strings.IndexByte(s, '<')
+		if i < 0 {
+			break
+		}
+		s = s[i:]
+		m := tagRegexp.FindStringSubmatch(s)
+		if m == nil {
+			return fmt.Errorf("unescaped \"<\"")
+		}
+		s = s[len(m[0]):]
+		tag := strings.ToLower(m[2])
+		if m[1] == "/" {
+			if len(stack) == 0 || stack[len(stack)-1] != tag {
+				return fmt.Errorf("unexpected </%s>", tag)
+			}
+			stack = stack[:len(stack)-1]
+			continue
+		}
+		_, ok := htmlEntityTypes[tag]
+		if tag == "span" {
+			ok = parseAttrs(m[3])["class"] == "tg-spoiler"
+		}
+		if !ok || strings.HasSuffix(m[3], "/") {
+			return fmt.Errorf("unsupported tag %s", m[0])
+		}
+		stack = append(stack, tag)
+	}
+	if len(stack) > 0 {
+		return fmt.Errorf("unclosed <%s>", stack[len(stack)-1])
+	}
+	return nil
+}
+
+func parseAttrs(s string) map[string]string {
+	attrs := make(map[string]string)
+	for _, m := range attrRegexp.FindAllStringSubmatch(s, -1) {
+		attrs[strings.ToLower(m[1])] = html.UnescapeString(m[2] + m[3])
+	}
+	return attrs
+}
+
+// A Part is a piece of text with its own entities.
+type Part struct {
+	Text     string
+	Entities tele.Entities
+}
+
+// Split divides text into parts of at most limit UTF-16 code units,
+// preferring to break between paragraphs, then lines, then words. Entities
+// which cross a break are divided between the parts.
+func Split(text string, ents tele.Entities, limit int) []Part {
+	u := utf16.Encode([]rune(text))
+	var parts []Part
+	for start := 0; start < len(u) || len(parts) == 0; {
+		end := len(u)
+		if end-start > limit {
+			end = splitPoint(u, start, start+limit)
+		}
+		next := end
+		for end > start && isSpace16(u[end-1]) {
+			end--
+		}
+		parts = append(parts, Part{string(utf16.Decode(u[start:end])), clip(ents, start, end)})
+		for next < len(u) && isSpace16(u[next]) {
+			next++
+		}
+		start = next
+	}
+	return parts
+}
+
+// splitPoint chooses where to end a part which starts at start and can't go
+// past end.
+func splitPoint(u []uint16, start, end int) int {
+	// Don't make parts much shorter than they need to be.
+	least := start + (end-start)/2
+	for _, sep := range []string{"\n\n", "\n", " "} {
+		s := utf16.Encode([]rune(sep))
+		for i := end - len(s); i > least; i-- {
+			if equal16(u[i:i+len(s)], s) {
+				return i
+			}
+		}
+	}
+	if utf16.IsSurrogate(rune(u[end-1])) && u[end-1] < 0xdc00 {
+		// Don't separate the halves of a surrogate pair.
+		return end - 1
+	}
+	return end
+}
+
+func equal16(a, b []uint16) bool {
+	for i := range b {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func isSpace16(c uint16) bool {
+	return c == ' ' || c == '\n' || c == '\t' || c == '\r'
+}
+
+// clip returns the parts of ents between start and end, relative to start.
+func clip(ents tele.Entities, start, end int) tele.Entities {
+	var clipped tele.Entities
+	for _, e := range ents {
+		from := max(e.Offset, start)
+		to := min(e.Offset+e.Length, end)
+		if to > from {
+			e.Offset = from - start
+			e.Length = to - from
+			clipped = append(clipped, e)
+		}
+	}
+	return clipped
+}
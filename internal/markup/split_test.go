@@ -0,0 +1,94 @@
+package markup
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	tele "gopkg.in/telebot.v3"
+)
+
+func TestFromHTML(t *testing.T) {
+	tests := []struct {
+		html     string
+		wantText string
+		wantEnts tele.Entities
+	}{
+		{"a &lt; b &amp;&amp; c &#34;d&#34;", `a < b && c "d"`, nil},
+		{"some <b>bold</b> text", "some bold text", tele.Entities{ent(tele.EntityBold, 5, 4)}},
+		{"<b>bold <i>both</i></b>", "bold both", tele.Entities{ent(tele.EntityBold, 0, 9), ent(tele.EntityItalic, 5, 4)}},
+		{`see <a href="https://example.test/?a=1&amp;b=2">the docs</a>`, "see the docs", tele.Entities{link("https://example.test/?a=1&b=2", 4, 8)}},
+		{`<pre><code class="language-go">x := 1</code></pre>`, "x := 1", tele.Entities{{Type: tele.EntityCodeBlock, Length: 6, Language: "go"}}},
+		{`<span class="tg-spoiler">secret</span>`, "secret", tele.Entities{ent(tele.EntitySpoiler, 0, 6)}},
+		{"<blockquote>quoted</blockquote>\n<unknown>text</unknown>", "quoted\ntext", tele.Entities{ent(tele.EntityBlockquote, 0, 6)}},
+		{"<b>unclosed", "unclosed", tele.Entities{ent(tele.EntityBold, 0, 8)}},
+		{"<b></b>empty", "empty", nil},
+		{"😀 <b>bold</b>", "😀 bold", tele.Entities{ent(tele.EntityBold, 3, 4)}},
+	}
+	for _, test := range tests {
+		text, ents := FromHTML(test.html)
+		if text != test.wantText || !reflect.DeepEqual(ents, test.wantEnts) {
+			t.Errorf("FromHTML(%q) returned %q, %v; want %q, %v", test.html, text, ents, test.wantText, test.wantEnts)
+		}
+	}
+
+	// HTML produced by ToHTML converts back to the same entities.
+	text := "see the docs & <more>"
+	ents := tele.Entities{link("https://example.test/", 4, 8), ent(tele.EntityBold, 8, 4)}
+	if gotText, gotEnts := FromHTML(ToHTML(text, ents)); gotText != text || !reflect.DeepEqual(gotEnts, ents) {
+		t.Errorf("FromHTML(ToHTML(%q, %v)) returned %q, %v", text, ents, gotText, gotEnts)
+	}
+}
+
+func TestCheckHTML(t *testing.T) {
+	for _, tt := range []struct {
+		html string
+		ok   bool
+	}{
+		{"plain &lt;text&gt;", true},
+		{`<b>bold <i>both</i></b> <a href="https://example.test/">link</a>`, true},
+		{`<span class="tg-spoiler">secret</span> <blockquote>q</blockquote>`, true},
+		{"<p>paragraph</p>", false},
+		{"<span>plain span</span>", false},
+		{"line<br/>break", false},
+		{"<b><i>crossed</b></i>", false},
+		{"<b>unclosed", false},
+		{"closed</b>", false},
+		{"a < b", false},
+	} {
+		if err := CheckHTML(tt.html); (err == nil) != tt.ok {
+			t.Errorf("CheckHTML(%q) returned err=%v; want ok=%v", tt.html, err, tt.ok)
+		}
+	}
+}
+
+func TestSplit(t *testing.T) {
+	tests := []struct {
+		text  string
+		ents  tele.Entities
+		limit int
+		want  []Part
+	}{
+		{"short", nil, 10, []Part{{"short", nil}}},
+		{"", nil, 10, []Part{{"", nil}}},
+		{"first para\n\nsecond para", nil, 15, []Part{{"first para", nil}, {"second para", nil}}},
+		{"one two\nthree four", nil, 12, []Part{{"one two", nil}, {"three four", nil}}},
+		{"one two three four", nil, 10, []Part{{"one two", nil}, {"three four", nil}}},
+		{"abcdefghij", nil, 4, []Part{{"abcd", nil}, {"efgh", nil}, {"ij", nil}}},
+		{"😀😀😀", nil, 3, []Part{{"😀", nil}, {"😀", nil}, {"😀", nil}}},
+		{"one two three four", tele.Entities{ent(tele.EntityBold, 4, 9)}, 10,
+			[]Part{{"one two", tele.Entities{ent(tele.EntityBold, 4, 3)}}, {"three four", tele.Entities{ent(tele.EntityBold, 0, 5)}}}},
+	}
+	for _, test := range tests {
+		if got := Split(test.text, test.ents, test.limit); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("Split(%q, %v, %d) returned %v; want %v", test.text, test.ents, test.limit, got, test.want)
+		}
+	}
+
+	long := strings.Repeat("word ", 2000)
+	for i, part := range Split(long, nil, 4096) {
+		if n := Length(part.Text); n > 4096 {
+			t.Errorf("Part %d has length %d", i, n)
+		}
+	}
+}
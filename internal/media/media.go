@@ -0,0 +1,90 @@
+// Package media stores files sent in Telegram so annotations can link to
+// them.
+package media
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// A Store keeps files where browsers can fetch them.
+type Store interface {
+	// Put stores a file and returns its URL. name is the file's original
+	// name, whose extension is kept.
+	Put(ctxt context.Context, name string, r io.Reader) (string, error)
+}
+
+// DirStore keeps files in a local directory, which it can serve over HTTP.
+type DirStore struct {
+	Dir string
+	// URL the directory is served at, e.g. https://irsal.example.com/media/
+	BaseURL string
+}
+
+func (d *DirStore) Put(ctxt context.Context, name string, r io.Reader) (string, error) {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(fmt.Sprintf("Failed to generate file name: %v", err))
+	}
+	// The name is random so that files can't be guessed.
+	stored := hex.EncodeToString(b[:]) + strings.ToLower(filepath.Ext(path.Base(name)))
+	f, err := os.OpenFile(filepath.Join(d.Dir, stored), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return "", fmt.Errorf("failed to create file: %v", err)
+	}
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", fmt.Errorf("failed to write file: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("failed to write file: %v", err)
+	}
+	return strings.TrimSuffix(d.BaseURL, "/") + "/" + stored, nil
+}
+
+// Types of images which browsers can show without running anything. SVG
+// can run scripts, so it isn't one.
+var inlineTypes = map[string]string{
+	".gif":  "image/gif",
+	".jpeg": "image/jpeg",
+	".jpg":  "image/jpeg",
+	".png":  "image/png",
+	".webp": "image/webp",
+}
+
+// ServeHTTP serves the stored file named by the last element of the path.
+// It doesn't list the directory. Files are uploaded by anyone in a chat, so
+// only safe images are shown in the browser; anything else, e.g. HTML, is
+// downloaded rather than run on the bot's site.
+func (d *DirStore) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	name := path.Base(r.URL.Path)
+	if name == "." || name == "/" || strings.HasPrefix(name, ".") {
+		http.NotFound(w, r)
+		return
+	}
+	info, err := os.Stat(filepath.Join(d.Dir, name))
+	if err != nil || info.IsDir() {
+		http.NotFound(w, r)
+		return
+	}
+	h := w.Header()
+	h.Set("X-Content-Type-Options", "nosniff")
+	h.Set("Content-Security-Policy", "sandbox")
+	if typ, ok := inlineTypes[filepath.Ext(name)]; ok {
+		h.Set("Content-Type", typ)
+	} else {
+		h.Set("Content-Type", "application/octet-stream")
+		h.Set("Content-Disposition", "attachment")
+	}
+	http.ServeFile(w, r, filepath.Join(d.Dir, name))
+}
@@ -0,0 +1,75 @@
+package media
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDirStore(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(dir+"/.hidden", []byte("secret"), 0644)
+	s := &DirStore{Dir: dir}
+	srv := httptest.NewServer(http.StripPrefix("/media/", s))
+	defer srv.Close()
+	s.BaseURL = srv.URL + "/media/"
+
+	url, err := s.Put(context.TODO(), "Photo.JPG", strings.NewReader("image data"))
+	if err != nil {
+		t.Fatalf("Put() returned err=%v", err)
+	}
+	if !strings.HasPrefix(url, s.BaseURL) || !strings.HasSuffix(url, ".jpg") {
+		t.Errorf("Put() returned URL %q; want a .jpg under %q", url, s.BaseURL)
+	}
+	other, err := s.Put(context.TODO(), "Photo.JPG", strings.NewReader("other data"))
+	if err != nil || other == url {
+		t.Errorf("Put() of another file returned %q, err=%v; want a different URL", other, err)
+	}
+
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("Failed to fetch %q: %v", url, err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "image data" {
+		t.Errorf("Fetching %q returned %d %q; want the stored file", url, resp.StatusCode, body)
+	}
+	if typ := resp.Header.Get("Content-Type"); typ != "image/jpeg" || resp.Header.Get("Content-Disposition") != "" {
+		t.Errorf("Fetching %q returned Content-Type %q; want an inline image/jpeg", url, typ)
+	}
+
+	// Other files, which browsers might run, are downloaded.
+	for _, name := range []string{"page.html", "image.svg", "notes"} {
+		u, err := s.Put(context.TODO(), name, strings.NewReader("<script>alert(1)</script>"))
+		if err != nil {
+			t.Fatalf("Put() returned err=%v", err)
+		}
+		resp, err := http.Get(u)
+		if err != nil {
+			t.Fatalf("Failed to fetch %q: %v", u, err)
+		}
+		resp.Body.Close()
+		if typ, disp := resp.Header.Get("Content-Type"), resp.Header.Get("Content-Disposition"); typ != "application/octet-stream" || disp != "attachment" {
+			t.Errorf("Fetching %s returned Content-Type %q, Content-Disposition %q; want a download", name, typ, disp)
+		}
+		if resp.Header.Get("X-Content-Type-Options") != "nosniff" || resp.Header.Get("Content-Security-Policy") != "sandbox" {
+			t.Errorf("Fetching %s returned headers %v; want nosniff and sandbox", name, resp.Header)
+		}
+	}
+
+	for _, path := range []string{"/media/", "/media/.hidden", "/media/missing.jpg"} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatalf("Failed to fetch %q: %v", path, err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("Fetching %q returned %d; want 404", path, resp.StatusCode)
+		}
+	}
+}
@@ -0,0 +1,245 @@
+package oauth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/objectiveryan/irsal/internal/common"
+	"github.com/objectiveryan/irsal/internal/crypt"
+	"github.com/objectiveryan/irsal/internal/hyp"
+)
+
+// now is replaced in tests.
+var now = time.Now
+
+const (
+	// How long a login link can be used for
+	stateLifetime = 10 * time.Minute
+	// How long before they expire tokens are refreshed
+	refreshMargin = 10 * time.Minute
+	// How often to look for tokens to refresh
+	refreshInterval = time.Minute
+)
+
+// A Binding is what a token is for: either a Telegram user, who posts
+// replies with it, or a subscription, which reads annotations with it.
+type Binding struct {
+	UserID int64
+	// The user's Telegram name, for mentioning them in chats
+	Name string
+	Sub  *common.SubKey
+}
+
+func (b Binding) String() string {
+	if b.Sub != nil {
+		return "subscription " + b.Sub.String()
+	}
+	return fmt.Sprintf("user %d", b.UserID)
+}
+
+// A Linker sends users to log in with Hypothesis and stores the tokens it
+// gets back. It is the http.Handler for the redirect URL.
+type Linker struct {
+	Config  *Config
+	Storage common.Storage
+	// Encrypts users' tokens
+	Cipher *crypt.Cipher
+	Hyp    hyp.ClientFactory
+
+	mut    sync.Mutex
+	states map[string]pendingLogin
+}
+
+type pendingLogin struct {
+	binding Binding
+	expires time.Time
+}
+
+// LoginURL returns a link which logs in with Hypothesis and binds the token
+// to b. It can be used once, for a limited time.
+func (l *Linker) LoginURL(b Binding) (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate state: %v", err)
+	}
+	state := hex.EncodeToString(buf)
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	if l.states == nil {
+		l.states = make(map[string]pendingLogin)
+	}
+	l.states[state] = pendingLogin{b, now().Add(stateLifetime)}
+	return l.Config.AuthCodeURL(state), nil
+}
+
+// takeState returns what a login was for, unless it is unknown or expired.
+func (l *Linker) takeState(state string) (Binding, bool) {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	p, ok := l.states[state]
+	delete(l.states, state)
+	if !ok || now().After(p.expires) {
+		return Binding{}, false
+	}
+	return p.binding, true
+}
+
+// pruneStates forgets logins which expired without being used.
+func (l *Linker) pruneStates() {
+	l.mut.Lock()
+	defer l.mut.Unlock()
+	for state, p := range l.states {
+		if now().After(p.expires) {
+			delete(l.states, state)
+		}
+	}
+}
+
+func (l *Linker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if e := query.Get("error"); e != "" {
+		log.Printf("OAuth login failed: %s %s", e, query.Get("error_description"))
+		http.Error(w, "Logging in with Hypothesis was cancelled or failed.", http.StatusBadRequest)
+		return
+	}
+	b, ok := l.takeState(query.Get("state"))
+	if !ok {
+		http.Error(w, "This login link has expired or was already used. Please ask the bot for a new one.", http.StatusBadRequest)
+		return
+	}
+	token, err := l.Config.Exchange(r.Context(), query.Get("code"))
+	if err != nil {
+		log.Printf("Failed to get token for %v: %v", b, err)
+		http.Error(w, "Failed to get a token from Hypothesis.", http.StatusBadGateway)
+		return
+	}
+	hypUser, err := l.bind(r.Context(), b, token)
+	if err != nil {
+		log.Printf("Failed to bind token to %v: %v", b, err)
+		http.Error(w, "Failed to save your login.", http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Bound token for %q to %v", hypUser, b)
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "Logged in as %s. You can close this page and return to Telegram.\n", hypUser)
+}
+
+// bind stores a token for b, returning the Hypothesis user it belongs to.
+func (l *Linker) bind(ctxt context.Context, b Binding, token *Token) (string, error) {
+	profile, err := l.Hyp.NewClient(token.AccessToken, "").Profile(ctxt)
+	if err != nil {
+		return "", err
+	}
+	if profile.UserID == "" {
+		return "", fmt.Errorf("token doesn't belong to a user")
+	}
+	if b.Sub != nil {
+		if _, err := l.Storage.Subscription(b.Sub.ChatID, b.Sub.HypGroup); err != nil {
+			return "", fmt.Errorf("failed to look up subscription: %v", err)
+		}
+		return profile.UserID, l.Storage.SetSubscriptionToken(&common.SubscriptionToken{
+			Key:          *b.Sub,
+			AccessToken:  token.AccessToken,
+			RefreshToken: token.RefreshToken,
+			Expiry:       token.Expiry,
+		})
+	}
+	if err := l.setUserToken(b.UserID, profile.UserID, token); err != nil {
+		return "", err
+	}
+	return profile.UserID, l.Storage.SetUserLink(&common.UserLink{HypUser: profile.UserID, UserID: b.UserID, Name: b.Name})
+}
+
+func (l *Linker) setUserToken(userID int64, hypUser string, token *Token) error {
+	t := &common.UserToken{UserID: userID, HypUser: hypUser, Expiry: token.Expiry}
+	var err error
+	t.Token, err = l.Cipher.Encrypt([]byte(token.AccessToken), crypt.UserAdditionalData(userID))
+	if err != nil {
+		return fmt.Errorf("failed to encrypt token: %v", err)
+	}
+	if token.RefreshToken != "" {
+		t.RefreshToken, err = l.Cipher.Encrypt([]byte(token.RefreshToken), crypt.UserAdditionalData(userID))
+		if err != nil {
+			return fmt.Errorf("failed to encrypt refresh token: %v", err)
+		}
+	}
+	return l.Storage.SetUserToken(t)
+}
+
+// RefreshTokens refreshes the tokens which will soon expire.
+func (l *Linker) RefreshTokens(ctxt context.Context) error {
+	before := now().Add(refreshMargin)
+	userTokens, err := l.Storage.ExpiringUserTokens(before)
+	if err != nil {
+		return fmt.Errorf("failed to get expiring user tokens: %v", err)
+	}
+	for _, t := range userTokens {
+		if err := l.refreshUserToken(ctxt, t); err != nil {
+			log.Printf("Failed to refresh token of user %d: %v", t.UserID, err)
+		}
+	}
+	subTokens, err := l.Storage.ExpiringSubscriptionTokens(before)
+	if err != nil {
+		return fmt.Errorf("failed to get expiring subscription tokens: %v", err)
+	}
+	for _, t := range subTokens {
+		if err := l.refreshSubscriptionToken(ctxt, t); err != nil {
+			log.Printf("Failed to refresh token of subscription %v: %v", t.Key, err)
+		}
+	}
+	return nil
+}
+
+func (l *Linker) refreshUserToken(ctxt context.Context, t *common.UserToken) error {
+	if t.RefreshToken == nil {
+		return fmt.Errorf("no refresh token")
+	}
+	refreshToken, err := l.Cipher.Decrypt(t.RefreshToken, crypt.UserAdditionalData(t.UserID))
+	if err != nil {
+		return err
+	}
+	token, err := l.Config.Refresh(ctxt, string(refreshToken))
+	if err != nil {
+		return err
+	}
+	if token.RefreshToken == "" {
+		token.RefreshToken = string(refreshToken)
+	}
+	return l.setUserToken(t.UserID, t.HypUser, token)
+}
+
+func (l *Linker) refreshSubscriptionToken(ctxt context.Context, t *common.SubscriptionToken) error {
+	token, err := l.Config.Refresh(ctxt, t.RefreshToken)
+	if err != nil {
+		return err
+	}
+	t.AccessToken = token.AccessToken
+	if token.RefreshToken != "" {
+		t.RefreshToken = token.RefreshToken
+	}
+	t.Expiry = token.Expiry
+	return l.Storage.SetSubscriptionToken(t)
+}
+
+// Run refreshes tokens until ctxt is done.
+func (l *Linker) Run(ctxt context.Context) error {
+	ticker := time.NewTicker(refreshInterval)
+	defer ticker.Stop()
+	for {
+		if err := l.RefreshTokens(ctxt); err != nil {
+			log.Println(err)
+		}
+		l.pruneStates()
+		select {
+		case <-ctxt.Done():
+			return ctxt.Err()
+		case <-ticker.C:
+		}
+	}
+}
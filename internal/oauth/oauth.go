@@ -0,0 +1,127 @@
+// Package oauth links Hypothesis accounts to Telegram users and subscriptions
+// with OAuth's authorization code flow, and keeps their tokens fresh.
+package oauth
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Hypothesis's OAuth endpoints
+const (
+	HypothesisAuthURL  = "https://hypothes.is/oauth/authorize"
+	HypothesisTokenURL = "https://hypothes.is/api/token"
+)
+
+// Config describes an OAuth client and the server it's registered with.
+type Config struct {
+	ClientID string
+	// Empty for public clients
+	ClientSecret string
+	AuthURL      string
+	TokenURL     string
+	// Where the authorization server sends users back to
+	RedirectURL string
+}
+
+// HypothesisConfig returns the Config for a client registered with Hypothesis.
+func HypothesisConfig(clientID, clientSecret, redirectURL string) *Config {
+	return &Config{
+		ClientID:     clientID,
+		ClientSecret: clientSecret,
+		AuthURL:      HypothesisAuthURL,
+		TokenURL:     HypothesisTokenURL,
+		RedirectURL:  redirectURL,
+	}
+}
+
+type Token struct {
+	AccessToken  string
+	RefreshToken string
+	// Zero if the token doesn't expire
+	Expiry time.Time
+}
+
+// AuthCodeURL returns the URL which asks the user to authorize the client.
+// The authorization server passes state back to the redirect URL.
+func (c *Config) AuthCodeURL(state string) string {
+	query := url.Values{
+		"response_type": {"code"},
+		"client_id":     {c.ClientID},
+		"state":         {state},
+	}
+	if c.RedirectURL != "" {
+		query.Set("redirect_uri", c.RedirectURL)
+	}
+	sep := "?"
+	if strings.Contains(c.AuthURL, "?") {
+		sep = "&"
+	}
+	return c.AuthURL + sep + query.Encode()
+}
+
+// Exchange exchanges an authorization code for a token.
+func (c *Config) Exchange(ctxt context.Context, code string) (*Token, error) {
+	params := url.Values{
+		"grant_type": {"authorization_code"},
+		"code":       {code},
+	}
+	if c.RedirectURL != "" {
+		params.Set("redirect_uri", c.RedirectURL)
+	}
+	return c.requestToken(ctxt, params)
+}
+
+// Refresh gets a new token with a refresh token.
+func (c *Config) Refresh(ctxt context.Context, refreshToken string) (*Token, error) {
+	return c.requestToken(ctxt, url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {refreshToken},
+	})
+}
+
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	Error        string `json:"error"`
+	Description  string `json:"error_description"`
+}
+
+func (c *Config) requestToken(ctxt context.Context, params url.Values) (*Token, error) {
+	params.Set("client_id", c.ClientID)
+	if c.ClientSecret != "" {
+		params.Set("client_secret", c.ClientSecret)
+	}
+	req, err := http.NewRequestWithContext(ctxt, "POST", c.TokenURL, strings.NewReader(params.Encode()))
+	if err != nil {
+		panic(fmt.Sprintf("Failed to create http request for token: %v", err))
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	requested := now()
+	httpResp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request token: %v", err)
+	}
+	defer httpResp.Body.Close()
+	var resp tokenResponse
+	if err := json.NewDecoder(httpResp.Body).Decode(&resp); err != nil {
+		return nil, fmt.Errorf("failed to decode token response (status %v): %v", httpResp.StatusCode, err)
+	}
+	if httpResp.StatusCode != 200 || resp.Error != "" {
+		return nil, fmt.Errorf("failed to request token: status=%v error=%q %s", httpResp.StatusCode, resp.Error, resp.Description)
+	}
+	if resp.AccessToken == "" {
+		return nil, fmt.Errorf("token response has no access token")
+	}
+	token := &Token{AccessToken: resp.AccessToken, RefreshToken: resp.RefreshToken}
+	if resp.ExpiresIn > 0 {
+		token.Expiry = requested.Add(time.Duration(resp.ExpiresIn) * time.Second)
+	}
+	return token, nil
+}
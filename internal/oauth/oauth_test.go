@@ -0,0 +1,212 @@
+package oauth
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/objectiveryan/irsal/internal/common"
+	"github.com/objectiveryan/irsal/internal/crypt"
+	"github.com/objectiveryan/irsal/internal/db"
+	"github.com/objectiveryan/irsal/internal/fake"
+)
+
+const CHAT_ID = -100
+
+// authServer stands in for Hypothesis's token endpoint. It grants access
+// token "<code>-token" for each code, and "<refresh token>-token" when
+// refreshing.
+func authServer(t *testing.T) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("ParseForm() returned err=%v", err)
+		}
+		if got := r.PostForm.Get("client_id"); got != "client" {
+			t.Errorf("Token request has client_id=%q; want %q", got, "client")
+		}
+		var prefix string
+		switch r.PostForm.Get("grant_type") {
+		case "authorization_code":
+			prefix = r.PostForm.Get("code")
+		case "refresh_token":
+			prefix = r.PostForm.Get("refresh_token")
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if prefix == "bad" {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]any{
+			"access_token":  prefix + "-token",
+			"refresh_token": prefix + "-refresh",
+			"expires_in":    3600,
+		})
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func newLinker(t *testing.T) *Linker {
+	t.Helper()
+	srv := authServer(t)
+	c, err := crypt.NewCipher(bytes.Repeat([]byte{1}, crypt.KeySize))
+	if err != nil {
+		t.Fatalf("NewCipher() returned err=%v", err)
+	}
+	h := &fake.HypFactory{Users: map[string]string{
+		"alice-token": "acct:alice@hypothes.is",
+		"bot-token":   "acct:bot@hypothes.is",
+	}}
+	return &Linker{
+		Config: &Config{
+			ClientID:    "client",
+			AuthURL:     srv.URL + "/authorize",
+			TokenURL:    srv.URL + "/token",
+			RedirectURL: "https://bot.example/oauth/callback",
+		},
+		Storage: db.NewInMemoryStorage(),
+		Cipher:  c,
+		Hyp:     h,
+	}
+}
+
+// callback follows a login link, as if the user authorized it with code.
+func callback(t *testing.T, l *Linker, loginURL, code string) *httptest.ResponseRecorder {
+	t.Helper()
+	u, err := url.Parse(loginURL)
+	if err != nil {
+		t.Fatalf("Failed to parse login URL %q: %v", loginURL, err)
+	}
+	query := url.Values{"code": {code}, "state": {u.Query().Get("state")}}
+	w := httptest.NewRecorder()
+	l.ServeHTTP(w, httptest.NewRequest("GET", "/oauth/callback?"+query.Encode(), nil))
+	return w
+}
+
+func TestLinkUser(t *testing.T) {
+	l := newLinker(t)
+	loginURL, err := l.LoginURL(Binding{UserID: 7, Name: "Alice"})
+	if err != nil {
+		t.Fatalf("LoginURL() returned err=%v", err)
+	}
+	u, _ := url.Parse(loginURL)
+	if got := u.Query().Get("redirect_uri"); got != l.Config.RedirectURL {
+		t.Errorf("Login URL has redirect_uri=%q; want %q", got, l.Config.RedirectURL)
+	}
+
+	if w := callback(t, l, loginURL, "alice"); w.Code != http.StatusOK {
+		t.Fatalf("Callback returned status %d: %s", w.Code, w.Body)
+	}
+	got, err := l.Storage.UserToken(7)
+	if err != nil {
+		t.Fatalf("UserToken() returned err=%v", err)
+	}
+	if got.HypUser != "acct:alice@hypothes.is" {
+		t.Errorf("Bound token for %q; want acct:alice@hypothes.is", got.HypUser)
+	}
+	if got.Expiry.IsZero() {
+		t.Errorf("Bound token has no expiry")
+	}
+	token, err := l.Cipher.Decrypt(got.Token, crypt.UserAdditionalData(7))
+	if err != nil || string(token) != "alice-token" {
+		t.Errorf("Stored token decrypts to %q, err=%v; want alice-token", token, err)
+	}
+	if link, err := l.Storage.UserLink("acct:alice@hypothes.is"); err != nil || link.UserID != 7 || link.Name != "Alice" {
+		t.Errorf("UserLink() returned %+v, err=%v; want a link to user 7", link, err)
+	}
+
+	// Each link can only be used once.
+	if w := callback(t, l, loginURL, "alice"); w.Code != http.StatusBadRequest {
+		t.Errorf("Reusing a login link returned status %d; want %d", w.Code, http.StatusBadRequest)
+	}
+}
+
+func TestLinkUser_Failures(t *testing.T) {
+	l := newLinker(t)
+
+	loginURL, _ := l.LoginURL(Binding{UserID: 7})
+	if w := callback(t, l, loginURL, "bad"); w.Code != http.StatusBadGateway {
+		t.Errorf("Callback with rejected code returned status %d; want %d", w.Code, http.StatusBadGateway)
+	}
+
+	defer func() { now = time.Now }()
+	loginURL, _ = l.LoginURL(Binding{UserID: 7})
+	now = func() time.Time { return time.Now().Add(stateLifetime + time.Minute) }
+	if w := callback(t, l, loginURL, "alice"); w.Code != http.StatusBadRequest {
+		t.Errorf("Callback with expired state returned status %d; want %d", w.Code, http.StatusBadRequest)
+	}
+
+	if _, err := l.Storage.UserToken(7); err != common.ErrNotFound {
+		t.Errorf("UserToken() returned err=%v; want ErrNotFound", err)
+	}
+}
+
+func TestLinkSubscription(t *testing.T) {
+	l := newLinker(t)
+	key := common.SubKey{ChatID: CHAT_ID, HypGroup: "grp"}
+
+	loginURL, _ := l.LoginURL(Binding{Sub: &key})
+	if w := callback(t, l, loginURL, "bot"); w.Code != http.StatusInternalServerError {
+		t.Errorf("Callback for missing subscription returned status %d; want %d", w.Code, http.StatusInternalServerError)
+	}
+
+	l.Storage.AddSubscription(&common.Subscription{"ht", "grp", time.Unix(1, 0), CHAT_ID})
+	loginURL, _ = l.LoginURL(Binding{Sub: &key})
+	if w := callback(t, l, loginURL, "bot"); w.Code != http.StatusOK {
+		t.Fatalf("Callback returned status %d: %s", w.Code, w.Body)
+	}
+	sub, err := l.Storage.Subscription(CHAT_ID, "grp")
+	if err != nil {
+		t.Fatalf("Subscription() returned err=%v", err)
+	}
+	if sub.HypToken != "bot-token" {
+		t.Errorf("Subscription has token %q; want bot-token", sub.HypToken)
+	}
+}
+
+func TestRefreshTokens(t *testing.T) {
+	l := newLinker(t)
+	ctxt := context.Background()
+	l.Storage.AddSubscription(&common.Subscription{"ht", "grp", time.Unix(1, 0), CHAT_ID})
+	key := common.SubKey{ChatID: CHAT_ID, HypGroup: "grp"}
+	for b, code := range map[Binding]string{{UserID: 7}: "alice", {Sub: &key}: "bot"} {
+		loginURL, _ := l.LoginURL(b)
+		if w := callback(t, l, loginURL, code); w.Code != http.StatusOK {
+			t.Fatalf("Callback returned status %d: %s", w.Code, w.Body)
+		}
+	}
+
+	// Tokens which aren't about to expire are left alone.
+	if err := l.RefreshTokens(ctxt); err != nil {
+		t.Fatalf("RefreshTokens() returned err=%v", err)
+	}
+	if sub, _ := l.Storage.Subscription(CHAT_ID, "grp"); sub.HypToken != "bot-token" {
+		t.Errorf("Subscription token was refreshed early to %q", sub.HypToken)
+	}
+
+	defer func() { now = time.Now }()
+	now = func() time.Time { return time.Now().Add(time.Hour) }
+	if err := l.RefreshTokens(ctxt); err != nil {
+		t.Fatalf("RefreshTokens() returned err=%v", err)
+	}
+	got, err := l.Storage.UserToken(7)
+	if err != nil {
+		t.Fatalf("UserToken() returned err=%v", err)
+	}
+	token, err := l.Cipher.Decrypt(got.Token, crypt.UserAdditionalData(7))
+	if err != nil || string(token) != "alice-refresh-token" {
+		t.Errorf("Refreshed token decrypts to %q, err=%v; want alice-refresh-token", token, err)
+	}
+	if !got.Expiry.After(now()) {
+		t.Errorf("Refreshed token expires at %v; want after %v", got.Expiry, now())
+	}
+	if sub, _ := l.Storage.Subscription(CHAT_ID, "grp"); sub.HypToken != "bot-refresh-token" {
+		t.Errorf("Subscription has token %q after refresh; want bot-refresh-token", sub.HypToken)
+	}
+}
@@ -0,0 +1,187 @@
+package poller
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/objectiveryan/irsal/internal/common"
+	"github.com/objectiveryan/irsal/internal/hyp"
+	"github.com/objectiveryan/irsal/internal/markup"
+)
+
+// now is replaced in tests.
+var now = time.Now
+
+const (
+	digestQuoteLength = 100
+	digestTextLength  = 200
+)
+
+// queueDigest queues an annotation to be posted in the subscription's next
+// digest message.
+func (p *Poller) queueDigest(annot *hyp.Annotation, key common.SubKey) error {
+	mID, err := p.Storage.MessageID(annot.ID, key.ChatID)
+	if err == nil {
+		log.Printf("Ignoring annotation %q which already has a chat message %d/%d\n", annot.ID, key.ChatID, mID)
+		return nil
+	} else if err != common.ErrNotFound {
+		return fmt.Errorf("failed to look up existing message for annotation %q: %v", annot.ID, err)
+	}
+	err = p.Storage.AddDigestItem(key, &common.DigestItem{
+		AnnotID: annot.ID,
+		Meta:    common.AnnotationMetadata{annot.References, annot.Group, annot.URI},
+		User:    annot.User,
+		Quote:   annot.Quote(),
+		Text:    annot.Text,
+		Queued:  now(),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to queue annotation %q for digest: %v", annot.ID, err)
+	}
+	return nil
+}
+
+// handleDigest posts the subscription's queued annotations once the oldest
+// has waited for the digest window. If digests have been turned off, any
+// remaining annotations are posted right away.
+func (p *Poller) handleDigest(ctxt context.Context, sub *common.Subscription) error {
+	entry, err := p.Storage.DigestOutboxEntry(sub.Key())
+	if err == common.ErrNotFound {
+		entry, err = p.newDigest(sub)
+		if entry == nil || err != nil {
+			return err
+		}
+	} else if err != nil {
+		return fmt.Errorf("failed to look up digest outbox entry: %v", err)
+	}
+	messageID, err := p.sendOnce(ctxt, &outboxMessage{
+		desc:      "digest message",
+		chatID:    sub.ChatID,
+		msg:       &entry.Message,
+		state:     entry.State,
+		messageID: entry.MessageID,
+		setState: func(state common.OutboxState, messageID int) error {
+			return p.Storage.SetDigestOutboxState(sub.Key(), state, messageID)
+		},
+	})
+	if err != nil {
+		return err
+	}
+	// Items queued since the digest was recorded wait for the next one.
+	queued, err := p.Storage.DigestItems(sub.Key())
+	if err != nil {
+		return fmt.Errorf("failed to get digest items: %v", err)
+	}
+	byID := make(map[string]*common.DigestItem)
+	for _, item := range queued {
+		byID[item.AnnotID] = item
+	}
+	var items []*common.DigestItem
+	for _, annotID := range entry.AnnotIDs {
+		if item, ok := byID[annotID]; ok {
+			items = append(items, item)
+		}
+	}
+	return retry(ctxt, fmt.Sprintf("record digest message %d", messageID), func() error {
+		return p.Storage.CompleteDigest(sub.Key(), messageID, items)
+	})
+}
+
+// newDigest records the digest message for the subscription's queued
+// annotations in the outbox, once the oldest has waited for the digest
+// window. It returns nil if there's nothing to post yet.
+func (p *Poller) newDigest(sub *common.Subscription) (*common.DigestOutboxEntry, error) {
+	raw, err := p.Storage.SubscriptionOptions(sub.Key())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get options: %v", err)
+	}
+	opts := ParseOptions(raw)
+	items, err := p.Storage.DigestItems(sub.Key())
+	if err != nil {
+		return nil, fmt.Errorf("failed to get digest items: %v", err)
+	}
+	if len(items) == 0 {
+		return nil, nil
+	}
+	if waited := now().Sub(items[0].Queued); waited < opts.Digest {
+		log.Printf("%d digest items waiting for %v of %v", len(items), waited, opts.Digest)
+		return nil, nil
+	}
+	items = groupByURI(items)
+	entry := &common.DigestOutboxEntry{
+		Key:     sub.Key(),
+		Message: common.Message{Text: DigestMessageText(items), HTML: true, NoPreview: !opts.LinkPreview},
+		State:   common.OutboxPending,
+	}
+	for _, item := range items {
+		entry.AnnotIDs = append(entry.AnnotIDs, item.AnnotID)
+	}
+	if err := p.Storage.AddDigestOutboxEntry(entry); err != nil {
+		return nil, fmt.Errorf("failed to add digest outbox entry: %v", err)
+	}
+	return entry, nil
+}
+
+// groupByURI returns items reordered so that items for the same document are
+// together, in order of each document's first item.
+func groupByURI(items []*common.DigestItem) []*common.DigestItem {
+	var uris []string
+	byURI := make(map[string][]*common.DigestItem)
+	for _, item := range items {
+		if _, ok := byURI[item.Meta.URI]; !ok {
+			uris = append(uris, item.Meta.URI)
+		}
+		byURI[item.Meta.URI] = append(byURI[item.Meta.URI], item)
+	}
+	var grouped []*common.DigestItem
+	for _, uri := range uris {
+		grouped = append(grouped, byURI[uri]...)
+	}
+	return grouped
+}
+
+// DigestMessageText lists items, numbered and grouped by document, in
+// Telegram HTML. Items are numbered in the order groupByURI puts them in.
+func DigestMessageText(items []*common.DigestItem) string {
+	var b strings.Builder
+	if len(items) == 1 {
+		b.WriteString("<b>1 new annotation</b>\n")
+	} else {
+		fmt.Fprintf(&b, "<b>%d new annotations</b>\n", len(items))
+	}
+	items = groupByURI(items)
+	for i, item := range items {
+		if i == 0 || item.Meta.URI != items[i-1].Meta.URI {
+			fmt.Fprintf(&b, "\n<i>%s</i>\n", html.EscapeString(item.Meta.URI))
+		}
+		fmt.Fprintf(&b, "%d. <b>%s</b>", i+1, html.EscapeString(username(item.User)))
+		if len(item.Meta.References) > 0 {
+			b.WriteString(" replied")
+		}
+		if item.Quote != "" {
+			fmt.Fprintf(&b, " on \"%s\"", html.EscapeString(Truncate(item.Quote, digestQuoteLength)))
+		}
+		// The text is shortened, so leave out its formatting.
+		if text, _ := markup.FromMarkdown(item.Text); text != "" {
+			fmt.Fprintf(&b, ": %s", html.EscapeString(Truncate(text, digestTextLength)))
+		}
+		fmt.Fprintf(&b, " <a href=\"https://hypothes.is/a/%s\">link</a>\n", html.EscapeString(item.AnnotID))
+	}
+	if len(items) > 1 {
+		b.WriteString("\nTo reply to an annotation, start your reply with its number.")
+	}
+	return b.String()
+}
+
+// Truncate shortens s to at most n characters, ending with an ellipsis.
+func Truncate(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+	return string(runes[:n-1]) + "…"
+}
@@ -0,0 +1,177 @@
+package poller
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/objectiveryan/irsal/internal/common"
+	"github.com/objectiveryan/irsal/internal/db"
+	"github.com/objectiveryan/irsal/internal/fake"
+	"github.com/objectiveryan/irsal/internal/hyp"
+)
+
+func setNow(t *testing.T, tm time.Time) {
+	t.Helper()
+	old := now
+	now = func() time.Time { return tm }
+	t.Cleanup(func() { now = old })
+}
+
+func TestDigest(t *testing.T) {
+	start := time.Unix(1000, 0)
+	const CHAT_ID = 42
+	h := fake.NewHypFactory([]*hyp.Annotation{
+		{ID: "a1", Group: "grp", Updated: hyp.ToTimestamp(time.Unix(2, 0)), URI: "https://one.test/", Text: "first"},
+		{ID: "a2", Group: "grp", Updated: hyp.ToTimestamp(time.Unix(3, 0)), URI: "https://two.test/", Text: "second"},
+		{ID: "a3", Group: "grp", Updated: hyp.ToTimestamp(time.Unix(4, 0)), URI: "https://one.test/", Text: "third", References: []string{"a1"}},
+	})
+	s := db.NewInMemoryStorage()
+	tg := &fake.Tg{}
+	p := &Poller{h, s, tg}
+	sub := &common.Subscription{"ht", "grp", time.Unix(1, 0), CHAT_ID}
+	s.AddSubscription(sub)
+	if err := s.SetSubscriptionOption(sub.Key(), OptionDigest, "hourly"); err != nil {
+		t.Fatalf("SetSubscriptionOption() returned err=%v", err)
+	}
+
+	setNow(t, start)
+	if err := p.handleSub(context.TODO(), sub); err != nil {
+		t.Fatalf("handleSub() returned err=%v", err)
+	}
+	if err := p.handleDigest(context.TODO(), sub); err != nil {
+		t.Fatalf("handleDigest() returned err=%v", err)
+	}
+	if len(tg.SentMessages) != 0 {
+		t.Fatalf("len(SentMessages)=%d before digest window passed; expected 0", len(tg.SentMessages))
+	}
+
+	setNow(t, start.Add(time.Hour))
+	if err := p.handleDigest(context.TODO(), sub); err != nil {
+		t.Fatalf("handleDigest() returned err=%v", err)
+	}
+	if len(tg.SentMessages) != 1 {
+		t.Fatalf("len(SentMessages)=%d; expected 1", len(tg.SentMessages))
+	}
+	digest := tg.SentMessages[0]
+	// Annotations are grouped by document
+	if one, two := strings.Index(digest.Text, "https://one.test/"), strings.Index(digest.Text, "https://two.test/"); one < 0 || two < one {
+		t.Errorf("Digest %q doesn't list one.test before two.test", digest.Text)
+	}
+	if i3, i2 := strings.Index(digest.Text, "third"), strings.Index(digest.Text, "second"); i3 > i2 {
+		t.Errorf("Digest %q doesn't list a3 with a1", digest.Text)
+	}
+	for _, annotID := range []string{"a1", "a2", "a3"} {
+		messageID, err := s.MessageID(annotID, CHAT_ID)
+		if err != nil {
+			t.Fatalf("MessageID(%q) returned err=%v", annotID, err)
+		}
+		if messageID != digest.MessageID {
+			t.Errorf("MessageID(%q)=%d; want %d", annotID, messageID, digest.MessageID)
+		}
+	}
+
+	// Items are stored in the order they are numbered in
+	posted, err := s.DigestMessageItems(CHAT_ID, digest.MessageID)
+	if err != nil {
+		t.Fatalf("DigestMessageItems() returned err=%v", err)
+	}
+	var order []string
+	for _, item := range posted {
+		order = append(order, item.AnnotID)
+	}
+	if want := []string{"a1", "a3", "a2"}; !reflect.DeepEqual(order, want) {
+		t.Errorf("DigestMessageItems() returned %q; want %q", order, want)
+	}
+
+	// Nothing left to post
+	setNow(t, start.Add(3*time.Hour))
+	if err := p.handleDigest(context.TODO(), sub); err != nil {
+		t.Fatalf("handleDigest() returned err=%v", err)
+	}
+	if len(tg.SentMessages) != 1 {
+		t.Fatalf("len(SentMessages)=%d; expected 1", len(tg.SentMessages))
+	}
+}
+
+func TestDigest_SentButNotRecorded(t *testing.T) {
+	const CHAT_ID = 42
+	s := db.NewInMemoryStorage()
+	tg := &fake.Tg{}
+	p := &Poller{fake.NewHypFactory(nil), s, tg}
+	sub := &common.Subscription{"ht", "grp", time.Unix(1, 0), CHAT_ID}
+	s.AddSubscription(sub)
+	for _, annotID := range []string{"a1", "a2"} {
+		if err := s.AddDigestItem(sub.Key(), &common.DigestItem{AnnotID: annotID, Meta: common.AnnotationMetadata{HypGroup: "grp"}, Queued: time.Unix(1, 0)}); err != nil {
+			t.Fatalf("AddDigestItem() returned err=%v", err)
+		}
+	}
+	// Simulate a crash after a digest of a1 was sent as message 9 but before
+	// it was recorded.
+	err := s.AddDigestOutboxEntry(&common.DigestOutboxEntry{Key: sub.Key(), AnnotIDs: []string{"a1"}, Message: common.Message{Text: "digest"}, State: common.OutboxSent, MessageID: 9})
+	if err != nil {
+		t.Fatalf("AddDigestOutboxEntry() returned err=%v", err)
+	}
+
+	if err := p.handleDigest(context.TODO(), sub); err != nil {
+		t.Fatalf("handleDigest() returned err=%v", err)
+	}
+	if len(tg.SentMessages) != 0 {
+		t.Fatalf("len(SentMessages)=%d; expected 0", len(tg.SentMessages))
+	}
+	if messageID, err := s.MessageID("a1", CHAT_ID); err != nil || messageID != 9 {
+		t.Errorf("MessageID(\"a1\") returned %d, err=%v; want 9", messageID, err)
+	}
+	// a2 was queued after the digest, so it's posted in the next one.
+	if err := p.handleDigest(context.TODO(), sub); err != nil {
+		t.Fatalf("handleDigest() returned err=%v", err)
+	}
+	if len(tg.SentMessages) != 1 {
+		t.Fatalf("len(SentMessages)=%d; expected 1", len(tg.SentMessages))
+	}
+	if messageID, err := s.MessageID("a2", CHAT_ID); err != nil || messageID != tg.SentMessages[0].MessageID {
+		t.Errorf("MessageID(\"a2\") returned %d, err=%v; want %d", messageID, err, tg.SentMessages[0].MessageID)
+	}
+}
+
+func TestDigestMessageText(t *testing.T) {
+	items := []*common.DigestItem{
+		{AnnotID: "a1", Meta: common.AnnotationMetadata{URI: "u1"}, User: "alice", Quote: "q", Text: "hello"},
+		{AnnotID: "a2", Meta: common.AnnotationMetadata{URI: "u2"}, User: "acct:bob@hypothes.is", Text: "<hi>"},
+		{AnnotID: "a3", Meta: common.AnnotationMetadata{URI: "u1", References: []string{"a1"}}, User: "carol", Text: strings.Repeat("x", 500)},
+	}
+	want := `<b>3 new annotations</b>
+
+<i>u1</i>
+1. <b>alice</b> on "q": hello <a href="https://hypothes.is/a/a1">link</a>
+2. <b>carol</b> replied: ` + strings.Repeat("x", digestTextLength-1) + `… <a href="https://hypothes.is/a/a3">link</a>
+
+<i>u2</i>
+3. <b>bob</b>: &lt;hi&gt; <a href="https://hypothes.is/a/a2">link</a>
+
+To reply to an annotation, start your reply with its number.`
+	if got := DigestMessageText(items); got != want {
+		t.Errorf("DigestMessageText()=%q; want %q", got, want)
+	}
+}
+
+func TestValidateOption(t *testing.T) {
+	for _, tt := range []struct {
+		name, value string
+		ok          bool
+	}{
+		{OptionDigest, "hourly", true},
+		{OptionDigest, "daily", true},
+		{OptionDigest, "6h", true},
+		{OptionDigest, "", true},
+		{OptionDigest, "1s", false},
+		{OptionDigest, "weekly", false},
+		{"nonexistent", "1", false},
+	} {
+		if err := ValidateOption(tt.name, tt.value); (err == nil) != tt.ok {
+			t.Errorf("ValidateOption(%q, %q) returned err=%v; want ok=%v", tt.name, tt.value, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package poller
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/objectiveryan/irsal/internal/common"
+	"github.com/objectiveryan/irsal/internal/hyp"
+)
+
+// allowed reports whether annot should be posted according to rules.
+func allowed(rules []*common.FilterRule, annot *hyp.Annotation) bool {
+	// For each field with include rules, whether one of them matched
+	included := make(map[common.FilterField]bool)
+	for _, rule := range rules {
+		m := matches(rule, annot)
+		if rule.Exclude {
+			if m {
+				return false
+			}
+			continue
+		}
+		included[rule.Field] = included[rule.Field] || m
+	}
+	for _, ok := range included {
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func matches(rule *common.FilterRule, annot *hyp.Annotation) bool {
+	switch rule.Field {
+	case common.FilterUser:
+		return strings.EqualFold(annot.User, rule.Pattern) || strings.EqualFold(username(annot.User), rule.Pattern)
+	case common.FilterTag:
+		for _, tag := range annot.Tags {
+			if strings.EqualFold(tag, rule.Pattern) {
+				return true
+			}
+		}
+		return false
+	case common.FilterURI:
+		return globRegexp(rule.Pattern).MatchString(annot.URI)
+	case common.FilterDomain:
+		u, err := url.Parse(annot.URI)
+		if err != nil {
+			return false
+		}
+		host := strings.ToLower(u.Hostname())
+		domain := strings.ToLower(rule.Pattern)
+		return host == domain || strings.HasSuffix(host, "."+domain)
+	case common.FilterKeyword:
+		keyword := strings.ToLower(rule.Pattern)
+		return strings.Contains(strings.ToLower(annot.Text), keyword) || strings.Contains(strings.ToLower(annot.Quote()), keyword)
+	case common.FilterHighlight:
+		return strings.TrimSpace(annot.Text) == ""
+	case common.FilterReply:
+		return len(annot.References) > 0
+	}
+	return false
+}
+
+// username returns "alice" for "acct:alice@hypothes.is".
+func username(user string) string {
+	name := strings.TrimPrefix(user, "acct:")
+	name, _, _ = strings.Cut(name, "@")
+	return name
+}
+
+// globRegexp converts a pattern where "*" matches any sequence of characters.
+func globRegexp(pattern string) *regexp.Regexp {
+	parts := strings.Split(pattern, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	return regexp.MustCompile("^" + strings.Join(parts, ".*") + "$")
+}
@@ -0,0 +1,72 @@
+package poller
+
+import (
+	"testing"
+
+	"github.com/objectiveryan/irsal/internal/common"
+	"github.com/objectiveryan/irsal/internal/hyp"
+)
+
+func mustParseRules(t *testing.T, specs ...string) []*common.FilterRule {
+	t.Helper()
+	var rules []*common.FilterRule
+	for _, spec := range specs {
+		rule, err := common.ParseFilterRule(spec)
+		if err != nil {
+			t.Fatalf("ParseFilterRule(%q) returned err=%v", spec, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules
+}
+
+func TestAllowed(t *testing.T) {
+	quote := "Quoted Words"
+	annot := &hyp.Annotation{
+		User:    "acct:alice@hypothes.is",
+		URI:     "https://blog.example.test/posts/1",
+		Text:    "Some Interesting text",
+		Tags:    []string{"Go", "testing"},
+		Targets: []*hyp.Target{{Selectors: hyp.Selectors{TextQuote: &quote}}},
+	}
+	reply := &hyp.Annotation{User: "acct:bob@hypothes.is", URI: "https://other.test/", References: []string{"x"}}
+
+	tests := []struct {
+		rules []string
+		annot *hyp.Annotation
+		want  bool
+	}{
+		{nil, annot, true},
+		{[]string{"user:alice"}, annot, true},
+		{[]string{"user:acct:alice@hypothes.is"}, annot, true},
+		{[]string{"user:bob"}, annot, false},
+		{[]string{"-user:alice"}, annot, false},
+		{[]string{"user:bob", "user:alice"}, annot, true},
+		{[]string{"tag:go"}, annot, true},
+		{[]string{"-tag:testing"}, annot, false},
+		{[]string{"tag:rust"}, annot, false},
+		{[]string{"uri:https://blog.example.test/*"}, annot, true},
+		{[]string{"uri:https://example.test/*"}, annot, false},
+		{[]string{"domain:example.test"}, annot, true},
+		{[]string{"domain:ample.test"}, annot, false},
+		{[]string{"-domain:blog.example.test"}, annot, false},
+		{[]string{"keyword:interesting"}, annot, true},
+		{[]string{"keyword:quoted"}, annot, true},
+		{[]string{"keyword:boring"}, annot, false},
+		{[]string{"-highlight"}, annot, true},
+		{[]string{"-highlight"}, reply, false},
+		{[]string{"+reply"}, annot, false},
+		{[]string{"+reply"}, reply, true},
+		{[]string{"-reply"}, reply, false},
+		// Include rules for different fields must all match
+		{[]string{"user:alice", "tag:go"}, annot, true},
+		{[]string{"user:alice", "tag:rust"}, annot, false},
+		// Exclude rules win over include rules
+		{[]string{"user:alice", "-tag:go"}, annot, false},
+	}
+	for _, tt := range tests {
+		if got := allowed(mustParseRules(t, tt.rules...), tt.annot); got != tt.want {
+			t.Errorf("allowed(%q, %q)=%v; want %v", tt.rules, tt.annot.User, got, tt.want)
+		}
+	}
+}
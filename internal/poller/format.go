@@ -0,0 +1,235 @@
+package poller
+
+import (
+	"fmt"
+	"html"
+	"html/template"
+	"io"
+	"strings"
+	texttemplate "text/template"
+
+	"github.com/objectiveryan/irsal/internal/common"
+	"github.com/objectiveryan/irsal/internal/hyp"
+	"github.com/objectiveryan/irsal/internal/markup"
+)
+
+// AnnotationData is what templates for messages about annotations can use.
+type AnnotationData struct {
+	ID string
+	// Hypothesis account, e.g. "acct:alice@hypothes.is"
+	User string
+	// e.g. "alice"
+	Username string
+	// The user's display name, or their username if they have none
+	DisplayName string
+	// ID of the Telegram user who logged in as the user, or 0
+	TelegramID int64
+	// That Telegram user's name
+	TelegramName string
+	Quote        string
+	// The annotation's text, which is Markdown
+	Text string
+	// The text converted to Telegram HTML
+	TextHTML template.HTML
+	Tags     []string
+	// The tags as Telegram hashtags, e.g. "#climate_change"
+	Hashtags []string
+	URI      string
+	Title    string
+	// Link to the annotation on its own
+	Link string
+	// Link to the annotation in the context of its document
+	InContextLink string
+	IsReply       bool
+}
+
+func NewAnnotationData(annot *hyp.Annotation) *AnnotationData {
+	d := &AnnotationData{
+		ID:          annot.ID,
+		User:        annot.User,
+		Username:    username(annot.User),
+		DisplayName: username(annot.User),
+		Quote:       annot.Quote(),
+		Text:        annot.Text,
+		TextHTML:    template.HTML(markup.ToHTML(markup.FromMarkdown(annot.Text))),
+		Tags:        annot.Tags,
+		Hashtags:    TagRules{}.Hashtags(annot.Tags),
+		URI:         annot.URI,
+		Title:       annot.Title(),
+		Link:        "https://hypothes.is/a/" + annot.ID,
+		IsReply:     len(annot.References) > 0,
+	}
+	if annot.UserInfo != nil && annot.UserInfo.DisplayName != "" {
+		d.DisplayName = annot.UserInfo.DisplayName
+	}
+	if annot.Links != nil {
+		if annot.Links.HTML != "" {
+			d.Link = annot.Links.HTML
+		}
+		d.InContextLink = annot.Links.InContext
+	}
+	return d
+}
+
+// SetUserLink shows the annotation as written by the linked Telegram user.
+func (d *AnnotationData) SetUserLink(l *common.UserLink) {
+	d.TelegramID = l.UserID
+	d.TelegramName = l.Name
+}
+
+// SetOrigin shows an annotation posted from a Telegram message by the bot,
+// on the sender's behalf, as written by the sender.
+func (d *AnnotationData) SetOrigin(o *common.AnnotationOrigin) {
+	// The sender posted it as themselves, or it has been edited since.
+	if o.Body == o.Text || o.Text != d.Text {
+		return
+	}
+	d.DisplayName = o.Name
+	d.Text = o.Body
+	d.TextHTML = template.HTML(markup.ToHTML(markup.FromMarkdown(o.Body)))
+}
+
+// Mention mentions the Telegram user who logged in as the annotation's
+// author, or else shows DisplayName.
+func (d *AnnotationData) Mention() template.HTML {
+	if d.TelegramID == 0 {
+		return template.HTML(html.EscapeString(d.DisplayName))
+	}
+	name := d.TelegramName
+	if name == "" {
+		name = d.DisplayName
+	}
+	return template.HTML(fmt.Sprintf(`<a href="tg://user?id=%d">%s</a>`, d.TelegramID, html.EscapeString(name)))
+}
+
+// SenderData describes the Telegram user who sent a message, or the chat it
+// was sent on behalf of, whose title is its FirstName.
+type SenderData struct {
+	ID int64
+	// Full name and username, as available
+	Name      string
+	FirstName string
+	LastName  string
+	Username  string
+}
+
+// ChatMessageData is what templates for annotations created from Telegram
+// messages can use.
+type ChatMessageData struct {
+	Sender SenderData
+	// The message's text, converted to Markdown
+	Text string
+	// URI of the annotated document
+	URI string
+}
+
+// Templates for messages about annotations produce Telegram HTML; values
+// from the annotation are escaped. The chat template produces plain text.
+const (
+	DefaultRootTemplate = `<b>{{.Mention}}</b>{{if .Title}} on <i>{{.Title}}</i>{{end}}
+{{if .Quote}}<blockquote>{{.Quote}}</blockquote>
+{{end}}{{.TextHTML}}
+{{if .Hashtags}}{{join .Hashtags " "}}
+{{end}}<a href="{{.Link}}">Annotation</a> · <a href="{{.URI}}">Document</a>`
+	DefaultReplyTemplate = `<b>{{.Mention}}</b>
+{{.TextHTML}}
+{{if .Hashtags}}{{join .Hashtags " "}}
+{{end}}<a href="{{.Link}}">Reply</a>`
+	DefaultChatTemplate = "{{.Sender.Name}} wrote \"{{.Text}}\""
+)
+
+var templateFuncs = map[string]any{
+	"join":     strings.Join,
+	"truncate": Truncate,
+}
+
+var (
+	defaultRootTemplate  = template.Must(parseHTMLTemplate(DefaultRootTemplate))
+	defaultReplyTemplate = template.Must(parseHTMLTemplate(DefaultReplyTemplate))
+	defaultChatTemplate  = texttemplate.Must(parseTextTemplate(DefaultChatTemplate))
+)
+
+// A Template is either an html/template or a text/template.
+type Template interface {
+	Execute(w io.Writer, data any) error
+}
+
+func parseHTMLTemplate(text string) (*template.Template, error) {
+	return template.New("").Funcs(templateFuncs).Parse(text)
+}
+
+func parseTextTemplate(text string) (*texttemplate.Template, error) {
+	return texttemplate.New("").Funcs(templateFuncs).Parse(text)
+}
+
+// Sample data used to check that templates can be executed
+var (
+	sampleAnnotationData = &AnnotationData{
+		ID:           "id",
+		User:         "acct:alice@hypothes.is",
+		Username:     "alice",
+		DisplayName:  "Alice",
+		TelegramID:   1,
+		TelegramName: "Alice Smith",
+		Quote:        "quote",
+		Text:         "text",
+		TextHTML:     "text",
+		Tags:         []string{"tag"},
+		Hashtags:     []string{"#tag"},
+		URI:          "https://example.com/",
+		Title:        "Example",
+		Link:         "https://hypothes.is/a/id",
+	}
+	sampleChatMessageData = &ChatMessageData{
+		Sender: SenderData{1, "Alice Smith (alice)", "Alice", "Smith", "alice"},
+		Text:   "text",
+		URI:    "https://example.com/",
+	}
+)
+
+// checkTemplate executes tmpl with sample data, so that mistakes like
+// misspelled fields are reported when the template is set. It returns the
+// sample message.
+func checkTemplate(tmpl Template, sample any) (string, error) {
+	var b strings.Builder
+	err := tmpl.Execute(&b, sample)
+	return b.String(), err
+}
+
+// annotationTemplate parses and checks a template for messages about
+// annotations. Telegram rejects messages with markup it doesn't support, so
+// such templates are too.
+func annotationTemplate(text string) (*template.Template, error) {
+	tmpl, err := parseHTMLTemplate(text)
+	if err != nil {
+		return nil, err
+	}
+	sample, err := checkTemplate(tmpl, sampleAnnotationData)
+	if err != nil {
+		return nil, err
+	}
+	if err := markup.CheckHTML(sample); err != nil {
+		return nil, fmt.Errorf("template makes invalid Telegram HTML: %v", err)
+	}
+	return tmpl, nil
+}
+
+// chatTemplate parses and checks a template for annotations created from
+// chat messages.
+func chatTemplate(text string) (*texttemplate.Template, error) {
+	tmpl, err := parseTextTemplate(text)
+	if err != nil {
+		return nil, err
+	}
+	_, err = checkTemplate(tmpl, sampleChatMessageData)
+	return tmpl, err
+}
+
+// Render executes tmpl with data.
+func Render(tmpl Template, data any) (string, error) {
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("failed to render message: %v", err)
+	}
+	return b.String(), nil
+}
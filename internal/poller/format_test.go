@@ -0,0 +1,198 @@
+package poller
+
+import (
+	"context"
+	"html/template"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/objectiveryan/irsal/internal/common"
+	"github.com/objectiveryan/irsal/internal/db"
+	"github.com/objectiveryan/irsal/internal/fake"
+	"github.com/objectiveryan/irsal/internal/hyp"
+)
+
+func TestNewAnnotationData(t *testing.T) {
+	quote := "quoted"
+	annot := &hyp.Annotation{
+		ID:         "a1",
+		User:       "acct:alice@hypothes.is",
+		URI:        "https://example.test/",
+		Text:       "text",
+		Tags:       []string{"t"},
+		Targets:    []*hyp.Target{{Selectors: hyp.Selectors{TextQuote: &quote}}},
+		References: []string{"a0"},
+		Document:   &hyp.Document{Title: []string{"Title"}},
+		UserInfo:   &hyp.UserInfo{DisplayName: "Alice A."},
+		Links:      &hyp.Links{HTML: "https://hypothes.is/a/a1", InContext: "https://hyp.is/a1/example.test/"},
+	}
+	want := &AnnotationData{
+		ID:            "a1",
+		User:          "acct:alice@hypothes.is",
+		Username:      "alice",
+		DisplayName:   "Alice A.",
+		Quote:         "quoted",
+		Text:          "text",
+		TextHTML:      "text",
+		Tags:          []string{"t"},
+		Hashtags:      []string{"#t"},
+		URI:           "https://example.test/",
+		Title:         "Title",
+		Link:          "https://hypothes.is/a/a1",
+		InContextLink: "https://hyp.is/a1/example.test/",
+		IsReply:       true,
+	}
+	if got := NewAnnotationData(annot); !reflect.DeepEqual(got, want) {
+		t.Errorf("NewAnnotationData()=%+v; want %+v", got, want)
+	}
+
+	// Display name and link fall back to what we can work out
+	got := NewAnnotationData(&hyp.Annotation{ID: "a2", User: "acct:bob@hypothes.is"})
+	if got.DisplayName != "bob" {
+		t.Errorf("DisplayName=%q; want \"bob\"", got.DisplayName)
+	}
+	if got.Link != "https://hypothes.is/a/a2" {
+		t.Errorf("Link=%q; want \"https://hypothes.is/a/a2\"", got.Link)
+	}
+}
+
+func TestDefaultTemplates(t *testing.T) {
+	opts := ParseOptions(nil)
+	data := &AnnotationData{DisplayName: "Alice", Quote: "q", Text: "t", TextHTML: "t", Title: "T", Link: "https://hypothes.is/a/1", URI: "https://example.test/"}
+	noQuote := &AnnotationData{DisplayName: "Alice", Text: "t", TextHTML: "t", Link: "https://hypothes.is/a/1", URI: "https://example.test/"}
+	for _, tt := range []struct {
+		name string
+		got  string
+		want string
+	}{
+		{"root", mustRender(t, opts.RootTemplate, data), "<b>Alice</b> on <i>T</i>\n<blockquote>q</blockquote>\nt\n<a href=\"https://hypothes.is/a/1\">Annotation</a> · <a href=\"https://example.test/\">Document</a>"},
+		{"root without quote", mustRender(t, opts.RootTemplate, noQuote), "<b>Alice</b>\nt\n<a href=\"https://hypothes.is/a/1\">Annotation</a> · <a href=\"https://example.test/\">Document</a>"},
+		{"reply", mustRender(t, opts.ReplyTemplate, data), "<b>Alice</b>\nt\n<a href=\"https://hypothes.is/a/1\">Reply</a>"},
+		{"chat", mustRender(t, opts.ChatTemplate, &ChatMessageData{Sender: SenderData{Name: "Alice"}, Text: "<t>"}), "Alice wrote \"<t>\""},
+	} {
+		if tt.got != tt.want {
+			t.Errorf("%s template rendered %q; want %q", tt.name, tt.got, tt.want)
+		}
+	}
+}
+
+func TestAnnotationMarkdown(t *testing.T) {
+	data := NewAnnotationData(&hyp.Annotation{ID: "1", Text: "**Bold** claim, see [this](https://example.test/?a&b) & `x<y`"})
+	want := template.HTML(`<b>Bold</b> claim, see <a href="https://example.test/?a&amp;b">this</a> &amp; <code>x&lt;y</code>`)
+	if data.TextHTML != want {
+		t.Errorf("TextHTML=%q; want %q", data.TextHTML, want)
+	}
+
+	// Links are written by anyone in the group, so only safe ones are kept.
+	data = NewAnnotationData(&hyp.Annotation{ID: "2", Text: "[click](javascript:alert`1`)"})
+	if want := template.HTML("click"); data.TextHTML != want {
+		t.Errorf("TextHTML=%q; want %q", data.TextHTML, want)
+	}
+}
+
+func mustRender(t *testing.T, tmpl Template, data any) string {
+	t.Helper()
+	text, err := Render(tmpl, data)
+	if err != nil {
+		t.Fatalf("Render() returned err=%v", err)
+	}
+	return text
+}
+
+func TestTemplateEscaping(t *testing.T) {
+	opts := ParseOptions(nil)
+	quote := "a < b & c"
+	data := NewAnnotationData(&hyp.Annotation{
+		ID:       "1",
+		UserInfo: &hyp.UserInfo{DisplayName: "<b>Mallory</b>"},
+		Targets:  []*hyp.Target{{Selectors: hyp.Selectors{TextQuote: &quote}}},
+		Text:     "</blockquote><a href=\"x\">",
+		URI:      "javascript:alert(1)",
+	})
+	got := mustRender(t, opts.RootTemplate, data)
+	want := "<b>&lt;b&gt;Mallory&lt;/b&gt;</b>\n<blockquote>a &lt; b &amp; c</blockquote>\n&lt;/blockquote&gt;&lt;a href=\"x\"&gt;\n<a href=\"https://hypothes.is/a/1\">Annotation</a> · <a href=\"#ZgotmplZ\">Document</a>"
+	if got != want {
+		t.Errorf("Rendered %q; want %q", got, want)
+	}
+}
+
+func TestValidateTemplates(t *testing.T) {
+	for _, tt := range []struct {
+		name, value string
+		ok          bool
+	}{
+		{OptionRootTemplate, "{{.DisplayName}}: {{.Text}} {{join .Tags \", \"}}", true},
+		{OptionRootTemplate, "{{.Sender.Name}}", false},
+		{OptionRootTemplate, "{{.Text", false},
+		{OptionReplyTemplate, "{{truncate .Text 10}}", true},
+		{OptionReplyTemplate, "{{.Nonexistent}}", false},
+		{OptionReplyTemplate, "<b>{{.DisplayName}}</b> <i>{{.Text}}</i>", true},
+		{OptionReplyTemplate, DefaultReplyTemplate, true},
+		{OptionRootTemplate, DefaultRootTemplate, true},
+		{OptionReplyTemplate, "<p>{{.Text}}</p>", false},
+		{OptionReplyTemplate, "<b>{{.Text}}", false},
+		{OptionChatTemplate, "{{.Sender.Username}}: {{.Text}}", true},
+		{OptionChatTemplate, "{{.Quote}}", false},
+		{OptionLinkPreview, "on", true},
+		{OptionLinkPreview, "off", true},
+		{OptionLinkPreview, "maybe", false},
+	} {
+		if err := ValidateOption(tt.name, tt.value); (err == nil) != tt.ok {
+			t.Errorf("ValidateOption(%q, %q) returned err=%v; want ok=%v", tt.name, tt.value, err, tt.ok)
+		}
+	}
+}
+
+func TestHandleSub_CustomTemplate(t *testing.T) {
+	const CHAT_ID = 42
+	h := fake.NewHypFactory([]*hyp.Annotation{
+		{ID: "a1", Group: "grp", Updated: hyp.ToTimestamp(time.Unix(2, 0)), User: "acct:alice@hypothes.is", Text: "Parent"},
+		{ID: "a2", Group: "grp", Updated: hyp.ToTimestamp(time.Unix(3, 0)), User: "acct:bob@hypothes.is", Text: "Child", References: []string{"a1"}},
+	})
+	s := db.NewInMemoryStorage()
+	tg := &fake.Tg{}
+	p := &Poller{h, s, tg}
+	sub := &common.Subscription{"ht", "grp", time.Unix(1, 0), CHAT_ID}
+	s.AddSubscription(sub)
+	s.SetSubscriptionOption(sub.Key(), OptionRootTemplate, "{{.Username}}: {{.Text}}")
+
+	if err := p.handleSub(context.TODO(), sub); err != nil {
+		t.Fatalf("handleSub() returned err=%v", err)
+	}
+	if len(tg.SentMessages) != 2 {
+		t.Fatalf("len(SentMessages)=%d; expected 2", len(tg.SentMessages))
+	}
+	if got, want := tg.SentMessages[0].Text, "alice: Parent"; got != want {
+		t.Errorf("Root message text=%q; want %q", got, want)
+	}
+	// The reply template is still the default
+	if got, want := tg.SentMessages[1].Text, "<b>bob</b>\nChild\n<a href=\"https://hypothes.is/a/a2\">Reply</a>"; got != want {
+		t.Errorf("Reply message text=%q; want %q", got, want)
+	}
+	for _, msg := range tg.SentMessages {
+		if !msg.HTML || msg.NoPreview {
+			t.Errorf("Message sent with HTML=%v NoPreview=%v; want HTML with preview", msg.HTML, msg.NoPreview)
+		}
+	}
+}
+
+func TestHandleSub_NoLinkPreview(t *testing.T) {
+	h := fake.NewHypFactory([]*hyp.Annotation{{ID: "a1", Group: "grp", Updated: hyp.ToTimestamp(time.Unix(2, 0))}})
+	s := db.NewInMemoryStorage()
+	tg := &fake.Tg{}
+	p := &Poller{h, s, tg}
+	sub := &common.Subscription{"ht", "grp", time.Unix(1, 0), 42}
+	s.AddSubscription(sub)
+	s.SetSubscriptionOption(sub.Key(), OptionLinkPreview, "off")
+
+	if err := p.handleSub(context.TODO(), sub); err != nil {
+		t.Fatalf("handleSub() returned err=%v", err)
+	}
+	if len(tg.SentMessages) != 1 {
+		t.Fatalf("len(SentMessages)=%d; expected 1", len(tg.SentMessages))
+	}
+	if !tg.SentMessages[0].NoPreview {
+		t.Errorf("Message sent with NoPreview=false; want true")
+	}
+}
@@ -0,0 +1,90 @@
+package poller
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"log"
+	"strings"
+
+	"github.com/objectiveryan/irsal/internal/common"
+	"github.com/objectiveryan/irsal/internal/hyp"
+)
+
+// header returns the header message for the annotation's document, posting
+// it if there isn't one yet. Like an outbox entry, the header is recorded
+// before it's sent, so it isn't posted twice.
+func (p *Poller) header(ctxt context.Context, chatID int64, annot *hyp.Annotation, threadID int, opts *Options) (int, error) {
+	h, err := p.Storage.DocumentHeader(chatID, annot.URI)
+	if err == common.ErrNotFound {
+		count, err := p.Storage.AnnotationCount(chatID, annot.URI)
+		if err != nil {
+			return -1, fmt.Errorf("failed to count annotations on %q: %v", annot.URI, err)
+		}
+		// Count the annotation about to be posted, so the header needn't be
+		// edited straight away.
+		h = &common.DocumentHeader{ChatID: chatID, URI: annot.URI, Title: annot.Title(), Count: count + 1, State: common.OutboxPending}
+		if err := p.Storage.SetDocumentHeader(h); err != nil {
+			return -1, fmt.Errorf("failed to add header for %q: %v", annot.URI, err)
+		}
+	} else if err != nil {
+		return -1, fmt.Errorf("failed to look up header for %q: %v", annot.URI, err)
+	}
+	return p.sendOnce(ctxt, &outboxMessage{
+		desc:      fmt.Sprintf("header for %q", annot.URI),
+		chatID:    chatID,
+		msg:       &common.Message{Text: HeaderMessageText(h), HTML: true, NoPreview: !opts.LinkPreview, ThreadID: threadID},
+		state:     h.State,
+		messageID: h.MessageID,
+		setState: func(state common.OutboxState, messageID int) error {
+			h.State, h.MessageID = state, messageID
+			return p.Storage.SetDocumentHeader(h)
+		},
+	})
+}
+
+// updateHeader edits the header message for a document, if it has one, so
+// that its count of annotations is up to date.
+func (p *Poller) updateHeader(chatID int64, uri string, opts *Options) error {
+	h, err := p.Storage.DocumentHeader(chatID, uri)
+	if err == common.ErrNotFound || err == nil && h.State != common.OutboxSent {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to look up header for %q: %v", uri, err)
+	}
+	count, err := p.Storage.AnnotationCount(chatID, uri)
+	if err != nil {
+		return fmt.Errorf("failed to count annotations on %q: %v", uri, err)
+	}
+	// Telegram refuses edits which don't change anything.
+	if count == h.Count {
+		return nil
+	}
+	h.Count = count
+	log.Printf("Updating header %d in chat %d to %d annotations", h.MessageID, chatID, count)
+	msg := &common.Message{Text: HeaderMessageText(h), HTML: true, NoPreview: !opts.LinkPreview}
+	if err := p.Tg.Edit(chatID, h.MessageID, msg); err != nil {
+		return fmt.Errorf("failed to edit header %d for %q: %v", h.MessageID, uri, err)
+	}
+	if err := p.Storage.SetDocumentHeader(h); err != nil {
+		return fmt.Errorf("failed to record header %d for %q: %v", h.MessageID, uri, err)
+	}
+	return nil
+}
+
+// HeaderMessageText describes a document and its annotations in Telegram HTML.
+func HeaderMessageText(h *common.DocumentHeader) string {
+	var b strings.Builder
+	title := h.Title
+	if title == "" {
+		title = h.URI
+	}
+	fmt.Fprintf(&b, "📄 <b>%s</b>\n", html.EscapeString(title))
+	fmt.Fprintf(&b, "<a href=\"%s\">%s</a>\n", html.EscapeString(h.URI), html.EscapeString(h.URI))
+	if h.Count == 1 {
+		b.WriteString("1 annotation")
+	} else {
+		fmt.Fprintf(&b, "%d annotations", h.Count)
+	}
+	return b.String()
+}
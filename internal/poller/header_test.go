@@ -0,0 +1,116 @@
+package poller
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/objectiveryan/irsal/internal/common"
+	"github.com/objectiveryan/irsal/internal/db"
+	"github.com/objectiveryan/irsal/internal/fake"
+	"github.com/objectiveryan/irsal/internal/hyp"
+)
+
+func TestHeaderMessageText(t *testing.T) {
+	for _, tt := range []struct {
+		h    *common.DocumentHeader
+		want string
+	}{
+		{&common.DocumentHeader{URI: "https://example.test/?a&b", Title: "<Title>", Count: 1},
+			"📄 <b>&lt;Title&gt;</b>\n<a href=\"https://example.test/?a&amp;b\">https://example.test/?a&amp;b</a>\n1 annotation"},
+		{&common.DocumentHeader{URI: "https://example.test/", Count: 3},
+			"📄 <b>https://example.test/</b>\n<a href=\"https://example.test/\">https://example.test/</a>\n3 annotations"},
+	} {
+		if got := HeaderMessageText(tt.h); got != tt.want {
+			t.Errorf("HeaderMessageText(%+v)=%q; want %q", tt.h, got, tt.want)
+		}
+	}
+}
+
+func TestHandleSub_Headers(t *testing.T) {
+	const CHAT_ID = 42
+	h := fake.NewHypFactory([]*hyp.Annotation{
+		{ID: "a1", Group: "grp", Updated: hyp.ToTimestamp(time.Unix(2, 0)), URI: "https://a.test/", Document: &hyp.Document{Title: []string{"Page A"}}},
+		{ID: "a2", Group: "grp", Updated: hyp.ToTimestamp(time.Unix(3, 0)), URI: "https://a.test/", References: []string{"a1"}},
+		{ID: "a3", Group: "grp", Updated: hyp.ToTimestamp(time.Unix(4, 0)), URI: "https://a.test/"},
+	})
+	s := db.NewInMemoryStorage()
+	tg := &fake.Tg{}
+	p := &Poller{h, s, tg}
+	sub := &common.Subscription{"ht", "grp", time.Unix(1, 0), CHAT_ID}
+	s.AddSubscription(sub)
+	s.SetSubscriptionOption(sub.Key(), OptionHeaders, "on")
+	subs, err := s.Subscriptions()
+	if err != nil {
+		t.Fatalf("Subscriptions() returned err=%v", err)
+	}
+
+	if err := p.handleSub(context.TODO(), subs[0]); err != nil {
+		t.Fatalf("handleSub() returned err=%v", err)
+	}
+	// The header, then the three annotations
+	if len(tg.SentMessages) != 4 {
+		t.Fatalf("len(SentMessages)=%d; expected 4", len(tg.SentMessages))
+	}
+	header := tg.SentMessages[0]
+	want := HeaderMessageText(&common.DocumentHeader{URI: "https://a.test/", Title: "Page A", Count: 3})
+	if header.Text != want {
+		t.Errorf("Header text is %q; want %q", header.Text, want)
+	}
+	for i, wantParent := range []int{header.MessageID, tg.SentMessages[1].MessageID, header.MessageID} {
+		if got := tg.SentMessages[i+1].ParentMessageID; got != wantParent {
+			t.Errorf("Annotation %d replied to %d; want %d", i+1, got, wantParent)
+		}
+	}
+	stored, err := s.DocumentHeader(CHAT_ID, "https://a.test/")
+	if err != nil {
+		t.Fatalf("DocumentHeader() returned err=%v", err)
+	}
+	if stored.MessageID != header.MessageID || stored.Count != 3 {
+		t.Errorf("DocumentHeader() returned %+v; want message %d with count 3", stored, header.MessageID)
+	}
+}
+
+// FlakyHeaderStorage fails to record that headers were sent a number of times.
+type FlakyHeaderStorage struct {
+	common.Storage
+	Failures int
+}
+
+func (s *FlakyHeaderStorage) SetDocumentHeader(h *common.DocumentHeader) error {
+	if h.State == common.OutboxSent && s.Failures > 0 {
+		s.Failures--
+		return errors.New("database is locked")
+	}
+	return s.Storage.SetDocumentHeader(h)
+}
+
+func TestHandleSub_HeaderRecordFailureIsRetried(t *testing.T) {
+	defer func(d time.Duration) { outboxRetryDelay = d }(outboxRetryDelay)
+	outboxRetryDelay = time.Millisecond
+	const CHAT_ID = 42
+	h := fake.NewHypFactory([]*hyp.Annotation{
+		{ID: "a1", Group: "grp", Updated: hyp.ToTimestamp(time.Unix(2, 0)), URI: "https://a.test/"},
+	})
+	s := &FlakyHeaderStorage{db.NewInMemoryStorage(), 2}
+	tg := &fake.Tg{}
+	p := &Poller{h, s, tg}
+	sub := &common.Subscription{"ht", "grp", time.Unix(1, 0), CHAT_ID}
+	s.AddSubscription(sub)
+	s.SetSubscriptionOption(sub.Key(), OptionHeaders, "on")
+
+	for i := 0; i < 2; i++ {
+		sub, _ := s.Subscription(CHAT_ID, "grp")
+		if err := p.handleSub(context.TODO(), sub); err != nil {
+			t.Fatalf("handleSub() returned err=%v", err)
+		}
+	}
+	// One header, then the annotation
+	if len(tg.SentMessages) != 2 {
+		t.Fatalf("len(SentMessages)=%d; expected 2", len(tg.SentMessages))
+	}
+	if got, want := tg.SentMessages[1].ParentMessageID, tg.SentMessages[0].MessageID; got != want {
+		t.Errorf("Annotation replied to %d; want header %d", got, want)
+	}
+}
@@ -0,0 +1,154 @@
+package poller
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/objectiveryan/irsal/internal/common"
+	"github.com/objectiveryan/irsal/internal/hyp"
+)
+
+// notificationData is what the template for private notifications uses.
+type notificationData struct {
+	*AnnotationData
+	// Whether the annotation replies to the user, rather than mentioning them
+	Reply bool
+}
+
+var notificationTemplate = template.Must(parseHTMLTemplate(`<b>{{.Mention}}</b> {{if .Reply}}replied to you{{else}}mentioned you{{end}}{{if .Title}} on <i>{{.Title}}</i>{{end}}
+{{.TextHTML}}
+<a href="{{.Link}}">{{if .IsReply}}Reply{{else}}Annotation{{end}}</a>`))
+
+var (
+	// Mentions inserted by the Hypothesis client
+	mentionLinkRegexp = regexp.MustCompile(`<a [^>]*data-userid="(acct:[^"@]+@[^"]+)"[^>]*>[^<]*</a>`)
+	// Mentions typed as plain text
+	mentionRegexp = regexp.MustCompile(`(?:^|[^\w@/.])@([A-Za-z0-9_.]{3,30})\b`)
+)
+
+// mentions returns the Hypothesis accounts the annotation's text mentions.
+func mentions(annot *hyp.Annotation) []string {
+	authority := "hypothes.is"
+	if i := strings.LastIndex(annot.User, "@"); i >= 0 {
+		authority = annot.User[i+1:]
+	}
+	var users []string
+	for _, m := range mentionLinkRegexp.FindAllStringSubmatch(annot.Text, -1) {
+		users = append(users, m[1])
+	}
+	text := mentionLinkRegexp.ReplaceAllString(annot.Text, "")
+	for _, m := range mentionRegexp.FindAllStringSubmatch(text, -1) {
+		users = append(users, "acct:"+m[1]+"@"+authority)
+	}
+	return users
+}
+
+// threadRoot returns the ID of the annotation which starts annot's thread.
+func threadRoot(annot *hyp.Annotation) string {
+	if len(annot.References) > 0 {
+		return annot.References[0]
+	}
+	return annot.ID
+}
+
+// notify sends private messages about annot to the linked Telegram users it
+// replies to or mentions, unless they don't want them. Failures are logged,
+// since they shouldn't hold up the subscription.
+func (p *Poller) notify(ctxt context.Context, annot *hyp.Annotation, h hyp.Client) {
+	// Finding who a reply replies to takes a request to Hypothesis, so don't
+	// bother unless someone could be notified.
+	if enabled, err := p.Storage.AnyNotificationsEnabled(); err != nil {
+		log.Printf("Failed to check whether anyone wants notifications: %v", err)
+		return
+	} else if !enabled {
+		return
+	}
+	// Whether each account is replied to, or just mentioned
+	recipients := make(map[string]bool)
+	for _, user := range mentions(annot) {
+		recipients[user] = false
+	}
+	if len(annot.References) > 0 {
+		parentID := annot.References[len(annot.References)-1]
+		if parent, err := h.Annotation(ctxt, parentID); err != nil {
+			log.Printf("Failed to look up %q to notify its author: %v", parentID, err)
+		} else if parent.User != "" {
+			recipients[parent.User] = true
+		}
+	}
+	delete(recipients, annot.User)
+	for hypUser, reply := range recipients {
+		if err := p.notifyUser(ctxt, annot, hypUser, reply); err != nil {
+			log.Printf("Failed to notify %q about %q: %v", hypUser, annot.ID, err)
+		}
+	}
+}
+
+func (p *Poller) notifyUser(ctxt context.Context, annot *hyp.Annotation, hypUser string, reply bool) error {
+	link, err := p.Storage.UserLink(hypUser)
+	if err == common.ErrNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if enabled, err := p.Storage.NotificationsEnabled(link.UserID); err != nil || !enabled {
+		return err
+	}
+	if muted, err := p.Storage.ThreadMuted(link.UserID, threadRoot(annot)); err != nil || muted {
+		return err
+	}
+	// If the user subscribed to the group in their private chat, which has
+	// the user's ID, the annotation is posted there anyway.
+	if _, err := p.Storage.Subscription(link.UserID, annot.Group); err == nil {
+		return nil
+	} else if err != common.ErrNotFound {
+		return err
+	}
+	n, err := p.Storage.Notification(annot.ID, link.UserID)
+	if err == common.ErrNotFound {
+		text, err := Render(notificationTemplate, &notificationData{LookupAnnotationData(p.Storage, annot), reply})
+		if err != nil {
+			return err
+		}
+		n = &common.Notification{
+			AnnotID: annot.ID,
+			UserID:  link.UserID,
+			RootID:  threadRoot(annot),
+			Message: common.Message{Text: text, HTML: true, NoPreview: true},
+			State:   common.OutboxPending,
+		}
+		if err := p.Storage.AddNotification(n); err != nil {
+			return fmt.Errorf("failed to record notification: %v", err)
+		}
+	} else if err != nil {
+		return err
+	}
+	return p.deliverNotification(ctxt, n)
+}
+
+// deliverNotification sends a recorded notification, unless it was already
+// sent.
+func (p *Poller) deliverNotification(ctxt context.Context, n *common.Notification) error {
+	if n.State == common.OutboxSent {
+		return nil
+	}
+	_, err := p.sendOnce(ctxt, &outboxMessage{
+		desc:      fmt.Sprintf("notification about %q", n.AnnotID),
+		chatID:    n.UserID,
+		msg:       &n.Message,
+		state:     n.State,
+		messageID: n.MessageID,
+		setState: func(state common.OutboxState, messageID int) error {
+			return p.Storage.SetNotificationState(n.AnnotID, n.UserID, state, messageID)
+		},
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("Notified user %d about %q", n.UserID, n.AnnotID)
+	return nil
+}
@@ -0,0 +1,217 @@
+package poller
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/objectiveryan/irsal/internal/common"
+	"github.com/objectiveryan/irsal/internal/db"
+	"github.com/objectiveryan/irsal/internal/fake"
+	"github.com/objectiveryan/irsal/internal/hyp"
+)
+
+func TestMentions(t *testing.T) {
+	annot := &hyp.Annotation{
+		User: "acct:bob@example.org",
+		Text: `Hi @alice and <a data-hyp-mention="" data-userid="acct:carol@hypothes.is">@carol</a>, mail dave@example.org`,
+	}
+	got := mentions(annot)
+	sort.Strings(got)
+	want := []string{"acct:alice@example.org", "acct:carol@hypothes.is"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("mentions()=%q; want %q", got, want)
+	}
+}
+
+func TestHandleSub_Notifications(t *testing.T) {
+	const CHAT_ID = -42
+	updated := func(sec int64) *hyp.Timestamp { return hyp.ToTimestamp(time.Unix(sec, 0)) }
+	h := fake.NewHypFactory([]*hyp.Annotation{
+		{ID: "a1", Group: "grp", User: "acct:alice@hypothes.is", Updated: updated(2)},
+		// Alice gets a reply, and Carol a mention.
+		{ID: "a2", Group: "grp", User: "acct:bob@hypothes.is", Text: "Ask @carol", Updated: updated(3), References: []string{"a1"}},
+		// Alice doesn't get notified of her own replies.
+		{ID: "a3", Group: "grp", User: "acct:alice@hypothes.is", Updated: updated(4), References: []string{"a1", "a2"}},
+		// Dave turned notifications off.
+		{ID: "a4", Group: "grp", User: "acct:bob@hypothes.is", Text: "@dave", Updated: updated(5)},
+		// Carol muted this thread.
+		{ID: "a5", Group: "grp", User: "acct:bob@hypothes.is", Text: "@carol", Updated: updated(6)},
+		{ID: "a6", Group: "grp", User: "acct:bob@hypothes.is", Text: "@carol again", Updated: updated(7), References: []string{"a5"}},
+	})
+	s := db.NewInMemoryStorage()
+	tg := &fake.Tg{}
+	p := &Poller{h, s, tg}
+	sub := &common.Subscription{"ht", "grp", time.Unix(1, 0), CHAT_ID}
+	s.AddSubscription(sub)
+	for i, name := range []string{"alice", "carol", "dave"} {
+		userID := int64(i + 1)
+		s.SetUserLink(&common.UserLink{HypUser: "acct:" + name + "@hypothes.is", UserID: userID, Name: name})
+		s.SetNotificationsEnabled(userID, name != "dave")
+	}
+	s.MuteThread(2, "a5")
+
+	if err := p.handleSub(context.TODO(), sub); err != nil {
+		t.Fatalf("handleSub() returned err=%v", err)
+	}
+	var notifications []*fake.SentMessage
+	for _, m := range tg.SentMessages {
+		if m.ChatID != CHAT_ID {
+			notifications = append(notifications, m)
+		}
+	}
+	if len(notifications) != 2 {
+		t.Fatalf("Sent %d notifications; want 2", len(notifications))
+	}
+	sort.Slice(notifications, func(i, j int) bool { return notifications[i].ChatID < notifications[j].ChatID })
+	for i, want := range []struct {
+		chatID int64
+		text   string
+	}{
+		{1, "<b>bob</b> replied to you"},
+		{2, "<b>bob</b> mentioned you"},
+	} {
+		if got := notifications[i]; got.ChatID != want.chatID || !strings.HasPrefix(got.Text, want.text) {
+			t.Errorf("Notification %d in chat %d is %q; want chat %d with prefix %q", i, got.ChatID, got.Text, want.chatID, want.text)
+		}
+	}
+	if rootID, err := s.NotificationThread(2, notifications[1].MessageID); err != nil || rootID != "a1" {
+		t.Errorf("NotificationThread() returned %q, err=%v; want \"a1\"", rootID, err)
+	}
+	// Notifications aren't annotation messages, so replies to them aren't
+	// posted as replies to the annotation.
+	if _, _, err := s.AnnotationID(2, notifications[1].MessageID); err != common.ErrNotFound {
+		t.Errorf("AnnotationID() of notification returned err=%v; want ErrNotFound", err)
+	}
+
+	// Polling the same annotations again doesn't notify anyone twice.
+	sub.SearchAfter = time.Unix(1, 0)
+	before := len(tg.SentMessages)
+	if err := p.handleSub(context.TODO(), sub); err != nil {
+		t.Fatalf("handleSub() returned err=%v", err)
+	}
+	if len(tg.SentMessages) != before {
+		t.Errorf("Second handleSub() sent %d messages; want none", len(tg.SentMessages)-before)
+	}
+}
+
+// countingHyp counts the annotations its clients look up.
+type countingHyp struct {
+	hyp.ClientFactory
+	lookups int
+}
+
+type countingClient struct {
+	hyp.Client
+	parent *countingHyp
+}
+
+func (h *countingHyp) NewClient(token, group string) hyp.Client {
+	return &countingClient{h.ClientFactory.NewClient(token, group), h}
+}
+
+func (c *countingClient) Annotation(ctxt context.Context, id string) (*hyp.Annotation, error) {
+	c.parent.lookups++
+	return c.Client.Annotation(ctxt, id)
+}
+
+func TestHandleSub_NoNotificationsNoLookups(t *testing.T) {
+	const CHAT_ID = -42
+	h := &countingHyp{ClientFactory: fake.NewHypFactory([]*hyp.Annotation{
+		{ID: "a1", Group: "grp", User: "acct:alice@hypothes.is", Updated: hyp.ToTimestamp(time.Unix(2, 0))},
+		{ID: "a2", Group: "grp", User: "acct:bob@hypothes.is", Updated: hyp.ToTimestamp(time.Unix(3, 0)), References: []string{"a1"}},
+	})}
+	s := db.NewInMemoryStorage()
+	p := &Poller{h, s, &fake.Tg{}}
+	sub := &common.Subscription{"ht", "grp", time.Unix(1, 0), CHAT_ID}
+	s.AddSubscription(sub)
+	// Alice is linked, but doesn't want notifications.
+	s.SetUserLink(&common.UserLink{HypUser: "acct:alice@hypothes.is", UserID: 1, Name: "alice"})
+
+	if err := p.handleSub(context.TODO(), sub); err != nil {
+		t.Fatalf("handleSub() returned err=%v", err)
+	}
+	if h.lookups != 0 {
+		t.Errorf("Looked up %d annotations; want none", h.lookups)
+	}
+}
+
+func TestHandleSub_NotifyOnceWhenBridged(t *testing.T) {
+	h := &countingHyp{ClientFactory: fake.NewHypFactory([]*hyp.Annotation{
+		{ID: "a1", Group: "grp", User: "acct:alice@hypothes.is", Updated: hyp.ToTimestamp(time.Unix(2, 0))},
+		{ID: "a2", Group: "grp", User: "acct:bob@hypothes.is", Updated: hyp.ToTimestamp(time.Unix(3, 0)), References: []string{"a1"}},
+	})}
+	s := db.NewInMemoryStorage()
+	tg := &fake.Tg{}
+	p := &Poller{h, s, tg}
+	s.SetUserLink(&common.UserLink{HypUser: "acct:alice@hypothes.is", UserID: 1, Name: "alice"})
+	s.SetNotificationsEnabled(1, true)
+	// The first chat doesn't want Bob's annotations, so they aren't bridged
+	// and nobody hears about them from it.
+	filtered := &common.Subscription{"ht", "grp", time.Unix(1, 0), -42}
+	s.AddSubscription(filtered)
+	if err := s.AddFilter(filtered.Key(), &common.FilterRule{Exclude: true, Field: common.FilterUser, Pattern: "bob"}); err != nil {
+		t.Fatalf("AddFilter() returned err=%v", err)
+	}
+	other := &common.Subscription{"ht", "grp", time.Unix(1, 0), -43}
+	s.AddSubscription(other)
+	notifications := func() int {
+		n := 0
+		for _, m := range tg.SentMessages {
+			if m.ChatID == 1 {
+				n++
+			}
+		}
+		return n
+	}
+
+	if err := p.handleSub(context.TODO(), filtered); err != nil {
+		t.Fatalf("handleSub() returned err=%v", err)
+	}
+	if n := notifications(); n != 0 || h.lookups != 0 {
+		t.Errorf("Sent %d notifications after %d lookups for filtered chat; want none", n, h.lookups)
+	}
+	if err := p.handleSub(context.TODO(), other); err != nil {
+		t.Fatalf("handleSub() returned err=%v", err)
+	}
+	if n := notifications(); n != 1 {
+		t.Errorf("Sent %d notifications; want 1", n)
+	}
+	// Polling the annotations again, as when they're edited, doesn't look up
+	// their parents to notify anyone.
+	lookups := h.lookups
+	other.SearchAfter = time.Unix(1, 0)
+	if err := p.handleSub(context.TODO(), other); err != nil {
+		t.Fatalf("handleSub() returned err=%v", err)
+	}
+	if h.lookups != lookups || notifications() != 1 {
+		t.Errorf("Polling again looked up %d annotations and sent %d notifications; want none", h.lookups-lookups, notifications()-1)
+	}
+}
+
+func TestReconcile_Notifications(t *testing.T) {
+	s := db.NewInMemoryStorage()
+	tg := &fake.Tg{}
+	p := &Poller{fake.NewHypFactory(nil), s, tg}
+	for _, n := range []*common.Notification{
+		{AnnotID: "a1", UserID: 1, RootID: "a1", Message: common.Message{Text: "pending"}, State: common.OutboxPending},
+		{AnnotID: "a2", UserID: 1, RootID: "a2", Message: common.Message{Text: "sent"}, State: common.OutboxSent, MessageID: 5},
+	} {
+		if err := s.AddNotification(n); err != nil {
+			t.Fatalf("AddNotification() returned err=%v", err)
+		}
+	}
+
+	if err := p.Reconcile(context.TODO()); err != nil {
+		t.Fatalf("Reconcile() returned err=%v", err)
+	}
+	if len(tg.SentMessages) != 1 || tg.SentMessages[0].Text != "pending" || tg.SentMessages[0].ChatID != 1 {
+		t.Fatalf("SentMessages=%+v; want just the pending notification, sent to user 1", tg.SentMessages)
+	}
+	if n, err := s.Notification("a1", 1); err != nil || n.State != common.OutboxSent || n.MessageID != tg.SentMessages[0].MessageID {
+		t.Errorf("Notification() returned %+v, err=%v; want it sent as message %d", n, err, tg.SentMessages[0].MessageID)
+	}
+}
@@ -0,0 +1,176 @@
+package poller
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"sort"
+	texttemplate "text/template"
+	"time"
+)
+
+// Names of subscription options
+const (
+	// How long to collect annotations before posting them together in one
+	// message: "hourly", "daily" or a duration such as "6h". Unset to post
+	// each annotation as its own message.
+	OptionDigest = "digest"
+	// Template for messages about top-level annotations, using AnnotationData
+	// and producing Telegram HTML
+	OptionRootTemplate = "template"
+	// Template for messages about replies, using AnnotationData and producing
+	// Telegram HTML
+	OptionReplyTemplate = "reply_template"
+	// Template for annotations created from chat replies, using ChatMessageData
+	OptionChatTemplate = "chat_template"
+	// "on" or "off" to show or hide previews of links in messages
+	OptionLinkPreview = "link_preview"
+	// "on" to post each document's annotations in a forum topic of their own,
+	// for chats which are forums
+	OptionTopics = "topics"
+	// "on" to post a header message for each document, which its top-level
+	// annotations reply to
+	OptionHeaders = "headers"
+	// "on" to reply to messages sharing links with a summary of the group's
+	// annotations on them
+	OptionLinkLookup = "link_lookup"
+	// How tags and hashtags correspond: a comma-separated list of "lower",
+	// to make tags lowercase, and "spaces", to make underscores in hashtags
+	// spaces in tags
+	OptionTagRules = "tag_rules"
+)
+
+var validators = map[string]func(value string) error{
+	OptionDigest: func(value string) error {
+		_, err := parseDigestWindow(value)
+		return err
+	},
+	OptionRootTemplate: func(value string) error {
+		_, err := annotationTemplate(value)
+		return err
+	},
+	OptionReplyTemplate: func(value string) error {
+		_, err := annotationTemplate(value)
+		return err
+	},
+	OptionChatTemplate: func(value string) error {
+		_, err := chatTemplate(value)
+		return err
+	},
+	OptionLinkPreview: func(value string) error {
+		_, err := parseSwitch(value)
+		return err
+	},
+	OptionTopics: func(value string) error {
+		_, err := parseSwitch(value)
+		return err
+	},
+	OptionHeaders: func(value string) error {
+		_, err := parseSwitch(value)
+		return err
+	},
+	OptionLinkLookup: func(value string) error {
+		_, err := parseSwitch(value)
+		return err
+	},
+	OptionTagRules: func(value string) error {
+		_, err := parseTagRules(value)
+		return err
+	},
+}
+
+// OptionNames returns the names of all subscription options.
+func OptionNames() []string {
+	var names []string
+	for name := range validators {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// ValidateOption returns an error if value isn't valid for the named option.
+// Empty values, which unset options, are always valid.
+func ValidateOption(name, value string) error {
+	validate, ok := validators[name]
+	if !ok {
+		return fmt.Errorf("unknown option %q", name)
+	}
+	if value == "" {
+		return nil
+	}
+	return validate(value)
+}
+
+func parseDigestWindow(value string) (time.Duration, error) {
+	switch value {
+	case "":
+		return 0, nil
+	case "hourly":
+		return time.Hour, nil
+	case "daily":
+		return 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("digest must be \"hourly\", \"daily\" or a duration: %v", err)
+	}
+	if d < time.Minute {
+		return 0, fmt.Errorf("digest window %v is shorter than a minute", d)
+	}
+	return d, nil
+}
+
+// parseSwitch parses "on" or "off".
+func parseSwitch(value string) (bool, error) {
+	switch value {
+	case "on":
+		return true, nil
+	case "off":
+		return false, nil
+	}
+	return false, fmt.Errorf("%q is neither \"on\" nor \"off\"", value)
+}
+
+// Options holds the parsed options of a subscription.
+type Options struct {
+	Digest        time.Duration
+	RootTemplate  *template.Template
+	ReplyTemplate *template.Template
+	ChatTemplate  *texttemplate.Template
+	LinkPreview   bool
+	Topics        bool
+	Headers       bool
+	LinkLookup    bool
+	TagRules      TagRules
+}
+
+// ParseOptions parses options which were stored. Invalid values, which can
+// only have been set by editing the database, are logged and ignored.
+func ParseOptions(raw map[string]string) *Options {
+	var opts Options
+	opts.Digest = optionValue(raw, OptionDigest, parseDigestWindow, 0)
+	opts.RootTemplate = optionValue(raw, OptionRootTemplate, annotationTemplate, defaultRootTemplate)
+	opts.ReplyTemplate = optionValue(raw, OptionReplyTemplate, annotationTemplate, defaultReplyTemplate)
+	opts.ChatTemplate = optionValue(raw, OptionChatTemplate, chatTemplate, defaultChatTemplate)
+	opts.LinkPreview = optionValue(raw, OptionLinkPreview, parseSwitch, true)
+	opts.Topics = optionValue(raw, OptionTopics, parseSwitch, false)
+	opts.Headers = optionValue(raw, OptionHeaders, parseSwitch, false)
+	opts.LinkLookup = optionValue(raw, OptionLinkLookup, parseSwitch, false)
+	opts.TagRules = optionValue(raw, OptionTagRules, parseTagRules, TagRules{})
+	return &opts
+}
+
+// optionValue parses the named option, returning def if it's unset or invalid.
+func optionValue[T any](raw map[string]string, name string, parse func(string) (T, error), def T) T {
+	value, ok := raw[name]
+	if !ok {
+		return def
+	}
+	v, err := parse(value)
+	if err != nil {
+		log.Printf("Ignoring option %s=%q: %v", name, value, err)
+		return def
+	}
+	return v
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"log"
+	"strings"
 	"time"
 
 	"github.com/objectiveryan/irsal/internal/common"
@@ -11,7 +12,10 @@ import (
 )
 
 type MessageSender interface {
-	Send(chatID int64, parentMessageID int, text string) (int, error)
+	Send(chatID int64, parentMessageID int, msg *common.Message) (int, error)
+	// CreateTopic creates a forum topic and returns its thread ID.
+	CreateTopic(chatID int64, name string) (int, error)
+	Edit(chatID int64, messageID int, msg *common.Message) error
 }
 
 type Poller struct {
@@ -33,6 +37,17 @@ func (p *Poller) handleSub(ctxt context.Context, sub *common.Subscription) error
 	// loop until all annotations are handled
 	h := p.Hyp.NewClient(sub.HypToken, sub.HypGroup)
 	log.Printf("handleSub(%v)", sub.Key())
+	rules, err := p.Storage.Filters(sub.Key())
+	if err != nil {
+		log.Printf("Failed to get filters: %v", err)
+		return nil
+	}
+	raw, err := p.Storage.SubscriptionOptions(sub.Key())
+	if err != nil {
+		log.Printf("Failed to get options: %v", err)
+		return nil
+	}
+	opts := ParseOptions(raw)
 	for {
 		if isDone(ctxt) {
 			return ctxt.Err()
@@ -52,8 +67,11 @@ func (p *Poller) handleSub(ctxt context.Context, sub *common.Subscription) error
 				log.Println("No 'updated' field in annotation")
 				return nil
 			}
-			_, err := p.handleAnnot(ctxt, annot, sub.ChatID, h)
-			if err != nil {
+			// Ancestors of a reply are still posted by handleAnnot even if they
+			// would have been filtered out, so the reply has some context.
+			if !allowed(rules, annot) {
+				log.Printf("Annotation %q filtered out", annot.ID)
+			} else if err := p.bridge(ctxt, annot, sub, h, opts); err != nil {
 				log.Println(err)
 				// Move on to the next subscription; next time try this annotation again
 				return nil
@@ -64,23 +82,31 @@ func (p *Poller) handleSub(ctxt context.Context, sub *common.Subscription) error
 	}
 }
 
-func (p *Poller) handleAncestor(ctxt context.Context, annotID string, chatID int64, h hyp.Client) (int, error) {
+// bridge posts or queues an annotation which passed the subscription's
+// filters. The users it replies to or mentions are notified first if no chat
+// has it yet, so not again when it's edited or polled for another chat.
+func (p *Poller) bridge(ctxt context.Context, annot *hyp.Annotation, sub *common.Subscription, h hyp.Client, opts *Options) error {
+	if bridged, err := p.Storage.AnnotationBridged(annot.ID); err != nil {
+		return fmt.Errorf("failed to check whether annotation %q was posted: %v", annot.ID, err)
+	} else if !bridged {
+		p.notify(ctxt, annot, h)
+	}
+	if opts.Digest > 0 {
+		return p.queueDigest(annot, sub.Key())
+	}
+	_, err := p.handleAnnot(ctxt, annot, sub.ChatID, h, opts)
+	return err
+}
+
+func (p *Poller) handleAncestor(ctxt context.Context, annotID string, chatID int64, h hyp.Client, opts *Options) (int, error) {
 	annot, err := h.Annotation(ctxt, annotID)
 	if err != nil {
 		return -1, fmt.Errorf("failed to look up annotation %q: %v", annotID, err)
 	}
-	return p.handleAnnot(ctxt, annot, chatID, h)
+	return p.handleAnnot(ctxt, annot, chatID, h, opts)
 }
 
-func RootMessageText(user, text, selection, url string) string {
-	return fmt.Sprintf("%s selected \"%s\" and wrote \"%s\"\n%s", user, selection, text, url)
-}
-
-func ReplyMessageText(user, text, url string) string {
-	return fmt.Sprintf("%s wrote \"%s\"\n%s", user, text, url)
-}
-
-func (p *Poller) handleAnnot(ctxt context.Context, annot *hyp.Annotation, chatID int64, h hyp.Client) (int, error) {
+func (p *Poller) handleAnnot(ctxt context.Context, annot *hyp.Annotation, chatID int64, h hyp.Client, opts *Options) (int, error) {
 	mID, err := p.Storage.MessageID(annot.ID, chatID)
 	if err == nil {
 		log.Printf("Ignoring annotation %q which already has a chat message %d/%d\n", annot.ID, chatID, mID)
@@ -88,6 +114,30 @@ func (p *Poller) handleAnnot(ctxt context.Context, annot *hyp.Annotation, chatID
 	} else if err != common.ErrNotFound {
 		return -1, fmt.Errorf("failed to look up existing message for annotation %q: %v", annot.ID, err)
 	}
+	// Never echo an annotation back into the chat it was posted from, even if
+	// recording its message failed.
+	origin, err := p.Storage.AnnotationOrigin(annot.ID)
+	if err == nil && origin.ChatID == chatID {
+		log.Printf("Annotation %q was posted from message %d/%d", annot.ID, chatID, origin.MessageID)
+		meta := common.AnnotationMetadata{annot.References, annot.Group, annot.URI}
+		if err := p.Storage.SetMessageID(annot.ID, meta, chatID, origin.MessageID); err != nil {
+			log.Printf("Failed to record message for annotation %q: %v", annot.ID, err)
+		}
+		return origin.MessageID, nil
+	} else if err != nil && err != common.ErrNotFound {
+		return -1, fmt.Errorf("failed to look up origin of annotation %q: %v", annot.ID, err)
+	}
+	// Replies from a channel's discussion group are already shown as comments
+	// on the channel's posts.
+	fromDiscussion := false
+	if origin != nil {
+		channelID, err := p.Storage.LinkedChannel(origin.ChatID)
+		if err == nil {
+			fromDiscussion = channelID == chatID
+		} else if err != common.ErrNotFound {
+			return -1, fmt.Errorf("failed to look up channel of chat %d: %v", origin.ChatID, err)
+		}
+	}
 
 	var parentMessageID int
 	if len(annot.References) > 0 {
@@ -98,7 +148,10 @@ func (p *Poller) handleAnnot(ctxt context.Context, annot *hyp.Annotation, chatID
 		var err error
 		parentMessageID, err = p.Storage.MessageID(parentAnnotID, chatID)
 		if err == common.ErrNotFound {
-			parentMessageID, err = p.handleAncestor(ctxt, parentAnnotID, chatID, h)
+			parentMessageID, err = p.discussionMessageID(parentAnnotID, chatID)
+		}
+		if err == common.ErrNotFound {
+			parentMessageID, err = p.handleAncestor(ctxt, parentAnnotID, chatID, h, opts)
 			if err != nil {
 				return -1, fmt.Errorf("failed to post ancestors of %q starting from %q: %v", annot.ID, parentAnnotID, err)
 			}
@@ -107,33 +160,384 @@ func (p *Poller) handleAnnot(ctxt context.Context, annot *hyp.Annotation, chatID
 		}
 		// fall through since parentMessageID was set
 	}
+	if fromDiscussion {
+		log.Printf("Not posting annotation %q from the discussion group of channel %d", annot.ID, chatID)
+		// Replies to it reply to its parent instead, which discussionMessageID
+		// finds from its message in the discussion group.
+		if _, err := p.Storage.MessageID(annot.ID, origin.ChatID); err == common.ErrNotFound {
+			meta := common.AnnotationMetadata{annot.References, annot.Group, annot.URI}
+			if err := p.Storage.SetMessageID(annot.ID, meta, origin.ChatID, origin.MessageID); err != nil {
+				log.Printf("Failed to record message for annotation %q: %v", annot.ID, err)
+			}
+		} else if err != nil {
+			log.Printf("Failed to look up message for annotation %q: %v", annot.ID, err)
+		}
+		return parentMessageID, nil
+	}
 
 	if isDone(ctxt) {
 		return -1, ctxt.Err()
 	}
-	var text string
+	tmpl := opts.ReplyTemplate
 	if parentMessageID == 0 {
-		var selection string
-		if annot.Targets != nil && len(annot.Targets) > 0 && annot.Targets[0].Selectors.TextQuote != nil {
-			selection = *annot.Targets[0].Selectors.TextQuote
-		} else {
+		tmpl = opts.RootTemplate
+		if annot.Quote() == "" {
 			log.Println("Warning: no TextQuote selector")
 		}
-		text = RootMessageText(annot.User, annot.Text, selection, "https://hypothes.is/a/"+annot.ID)
-	} else {
-		text = ReplyMessageText(annot.User, annot.Text, "https://hypothes.is/a/"+annot.ID)
 	}
-	messageID, err := p.Tg.Send(chatID, parentMessageID, text)
+	d := LookupAnnotationData(p.Storage, annot)
+	d.Hashtags = opts.TagRules.Hashtags(annot.Tags)
+	text, err := Render(tmpl, d)
 	if err != nil {
-		return -1, fmt.Errorf("failed to send message for annotation: %v", err)
+		return -1, fmt.Errorf("failed to render annotation %q: %v", annot.ID, err)
 	}
-	err = p.Storage.SetMessageID(annot.ID, common.AnnotationMetadata{annot.References, annot.Group, annot.URI}, chatID, messageID)
+	var threadID int
+	if opts.Topics {
+		threadID, err = p.topic(ctxt, chatID, annot)
+		if err != nil {
+			return -1, err
+		}
+	}
+	if parentMessageID == 0 && opts.Headers {
+		parentMessageID, err = p.header(ctxt, chatID, annot, threadID, opts)
+		if err != nil {
+			return -1, err
+		}
+	}
+	entry, err := p.Storage.OutboxEntry(annot.ID, chatID)
+	if err == common.ErrNotFound {
+		entry = &common.OutboxEntry{
+			AnnotID:         annot.ID,
+			Meta:            common.AnnotationMetadata{annot.References, annot.Group, annot.URI},
+			ChatID:          chatID,
+			ParentMessageID: parentMessageID,
+			Message:         common.Message{Text: text, HTML: true, NoPreview: !opts.LinkPreview, ThreadID: threadID, Buttons: annotationButtons(d)},
+			State:           common.OutboxPending,
+		}
+		if err := p.Storage.AddOutboxEntry(entry); err != nil {
+			return -1, fmt.Errorf("failed to add outbox entry for annotation %q: %v", annot.ID, err)
+		}
+	} else if err != nil {
+		return -1, fmt.Errorf("failed to look up outbox entry for annotation %q: %v", annot.ID, err)
+	}
+	messageID, err := p.deliver(ctxt, entry)
+	if err == nil && opts.Headers {
+		// The annotation was posted, so don't fail if the header can't be updated.
+		if err := p.updateHeader(chatID, annot.URI, opts); err != nil {
+			log.Println(err)
+		}
+	}
+	return messageID, err
+}
+
+// discussionMessageID returns the message in a channel which replies to an
+// annotation from the channel's discussion group reply to: the message for
+// the nearest ancestor which isn't from the group. It uses the annotations'
+// messages in the group, so nothing needs to be looked up in Hypothesis.
+func (p *Poller) discussionMessageID(annotID string, channelID int64) (int, error) {
+	origin, err := p.Storage.AnnotationOrigin(annotID)
 	if err != nil {
 		return -1, err
 	}
+	if linked, err := p.Storage.LinkedChannel(origin.ChatID); err != nil {
+		return -1, err
+	} else if linked != channelID {
+		return -1, common.ErrNotFound
+	}
+	_, meta, err := p.Storage.AnnotationID(origin.ChatID, origin.MessageID)
+	if err != nil {
+		return -1, err
+	}
+	if len(meta.References) == 0 {
+		return -1, common.ErrNotFound
+	}
+	parentAnnotID := meta.References[len(meta.References)-1]
+	messageID, err := p.Storage.MessageID(parentAnnotID, channelID)
+	if err == common.ErrNotFound {
+		return p.discussionMessageID(parentAnnotID, channelID)
+	}
+	return messageID, err
+}
+
+// annotationButtons are shown under an annotation's message. Telegram only
+// opens http and https links from buttons.
+func annotationButtons(d *AnnotationData) []common.Button {
+	var buttons []common.Button
+	if d.InContextLink != "" {
+		buttons = append(buttons, common.Button{Text: "Open in context", URL: d.InContextLink})
+	}
+	if strings.HasPrefix(d.URI, "https://") || strings.HasPrefix(d.URI, "http://") {
+		buttons = append(buttons, common.Button{Text: "Open document", URL: d.URI})
+	}
+	return append(buttons,
+		common.Button{Text: "Mute thread", Action: common.ActionMute},
+		common.Button{Text: "Show thread", Action: common.ActionThread})
+}
+
+// LookupAnnotationData is the data for the annotation's message, mentioning
+// the Telegram user linked to its author, or showing who sent the Telegram
+// message it was posted from.
+func LookupAnnotationData(s common.Storage, annot *hyp.Annotation) *AnnotationData {
+	d := NewAnnotationData(annot)
+	if annot.User != "" {
+		link, err := s.UserLink(annot.User)
+		if err == nil {
+			d.SetUserLink(link)
+		} else if err != common.ErrNotFound {
+			log.Printf("Failed to look up Telegram user linked to %q: %v", annot.User, err)
+		}
+	}
+	origin, err := s.AnnotationOrigin(annot.ID)
+	if err == nil {
+		d.SetOrigin(origin)
+	} else if err != common.ErrNotFound {
+		log.Printf("Failed to look up origin of %q: %v", annot.ID, err)
+	}
+	return d
+}
+
+// maxTopicNameLength is Telegram's limit on the length of a topic's name.
+const maxTopicNameLength = 128
+
+// topic returns the forum topic for the annotation's document, creating it
+// if there isn't one yet. Like a header, the topic is recorded before it's
+// created, so it isn't created twice.
+func (p *Poller) topic(ctxt context.Context, chatID int64, annot *hyp.Annotation) (int, error) {
+	t, err := p.Storage.Topic(chatID, annot.URI)
+	if err == common.ErrNotFound {
+		name := annot.Title()
+		if name == "" {
+			name = annot.URI
+		}
+		t = &common.Topic{ChatID: chatID, URI: annot.URI, Name: Truncate(name, maxTopicNameLength), State: common.OutboxPending}
+		if err := p.Storage.SetTopic(t); err != nil {
+			return -1, fmt.Errorf("failed to add topic for %q: %v", annot.URI, err)
+		}
+	} else if err != nil {
+		return -1, fmt.Errorf("failed to look up topic for %q: %v", annot.URI, err)
+	}
+	return p.createTopic(ctxt, t)
+}
+
+// createTopic creates a recorded forum topic, unless it was already created,
+// and returns its thread ID.
+func (p *Poller) createTopic(ctxt context.Context, t *common.Topic) (int, error) {
+	threadID, err := p.sendOnce(ctxt, &outboxMessage{
+		desc:      fmt.Sprintf("topic for %q", t.URI),
+		chatID:    t.ChatID,
+		state:     t.State,
+		messageID: t.ThreadID,
+		send:      func() (int, error) { return p.Tg.CreateTopic(t.ChatID, t.Name) },
+		setState: func(state common.OutboxState, threadID int) error {
+			t.State, t.ThreadID = state, threadID
+			return p.Storage.SetTopic(t)
+		},
+	})
+	if err == nil {
+		log.Printf("Using topic %d in chat %d for %q", threadID, t.ChatID, t.URI)
+	}
+	return threadID, err
+}
+
+// outboxRetryDelay is how long to wait before first retrying a failed write
+// of what happened to a message. The delay doubles up to a minute.
+var outboxRetryDelay = time.Second
+
+// retry calls f until it succeeds or ctxt is done.
+func retry(ctxt context.Context, what string, f func() error) error {
+	delay := outboxRetryDelay
+	for {
+		err := f()
+		if err == nil {
+			return nil
+		}
+		log.Printf("Failed to %s, retrying in %v: %v", what, delay, err)
+		select {
+		case <-ctxt.Done():
+			return fmt.Errorf("failed to %s: %v", what, err)
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, time.Minute)
+	}
+}
+
+// An outboxMessage is a message which is recorded before it's sent, so that
+// it isn't sent twice.
+type outboxMessage struct {
+	// What the message is, for logs and errors
+	desc            string
+	chatID          int64
+	parentMessageID int
+	msg             *common.Message
+	// send, if set, is called instead of sending msg, as to create a forum
+	// topic, whose thread ID is recorded like a message ID.
+	send func() (int, error)
+	// What's been recorded so far
+	state     common.OutboxState
+	messageID int
+	// setState records the message's state and, once it's sent, its ID.
+	setState func(state common.OutboxState, messageID int) error
+}
+
+// sendOnce sends an outbox message, unless it was already sent, and returns
+// its message ID.
+//
+// Once a send has been attempted, its outcome is written back before sendOnce
+// returns, so a message is only left sending if the process stops in between.
+// Only then, after a restart, is it resent without knowing whether the first
+// attempt reached the chat.
+func (p *Poller) sendOnce(ctxt context.Context, o *outboxMessage) (int, error) {
+	if o.state == common.OutboxSent {
+		return o.messageID, nil
+	}
+	if o.state == common.OutboxSending {
+		log.Printf("Warning: resending %s in chat %d; an earlier attempt may have been delivered", o.desc, o.chatID)
+	}
+	if err := o.setState(common.OutboxSending, 0); err != nil {
+		return -1, fmt.Errorf("failed to mark %s sending: %v", o.desc, err)
+	}
+	send := o.send
+	// The rest of a message too long to send as one
+	var rest []*common.Message
+	if send == nil {
+		msgs := splitMessage(o.msg)
+		rest = msgs[1:]
+		send = func() (int, error) { return p.Tg.Send(o.chatID, o.parentMessageID, msgs[0]) }
+	}
+	messageID, err := send()
+	if err != nil {
+		if err := retry(ctxt, "mark "+o.desc+" pending", func() error { return o.setState(common.OutboxPending, 0) }); err != nil {
+			log.Println(err)
+		}
+		return -1, fmt.Errorf("failed to send %s: %v", o.desc, err)
+	}
+	// The other parts are recorded before the message is, so they're sent
+	// even if this is interrupted once the message is recorded.
+	parts := messageParts(o.chatID, messageID, rest)
+	if len(parts) > 0 {
+		err = retry(ctxt, fmt.Sprintf("record parts of message %d for %s", messageID, o.desc), func() error { return p.Storage.AddPendingMessageParts(parts) })
+		if err != nil {
+			return -1, err
+		}
+	}
+	err = retry(ctxt, fmt.Sprintf("record message %d for %s", messageID, o.desc), func() error { return o.setState(common.OutboxSent, messageID) })
+	if err != nil {
+		return -1, err
+	}
+	o.state, o.messageID = common.OutboxSent, messageID
+	// The message was delivered, so don't fail and have it sent again.
+	if err := p.sendParts(ctxt, parts); err != nil {
+		log.Printf("%v; leaving the rest for later", err)
+	}
+	return messageID, nil
+}
+
+// deliver sends the message for an outbox entry, unless it was already sent,
+// and records its message ID.
+func (p *Poller) deliver(ctxt context.Context, entry *common.OutboxEntry) (int, error) {
+	messageID, err := p.sendOnce(ctxt, &outboxMessage{
+		desc:            fmt.Sprintf("message for annotation %q", entry.AnnotID),
+		chatID:          entry.ChatID,
+		parentMessageID: entry.ParentMessageID,
+		msg:             &entry.Message,
+		state:           entry.State,
+		messageID:       entry.MessageID,
+		setState: func(state common.OutboxState, messageID int) error {
+			return p.Storage.SetOutboxState(entry.ID, state, messageID)
+		},
+	})
+	if err != nil {
+		return -1, err
+	}
+	entry.State, entry.MessageID = common.OutboxSent, messageID
+	if err := p.Storage.CompleteOutboxEntry(entry.ID); err != nil {
+		return -1, fmt.Errorf("failed to record message %d for annotation %q: %v", messageID, entry.AnnotID, err)
+	}
 	return messageID, nil
 }
 
+// Reconcile finishes delivering any messages left in the outbox, e.g. by a
+// crash, and sending any parts of long messages, creating any topics and
+// sending any notifications left behind.
+// Messages which were sent are recorded without sending them again.
+func (p *Poller) Reconcile(ctxt context.Context) error {
+	entries, err := p.Storage.PendingOutboxEntries()
+	if err != nil {
+		return fmt.Errorf("failed to get outbox entries: %v", err)
+	}
+	log.Printf("%d outbox entries to reconcile", len(entries))
+	var lastErr error
+	for _, entry := range entries {
+		if isDone(ctxt) {
+			return ctxt.Err()
+		}
+		log.Printf("Reconciling outbox entry %d for annotation %q in chat %d (%v)", entry.ID, entry.AnnotID, entry.ChatID, entry.State)
+		if _, err := p.deliver(ctxt, entry); err != nil {
+			log.Println(err)
+			lastErr = err
+		}
+	}
+	// Parts of long messages are sent in order, so the rest of a message
+	// waits for any part which can't be sent.
+	parts, err := p.Storage.PendingMessageParts()
+	if err != nil {
+		return fmt.Errorf("failed to get pending message parts: %v", err)
+	}
+	type message struct {
+		chatID    int64
+		messageID int
+	}
+	failed := make(map[message]bool)
+	for _, part := range parts {
+		if isDone(ctxt) {
+			return ctxt.Err()
+		}
+		primary := message{part.ChatID, part.PrimaryMessageID}
+		if failed[primary] {
+			continue
+		}
+		log.Printf("Reconciling part %d of message %d in chat %d (%v)", part.Index+1, part.PrimaryMessageID, part.ChatID, part.State)
+		if err := p.sendParts(ctxt, []*common.MessagePart{part}); err != nil {
+			log.Println(err)
+			failed[primary] = true
+			lastErr = err
+		}
+	}
+	// A topic left behind is created now, rather than when an annotation on
+	// its document is next posted.
+	topics, err := p.Storage.PendingTopics()
+	if err != nil {
+		return fmt.Errorf("failed to get pending topics: %v", err)
+	}
+	for _, t := range topics {
+		if isDone(ctxt) {
+			return ctxt.Err()
+		}
+		log.Printf("Reconciling topic for %q in chat %d (%v)", t.URI, t.ChatID, t.State)
+		if _, err := p.createTopic(ctxt, t); err != nil {
+			log.Println(err)
+			lastErr = err
+		}
+	}
+	// Annotations are only checked for notifications until they're posted,
+	// so notifications left behind are sent from here.
+	notifications, err := p.Storage.PendingNotifications()
+	if err != nil {
+		return fmt.Errorf("failed to get pending notifications: %v", err)
+	}
+	for _, n := range notifications {
+		if isDone(ctxt) {
+			return ctxt.Err()
+		}
+		log.Printf("Reconciling notification about %q to user %d (%v)", n.AnnotID, n.UserID, n.State)
+		if err := p.deliverNotification(ctxt, n); err != nil {
+			log.Println(err)
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
 func (p *Poller) RunOnce(ctxt context.Context) error {
 	subs, err := p.Storage.Subscriptions()
 	if err != nil {
@@ -145,6 +549,9 @@ func (p *Poller) RunOnce(ctxt context.Context) error {
 		for i, sub := range subs {
 			log.Printf("[%d/%d] ChatID=%d Group=%s", i+1, len(subs), sub.ChatID, sub.HypGroup)
 			err = p.handleSub(ctxt, sub)
+			if err == nil {
+				err = p.handleDigest(ctxt, sub)
+			}
 			if err != nil {
 				// Ignore but log error
 				log.Println(err)
@@ -155,16 +562,25 @@ func (p *Poller) RunOnce(ctxt context.Context) error {
 	}
 }
 
-// Only returns once the context is closed.
+// pollInterval is how long Run waits between polls.
+var pollInterval = time.Minute
+
+// Only returns once the context is closed. Messages left undelivered are
+// reconciled before every poll, not just the first, so one left behind by a
+// failed write isn't stuck until a restart.
 func (p *Poller) Run(ctxt context.Context) error {
 	for {
 		if isDone(ctxt) {
 			return ctxt.Err()
 		}
 
+		_ = p.Reconcile(ctxt)
 		_ = p.RunOnce(ctxt)
 
 		log.Println("Sleeping to poll Hypothesis again")
-		time.Sleep(1 * time.Minute)
+		select {
+		case <-ctxt.Done():
+		case <-time.After(pollInterval):
+		}
 	}
 }
@@ -2,7 +2,8 @@ package poller
 
 import (
 	"context"
-	"log"
+	"errors"
+	"strings"
 	"testing"
 	"time"
 
@@ -13,26 +14,6 @@ import (
 	"github.com/objectiveryan/irsal/internal/hyp"
 )
 
-type SentMessage struct {
-	ChatID          int64
-	MessageID       int
-	ParentMessageID int
-	Text            string
-}
-
-type FakeTg struct {
-	NextMessageID int
-	SentMessages  []*SentMessage
-}
-
-func (tg *FakeTg) Send(chatID int64, parentMessageID int, text string) (int, error) {
-	tg.NextMessageID++
-	log.Printf("Sending messageID=%d in chatID=%d with parent %d: %q", tg.NextMessageID, chatID, parentMessageID, text)
-	msg := &SentMessage{chatID, tg.NextMessageID, parentMessageID, text}
-	tg.SentMessages = append(tg.SentMessages, msg)
-	return msg.MessageID, nil
-}
-
 // func getSub(s common.Storage, sub *common.Subscription) *common.Subscription {
 // 	subs, err := s.Subscriptions()
 // 	if err != nil {
@@ -53,7 +34,7 @@ func TestHandleSub_NewAnnotation(t *testing.T) {
 	subTemplate := &common.Subscription{"ht", "grp", SEARCH_AFTER, CHAT_ID}
 	h := fake.NewHypFactory([]*hyp.Annotation{{ID: "a1", Group: "grp", Updated: hyp.ToTimestamp(LAST_UPDATED)}})
 	s := db.NewInMemoryStorage()
-	tg := &FakeTg{}
+	tg := &fake.Tg{}
 	p := &Poller{h, s, tg}
 	s.AddSubscription(subTemplate)
 	subs, err := s.Subscriptions()
@@ -93,7 +74,7 @@ func TestHandleSub_Reply(t *testing.T) {
 		{ID: "a2", Group: "grp", Updated: hyp.ToTimestamp(LAST_UPDATED2), Text: "Child", References: []string{"a1"}},
 	})
 	s := db.NewInMemoryStorage()
-	tg := &FakeTg{}
+	tg := &fake.Tg{}
 	p := &Poller{h, s, tg}
 	s.AddSubscription(subTemplate)
 	subs, err := s.Subscriptions()
@@ -138,7 +119,7 @@ func TestHandleSub_ReplyToUnposted(t *testing.T) {
 		{ID: "a2", Group: "grp", Updated: hyp.ToTimestamp(LAST_UPDATED2), Text: "Child", References: []string{"a1"}},
 	})
 	s := db.NewInMemoryStorage()
-	tg := &FakeTg{}
+	tg := &fake.Tg{}
 	p := &Poller{h, s, tg}
 	s.AddSubscription(subTemplate)
 	subs, err := s.Subscriptions()
@@ -183,3 +164,485 @@ func TestHandleSub_ReplyToUnposted(t *testing.T) {
 		t.Errorf("SentMessages[1].ParentMessageID=%v; expected %v", tg.SentMessages[1].ParentMessageID, tg.SentMessages[0].MessageID)
 	}
 }
+
+type FailingTg struct {
+	fake.Tg
+	Fail bool
+}
+
+func (tg *FailingTg) Send(chatID int64, parentMessageID int, msg *common.Message) (int, error) {
+	if tg.Fail {
+		return -1, errors.New("send failed")
+	}
+	return tg.Tg.Send(chatID, parentMessageID, msg)
+}
+
+func TestHandleSub_SendFailureIsRetried(t *testing.T) {
+	SEARCH_AFTER := time.Unix(1, 0)
+	LAST_UPDATED := time.Unix(2, 0)
+	const CHAT_ID = 42
+	h := fake.NewHypFactory([]*hyp.Annotation{{ID: "a1", Group: "grp", Updated: hyp.ToTimestamp(LAST_UPDATED)}})
+	s := db.NewInMemoryStorage()
+	tg := &FailingTg{Fail: true}
+	p := &Poller{h, s, tg}
+	s.AddSubscription(&common.Subscription{"ht", "grp", SEARCH_AFTER, CHAT_ID})
+
+	sub, _ := s.Subscription(CHAT_ID, "grp")
+	if err := p.handleSub(context.TODO(), sub); err != nil {
+		t.Fatalf("handleSub() returned err=%v", err)
+	}
+	entry, err := s.OutboxEntry("a1", CHAT_ID)
+	if err != nil {
+		t.Fatalf("OutboxEntry() returned err=%v", err)
+	}
+	if entry.State != common.OutboxPending {
+		t.Errorf("entry.State=%v; want %v", entry.State, common.OutboxPending)
+	}
+
+	tg.Fail = false
+	sub, _ = s.Subscription(CHAT_ID, "grp")
+	if err := p.handleSub(context.TODO(), sub); err != nil {
+		t.Fatalf("handleSub() returned err=%v", err)
+	}
+	if len(tg.SentMessages) != 1 {
+		t.Fatalf("len(SentMessages)=%d; expected 1", len(tg.SentMessages))
+	}
+	check.AnnotationMessage(t, s, "a1", common.AnnotationMetadata{HypGroup: "grp"}, CHAT_ID, tg.SentMessages[0].MessageID)
+	if _, err := s.OutboxEntry("a1", CHAT_ID); err != common.ErrNotFound {
+		t.Errorf("OutboxEntry() returned err=%v; want ErrNotFound", err)
+	}
+}
+
+func TestHandleSub_SentButNotRecorded(t *testing.T) {
+	SEARCH_AFTER := time.Unix(1, 0)
+	LAST_UPDATED := time.Unix(2, 0)
+	const CHAT_ID = 42
+	h := fake.NewHypFactory([]*hyp.Annotation{{ID: "a1", Group: "grp", Updated: hyp.ToTimestamp(LAST_UPDATED)}})
+	s := db.NewInMemoryStorage()
+	tg := &fake.Tg{}
+	p := &Poller{h, s, tg}
+	s.AddSubscription(&common.Subscription{"ht", "grp", SEARCH_AFTER, CHAT_ID})
+	// Simulate a crash after message 5 was sent but before it was recorded.
+	err := s.AddOutboxEntry(&common.OutboxEntry{AnnotID: "a1", Meta: common.AnnotationMetadata{HypGroup: "grp"}, ChatID: CHAT_ID, State: common.OutboxSent, MessageID: 5})
+	if err != nil {
+		t.Fatalf("AddOutboxEntry() returned err=%v", err)
+	}
+
+	sub, _ := s.Subscription(CHAT_ID, "grp")
+	if err := p.handleSub(context.TODO(), sub); err != nil {
+		t.Fatalf("handleSub() returned err=%v", err)
+	}
+	if len(tg.SentMessages) != 0 {
+		t.Errorf("len(SentMessages)=%d; expected 0", len(tg.SentMessages))
+	}
+	check.AnnotationMessage(t, s, "a1", common.AnnotationMetadata{HypGroup: "grp"}, CHAT_ID, 5)
+}
+
+// FlakyStorage fails to record that messages were sent a number of times.
+type FlakyStorage struct {
+	common.Storage
+	Failures int
+}
+
+func (s *FlakyStorage) SetOutboxState(id int64, state common.OutboxState, messageID int) error {
+	if state == common.OutboxSent && s.Failures > 0 {
+		s.Failures--
+		return errors.New("database is locked")
+	}
+	return s.Storage.SetOutboxState(id, state, messageID)
+}
+
+func TestHandleSub_RecordFailureIsRetried(t *testing.T) {
+	defer func(d time.Duration) { outboxRetryDelay = d }(outboxRetryDelay)
+	outboxRetryDelay = time.Millisecond
+	const CHAT_ID = 42
+	h := fake.NewHypFactory([]*hyp.Annotation{{ID: "a1", Group: "grp", Updated: hyp.ToTimestamp(time.Unix(2, 0))}})
+	s := &FlakyStorage{db.NewInMemoryStorage(), 3}
+	tg := &fake.Tg{}
+	p := &Poller{h, s, tg}
+	s.AddSubscription(&common.Subscription{"ht", "grp", time.Unix(1, 0), CHAT_ID})
+
+	for i := 0; i < 2; i++ {
+		sub, _ := s.Subscription(CHAT_ID, "grp")
+		if err := p.handleSub(context.TODO(), sub); err != nil {
+			t.Fatalf("handleSub() returned err=%v", err)
+		}
+	}
+	if len(tg.SentMessages) != 1 {
+		t.Fatalf("len(SentMessages)=%d; expected 1", len(tg.SentMessages))
+	}
+	check.AnnotationMessage(t, s, "a1", common.AnnotationMetadata{HypGroup: "grp"}, CHAT_ID, tg.SentMessages[0].MessageID)
+}
+
+func TestHandleSub_ReplyAfterMigration(t *testing.T) {
+	const OLD, NEW = -1, -1001
+	h := fake.NewHypFactory([]*hyp.Annotation{
+		{ID: "a1", Group: "grp", Updated: hyp.ToTimestamp(time.Unix(2, 0)), Text: "Parent"},
+	})
+	s := db.NewInMemoryStorage()
+	tg := &fake.Tg{}
+	p := &Poller{h, s, tg}
+	s.AddSubscription(&common.Subscription{"ht", "grp", time.Unix(1, 0), OLD})
+	subs, err := s.Subscriptions()
+	if err != nil {
+		t.Fatalf("Subscriptions() returned err=%v", err)
+	}
+	if err := p.handleSub(context.TODO(), subs[0]); err != nil {
+		t.Fatalf("handleSub() returned err=%v", err)
+	}
+	if len(tg.SentMessages) != 1 {
+		t.Fatalf("len(SentMessages)=%d; expected 1", len(tg.SentMessages))
+	}
+	oldMessageID := tg.SentMessages[0].MessageID
+
+	if err := s.MigrateChat(OLD, NEW); err != nil {
+		t.Fatalf("MigrateChat() returned err=%v", err)
+	}
+	h.Annots = append(h.Annots, &hyp.Annotation{ID: "a2", Group: "grp", Updated: hyp.ToTimestamp(time.Unix(3, 0)), Text: "Child", References: []string{"a1"}})
+	subs, err = s.Subscriptions()
+	if err != nil {
+		t.Fatalf("Subscriptions() returned err=%v", err)
+	}
+	if err := p.handleSub(context.TODO(), subs[0]); err != nil {
+		t.Fatalf("handleSub() returned err=%v", err)
+	}
+
+	// The reply went to the parent's message, which kept its ID in the new
+	// chat, without posting the parent again.
+	if len(tg.SentMessages) != 2 {
+		t.Fatalf("len(SentMessages)=%d; expected 2", len(tg.SentMessages))
+	}
+	reply := tg.SentMessages[1]
+	if reply.ChatID != NEW || reply.ParentMessageID != oldMessageID {
+		t.Errorf("SentMessages[1]=%+v; expected a reply to %d in chat %d", reply, oldMessageID, NEW)
+	}
+	check.AnnotationMessage(t, s, "a2", common.AnnotationMetadata{References: []string{"a1"}, HypGroup: "grp"}, NEW, reply.MessageID)
+}
+
+func TestReconcile(t *testing.T) {
+	const CHAT_ID = 42
+	s := db.NewInMemoryStorage()
+	tg := &fake.Tg{NextMessageID: 10}
+	p := &Poller{fake.NewHypFactory(nil), s, tg}
+	entries := []*common.OutboxEntry{
+		{AnnotID: "sent", Meta: common.AnnotationMetadata{HypGroup: "grp"}, ChatID: CHAT_ID, State: common.OutboxSent, MessageID: 5},
+		{AnnotID: "pending", Meta: common.AnnotationMetadata{HypGroup: "grp"}, ChatID: CHAT_ID, Message: common.Message{Text: "p"}, State: common.OutboxPending},
+		{AnnotID: "sending", Meta: common.AnnotationMetadata{HypGroup: "grp"}, ChatID: CHAT_ID, Message: common.Message{Text: "s"}, State: common.OutboxSending},
+	}
+	for _, e := range entries {
+		if err := s.AddOutboxEntry(e); err != nil {
+			t.Fatalf("AddOutboxEntry() returned err=%v", err)
+		}
+	}
+
+	if err := p.Reconcile(context.TODO()); err != nil {
+		t.Fatalf("Reconcile() returned err=%v", err)
+	}
+
+	// Only the entries which might not have been delivered were sent.
+	if len(tg.SentMessages) != 2 {
+		t.Fatalf("len(SentMessages)=%d; expected 2", len(tg.SentMessages))
+	}
+	check.AnnotationMessage(t, s, "sent", common.AnnotationMetadata{HypGroup: "grp"}, CHAT_ID, 5)
+	check.AnnotationMessage(t, s, "pending", common.AnnotationMetadata{HypGroup: "grp"}, CHAT_ID, tg.SentMessages[0].MessageID)
+	check.AnnotationMessage(t, s, "sending", common.AnnotationMetadata{HypGroup: "grp"}, CHAT_ID, tg.SentMessages[1].MessageID)
+	remaining, err := s.PendingOutboxEntries()
+	if err != nil {
+		t.Fatalf("PendingOutboxEntries() returned err=%v", err)
+	}
+	if len(remaining) != 0 {
+		t.Errorf("%d outbox entries remain; want 0", len(remaining))
+	}
+}
+
+// StuckStorage leaves an outbox entry sending after it's first asked for
+// them, as if recording what happened to it had failed, and stops the poller
+// the next time after that.
+type StuckStorage struct {
+	common.Storage
+	calls  int
+	cancel func()
+}
+
+func (s *StuckStorage) PendingOutboxEntries() ([]*common.OutboxEntry, error) {
+	s.calls++
+	entries, err := s.Storage.PendingOutboxEntries()
+	switch s.calls {
+	case 1:
+		err = s.AddOutboxEntry(&common.OutboxEntry{AnnotID: "a1", Meta: common.AnnotationMetadata{HypGroup: "grp"}, ChatID: 42, Message: common.Message{Text: "stuck"}, State: common.OutboxSending})
+	case 3:
+		s.cancel()
+	}
+	return entries, err
+}
+
+func TestRun_ReconcilesEachPoll(t *testing.T) {
+	defer func(d time.Duration) { pollInterval = d }(pollInterval)
+	pollInterval = time.Millisecond
+	ctxt, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s := &StuckStorage{Storage: db.NewInMemoryStorage(), cancel: cancel}
+	tg := &fake.Tg{}
+	p := &Poller{fake.NewHypFactory(nil), s, tg}
+
+	if err := p.Run(ctxt); err != context.Canceled {
+		t.Fatalf("Run() returned err=%v; want context.Canceled", err)
+	}
+	if len(tg.SentMessages) != 1 {
+		t.Fatalf("len(SentMessages)=%d; expected 1", len(tg.SentMessages))
+	}
+	check.AnnotationMessage(t, s, "a1", common.AnnotationMetadata{HypGroup: "grp"}, 42, tg.SentMessages[0].MessageID)
+}
+
+func TestHandleSub_Filtered(t *testing.T) {
+	SEARCH_AFTER := time.Unix(1, 0)
+	const CHAT_ID = 42
+	h := fake.NewHypFactory([]*hyp.Annotation{
+		{ID: "a1", Group: "grp", Updated: hyp.ToTimestamp(time.Unix(2, 0)), User: "acct:alice@hypothes.is"},
+		{ID: "a2", Group: "grp", Updated: hyp.ToTimestamp(time.Unix(3, 0)), User: "acct:bob@hypothes.is"},
+	})
+	s := db.NewInMemoryStorage()
+	tg := &fake.Tg{}
+	p := &Poller{h, s, tg}
+	sub := &common.Subscription{"ht", "grp", SEARCH_AFTER, CHAT_ID}
+	s.AddSubscription(sub)
+	if err := s.AddFilter(sub.Key(), &common.FilterRule{Exclude: true, Field: common.FilterUser, Pattern: "alice"}); err != nil {
+		t.Fatalf("AddFilter() returned err=%v", err)
+	}
+
+	if err := p.handleSub(context.TODO(), sub); err != nil {
+		t.Fatalf("handleSub() returned err=%v", err)
+	}
+
+	if len(tg.SentMessages) != 1 {
+		t.Fatalf("len(SentMessages)=%d; expected 1", len(tg.SentMessages))
+	}
+	check.AnnotationMessage(t, s, "a2", common.AnnotationMetadata{HypGroup: "grp"}, CHAT_ID, tg.SentMessages[0].MessageID)
+	check.NoAnnotationForMessage(t, s, CHAT_ID, 2)
+	// The filtered annotation isn't considered again.
+	if got, _ := s.Subscription(CHAT_ID, "grp"); got.SearchAfter != time.Unix(3, 0) {
+		t.Errorf("sub.SearchAfter=%v; expected %v", got.SearchAfter, time.Unix(3, 0))
+	}
+}
+
+func TestHandleSub_Topics(t *testing.T) {
+	const CHAT_ID = -42
+	h := fake.NewHypFactory([]*hyp.Annotation{
+		{ID: "a1", Group: "grp", Updated: hyp.ToTimestamp(time.Unix(2, 0)), URI: "https://a.test/", Document: &hyp.Document{Title: []string{"Page A"}}},
+		{ID: "a2", Group: "grp", Updated: hyp.ToTimestamp(time.Unix(3, 0)), URI: "https://b.test/"},
+		{ID: "a3", Group: "grp", Updated: hyp.ToTimestamp(time.Unix(4, 0)), URI: "https://a.test/", References: []string{"a1"}},
+	})
+	s := db.NewInMemoryStorage()
+	tg := &fake.Tg{}
+	p := &Poller{h, s, tg}
+	sub := &common.Subscription{"ht", "grp", time.Unix(1, 0), CHAT_ID}
+	s.AddSubscription(sub)
+	s.SetSubscriptionOption(sub.Key(), OptionTopics, "on")
+	subs, err := s.Subscriptions()
+	if err != nil {
+		t.Fatalf("Subscriptions() returned err=%v", err)
+	}
+
+	if err := p.handleSub(context.TODO(), subs[0]); err != nil {
+		t.Fatalf("handleSub() returned err=%v", err)
+	}
+	if len(tg.Topics) != 2 {
+		t.Fatalf("Created topics %v; want 2", tg.Topics)
+	}
+	a, err := s.Topic(CHAT_ID, "https://a.test/")
+	if err != nil {
+		t.Fatalf("Topic() returned err=%v", err)
+	}
+	topicA := a.ThreadID
+	if tg.Topics[topicA] != "Page A" {
+		t.Errorf("Topic for https://a.test/ is named %q; want \"Page A\"", tg.Topics[topicA])
+	}
+	b, err := s.Topic(CHAT_ID, "https://b.test/")
+	if err != nil {
+		t.Fatalf("Topic() returned err=%v", err)
+	}
+	topicB := b.ThreadID
+	if tg.Topics[topicB] != "https://b.test/" {
+		t.Errorf("Topic for https://b.test/ is named %q; want \"https://b.test/\"", tg.Topics[topicB])
+	}
+	if len(tg.SentMessages) != 3 {
+		t.Fatalf("len(SentMessages)=%d; expected 3", len(tg.SentMessages))
+	}
+	for i, want := range []int{topicA, topicB, topicA} {
+		if got := tg.SentMessages[i].ThreadID; got != want {
+			t.Errorf("Message %d sent in topic %d; want %d", i, got, want)
+		}
+	}
+}
+
+// FlakyTopicStorage fails to record that topics were created a number of
+// times.
+type FlakyTopicStorage struct {
+	common.Storage
+	Failures int
+}
+
+func (s *FlakyTopicStorage) SetTopic(t *common.Topic) error {
+	if t.State == common.OutboxSent && s.Failures > 0 {
+		s.Failures--
+		return errors.New("database is locked")
+	}
+	return s.Storage.SetTopic(t)
+}
+
+func TestHandleSub_TopicRecordFailureIsRetried(t *testing.T) {
+	defer func(d time.Duration) { outboxRetryDelay = d }(outboxRetryDelay)
+	outboxRetryDelay = time.Millisecond
+	const CHAT_ID = -42
+	h := fake.NewHypFactory([]*hyp.Annotation{
+		{ID: "a1", Group: "grp", Updated: hyp.ToTimestamp(time.Unix(2, 0)), URI: "https://a.test/"},
+	})
+	s := &FlakyTopicStorage{db.NewInMemoryStorage(), 2}
+	tg := &fake.Tg{}
+	p := &Poller{h, s, tg}
+	sub := &common.Subscription{"ht", "grp", time.Unix(1, 0), CHAT_ID}
+	s.AddSubscription(sub)
+	s.SetSubscriptionOption(sub.Key(), OptionTopics, "on")
+
+	for i := 0; i < 2; i++ {
+		sub, _ := s.Subscription(CHAT_ID, "grp")
+		if err := p.handleSub(context.TODO(), sub); err != nil {
+			t.Fatalf("handleSub() returned err=%v", err)
+		}
+	}
+	if len(tg.Topics) != 1 {
+		t.Fatalf("Created topics %v; want 1", tg.Topics)
+	}
+	topic, err := s.Topic(CHAT_ID, "https://a.test/")
+	if err != nil {
+		t.Fatalf("Topic() returned err=%v", err)
+	}
+	if len(tg.SentMessages) != 1 || tg.SentMessages[0].ThreadID != topic.ThreadID {
+		t.Errorf("SentMessages=%+v; want one message in topic %d", tg.SentMessages, topic.ThreadID)
+	}
+}
+
+func TestReconcile_Topics(t *testing.T) {
+	s := db.NewInMemoryStorage()
+	tg := &fake.Tg{}
+	p := &Poller{fake.NewHypFactory(nil), s, tg}
+	for _, topic := range []*common.Topic{
+		{ChatID: -42, URI: "https://a.test/", Name: "Page A", State: common.OutboxSending},
+		{ChatID: -42, URI: "https://b.test/", Name: "Page B", ThreadID: 5, State: common.OutboxSent},
+	} {
+		if err := s.SetTopic(topic); err != nil {
+			t.Fatalf("SetTopic() returned err=%v", err)
+		}
+	}
+
+	if err := p.Reconcile(context.TODO()); err != nil {
+		t.Fatalf("Reconcile() returned err=%v", err)
+	}
+	if len(tg.Topics) != 1 {
+		t.Fatalf("Created topics %v; want 1", tg.Topics)
+	}
+	got, err := s.Topic(-42, "https://a.test/")
+	if err != nil || got.State != common.OutboxSent || tg.Topics[got.ThreadID] != "Page A" {
+		t.Errorf("Topic() returned %+v, err=%v; want it created", got, err)
+	}
+}
+
+func TestHandleSub_LinkedUser(t *testing.T) {
+	const CHAT_ID = 42
+	h := fake.NewHypFactory([]*hyp.Annotation{
+		{ID: "a1", Group: "grp", User: "acct:alice@hypothes.is", Updated: hyp.ToTimestamp(time.Unix(2, 0))},
+		{ID: "a2", Group: "grp", User: "acct:bob@hypothes.is", Updated: hyp.ToTimestamp(time.Unix(3, 0))},
+	})
+	s := db.NewInMemoryStorage()
+	tg := &fake.Tg{}
+	p := &Poller{h, s, tg}
+	sub := &common.Subscription{"ht", "grp", time.Unix(1, 0), CHAT_ID}
+	s.AddSubscription(sub)
+	s.SetUserLink(&common.UserLink{HypUser: "acct:alice@hypothes.is", UserID: 7, Name: "Alice <A>"})
+
+	if err := p.handleSub(context.TODO(), sub); err != nil {
+		t.Fatalf("handleSub() returned err=%v", err)
+	}
+	if len(tg.SentMessages) != 2 {
+		t.Fatalf("len(SentMessages)=%d; expected 2", len(tg.SentMessages))
+	}
+	if got, want := tg.SentMessages[0].Text, `<b><a href="tg://user?id=7">Alice &lt;A&gt;</a></b>`; !strings.HasPrefix(got, want) {
+		t.Errorf("Message for linked user's annotation is %q; want prefix %q", got, want)
+	}
+	if got, want := tg.SentMessages[1].Text, "<b>bob</b>"; !strings.HasPrefix(got, want) {
+		t.Errorf("Message for unlinked user's annotation is %q; want prefix %q", got, want)
+	}
+}
+
+func TestHandleSub_PostedFromChat(t *testing.T) {
+	h := fake.NewHypFactory([]*hyp.Annotation{
+		{ID: "a1", Group: "grp", User: "acct:bot@hypothes.is", Text: `Alice wrote "*hi*"`, Updated: hyp.ToTimestamp(time.Unix(2, 0))},
+	})
+	s := db.NewInMemoryStorage()
+	tg := &fake.Tg{}
+	p := &Poller{h, s, tg}
+	origin := &common.Subscription{"ht", "grp", time.Unix(1, 0), 1}
+	other := &common.Subscription{"ht", "grp", time.Unix(1, 0), 2}
+	s.AddSubscription(origin)
+	s.AddSubscription(other)
+	// Recording the annotation's message in chat 1 failed, but its origin
+	// was recorded.
+	s.AddAnnotationOrigin(&common.AnnotationOrigin{AnnotID: "a1", ChatID: 1, MessageID: 5, UserID: 7, Name: "Alice", Text: `Alice wrote "*hi*"`, Body: "*hi*"})
+
+	for _, sub := range []*common.Subscription{origin, other} {
+		if err := p.handleSub(context.TODO(), sub); err != nil {
+			t.Fatalf("handleSub() returned err=%v", err)
+		}
+	}
+	if len(tg.SentMessages) != 1 {
+		t.Fatalf("len(SentMessages)=%d; expected 1", len(tg.SentMessages))
+	}
+	if got, want := tg.SentMessages[0], "<b>Alice</b>\n<i>hi</i>"; got.ChatID != 2 || !strings.HasPrefix(got.Text, want) {
+		t.Errorf("Sent %q in chat %d; want prefix %q in chat 2", got.Text, got.ChatID, want)
+	}
+	check.AnnotationMessage(t, s, "a1", common.AnnotationMetadata{HypGroup: "grp"}, 1, 5)
+}
+
+func TestHandleSub_FromDiscussionGroup(t *testing.T) {
+	const CHANNEL_ID, GROUP_ID = -100, -200
+	h := fake.NewHypFactory([]*hyp.Annotation{
+		{ID: "a1", Group: "grp", User: "acct:bot@hypothes.is", Text: "Comment", References: []string{"a0"}, Updated: hyp.ToTimestamp(time.Unix(2, 0))},
+		{ID: "a2", Group: "grp", User: "acct:bob@hypothes.is", Text: "Reply to comment", References: []string{"a0", "a1"}, Updated: hyp.ToTimestamp(time.Unix(3, 0))},
+	})
+	s := db.NewInMemoryStorage()
+	tg := &fake.Tg{NextMessageID: 10}
+	p := &Poller{h, s, tg}
+	sub := &common.Subscription{"ht", "grp", time.Unix(1, 0), CHANNEL_ID}
+	s.AddSubscription(sub)
+	s.SetMessageID("a0", common.AnnotationMetadata{HypGroup: "grp"}, CHANNEL_ID, 5)
+	// a1 was posted from a comment in the channel's discussion group.
+	s.SetLinkedChannel(GROUP_ID, CHANNEL_ID)
+	s.AddAnnotationOrigin(&common.AnnotationOrigin{AnnotID: "a1", ChatID: GROUP_ID, MessageID: 8, UserID: 7, Name: "Alice", Text: "Comment", Body: "Comment"})
+
+	if err := p.handleSub(context.TODO(), sub); err != nil {
+		t.Fatalf("handleSub() returned err=%v", err)
+	}
+	if len(tg.SentMessages) != 1 {
+		t.Fatalf("len(SentMessages)=%d; expected 1", len(tg.SentMessages))
+	}
+	if got := tg.SentMessages[0]; got.ChatID != CHANNEL_ID || got.ParentMessageID != 5 || !strings.Contains(got.Text, "Reply to comment") {
+		t.Errorf("Sent %q in chat %d replying to %d; want a2 in the channel replying to a0's message 5", got.Text, got.ChatID, got.ParentMessageID)
+	}
+	// a1 is recorded as its comment, so replies to it in the group are bridged.
+	check.AnnotationMessage(t, s, "a1", common.AnnotationMetadata{References: []string{"a0"}, HypGroup: "grp"}, GROUP_ID, 8)
+
+	// A later reply to a1 finds what to reply to without looking a1 up again.
+	h.Annots = append(h.Annots, &hyp.Annotation{ID: "a3", Group: "grp", User: "acct:bob@hypothes.is", Text: "Another reply", References: []string{"a0", "a1"}, Updated: hyp.ToTimestamp(time.Unix(4, 0))})
+	counting := &countingHyp{ClientFactory: h}
+	p.Hyp = counting
+	sub, _ = s.Subscription(CHANNEL_ID, "grp")
+	if err := p.handleSub(context.TODO(), sub); err != nil {
+		t.Fatalf("handleSub() returned err=%v", err)
+	}
+	if len(tg.SentMessages) != 2 || tg.SentMessages[1].ParentMessageID != 5 {
+		t.Fatalf("SentMessages=%+v; want a3 replying to a0's message 5", tg.SentMessages)
+	}
+	if counting.lookups != 0 {
+		t.Errorf("Looked up %d annotations; want none", counting.lookups)
+	}
+}
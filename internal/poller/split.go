@@ -0,0 +1,82 @@
+package poller
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/objectiveryan/irsal/internal/common"
+	"github.com/objectiveryan/irsal/internal/markup"
+)
+
+// maxMessageLength is Telegram's limit on the length of a message's text,
+// after any HTML has been parsed.
+const maxMessageLength = 4096
+
+// splitMessage divides msg into messages which are short enough to send.
+func splitMessage(msg *common.Message) []*common.Message {
+	var parts []markup.Part
+	if msg.HTML {
+		text, ents := markup.FromHTML(msg.Text)
+		parts = markup.Split(text, ents, maxMessageLength)
+	} else {
+		parts = markup.Split(msg.Text, nil, maxMessageLength)
+	}
+	if len(parts) == 1 {
+		return []*common.Message{msg}
+	}
+	var msgs []*common.Message
+	for i, part := range parts {
+		m := *msg
+		// Buttons go under the last part.
+		if i < len(parts)-1 {
+			m.Buttons = nil
+		}
+		m.Text = part.Text
+		if msg.HTML {
+			m.Text = markup.ToHTML(part.Text, part.Entities)
+		}
+		msgs = append(msgs, &m)
+	}
+	return msgs
+}
+
+// messageParts are the parts of a message which continue the message sent
+// as primaryMessageID.
+func messageParts(chatID int64, primaryMessageID int, msgs []*common.Message) []*common.MessagePart {
+	var parts []*common.MessagePart
+	for i, m := range msgs {
+		parts = append(parts, &common.MessagePart{
+			ChatID:           chatID,
+			PrimaryMessageID: primaryMessageID,
+			Index:            i + 1,
+			Message:          *m,
+			State:            common.OutboxPending,
+		})
+	}
+	return parts
+}
+
+// sendParts sends the parts continuing a message, in order. A part which
+// can't be sent is left for Reconcile, along with the parts after it.
+func (p *Poller) sendParts(ctxt context.Context, parts []*common.MessagePart) error {
+	for _, part := range parts {
+		_, err := p.sendOnce(ctxt, &outboxMessage{
+			desc:   fmt.Sprintf("part %d of message %d", part.Index+1, part.PrimaryMessageID),
+			chatID: part.ChatID,
+			msg:    &part.Message,
+			send:   func() (int, error) { return p.Tg.Send(part.ChatID, 0, &part.Message) },
+			state:  part.State,
+			setState: func(state common.OutboxState, messageID int) error {
+				part.State = state
+				if state == common.OutboxSent {
+					return p.Storage.CompleteMessagePart(part, messageID)
+				}
+				return p.Storage.SetMessagePartState(part)
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
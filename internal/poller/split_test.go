@@ -0,0 +1,133 @@
+package poller
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/objectiveryan/irsal/internal/common"
+	"github.com/objectiveryan/irsal/internal/db"
+	"github.com/objectiveryan/irsal/internal/fake"
+	"github.com/objectiveryan/irsal/internal/hyp"
+	"github.com/objectiveryan/irsal/internal/markup"
+)
+
+func TestSplitMessage(t *testing.T) {
+	short := &common.Message{Text: "<b>short</b>", HTML: true}
+	if got := splitMessage(short); len(got) != 1 || got[0] != short {
+		t.Errorf("splitMessage() split a short message into %+v", got)
+	}
+
+	// Escaping and tags don't count towards the limit.
+	escaped := &common.Message{Text: "<b>" + strings.Repeat("&lt;", maxMessageLength) + "</b>", HTML: true}
+	if got := splitMessage(escaped); len(got) != 1 {
+		t.Errorf("splitMessage() split a message with %d characters into %d", maxMessageLength, len(got))
+	}
+
+	buttons := []common.Button{{Text: "Show thread", Action: common.ActionThread}}
+	long := &common.Message{Text: "<b>" + strings.Repeat("word ", maxMessageLength/2) + "</b>", HTML: true, NoPreview: true, Buttons: buttons}
+	got := splitMessage(long)
+	if len(got) != 3 {
+		t.Fatalf("splitMessage() returned %d messages; want 3", len(got))
+	}
+	for i, m := range got {
+		text, _ := markup.FromHTML(m.Text)
+		if markup.Length(text) > maxMessageLength {
+			t.Errorf("Part %d has %d characters", i, markup.Length(text))
+		}
+		if !strings.HasPrefix(m.Text, "<b>") || !strings.HasSuffix(m.Text, "</b>") || !m.HTML || !m.NoPreview {
+			t.Errorf("Part %d is %+v; want bold HTML without preview", i, m)
+		}
+		if hasButtons := len(m.Buttons) > 0; hasButtons != (i == len(got)-1) {
+			t.Errorf("Part %d has buttons %v; want them only under the last part", i, m.Buttons)
+		}
+	}
+}
+
+func TestHandleSub_LongAnnotation(t *testing.T) {
+	const CHAT_ID = 42
+	h := fake.NewHypFactory([]*hyp.Annotation{
+		{ID: "a1", Group: "grp", Updated: hyp.ToTimestamp(time.Unix(2, 0)), Text: strings.Repeat("Lorem ipsum. ", 500)},
+	})
+	s := db.NewInMemoryStorage()
+	tg := &fake.Tg{}
+	p := &Poller{h, s, tg}
+	s.AddSubscription(&common.Subscription{"ht", "grp", time.Unix(1, 0), CHAT_ID})
+	subs, err := s.Subscriptions()
+	if err != nil {
+		t.Fatalf("Subscriptions() returned err=%v", err)
+	}
+
+	if err := p.handleSub(context.TODO(), subs[0]); err != nil {
+		t.Fatalf("handleSub() returned err=%v", err)
+	}
+	if len(tg.SentMessages) != 2 {
+		t.Fatalf("len(SentMessages)=%d; expected 2", len(tg.SentMessages))
+	}
+	primary := tg.SentMessages[0].MessageID
+	if messageID, err := s.MessageID("a1", CHAT_ID); err != nil || messageID != primary {
+		t.Errorf("MessageID() returned %d, err=%v; want %d", messageID, err, primary)
+	}
+	// Replies to either part refer to the annotation.
+	for _, m := range tg.SentMessages {
+		if annotID, _, err := s.AnnotationID(CHAT_ID, m.MessageID); err != nil || annotID != "a1" {
+			t.Errorf("AnnotationID(%d) returned %q, err=%v; want \"a1\"", m.MessageID, annotID, err)
+		}
+	}
+}
+
+// LimitedTg fails to send messages once it has sent Limit of them.
+type LimitedTg struct {
+	fake.Tg
+	Limit int
+}
+
+func (tg *LimitedTg) Send(chatID int64, parentMessageID int, msg *common.Message) (int, error) {
+	if len(tg.SentMessages) >= tg.Limit {
+		return -1, errors.New("send failed")
+	}
+	return tg.Tg.Send(chatID, parentMessageID, msg)
+}
+
+func TestHandleSub_LongAnnotationPartFailure(t *testing.T) {
+	const CHAT_ID = 42
+	h := fake.NewHypFactory([]*hyp.Annotation{
+		{ID: "a1", Group: "grp", Updated: hyp.ToTimestamp(time.Unix(2, 0)), Text: strings.Repeat("Lorem ipsum. ", 500)},
+	})
+	s := db.NewInMemoryStorage()
+	tg := &LimitedTg{Limit: 1}
+	p := &Poller{h, s, tg}
+	s.AddSubscription(&common.Subscription{"ht", "grp", time.Unix(1, 0), CHAT_ID})
+	subs, err := s.Subscriptions()
+	if err != nil {
+		t.Fatalf("Subscriptions() returned err=%v", err)
+	}
+
+	if err := p.handleSub(context.TODO(), subs[0]); err != nil {
+		t.Fatalf("handleSub() returned err=%v", err)
+	}
+	// The annotation was posted, and the rest of it is left to send later.
+	primary := tg.SentMessages[0].MessageID
+	if messageID, err := s.MessageID("a1", CHAT_ID); err != nil || messageID != primary {
+		t.Errorf("MessageID() returned %d, err=%v; want %d", messageID, err, primary)
+	}
+	if parts, err := s.PendingMessageParts(); err != nil || len(parts) != 1 {
+		t.Fatalf("PendingMessageParts() returned %d, err=%v; want 1", len(parts), err)
+	}
+
+	tg.Limit = 2
+	if err := p.Reconcile(context.TODO()); err != nil {
+		t.Fatalf("Reconcile() returned err=%v", err)
+	}
+	if len(tg.SentMessages) != 2 {
+		t.Fatalf("len(SentMessages)=%d; expected 2", len(tg.SentMessages))
+	}
+	if annotID, _, err := s.AnnotationID(CHAT_ID, tg.SentMessages[1].MessageID); err != nil || annotID != "a1" {
+		t.Errorf("AnnotationID() of second part returned %q, err=%v; want \"a1\"", annotID, err)
+	}
+	if parts, err := s.PendingMessageParts(); err != nil || len(parts) != 0 {
+		t.Errorf("PendingMessageParts() returned %d, err=%v; want none", len(parts), err)
+	}
+}
@@ -0,0 +1,75 @@
+package poller
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// TagRules say how Hypothesis tags and Telegram hashtags correspond.
+type TagRules struct {
+	// Tags are lowercase
+	Lower bool
+	// Underscores in hashtags are spaces in tags
+	Spaces bool
+}
+
+// parseTagRules parses a comma-separated list of rules: "lower" and
+// "spaces".
+func parseTagRules(value string) (TagRules, error) {
+	var r TagRules
+	for _, rule := range strings.Split(value, ",") {
+		switch strings.TrimSpace(rule) {
+		case "lower":
+			r.Lower = true
+		case "spaces":
+			r.Spaces = true
+		case "":
+		default:
+			return TagRules{}, fmt.Errorf("unknown tag rule %q; want \"lower\" or \"spaces\"", rule)
+		}
+	}
+	return r, nil
+}
+
+// Hashtag returns the hashtag for a tag, or the empty string if it has no
+// letters or digits. Hashtags can only contain letters, digits and
+// underscores, so other characters become underscores.
+func (r TagRules) Hashtag(tag string) string {
+	if r.Lower {
+		tag = strings.ToLower(tag)
+	}
+	words := strings.FieldsFunc(tag, func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+	})
+	if len(words) == 0 {
+		return ""
+	}
+	return "#" + strings.Join(words, "_")
+}
+
+// Hashtags returns the distinct hashtags for tags.
+func (r TagRules) Hashtags(tags []string) []string {
+	var hashtags []string
+	seen := make(map[string]bool)
+	for _, tag := range tags {
+		h := r.Hashtag(tag)
+		if h != "" && !seen[h] {
+			seen[h] = true
+			hashtags = append(hashtags, h)
+		}
+	}
+	return hashtags
+}
+
+// Tag returns the tag for a hashtag.
+func (r TagRules) Tag(hashtag string) string {
+	tag := strings.TrimPrefix(hashtag, "#")
+	if r.Spaces {
+		tag = strings.TrimSpace(strings.ReplaceAll(tag, "_", " "))
+	}
+	if r.Lower {
+		tag = strings.ToLower(tag)
+	}
+	return tag
+}
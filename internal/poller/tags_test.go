@@ -0,0 +1,63 @@
+package poller
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/objectiveryan/irsal/internal/hyp"
+)
+
+func TestParseTagRules(t *testing.T) {
+	for _, tt := range []struct {
+		value string
+		want  TagRules
+		ok    bool
+	}{
+		{"", TagRules{}, true},
+		{"lower", TagRules{Lower: true}, true},
+		{"spaces, lower", TagRules{Lower: true, Spaces: true}, true},
+		{"upper", TagRules{}, false},
+	} {
+		got, err := parseTagRules(tt.value)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseTagRules(%q) returned %+v, err=%v; want %+v, ok=%v", tt.value, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestTagRules(t *testing.T) {
+	tags := []string{"Climate change", "climate-change", "C++", "日本語", "!!"}
+	if got, want := (TagRules{}).Hashtags(tags), []string{"#Climate_change", "#climate_change", "#C", "#日本語"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Hashtags()=%q; want %q", got, want)
+	}
+	if got, want := (TagRules{Lower: true}).Hashtags(tags), []string{"#climate_change", "#c", "#日本語"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Hashtags() with lower=%q; want %q", got, want)
+	}
+
+	for _, tt := range []struct {
+		rules   TagRules
+		hashtag string
+		want    string
+	}{
+		{TagRules{}, "#Climate_Change", "Climate_Change"},
+		{TagRules{Lower: true}, "#Climate_Change", "climate_change"},
+		{TagRules{Spaces: true}, "#Climate_Change", "Climate Change"},
+		{TagRules{Lower: true, Spaces: true}, "#Climate_Change", "climate change"},
+	} {
+		if got := tt.rules.Tag(tt.hashtag); got != tt.want {
+			t.Errorf("%+v.Tag(%q)=%q; want %q", tt.rules, tt.hashtag, got, tt.want)
+		}
+	}
+}
+
+func TestDefaultTemplateHashtags(t *testing.T) {
+	annot := &hyp.Annotation{ID: "a1", User: "acct:alice@hypothes.is", Text: "text", Tags: []string{"climate change", "policy"}}
+	text, err := Render(ParseOptions(nil).RootTemplate, NewAnnotationData(annot))
+	if err != nil {
+		t.Fatalf("Render() returned err=%v", err)
+	}
+	if !strings.Contains(text, "text\n#climate_change #policy\n<a") {
+		t.Errorf("Render()=%q; want it to show the tags as hashtags", text)
+	}
+}
@@ -0,0 +1,99 @@
+package tbot
+
+import (
+	"fmt"
+
+	tele "gopkg.in/telebot.v3"
+
+	"github.com/objectiveryan/irsal/internal/common"
+)
+
+// replyMarkup shows buttons under a message: links in one row, and actions
+// in the next.
+func replyMarkup(buttons []common.Button) *tele.ReplyMarkup {
+	if len(buttons) == 0 {
+		return nil
+	}
+	m := &tele.ReplyMarkup{}
+	var links, actions []tele.Btn
+	for _, b := range buttons {
+		if b.URL != "" {
+			links = append(links, m.URL(b.Text, b.URL))
+		} else {
+			actions = append(actions, m.Data(b.Text, b.Action))
+		}
+	}
+	var rows []tele.Row
+	for _, row := range [][]tele.Btn{links, actions} {
+		if len(row) > 0 {
+			rows = append(rows, row)
+		}
+	}
+	m.Inline(rows...)
+	return m
+}
+
+// toggleMute mutes notifications to a user about the thread of an
+// annotation's message, or unmutes them if they were muted.
+func (tb *Bot) toggleMute(userID, chatID int64, messageID int) (string, error) {
+	annotID, meta, err := tb.Storage.AnnotationID(chatID, messageID)
+	if err == common.ErrNotFound {
+		return "This message isn't about an annotation.", nil
+	} else if err != nil {
+		return "", fmt.Errorf("failed to look up annotation: %v", err)
+	}
+	rootID := annotID
+	if len(meta.References) > 0 {
+		rootID = meta.References[0]
+	}
+	muted, err := tb.Storage.ThreadMuted(userID, rootID)
+	if err != nil {
+		return "", fmt.Errorf("failed to look up whether thread is muted: %v", err)
+	}
+	if muted {
+		if err := tb.Storage.UnmuteThread(userID, rootID); err != nil {
+			return "", fmt.Errorf("failed to unmute thread: %v", err)
+		}
+		return "You'll be notified about this thread again.", nil
+	}
+	if err := tb.Storage.MuteThread(userID, rootID); err != nil {
+		return "", fmt.Errorf("failed to mute thread: %v", err)
+	}
+	return "You won't be notified about this thread. Press Mute thread again to undo.", nil
+}
+
+func (r *BotRunner) onMuteButton(c tele.Context) error {
+	msg := c.Callback().Message
+	if msg == nil {
+		return c.Respond()
+	}
+	text, err := r.b.toggleMute(c.Sender().ID, msg.Chat.ID, msg.ID)
+	if err != nil {
+		return err
+	}
+	return c.Respond(&tele.CallbackResponse{Text: text})
+}
+
+// onThreadButton posts the thread of the message the button is under, as
+// if its presser had replied to it with /thread.
+func (r *BotRunner) onThreadButton(c tele.Context) error {
+	msg := c.Callback().Message
+	if msg == nil {
+		return c.Respond()
+	}
+	cmd := &tele.Message{
+		Chat:         msg.Chat,
+		Sender:       c.Sender(),
+		ReplyTo:      msg,
+		ThreadID:     msg.ThreadID,
+		TopicMessage: msg.TopicMessage,
+	}
+	reply, err := r.sendThread(cmd)
+	if err != nil {
+		return err
+	}
+	if reply == "" {
+		return c.Respond()
+	}
+	return c.Respond(&tele.CallbackResponse{Text: reply})
+}
@@ -0,0 +1,55 @@
+package tbot
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/objectiveryan/irsal/internal/common"
+	"github.com/objectiveryan/irsal/internal/db"
+)
+
+func TestReplyMarkup(t *testing.T) {
+	if m := replyMarkup(nil); m != nil {
+		t.Errorf("replyMarkup(nil)=%v; want nil", m)
+	}
+	m := replyMarkup([]common.Button{
+		{Text: "Open in context", URL: "https://hyp.is/a1"},
+		{Text: "Mute thread", Action: common.ActionMute},
+		{Text: "Open document", URL: "https://example.test"},
+	})
+	var got [][]string
+	for _, row := range m.InlineKeyboard {
+		var texts []string
+		for _, b := range row {
+			texts = append(texts, b.Text+"="+b.URL+b.Unique)
+		}
+		got = append(got, texts)
+	}
+	want := [][]string{
+		{"Open in context=https://hyp.is/a1", "Open document=https://example.test"},
+		{"Mute thread=mute"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("replyMarkup() has buttons %q; want %q", got, want)
+	}
+}
+
+func TestToggleMute(t *testing.T) {
+	const CHAT_ID = -1
+	s := db.NewInMemoryStorage()
+	s.SetMessageID("a2", common.AnnotationMetadata{References: []string{"a1"}}, CHAT_ID, 10)
+	tb := &Bot{Token: "token", Storage: s}
+
+	if reply, err := tb.toggleMute(7, CHAT_ID, 11); err != nil || !strings.Contains(reply, "isn't about an annotation") {
+		t.Errorf("toggleMute() for an unknown message returned %q, err=%v", reply, err)
+	}
+	for _, want := range []bool{true, false} {
+		if _, err := tb.toggleMute(7, CHAT_ID, 10); err != nil {
+			t.Fatalf("toggleMute() returned err=%v", err)
+		}
+		if muted, err := s.ThreadMuted(7, "a1"); err != nil || muted != want {
+			t.Errorf("ThreadMuted() returned %v, err=%v; want %v", muted, err, want)
+		}
+	}
+}
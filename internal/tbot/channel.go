@@ -0,0 +1,72 @@
+package tbot
+
+import (
+	"context"
+	"fmt"
+	"log"
+
+	tele "gopkg.in/telebot.v3"
+
+	"github.com/objectiveryan/irsal/internal/common"
+)
+
+// forwardedPost returns the channel post a message was forwarded from.
+func forwardedPost(msg *tele.Message) (channelID int64, messageID int, ok bool) {
+	if o := msg.Origin; o != nil && o.Chat != nil {
+		return o.Chat.ID, o.MessageID, true
+	}
+	if msg.OriginalChat != nil {
+		return msg.OriginalChat.ID, msg.OriginalMessageID, true
+	}
+	return 0, 0, false
+}
+
+// recordForward handles a channel post which Telegram forwarded to the
+// channel's discussion group. It records that the group discusses the
+// channel and, if the post is about an annotation, that the forwarded copy
+// is too, so comments on it are posted as replies.
+func (tb *Bot) recordForward(msg *tele.Message) error {
+	channelID, postID, ok := forwardedPost(msg)
+	if !ok {
+		log.Println("Ignoring automatic forward with no origin")
+		return nil
+	}
+	if err := tb.Storage.SetLinkedChannel(msg.Chat.ID, channelID); err != nil {
+		return fmt.Errorf("failed to record discussion group of channel %d: %v", channelID, err)
+	}
+	annotID, meta, err := tb.Storage.AnnotationID(channelID, postID)
+	if err == common.ErrNotFound {
+		log.Println("Ignoring forward of non-annotation post")
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed to look up annotation for post: %v", err)
+	}
+	if err := tb.Storage.SetMessageID(annotID, meta, msg.Chat.ID, msg.ID); err != nil {
+		return fmt.Errorf("failed to record forward of annotation %q: %v", annotID, err)
+	}
+	return nil
+}
+
+// replySubscription finds the subscription replies in a chat are posted
+// with: the chat's own, or that of the channel whose discussion group it is.
+func (tb *Bot) replySubscription(chatID int64, group string) (*common.Subscription, error) {
+	sub, err := tb.Storage.Subscription(chatID, group)
+	if err != common.ErrNotFound {
+		return sub, err
+	}
+	channelID, err := tb.Storage.LinkedChannel(chatID)
+	if err != nil {
+		return nil, err
+	}
+	return tb.Storage.Subscription(channelID, group)
+}
+
+// onChannelPost posts replies which administrators make in a channel, which
+// Telegram doesn't handle as ordinary messages.
+func (r *BotRunner) onChannelPost(c tele.Context) error {
+	msg := c.Message()
+	if msg == nil || msg.Text != "" {
+		return r.b.onText(msg)
+	}
+	return r.b.onMedia(context.TODO(), msg, r.tb.File)
+}
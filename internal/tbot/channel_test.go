@@ -0,0 +1,97 @@
+package tbot
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	tele "gopkg.in/telebot.v3"
+
+	"github.com/objectiveryan/irsal/internal/check"
+	"github.com/objectiveryan/irsal/internal/common"
+	"github.com/objectiveryan/irsal/internal/db"
+	"github.com/objectiveryan/irsal/internal/fake"
+)
+
+func TestOnText_DiscussionGroup(t *testing.T) {
+	const CHANNEL_ID, GROUP_ID = -100, -200
+	s := db.NewInMemoryStorage()
+	s.AddSubscription(&common.Subscription{"ht", "g", time.Now(), CHANNEL_ID})
+	s.SetMessageID("a0", common.AnnotationMetadata{HypGroup: "g"}, CHANNEL_ID, 5)
+	h := &fake.HypFactory{}
+	tb := &Bot{Token: "token", Storage: s, Hyp: h}
+	channel := &tele.Chat{ID: CHANNEL_ID, Type: tele.ChatChannel, Title: "News"}
+	group := &tele.Chat{ID: GROUP_ID, Type: tele.ChatSuperGroup}
+
+	// Telegram forwards the channel's post about a0 to its discussion group.
+	forward := &tele.Message{
+		ID:               9,
+		Chat:             group,
+		SenderChat:       channel,
+		Text:             "About a0",
+		AutomaticForward: true,
+		Origin:           &tele.MessageOrigin{Type: "channel", Chat: channel, MessageID: 5},
+	}
+	if err := tb.onText(forward); err != nil {
+		t.Fatalf("onText() of forward returned err=%v", err)
+	}
+	if len(h.Annots) != 0 {
+		t.Fatalf("onText() of forward created %d annotations; expected 0", len(h.Annots))
+	}
+	check.AnnotationMessage(t, s, "a0", common.AnnotationMetadata{HypGroup: "g"}, GROUP_ID, 9)
+
+	// A comment on the post is posted with the channel's subscription.
+	err := tb.onText(&tele.Message{
+		ID:      10,
+		Chat:    group,
+		Sender:  &tele.User{ID: 7, FirstName: "Alice"},
+		Text:    "Nice",
+		ReplyTo: forward,
+	})
+	if err != nil {
+		t.Fatalf("onText() of comment returned err=%v", err)
+	}
+	if len(h.Annots) != 1 {
+		t.Fatalf("onText() of comment created %d annotations; expected 1", len(h.Annots))
+	}
+	annot := h.Annots[0]
+	if !reflect.DeepEqual(annot.References, []string{"a0"}) || annot.Text != `Alice wrote "Nice"` {
+		t.Errorf("Posted %q replying to %q; want Alice's comment replying to a0", annot.Text, annot.References)
+	}
+	check.AnnotationMessage(t, s, annot.ID, common.AnnotationMetadata{References: []string{"a0"}, HypGroup: "g"}, GROUP_ID, 10)
+}
+
+func TestOnText_SenderChat(t *testing.T) {
+	s := db.NewInMemoryStorage()
+	s.AddSubscription(&common.Subscription{"ht", "g", time.Now(), -1})
+	s.SetMessageID("a0", common.AnnotationMetadata{HypGroup: "g"}, -1, 2)
+	h := &fake.HypFactory{}
+	tb := &Bot{Token: "token", Storage: s, Hyp: h}
+	group := &tele.Chat{ID: -1, Type: tele.ChatSuperGroup, Title: "Readers", Username: "readers"}
+
+	// An anonymous administrator's message has a placeholder sender.
+	err := tb.onText(&tele.Message{
+		ID:         3,
+		Chat:       group,
+		Sender:     &tele.User{ID: 1087968824, FirstName: "Group", Username: "GroupAnonymousBot"},
+		SenderChat: group,
+		Text:       "Noted",
+		ReplyTo:    &tele.Message{ID: 2, Chat: group},
+	})
+	if err != nil {
+		t.Fatalf("onText() returned err=%v", err)
+	}
+	if len(h.Annots) != 1 {
+		t.Fatalf("onText() created %d annotations; expected 1", len(h.Annots))
+	}
+	if got, want := h.Annots[0].Text, `Readers (readers) wrote "Noted"`; got != want {
+		t.Errorf("annot.Text=%q; want %q", got, want)
+	}
+	o, err := s.AnnotationOrigin(h.Annots[0].ID)
+	if err != nil {
+		t.Fatalf("AnnotationOrigin() returned err=%v", err)
+	}
+	if o.UserID != 0 || o.Name != "Readers (readers)" {
+		t.Errorf("AnnotationOrigin() returned user %d named %q; want no user named after the chat", o.UserID, o.Name)
+	}
+}
@@ -0,0 +1,75 @@
+package tbot
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	tele "gopkg.in/telebot.v3"
+
+	"github.com/objectiveryan/irsal/internal/common"
+)
+
+const filterUsage = `Usage:
+/filter [GROUP] [list]
+/filter [GROUP] add RULE...
+/filter [GROUP] rm ID
+Rules look like "-user:alice", "+tag:news", "uri:https://example.com/*", "domain:example.com", "keyword:word", "-highlight" or "+reply".`
+
+func (tb *Bot) onFilter(msg *tele.Message, args []string) (string, error) {
+	sub, args, err := tb.chatSubscription(msg.Chat.ID, args)
+	if err == errNoSubscription {
+		return noSubscriptionText, nil
+	} else if err != nil {
+		return "", err
+	}
+	key := sub.Key()
+
+	if len(args) == 0 || (args[0] == "list" && len(args) == 1) {
+		rules, err := tb.Storage.Filters(key)
+		if err != nil {
+			return "", fmt.Errorf("failed to get filters: %v", err)
+		}
+		if len(rules) == 0 {
+			return fmt.Sprintf("No filters for group %s; all annotations are posted.", sub.HypGroup), nil
+		}
+		lines := []string{fmt.Sprintf("Filters for group %s:", sub.HypGroup)}
+		for _, rule := range rules {
+			lines = append(lines, fmt.Sprintf("%d: %v", rule.ID, rule))
+		}
+		return strings.Join(lines, "\n"), nil
+	}
+
+	switch {
+	case args[0] == "add" && len(args) > 1:
+		var rules []*common.FilterRule
+		for _, arg := range args[1:] {
+			rule, err := common.ParseFilterRule(arg)
+			if err != nil {
+				return fmt.Sprintf("Invalid rule %q: %v", arg, err), nil
+			}
+			rules = append(rules, rule)
+		}
+		var added []string
+		for _, rule := range rules {
+			if err := tb.Storage.AddFilter(key, rule); err != nil {
+				return "", fmt.Errorf("failed to add filter: %v", err)
+			}
+			added = append(added, fmt.Sprintf("%d: %v", rule.ID, rule))
+		}
+		return "Added " + strings.Join(added, ", "), nil
+	case args[0] == "rm" && len(args) == 2:
+		id, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return fmt.Sprintf("Invalid filter ID %q", args[1]), nil
+		}
+		err = tb.Storage.RemoveFilter(key, id)
+		if err == common.ErrNotFound {
+			return fmt.Sprintf("No filter %d", id), nil
+		} else if err != nil {
+			return "", fmt.Errorf("failed to remove filter: %v", err)
+		}
+		return fmt.Sprintf("Removed filter %d", id), nil
+	}
+	return filterUsage, nil
+}
@@ -0,0 +1,69 @@
+package tbot
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	tele "gopkg.in/telebot.v3"
+
+	"github.com/objectiveryan/irsal/internal/common"
+	"github.com/objectiveryan/irsal/internal/db"
+	"github.com/objectiveryan/irsal/internal/fake"
+)
+
+func TestOnFilter(t *testing.T) {
+	s := db.NewInMemoryStorage()
+	s.AddSubscription(&common.Subscription{"ht", "g", time.Now(), 1})
+	tb := &Bot{Token: "token", Storage: s, Hyp: &fake.HypFactory{}}
+	msg := &tele.Message{ID: 2, Chat: &tele.Chat{ID: 1}}
+	key := common.SubKey{HypGroup: "g", ChatID: 1}
+
+	if _, err := tb.onFilter(msg, []string{"add", "-user:alice", "+tag:news"}); err != nil {
+		t.Fatalf("onFilter(add) returned err=%v", err)
+	}
+	rules, err := s.Filters(key)
+	if err != nil {
+		t.Fatalf("Filters() returned err=%v", err)
+	}
+	if len(rules) != 2 || rules[0].String() != "-user:alice" || rules[1].String() != "+tag:news" {
+		t.Fatalf("Filters() returned %v; want [-user:alice +tag:news]", rules)
+	}
+
+	reply, err := tb.onFilter(msg, []string{"g", "list"})
+	if err != nil {
+		t.Fatalf("onFilter(list) returned err=%v", err)
+	}
+	if !strings.Contains(reply, "-user:alice") || !strings.Contains(reply, "+tag:news") {
+		t.Errorf("onFilter(list) returned %q; want both rules", reply)
+	}
+
+	if _, err := tb.onFilter(msg, []string{"rm", "1"}); err != nil {
+		t.Fatalf("onFilter(rm) returned err=%v", err)
+	}
+	rules, err = s.Filters(key)
+	if err != nil {
+		t.Fatalf("Filters() returned err=%v", err)
+	}
+	if len(rules) != 1 {
+		t.Fatalf("Filters() returned %v; want 1 rule", rules)
+	}
+
+	// Invalid rules aren't added
+	reply, err = tb.onFilter(msg, []string{"add", "color:red"})
+	if err != nil {
+		t.Fatalf("onFilter(add) returned err=%v", err)
+	}
+	if !strings.HasPrefix(reply, "Invalid rule") {
+		t.Errorf("onFilter(add) returned %q; want invalid rule", reply)
+	}
+
+	// Chats without a subscription are told so
+	reply, err = tb.onFilter(&tele.Message{ID: 2, Chat: &tele.Chat{ID: 5}}, nil)
+	if err != nil {
+		t.Fatalf("onFilter() returned err=%v", err)
+	}
+	if reply != noSubscriptionText {
+		t.Errorf("onFilter() returned %q; want %q", reply, noSubscriptionText)
+	}
+}
@@ -0,0 +1,161 @@
+package tbot
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	tele "gopkg.in/telebot.v3"
+
+	"github.com/objectiveryan/irsal/internal/hyp"
+	"github.com/objectiveryan/irsal/internal/markup"
+	"github.com/objectiveryan/irsal/internal/poller"
+)
+
+const (
+	// The most annotations an inline query returns from each group
+	inlineGroupLimit = 10
+	// The most annotations an inline query returns
+	inlineLimit = 20
+	// How long Telegram may cache a user's results
+	inlineCacheSeconds = 30
+	// How long to remember whether a user is a member of a chat
+	membershipLifetime = 10 * time.Minute
+	// Telegram's limit on the length of a message
+	maxMessageLength = 4096
+)
+
+// inlineResults searches the groups subscribed to in chats the user is a
+// member of, and returns a card for each annotation found, formatted like
+// the chat's messages.
+func (tb *Bot) inlineResults(ctxt context.Context, userID int64, query string, isMember func(chatID, userID int64) bool) ([]tele.Result, error) {
+	subs, err := tb.Storage.Subscriptions()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get subscriptions: %v", err)
+	}
+	type card struct {
+		annot *hyp.Annotation
+		data  *poller.AnnotationData
+		text  string
+	}
+	var cards []card
+	searched := make(map[string]bool)
+	for _, sub := range subs {
+		if searched[sub.HypGroup] || !isMember(sub.ChatID, userID) {
+			continue
+		}
+		searched[sub.HypGroup] = true
+		q := parseSearchQuery(strings.Fields(query))
+		q.Limit = inlineGroupLimit
+		res, err := tb.Hyp.NewClient(sub.HypToken, sub.HypGroup).Search(ctxt, q)
+		if err != nil {
+			log.Printf("Failed to search %v for inline query: %v", sub.Key(), err)
+			continue
+		}
+		raw, err := tb.Storage.SubscriptionOptions(sub.Key())
+		if err != nil {
+			return nil, fmt.Errorf("failed to get options: %v", err)
+		}
+		opts := poller.ParseOptions(raw)
+		for _, annot := range res.Annotations {
+			d := poller.LookupAnnotationData(tb.Storage, annot)
+			d.Hashtags = opts.TagRules.Hashtags(annot.Tags)
+			text, err := poller.Render(opts.RootTemplate, d)
+			if err != nil {
+				log.Printf("Failed to render %q for inline query: %v", annot.ID, err)
+				continue
+			}
+			cards = append(cards, card{annot, d, text})
+		}
+	}
+	sort.SliceStable(cards, func(i, j int) bool {
+		return time.Time(*cards[i].annot.Updated).After(time.Time(*cards[j].annot.Updated))
+	})
+
+	var results []tele.Result
+	for _, c := range cards[:min(len(cards), inlineLimit)] {
+		title := c.data.DisplayName
+		if c.data.Title != "" {
+			title += " on " + c.data.Title
+		}
+		description, _ := markup.FromMarkdown(c.annot.Text)
+		results = append(results, &tele.ArticleResult{
+			ResultBase: tele.ResultBase{
+				ID: c.annot.ID,
+				Content: &tele.InputTextMessageContent{
+					Text:           firstPart(c.text),
+					ParseMode:      tele.ModeHTML,
+					PreviewOptions: &tele.PreviewOptions{Disabled: true},
+				},
+			},
+			Title:       title,
+			Description: poller.Truncate(description, searchTextLength),
+		})
+	}
+	return results, nil
+}
+
+// firstPart shortens a message in Telegram HTML to the length of one
+// message.
+func firstPart(text string) string {
+	plain, ents := markup.FromHTML(text)
+	if markup.Length(plain) <= maxMessageLength {
+		return text
+	}
+	part := markup.Split(plain, ents, maxMessageLength)[0]
+	return markup.ToHTML(part.Text, part.Entities)
+}
+
+// membership caches whether users are members of chats.
+type membership struct {
+	isMember bool
+	checked  time.Time
+}
+
+// isMember returns whether a user is a member of a chat. Failures are taken
+// to mean they aren't.
+func (r *BotRunner) isMember(chatID, userID int64) bool {
+	if chatID > 0 {
+		// A private chat's only member has its ID.
+		return chatID == userID
+	}
+	key := [2]int64{chatID, userID}
+	r.mut.Lock()
+	m, ok := r.members[key]
+	r.mut.Unlock()
+	if ok && time.Since(m.checked) < membershipLifetime {
+		return m.isMember
+	}
+	member, err := r.tb.ChatMemberOf(&tele.Chat{ID: chatID}, &tele.User{ID: userID})
+	isMember := false
+	if err != nil {
+		log.Printf("Failed to look up whether user %d is a member of chat %d: %v", userID, chatID, err)
+	} else {
+		switch member.Role {
+		case tele.Left, tele.Kicked:
+		case tele.Restricted:
+			isMember = member.Member
+		default:
+			isMember = true
+		}
+	}
+	r.mut.Lock()
+	defer r.mut.Unlock()
+	if r.members == nil {
+		r.members = make(map[[2]int64]membership)
+	}
+	r.members[key] = membership{isMember, time.Now()}
+	return isMember
+}
+
+func (r *BotRunner) onQuery(c tele.Context) error {
+	q := c.Query()
+	results, err := r.b.inlineResults(context.TODO(), q.Sender.ID, q.Text, r.isMember)
+	if err != nil {
+		return err
+	}
+	return c.Answer(&tele.QueryResponse{Results: results, CacheTime: inlineCacheSeconds, IsPersonal: true})
+}
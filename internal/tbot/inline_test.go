@@ -0,0 +1,55 @@
+package tbot
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	tele "gopkg.in/telebot.v3"
+
+	"github.com/objectiveryan/irsal/internal/common"
+	"github.com/objectiveryan/irsal/internal/db"
+	"github.com/objectiveryan/irsal/internal/fake"
+	"github.com/objectiveryan/irsal/internal/hyp"
+)
+
+func TestInlineResults(t *testing.T) {
+	h := fake.NewHypFactory([]*hyp.Annotation{
+		{ID: "a1", Group: "g1", User: "acct:alice@hypothes.is", Text: "Old **note**", Updated: hyp.ToTimestamp(time.Unix(1, 0))},
+		{ID: "a2", Group: "g1", User: "acct:bob@hypothes.is", Text: "Unrelated", Updated: hyp.ToTimestamp(time.Unix(2, 0))},
+		{ID: "a3", Group: "g2", User: "acct:carol@hypothes.is", Text: "New note", Updated: hyp.ToTimestamp(time.Unix(3, 0)), Document: &hyp.Document{Title: []string{"Doc"}}},
+		{ID: "a4", Group: "g3", User: "acct:dave@hypothes.is", Text: "Secret note", Updated: hyp.ToTimestamp(time.Unix(4, 0))},
+	})
+	s := db.NewInMemoryStorage()
+	for _, sub := range []*common.Subscription{
+		{"ht", "g1", time.Now(), -1},
+		{"ht", "g2", time.Now(), 7},
+		{"ht", "g3", time.Now(), -3},
+	} {
+		s.AddSubscription(sub)
+	}
+	tb := &Bot{Token: "token", Storage: s, Hyp: h}
+	// The user is a member of chat -1 and their private chat 7, but not chat -3.
+	isMember := func(chatID, userID int64) bool { return chatID == -1 || chatID == userID }
+
+	results, err := tb.inlineResults(context.TODO(), 7, "note", isMember)
+	if err != nil {
+		t.Fatalf("inlineResults() returned err=%v", err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("inlineResults() returned %d results; want 2", len(results))
+	}
+	for i, want := range []struct {
+		id, title, text string
+	}{
+		{"a3", "carol on Doc", "<b>carol</b> on <i>Doc</i>\nNew note\n"},
+		{"a1", "alice", "<b>alice</b>\nOld <b>note</b>\n"},
+	} {
+		got := results[i].(*tele.ArticleResult)
+		content := got.Content.(*tele.InputTextMessageContent)
+		if got.ID != want.id || got.Title != want.title || !strings.HasPrefix(content.Text, want.text) {
+			t.Errorf("Result %d has ID %q, title %q and text %q; want %q, %q and prefix %q", i, got.ID, got.Title, content.Text, want.id, want.title, want.text)
+		}
+	}
+}
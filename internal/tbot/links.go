@@ -0,0 +1,142 @@
+package tbot
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"log"
+	"strings"
+
+	tele "gopkg.in/telebot.v3"
+
+	"github.com/objectiveryan/irsal/internal/hyp"
+	"github.com/objectiveryan/irsal/internal/poller"
+)
+
+const (
+	// The most links in a message to look up
+	maxLinkLookups = 3
+	// How many annotations on each link to look at for quotes
+	linkSearchLimit = 20
+	// How many quotes each summary shows
+	linkQuoteCount = 3
+	// The Hypothesis proxy, which shows a page with its annotations
+	viaPrefix = "https://via.hypothes.is/"
+)
+
+// messageURLs returns the distinct web links in a message.
+func messageURLs(msg *tele.Message) []string {
+	var urls []string
+	seen := make(map[string]bool)
+	for _, ent := range msg.Entities {
+		var u string
+		switch ent.Type {
+		case tele.EntityURL:
+			u = msg.EntityText(ent)
+			if !strings.Contains(u, "://") {
+				u = "https://" + u
+			}
+		case tele.EntityTextLink:
+			u = ent.URL
+		}
+		if !strings.HasPrefix(u, "https://") && !strings.HasPrefix(u, "http://") || seen[u] {
+			continue
+		}
+		seen[u] = true
+		urls = append(urls, u)
+	}
+	return urls
+}
+
+// linkSummary describes the annotations on the links in a message, by the
+// chat's subscriptions which have opted in. It returns the empty string if
+// there are none.
+func (tb *Bot) linkSummary(ctxt context.Context, msg *tele.Message) (string, error) {
+	if msg.AutomaticForward {
+		// It's a copy of a channel post.
+		return "", nil
+	}
+	urls := messageURLs(msg)
+	if len(urls) == 0 {
+		return "", nil
+	}
+	urls = urls[:min(len(urls), maxLinkLookups)]
+	subs, err := tb.Storage.Subscriptions()
+	if err != nil {
+		return "", fmt.Errorf("failed to get subscriptions: %v", err)
+	}
+	var summaries []string
+	for _, sub := range subs {
+		if sub.ChatID != msg.Chat.ID {
+			continue
+		}
+		raw, err := tb.Storage.SubscriptionOptions(sub.Key())
+		if err != nil {
+			return "", fmt.Errorf("failed to get options: %v", err)
+		}
+		if !poller.ParseOptions(raw).LinkLookup {
+			continue
+		}
+		client := tb.Hyp.NewClient(sub.HypToken, sub.HypGroup)
+		for _, u := range urls {
+			res, err := client.Search(ctxt, &hyp.SearchQuery{URI: u, Limit: linkSearchLimit})
+			if err != nil {
+				log.Printf("Failed to look up annotations of %v on %q: %v", sub.Key(), u, err)
+				continue
+			}
+			if res.Total > 0 {
+				summaries = append(summaries, summarizeLink(u, res))
+			}
+		}
+	}
+	return strings.Join(summaries, "\n\n"), nil
+}
+
+// summarizeLink describes the annotations found on a page: how many there
+// are, and the most recently annotated quotes.
+func summarizeLink(u string, res *hyp.SearchResult) string {
+	title := u
+	for _, annot := range res.Annotations {
+		if annot.Title() != "" {
+			title = annot.Title()
+			break
+		}
+	}
+	noun := "annotations"
+	if res.Total == 1 {
+		noun = "annotation"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "<b>%d %s</b> on <a href=\"%s\">%s</a>", res.Total, noun, html.EscapeString(viaPrefix+u), html.EscapeString(title))
+	seen := make(map[string]bool)
+	for _, annot := range res.Annotations {
+		quote := annot.Quote()
+		if quote == "" || seen[quote] {
+			continue
+		}
+		seen[quote] = true
+		fmt.Fprintf(&b, "\n• <i>%s</i>", html.EscapeString(poller.Truncate(quote, searchTextLength)))
+		if len(seen) == linkQuoteCount {
+			break
+		}
+	}
+	return b.String()
+}
+
+// onLinks replies to a message sharing links which the group has annotated.
+func (r *BotRunner) onLinks(c tele.Context) error {
+	msg := c.Message()
+	if msg == nil {
+		return nil
+	}
+	summary, err := r.b.linkSummary(context.TODO(), msg)
+	if err != nil || summary == "" {
+		return err
+	}
+	opts := &tele.SendOptions{ParseMode: tele.ModeHTML, DisableWebPagePreview: true, ReplyTo: msg}
+	if msg.TopicMessage {
+		opts.ThreadID = msg.ThreadID
+	}
+	_, err = r.tb.Send(msg.Chat, summary, opts)
+	return err
+}
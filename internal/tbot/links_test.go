@@ -0,0 +1,72 @@
+package tbot
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	tele "gopkg.in/telebot.v3"
+
+	"github.com/objectiveryan/irsal/internal/common"
+	"github.com/objectiveryan/irsal/internal/db"
+	"github.com/objectiveryan/irsal/internal/fake"
+	"github.com/objectiveryan/irsal/internal/hyp"
+	"github.com/objectiveryan/irsal/internal/poller"
+)
+
+func TestMessageURLs(t *testing.T) {
+	msg := &tele.Message{
+		Text: "See example.test/a and this and https://example.test/a or them",
+		Entities: tele.Entities{
+			{Type: tele.EntityURL, Offset: 4, Length: 14},
+			{Type: tele.EntityTextLink, Offset: 23, Length: 4, URL: "http://example.test/b"},
+			{Type: tele.EntityURL, Offset: 32, Length: 22},
+			{Type: tele.EntityTextLink, Offset: 58, Length: 4, URL: "tg://user?id=7"},
+		},
+	}
+	want := []string{"https://example.test/a", "http://example.test/b"}
+	if got := messageURLs(msg); !reflect.DeepEqual(got, want) {
+		t.Errorf("messageURLs()=%q; want %q", got, want)
+	}
+}
+
+func TestLinkSummary(t *testing.T) {
+	const CHAT_ID = -1
+	quote := func(q string) []*hyp.Target {
+		return []*hyp.Target{{Selectors: hyp.Selectors{TextQuote: &q}}}
+	}
+	h := fake.NewHypFactory([]*hyp.Annotation{
+		{ID: "a1", Group: "g", URI: "https://example.test/a", Targets: quote("First & best"), Updated: hyp.ToTimestamp(time.Unix(1, 0))},
+		{ID: "a2", Group: "g", URI: "https://example.test/a", Targets: quote("Second"), Updated: hyp.ToTimestamp(time.Unix(2, 0)), Document: &hyp.Document{Title: []string{"Page A"}}},
+		{ID: "a3", Group: "g", URI: "https://example.test/a", Targets: quote("Second"), Updated: hyp.ToTimestamp(time.Unix(3, 0))},
+		{ID: "a4", Group: "g", URI: "https://example.test/a", Text: "A page note", Updated: hyp.ToTimestamp(time.Unix(4, 0))},
+		{ID: "a5", Group: "other", URI: "https://example.test/b", Updated: hyp.ToTimestamp(time.Unix(5, 0))},
+	})
+	s := db.NewInMemoryStorage()
+	sub := &common.Subscription{"ht", "g", time.Now(), CHAT_ID}
+	s.AddSubscription(sub)
+	tb := &Bot{Token: "token", Storage: s, Hyp: h}
+	msg := &tele.Message{
+		Chat:     &tele.Chat{ID: CHAT_ID},
+		Text:     "https://example.test/a https://example.test/b",
+		Entities: tele.Entities{{Type: tele.EntityURL, Offset: 0, Length: 22}, {Type: tele.EntityURL, Offset: 23, Length: 22}},
+	}
+
+	if summary, err := tb.linkSummary(context.TODO(), msg); err != nil || summary != "" {
+		t.Errorf("linkSummary() before opting in returned %q, err=%v", summary, err)
+	}
+	s.SetSubscriptionOption(sub.Key(), poller.OptionLinkLookup, "on")
+	summary, err := tb.linkSummary(context.TODO(), msg)
+	if err != nil {
+		t.Fatalf("linkSummary() returned err=%v", err)
+	}
+	want := "<b>4 annotations</b> on <a href=\"https://via.hypothes.is/https://example.test/a\">Page A</a>\n• <i>Second</i>\n• <i>First &amp; best</i>"
+	if summary != want {
+		t.Errorf("linkSummary()=%q; want %q", summary, want)
+	}
+	if strings.Contains(summary, "example.test/b") {
+		t.Errorf("linkSummary() includes another group's annotations")
+	}
+}
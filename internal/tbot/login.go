@@ -0,0 +1,158 @@
+package tbot
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	tele "gopkg.in/telebot.v3"
+
+	"github.com/objectiveryan/irsal/internal/common"
+	"github.com/objectiveryan/irsal/internal/crypt"
+	"github.com/objectiveryan/irsal/internal/hyp"
+	"github.com/objectiveryan/irsal/internal/oauth"
+)
+
+const tokenURL = "https://hypothes.is/account/developer"
+
+func (tb *Bot) onLogin(msg *tele.Message, args []string) (string, error) {
+	if tb.Cipher == nil {
+		return "Logging in isn't enabled for this bot.", nil
+	}
+	if msg.Chat.Type != tele.ChatPrivate {
+		if len(args) > 0 {
+			return fmt.Sprintf("Your token is no longer secret, since you posted it here. Please regenerate it at %s and send /login to me in a private chat.", tokenURL), nil
+		}
+		return "To keep your token secret, send /login to me in a private chat.", nil
+	}
+	if msg.Sender == nil {
+		return "", fmt.Errorf("login message has no sender")
+	}
+	if len(args) > 0 {
+		return tb.login(msg.Sender, args[0])
+	}
+	if tb.OAuth != nil {
+		url, err := tb.OAuth.LoginURL(oauth.Binding{UserID: msg.Sender.ID, Name: formatUser(msg.Sender)})
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Log in with Hypothesis at %s and your replies to annotations will be posted as you. The link works once, for a few minutes.", url), nil
+	}
+	tb.mut.Lock()
+	defer tb.mut.Unlock()
+	if tb.awaitingToken == nil {
+		tb.awaitingToken = make(map[int64]bool)
+	}
+	tb.awaitingToken[msg.Sender.ID] = true
+	return fmt.Sprintf("Send me your Hypothesis API token, which you can generate at %s. Your replies to annotations will then be posted as you.", tokenURL), nil
+}
+
+// onLoginToken handles a text message which might be the token of a user
+// who sent /login. If it isn't, it returns an empty reply.
+func (tb *Bot) onLoginToken(msg *tele.Message) (string, error) {
+	if msg == nil || msg.Sender == nil || msg.Chat.Type != tele.ChatPrivate {
+		return "", nil
+	}
+	tb.mut.Lock()
+	awaiting := tb.awaitingToken[msg.Sender.ID]
+	delete(tb.awaitingToken, msg.Sender.ID)
+	tb.mut.Unlock()
+	if !awaiting {
+		return "", nil
+	}
+	return tb.login(msg.Sender, strings.TrimSpace(msg.Text))
+}
+
+func (tb *Bot) login(user *tele.User, token string) (string, error) {
+	profile, err := tb.Hyp.NewClient(token, "").Profile(context.TODO())
+	if err != nil {
+		log.Printf("Failed to check token of user %d: %v", user.ID, err)
+		return "That token doesn't work. Send /login to try again.", nil
+	}
+	if profile.UserID == "" {
+		return "That token doesn't belong to a Hypothesis user. Send /login to try again.", nil
+	}
+	encrypted, err := tb.Cipher.Encrypt([]byte(token), crypt.UserAdditionalData(user.ID))
+	if err != nil {
+		return "", fmt.Errorf("failed to encrypt token: %v", err)
+	}
+	if err := tb.Storage.SetUserToken(&common.UserToken{UserID: user.ID, HypUser: profile.UserID, Token: encrypted}); err != nil {
+		return "", fmt.Errorf("failed to store token: %v", err)
+	}
+	tb.linkUser(user, profile.UserID)
+	log.Printf("User %d logged in as %q", user.ID, profile.UserID)
+	return fmt.Sprintf("Logged in as %s. Your replies to annotations will be posted as you. Send /logout to stop.", profile.UserID), nil
+}
+
+func (tb *Bot) onLogout(msg *tele.Message, args []string) (string, error) {
+	if msg.Sender == nil {
+		return "", fmt.Errorf("logout message has no sender")
+	}
+	err := tb.Storage.DeleteUserToken(msg.Sender.ID)
+	if err == common.ErrNotFound {
+		return "You aren't logged in.", nil
+	} else if err != nil {
+		return "", fmt.Errorf("failed to delete token: %v", err)
+	}
+	if err := tb.Storage.DeleteUserLink(msg.Sender.ID); err != nil && err != common.ErrNotFound {
+		return "", fmt.Errorf("failed to unlink accounts: %v", err)
+	}
+	return "Logged out. Your replies will be posted by the bot.", nil
+}
+
+// onConnect makes a link which binds a Hypothesis account to the chat's
+// subscription, so annotations are read with that account's token. The link
+// is for the sender's eyes only, so it's returned separately from the reply.
+func (tb *Bot) onConnect(msg *tele.Message, args []string) (link, reply string, err error) {
+	if tb.OAuth == nil {
+		return "", "Connecting accounts isn't enabled for this bot.", nil
+	}
+	sub, _, err := tb.chatSubscription(msg.Chat.ID, args)
+	if err == errNoSubscription {
+		return "", noSubscriptionText, nil
+	} else if err != nil {
+		return "", "", err
+	}
+	if msg.Sender == nil || msg.SenderChat != nil {
+		return "", "I can't send a login link to an anonymous administrator.", nil
+	}
+	key := sub.Key()
+	url, err := tb.OAuth.LoginURL(oauth.Binding{Sub: &key})
+	if err != nil {
+		return "", "", err
+	}
+	link = fmt.Sprintf("Log in with Hypothesis at %s to read group %s's annotations with your account. The link works once, for a few minutes.", url, sub.HypGroup)
+	if msg.Chat.Type == tele.ChatPrivate {
+		return link, "", nil
+	}
+	return link, "I sent you a login link in a private chat.", nil
+}
+
+// userClient returns a client which posts as user, and the Hypothesis
+// account it posts as, or nil if they haven't logged in.
+func (tb *Bot) userClient(user *tele.User, group string) (hyp.Client, string, error) {
+	if user == nil || tb.Cipher == nil {
+		return nil, "", nil
+	}
+	t, err := tb.Storage.UserToken(user.ID)
+	if err == common.ErrNotFound {
+		return nil, "", nil
+	} else if err != nil {
+		return nil, "", fmt.Errorf("failed to look up token: %v", err)
+	}
+	token, err := tb.Cipher.Decrypt(t.Token, crypt.UserAdditionalData(user.ID))
+	if err != nil {
+		return nil, "", err
+	}
+	return tb.Hyp.NewClient(string(token), group), t.HypUser, nil
+}
+
+// linkUser records that user is hypUser, so messages about hypUser's
+// annotations mention them by their current name.
+func (tb *Bot) linkUser(user *tele.User, hypUser string) {
+	err := tb.Storage.SetUserLink(&common.UserLink{HypUser: hypUser, UserID: user.ID, Name: formatUser(user)})
+	if err != nil {
+		log.Printf("Failed to link user %d to %q: %v", user.ID, hypUser, err)
+	}
+}
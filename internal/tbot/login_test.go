@@ -0,0 +1,172 @@
+package tbot
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	tele "gopkg.in/telebot.v3"
+
+	"github.com/objectiveryan/irsal/internal/common"
+	"github.com/objectiveryan/irsal/internal/crypt"
+	"github.com/objectiveryan/irsal/internal/db"
+	"github.com/objectiveryan/irsal/internal/fake"
+	"github.com/objectiveryan/irsal/internal/oauth"
+)
+
+func newLoginBot(t *testing.T) (*Bot, *fake.HypFactory) {
+	t.Helper()
+	c, err := crypt.NewCipher(bytes.Repeat([]byte{1}, crypt.KeySize))
+	if err != nil {
+		t.Fatalf("NewCipher() returned err=%v", err)
+	}
+	h := &fake.HypFactory{Users: map[string]string{"alice-token": "acct:alice@hypothes.is", "ht": "acct:bot@hypothes.is"}}
+	return &Bot{Token: "token", Storage: db.NewInMemoryStorage(), Hyp: h, Cipher: c}, h
+}
+
+func TestOnLogin(t *testing.T) {
+	tb, _ := newLoginBot(t)
+	alice := &tele.User{ID: 7, FirstName: "Alice"}
+	private := &tele.Chat{ID: 7, Type: tele.ChatPrivate}
+	group := &tele.Chat{ID: -1, Type: tele.ChatGroup}
+
+	reply, err := tb.onLogin(&tele.Message{Chat: group, Sender: alice}, nil)
+	if err != nil {
+		t.Fatalf("onLogin() returned err=%v", err)
+	}
+	if !strings.Contains(reply, "private chat") {
+		t.Errorf("onLogin() in a group replied %q; want it to ask for a private chat", reply)
+	}
+
+	// Other messages aren't taken as tokens until the user sends /login.
+	if reply, err := tb.onLoginToken(&tele.Message{Chat: private, Sender: alice, Text: "alice-token"}); err != nil || reply != "" {
+		t.Fatalf("onLoginToken() before /login returned %q, err=%v; want no reply", reply, err)
+	}
+	if _, err := tb.onLogin(&tele.Message{Chat: private, Sender: alice}, nil); err != nil {
+		t.Fatalf("onLogin() returned err=%v", err)
+	}
+	reply, err = tb.onLoginToken(&tele.Message{Chat: private, Sender: alice, Text: "wrong-token"})
+	if err != nil {
+		t.Fatalf("onLoginToken() returned err=%v", err)
+	}
+	if !strings.Contains(reply, "try again") {
+		t.Errorf("onLoginToken() with an invalid token replied %q", reply)
+	}
+	if _, err := tb.Storage.UserToken(alice.ID); err != common.ErrNotFound {
+		t.Fatalf("UserToken() after invalid token returned err=%v; want ErrNotFound", err)
+	}
+
+	if _, err := tb.onLogin(&tele.Message{Chat: private, Sender: alice}, nil); err != nil {
+		t.Fatalf("onLogin() returned err=%v", err)
+	}
+	reply, err = tb.onLoginToken(&tele.Message{Chat: private, Sender: alice, Text: " alice-token\n"})
+	if err != nil {
+		t.Fatalf("onLoginToken() returned err=%v", err)
+	}
+	if !strings.Contains(reply, "acct:alice@hypothes.is") {
+		t.Errorf("onLoginToken() replied %q; want it to say who Alice logged in as", reply)
+	}
+	stored, err := tb.Storage.UserToken(alice.ID)
+	if err != nil {
+		t.Fatalf("UserToken() returned err=%v", err)
+	}
+	if stored.HypUser != "acct:alice@hypothes.is" {
+		t.Errorf("HypUser=%q; want \"acct:alice@hypothes.is\"", stored.HypUser)
+	}
+	if bytes.Contains(stored.Token, []byte("alice-token")) {
+		t.Errorf("Token was stored unencrypted")
+	}
+	if link, err := tb.Storage.UserLink("acct:alice@hypothes.is"); err != nil || link.UserID != alice.ID || link.Name != "Alice" {
+		t.Errorf("UserLink() returned %+v, err=%v; want a link to Alice", link, err)
+	}
+
+	if _, err := tb.onLogout(&tele.Message{Chat: private, Sender: alice}, nil); err != nil {
+		t.Fatalf("onLogout() returned err=%v", err)
+	}
+	if _, err := tb.Storage.UserToken(alice.ID); err != common.ErrNotFound {
+		t.Errorf("UserToken() after onLogout() returned err=%v; want ErrNotFound", err)
+	}
+	if _, err := tb.Storage.UserLink("acct:alice@hypothes.is"); err != common.ErrNotFound {
+		t.Errorf("UserLink() after onLogout() returned err=%v; want ErrNotFound", err)
+	}
+}
+
+func TestOnLogin_OAuth(t *testing.T) {
+	tb, _ := newLoginBot(t)
+	tb.OAuth = &oauth.Linker{Config: &oauth.Config{ClientID: "client", AuthURL: "https://auth.example/authorize"}}
+	alice := &tele.User{ID: 7, FirstName: "Alice"}
+
+	reply, err := tb.onLogin(&tele.Message{Chat: &tele.Chat{ID: 7, Type: tele.ChatPrivate}, Sender: alice}, nil)
+	if err != nil {
+		t.Fatalf("onLogin() returned err=%v", err)
+	}
+	if !strings.Contains(reply, "https://auth.example/authorize?") {
+		t.Errorf("onLogin() replied %q; want a login link", reply)
+	}
+	// The user logs in on the web, so their next message isn't a token.
+	if reply, err := tb.onLoginToken(&tele.Message{Chat: &tele.Chat{ID: 7, Type: tele.ChatPrivate}, Sender: alice, Text: "hi"}); err != nil || reply != "" {
+		t.Errorf("onLoginToken() returned %q, err=%v; want no reply", reply, err)
+	}
+}
+
+func TestOnConnect(t *testing.T) {
+	tb, _ := newLoginBot(t)
+	group := &tele.Chat{ID: -1, Type: tele.ChatGroup}
+	alice := &tele.User{ID: 7, FirstName: "Alice"}
+	tb.Storage.AddSubscription(&common.Subscription{"ht", "g", time.Now(), group.ID})
+
+	if link, reply, err := tb.onConnect(&tele.Message{Chat: group, Sender: alice}, nil); err != nil || link != "" || !strings.Contains(reply, "isn't enabled") {
+		t.Errorf("onConnect() without OAuth returned link=%q reply=%q err=%v", link, reply, err)
+	}
+
+	tb.OAuth = &oauth.Linker{Config: &oauth.Config{ClientID: "client", AuthURL: "https://auth.example/authorize"}}
+	link, reply, err := tb.onConnect(&tele.Message{Chat: group, Sender: alice}, nil)
+	if err != nil {
+		t.Fatalf("onConnect() returned err=%v", err)
+	}
+	if !strings.Contains(link, "https://auth.example/authorize?") || !strings.Contains(link, "group g") {
+		t.Errorf("onConnect() made link message %q", link)
+	}
+	if !strings.Contains(reply, "private chat") {
+		t.Errorf("onConnect() replied %q in the group", reply)
+	}
+
+	anon := &tele.Message{Chat: group, Sender: &tele.User{ID: 1087968824}, SenderChat: group}
+	if link, _, err := tb.onConnect(anon, nil); err != nil || link != "" {
+		t.Errorf("onConnect() by anonymous administrator returned link=%q err=%v; want no link", link, err)
+	}
+}
+
+func TestOnText_LoggedInUser(t *testing.T) {
+	tb, h := newLoginBot(t)
+	s := tb.Storage
+	s.AddSubscription(&common.Subscription{"ht", "g", time.Now(), 1})
+	if err := s.SetMessageID("a0", common.AnnotationMetadata{HypGroup: "g"}, 1, 2); err != nil {
+		t.Fatalf("Failed to initialize storage: %v", err)
+	}
+	alice := &tele.User{ID: 7, FirstName: "Alice"}
+	bob := &tele.User{ID: 8, FirstName: "Bob"}
+	if _, err := tb.onLogin(&tele.Message{Chat: &tele.Chat{ID: 7, Type: tele.ChatPrivate}, Sender: alice}, []string{"alice-token"}); err != nil {
+		t.Fatalf("onLogin() returned err=%v", err)
+	}
+
+	chat := &tele.Chat{ID: 1}
+	for i, sender := range []*tele.User{alice, bob} {
+		if err := tb.onText(&tele.Message{ID: 3 + i, Chat: chat, Sender: sender, Text: "hello", ReplyTo: &tele.Message{ID: 2, Chat: chat}}); err != nil {
+			t.Fatalf("Failed to handle message: %v", err)
+		}
+	}
+	if len(h.Annots) != 2 {
+		t.Fatalf("onText() created %d annotations; expected 2", len(h.Annots))
+	}
+	// Alice's reply is hers, and Bob's is posted by the bot.
+	for i, want := range []struct{ user, text string }{
+		{"acct:alice@hypothes.is", "hello"},
+		{"acct:bot@hypothes.is", "Bob wrote \"hello\""},
+	} {
+		if got := h.Annots[i]; got.User != want.user || got.Text != want.text {
+			t.Errorf("Annotation %d by %q with text %q; want %q with %q", i, got.User, got.Text, want.user, want.text)
+		}
+	}
+}
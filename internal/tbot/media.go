@@ -0,0 +1,89 @@
+package tbot
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+
+	tele "gopkg.in/telebot.v3"
+
+	"github.com/objectiveryan/irsal/internal/markup"
+)
+
+// The largest file bots can download from Telegram
+const maxDownloadSize = 20 << 20
+
+// Events for messages with media which can be posted as replies
+var mediaEvents = []string{tele.OnPhoto, tele.OnDocument, tele.OnVoice, tele.OnAudio, tele.OnVideo, tele.OnAnimation, tele.OnVideoNote}
+
+// mediaFile returns the media sent in a message, the name to store it under,
+// and whether it's an image.
+func mediaFile(msg *tele.Message) (*tele.File, string, bool) {
+	orDefault := func(name, def string) string {
+		if name == "" {
+			return def
+		}
+		return name
+	}
+	switch {
+	case msg.Photo != nil:
+		return &msg.Photo.File, "photo.jpg", true
+	case msg.Animation != nil:
+		return &msg.Animation.File, orDefault(msg.Animation.FileName, "animation.mp4"), false
+	case msg.Document != nil:
+		return &msg.Document.File, orDefault(msg.Document.FileName, "document"), false
+	case msg.Voice != nil:
+		return &msg.Voice.File, "voice.ogg", false
+	case msg.Audio != nil:
+		return &msg.Audio.File, orDefault(msg.Audio.FileName, "audio"), false
+	case msg.Video != nil:
+		return &msg.Video.File, orDefault(msg.Video.FileName, "video.mp4"), false
+	case msg.VideoNote != nil:
+		return &msg.VideoNote.File, "video.mp4", false
+	}
+	return nil, "", false
+}
+
+// mediaLink links to a stored file in Markdown, showing it if it's an image.
+func mediaLink(name, url string, image bool) string {
+	link := markup.ToMarkdown(name, tele.Entities{{Type: tele.EntityTextLink, Length: markup.Length(name), URL: url}})
+	if image {
+		return "!" + link
+	}
+	return link
+}
+
+// onMedia posts a reply with a photo, file or other media, using its caption
+// as the text and linking to a copy of the media in tb.Media.
+func (tb *Bot) onMedia(ctxt context.Context, msg *tele.Message, download func(*tele.File) (io.ReadCloser, error)) error {
+	if msg == nil {
+		log.Println("Ignoring media with no message")
+		return nil
+	}
+	log.Printf("onMedia: ChatID=%d MessageID=%d Caption=%q", msg.Chat.ID, msg.ID, msg.Caption)
+	if msg.AutomaticForward {
+		return tb.recordForward(msg)
+	}
+	attach := func() (string, error) {
+		file, name, image := mediaFile(msg)
+		if file == nil || tb.Media == nil {
+			return "", nil
+		}
+		if file.FileSize > maxDownloadSize {
+			log.Printf("Not storing %q of %d bytes, which is too large to download", name, file.FileSize)
+			return "", nil
+		}
+		r, err := download(file)
+		if err != nil {
+			return "", fmt.Errorf("failed to download %q: %v", name, err)
+		}
+		defer r.Close()
+		url, err := tb.Media.Put(ctxt, name, r)
+		if err != nil {
+			return "", fmt.Errorf("failed to store %q: %v", name, err)
+		}
+		return mediaLink(name, url, image), nil
+	}
+	return tb.bridgeReply(msg, markup.ToMarkdown(msg.Caption, msg.CaptionEntities), attach)
+}
@@ -0,0 +1,90 @@
+package tbot
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	tele "gopkg.in/telebot.v3"
+
+	"github.com/objectiveryan/irsal/internal/common"
+	"github.com/objectiveryan/irsal/internal/db"
+	"github.com/objectiveryan/irsal/internal/fake"
+)
+
+// memStore keeps files in memory.
+type memStore map[string]string
+
+func (m memStore) Put(ctxt context.Context, name string, r io.Reader) (string, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return "", err
+	}
+	url := fmt.Sprintf("https://media.test/%d/%s", len(m), name)
+	m[url] = string(data)
+	return url, nil
+}
+
+func TestOnMedia(t *testing.T) {
+	s := db.NewInMemoryStorage()
+	s.AddSubscription(&common.Subscription{"ht", "g", time.Now(), 1})
+	s.SetMessageID("a0", common.AnnotationMetadata{HypGroup: "g"}, 1, 2)
+	h := &fake.HypFactory{}
+	store := memStore{}
+	tb := &Bot{Token: "token", Storage: s, Hyp: h, Media: store}
+	chat := &tele.Chat{ID: 1}
+	var downloaded []string
+	download := func(f *tele.File) (io.ReadCloser, error) {
+		downloaded = append(downloaded, f.FileID)
+		return io.NopCloser(strings.NewReader("data of " + f.FileID)), nil
+	}
+
+	for i, tt := range []struct {
+		msg  *tele.Message
+		want string
+	}{
+		{
+			&tele.Message{Caption: "Look here", CaptionEntities: tele.Entities{{Type: tele.EntityBold, Offset: 5, Length: 4}}, Photo: &tele.Photo{File: tele.File{FileID: "p1"}}},
+			"Look **here**\n\n![photo.jpg](https://media.test/0/photo.jpg)",
+		},
+		{
+			&tele.Message{Document: &tele.Document{File: tele.File{FileID: "d1"}, FileName: "notes [draft].pdf"}},
+			"[notes \\[draft\\].pdf](https://media.test/1/notes [draft].pdf)",
+		},
+		{
+			&tele.Message{Caption: "Too big", Video: &tele.Video{File: tele.File{FileID: "v1", FileSize: maxDownloadSize + 1}}},
+			"Too big",
+		},
+	} {
+		tt.msg.ID = 10 + i
+		tt.msg.Chat = chat
+		tt.msg.ReplyTo = &tele.Message{ID: 2, Chat: chat}
+		h.Annots = nil
+		if err := tb.onMedia(context.TODO(), tt.msg, download); err != nil {
+			t.Fatalf("onMedia() returned err=%v", err)
+		}
+		if len(h.Annots) != 1 {
+			t.Fatalf("onMedia() created %d annotations; want 1", len(h.Annots))
+		}
+		if !strings.Contains(h.Annots[0].Text, tt.want) {
+			t.Errorf("onMedia() posted %q; want it to contain %q", h.Annots[0].Text, tt.want)
+		}
+	}
+	if want := "p1 d1"; strings.Join(downloaded, " ") != want {
+		t.Errorf("Downloaded %q; want %q", downloaded, want)
+	}
+	if got := store["https://media.test/0/photo.jpg"]; got != "data of p1" {
+		t.Errorf("Stored photo %q; want %q", got, "data of p1")
+	}
+
+	// Without a caption or a store, there's nothing to post.
+	h.Annots = nil
+	tb.Media = nil
+	msg := &tele.Message{ID: 20, Chat: chat, ReplyTo: &tele.Message{ID: 2, Chat: chat}, Voice: &tele.Voice{File: tele.File{FileID: "o1"}}}
+	if err := tb.onMedia(context.TODO(), msg, download); err != nil || len(h.Annots) != 0 {
+		t.Errorf("onMedia() without a store returned err=%v and created %d annotations; want none", err, len(h.Annots))
+	}
+}
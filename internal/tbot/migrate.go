@@ -0,0 +1,54 @@
+package tbot
+
+import (
+	"fmt"
+	"log"
+
+	tele "gopkg.in/telebot.v3"
+)
+
+// migration returns the old and new IDs of a group upgraded to a supergroup,
+// from either of the messages Telegram sends about it: one in the old group
+// with migrate_to_chat_id and one in the supergroup with
+// migrate_from_chat_id.
+func migration(msg *tele.Message) (from, to int64, ok bool) {
+	switch {
+	case msg.MigrateTo != 0:
+		return msg.Chat.ID, msg.MigrateTo, true
+	case msg.MigrateFrom != 0:
+		return msg.MigrateFrom, msg.Chat.ID, true
+	}
+	return 0, 0, false
+}
+
+// onMigration moves everything stored about a group, including records of its
+// messages, to its new ID when it's upgraded to a supergroup. Whichever of the
+// two messages about it arrives second finds nothing left to move.
+func (tb *Bot) onMigration(msg *tele.Message) error {
+	if msg == nil {
+		return nil
+	}
+	from, to, ok := migration(msg)
+	if !ok {
+		return nil
+	}
+	log.Printf("onMigration: From=%d To=%d", from, to)
+	if err := tb.Storage.MigrateChat(from, to); err != nil {
+		return fmt.Errorf("failed to migrate chat %d to %d: %v", from, to, err)
+	}
+	return nil
+}
+
+// migrationPoller passes migrate_from_chat_id messages to onMigration as they
+// are polled, since telebot only raises OnMigration for migrate_to_chat_id
+// ones.
+func (r *BotRunner) migrationPoller(p tele.Poller) tele.Poller {
+	return tele.NewMiddlewarePoller(p, func(u *tele.Update) bool {
+		if msg := u.Message; msg != nil && msg.MigrateFrom != 0 {
+			if err := r.b.onMigration(msg); err != nil {
+				log.Println(err)
+			}
+		}
+		return true
+	})
+}
@@ -0,0 +1,45 @@
+package tbot
+
+import (
+	"testing"
+	"time"
+
+	tele "gopkg.in/telebot.v3"
+
+	"github.com/objectiveryan/irsal/internal/check"
+	"github.com/objectiveryan/irsal/internal/common"
+	"github.com/objectiveryan/irsal/internal/db"
+)
+
+func TestOnMigration(t *testing.T) {
+	const OLD, NEW = -1, -1001
+	group := &tele.Chat{ID: OLD, Type: tele.ChatGroup}
+	supergroup := &tele.Chat{ID: NEW, Type: tele.ChatSuperGroup}
+	for _, tc := range []struct {
+		name string
+		msgs []*tele.Message
+	}{
+		{"MigrateTo", []*tele.Message{{ID: 7, Chat: group, MigrateTo: NEW}}},
+		{"MigrateFrom", []*tele.Message{{ID: 1, Chat: supergroup, MigrateFrom: OLD}}},
+		{"Both", []*tele.Message{{ID: 7, Chat: group, MigrateTo: NEW}, {ID: 1, Chat: supergroup, MigrateFrom: OLD}}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := db.NewInMemoryStorage()
+			s.AddSubscription(&common.Subscription{"ht", "g", time.Now(), OLD})
+			s.SetMessageID("a0", common.AnnotationMetadata{HypGroup: "g"}, OLD, 5)
+			tb := &Bot{Token: "token", Storage: s}
+			for _, msg := range tc.msgs {
+				if err := tb.onMigration(msg); err != nil {
+					t.Fatalf("onMigration() returned err=%v", err)
+				}
+			}
+			if _, err := s.Subscription(NEW, "g"); err != nil {
+				t.Errorf("Subscription(NEW) returned err=%v", err)
+			}
+			if _, err := s.Subscription(OLD, "g"); err != common.ErrNotFound {
+				t.Errorf("Subscription(OLD) returned err=%v; want ErrNotFound", err)
+			}
+			check.AnnotationMessage(t, s, "a0", common.AnnotationMetadata{HypGroup: "g"}, NEW, 5)
+		})
+	}
+}
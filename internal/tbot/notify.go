@@ -0,0 +1,103 @@
+package tbot
+
+import (
+	"fmt"
+
+	tele "gopkg.in/telebot.v3"
+
+	"github.com/objectiveryan/irsal/internal/common"
+)
+
+func (tb *Bot) onNotify(msg *tele.Message, args []string) (string, error) {
+	if sendingUser(msg) == nil {
+		return "Send /notify as yourself, not on behalf of a chat.", nil
+	}
+	userID := msg.Sender.ID
+	if len(args) == 0 {
+		enabled, err := tb.Storage.NotificationsEnabled(userID)
+		if err != nil {
+			return "", fmt.Errorf("failed to get notification setting: %v", err)
+		}
+		if enabled {
+			return "Notifications are on. Send /notify off to stop them.", nil
+		}
+		return "Notifications are off. Send /notify on to get private messages about replies to your annotations and mentions of you.", nil
+	}
+	var enabled bool
+	switch args[0] {
+	case "on":
+		enabled = true
+	case "off":
+	default:
+		return "Send /notify on or /notify off.", nil
+	}
+	if enabled {
+		if _, err := tb.Storage.UserToken(userID); err == common.ErrNotFound {
+			return "Send /login to me in a private chat first, so I know which annotations are yours.", nil
+		} else if err != nil {
+			return "", fmt.Errorf("failed to look up token: %v", err)
+		}
+	}
+	if err := tb.Storage.SetNotificationsEnabled(userID, enabled); err != nil {
+		return "", fmt.Errorf("failed to set notification setting: %v", err)
+	}
+	if enabled {
+		return "Notifications are on. I'll message you privately about replies to your annotations and mentions of you. Reply to a message with /mute to stop notifications about its thread.", nil
+	}
+	return "Notifications are off.", nil
+}
+
+// threadOf returns the root of the thread of the annotation msg replies to,
+// or which the notification it replies to is about.
+func (tb *Bot) threadOf(msg *tele.Message) (string, error) {
+	if msg.ReplyTo == nil {
+		return "", common.ErrNotFound
+	}
+	annotID, meta, err := tb.Storage.AnnotationID(msg.Chat.ID, msg.ReplyTo.ID)
+	if err == common.ErrNotFound && msg.Chat.Type == tele.ChatPrivate {
+		// Notifications are sent to the user's private chat, which has the
+		// user's ID.
+		return tb.Storage.NotificationThread(msg.Chat.ID, msg.ReplyTo.ID)
+	} else if err != nil {
+		return "", err
+	}
+	if len(meta.References) > 0 {
+		return meta.References[0], nil
+	}
+	return annotID, nil
+}
+
+func (tb *Bot) onMute(msg *tele.Message, args []string) (string, error) {
+	if sendingUser(msg) == nil {
+		return "Send /mute as yourself, not on behalf of a chat.", nil
+	}
+	rootID, err := tb.threadOf(msg)
+	if err == common.ErrNotFound {
+		return "Reply to a message about an annotation with /mute to stop notifications about its thread.", nil
+	} else if err != nil {
+		return "", fmt.Errorf("failed to look up annotation: %v", err)
+	}
+	if err := tb.Storage.MuteThread(msg.Sender.ID, rootID); err != nil {
+		return "", fmt.Errorf("failed to mute thread: %v", err)
+	}
+	return "Muted notifications about this thread. Reply to it with /unmute to undo.", nil
+}
+
+func (tb *Bot) onUnmute(msg *tele.Message, args []string) (string, error) {
+	if sendingUser(msg) == nil {
+		return "Send /unmute as yourself, not on behalf of a chat.", nil
+	}
+	rootID, err := tb.threadOf(msg)
+	if err == common.ErrNotFound {
+		return "Reply to a message about an annotation with /unmute to get notifications about its thread again.", nil
+	} else if err != nil {
+		return "", fmt.Errorf("failed to look up annotation: %v", err)
+	}
+	err = tb.Storage.UnmuteThread(msg.Sender.ID, rootID)
+	if err == common.ErrNotFound {
+		return "This thread isn't muted.", nil
+	} else if err != nil {
+		return "", fmt.Errorf("failed to unmute thread: %v", err)
+	}
+	return "Unmuted notifications about this thread.", nil
+}
@@ -0,0 +1,70 @@
+package tbot
+
+import (
+	"strings"
+	"testing"
+
+	tele "gopkg.in/telebot.v3"
+
+	"github.com/objectiveryan/irsal/internal/common"
+)
+
+func TestOnNotify(t *testing.T) {
+	tb, _ := newLoginBot(t)
+	private := &tele.Chat{ID: 7, Type: tele.ChatPrivate}
+	alice := &tele.User{ID: 7, FirstName: "Alice"}
+
+	reply, err := tb.onNotify(&tele.Message{Chat: private, Sender: alice}, []string{"on"})
+	if err != nil {
+		t.Fatalf("onNotify() returned err=%v", err)
+	}
+	if !strings.Contains(reply, "/login") {
+		t.Errorf("onNotify() before logging in replied %q; want it to ask to log in", reply)
+	}
+	if enabled, _ := tb.Storage.NotificationsEnabled(alice.ID); enabled {
+		t.Errorf("Notifications enabled before logging in")
+	}
+
+	if _, err := tb.onLogin(&tele.Message{Chat: private, Sender: alice}, []string{"alice-token"}); err != nil {
+		t.Fatalf("onLogin() returned err=%v", err)
+	}
+	for _, arg := range []string{"on", "off"} {
+		if _, err := tb.onNotify(&tele.Message{Chat: private, Sender: alice}, []string{arg}); err != nil {
+			t.Fatalf("onNotify(%q) returned err=%v", arg, err)
+		}
+		if enabled, err := tb.Storage.NotificationsEnabled(alice.ID); err != nil || enabled != (arg == "on") {
+			t.Errorf("NotificationsEnabled() after /notify %s returned %v, err=%v", arg, enabled, err)
+		}
+	}
+}
+
+func TestOnMute(t *testing.T) {
+	tb, _ := newLoginBot(t)
+	private := &tele.Chat{ID: 7, Type: tele.ChatPrivate}
+	alice := &tele.User{ID: 7, FirstName: "Alice"}
+	if err := tb.Storage.AddNotification(&common.Notification{AnnotID: "a2", UserID: private.ID, RootID: "a1", State: common.OutboxSent, MessageID: 10}); err != nil {
+		t.Fatalf("Failed to initialize storage: %v", err)
+	}
+
+	reply, err := tb.onMute(&tele.Message{Chat: private, Sender: alice}, nil)
+	if err != nil {
+		t.Fatalf("onMute() returned err=%v", err)
+	}
+	if !strings.Contains(reply, "Reply to") {
+		t.Errorf("onMute() without a reply replied %q", reply)
+	}
+
+	notification := &tele.Message{ID: 10, Chat: private}
+	if _, err := tb.onMute(&tele.Message{Chat: private, Sender: alice, ReplyTo: notification}, nil); err != nil {
+		t.Fatalf("onMute() returned err=%v", err)
+	}
+	if muted, err := tb.Storage.ThreadMuted(alice.ID, "a1"); err != nil || !muted {
+		t.Errorf("ThreadMuted() returned %v, err=%v; want the thread of the annotation replied to muted", muted, err)
+	}
+	if _, err := tb.onUnmute(&tele.Message{Chat: private, Sender: alice, ReplyTo: notification}, nil); err != nil {
+		t.Fatalf("onUnmute() returned err=%v", err)
+	}
+	if muted, err := tb.Storage.ThreadMuted(alice.ID, "a1"); err != nil || muted {
+		t.Errorf("ThreadMuted() after onUnmute() returned %v, err=%v; want false", muted, err)
+	}
+}
@@ -0,0 +1,60 @@
+package tbot
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	tele "gopkg.in/telebot.v3"
+
+	"github.com/objectiveryan/irsal/internal/poller"
+)
+
+func (tb *Bot) onSet(msg *tele.Message, allArgs []string) (string, error) {
+	sub, args, err := tb.chatSubscription(msg.Chat.ID, allArgs)
+	if err == errNoSubscription {
+		return noSubscriptionText, nil
+	} else if err != nil {
+		return "", err
+	}
+
+	if len(args) == 0 {
+		opts, err := tb.Storage.SubscriptionOptions(sub.Key())
+		if err != nil {
+			return "", fmt.Errorf("failed to get options: %v", err)
+		}
+		lines := []string{fmt.Sprintf("Options for group %s:", sub.HypGroup)}
+		for _, name := range poller.OptionNames() {
+			lines = append(lines, fmt.Sprintf("%s=%q", name, opts[name]))
+		}
+		lines = append(lines, "Use /set NAME VALUE to change an option, or /set NAME to unset it.")
+		return strings.Join(lines, "\n"), nil
+	}
+
+	// The value is the rest of the message, which may contain spaces and newlines.
+	name := args[0]
+	value := strings.TrimSpace(skipFields(msg.Payload, len(allArgs)-len(args)+1))
+	if err := poller.ValidateOption(name, value); err != nil {
+		return fmt.Sprintf("Invalid option: %v", err), nil
+	}
+	if err := tb.Storage.SetSubscriptionOption(sub.Key(), name, value); err != nil {
+		return "", fmt.Errorf("failed to set option: %v", err)
+	}
+	if value == "" {
+		return fmt.Sprintf("Unset %s", name), nil
+	}
+	return fmt.Sprintf("Set %s=%q", name, value), nil
+}
+
+// skipFields returns s without its first n space-separated fields.
+func skipFields(s string, n int) string {
+	for i := 0; i < n; i++ {
+		s = strings.TrimLeftFunc(s, unicode.IsSpace)
+		end := strings.IndexFunc(s, unicode.IsSpace)
+		if end < 0 {
+			return ""
+		}
+		s = s[end:]
+	}
+	return s
+}
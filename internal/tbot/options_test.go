@@ -0,0 +1,74 @@
+package tbot
+
+import (
+	"testing"
+	"time"
+
+	tele "gopkg.in/telebot.v3"
+
+	"github.com/objectiveryan/irsal/internal/common"
+	"github.com/objectiveryan/irsal/internal/db"
+	"github.com/objectiveryan/irsal/internal/fake"
+	"github.com/objectiveryan/irsal/internal/poller"
+)
+
+func TestOnSet(t *testing.T) {
+	s := db.NewInMemoryStorage()
+	s.AddSubscription(&common.Subscription{"ht", "g", time.Now(), 1})
+	tb := &Bot{Token: "token", Storage: s, Hyp: &fake.HypFactory{}}
+	chat := &tele.Chat{ID: 1}
+	key := common.SubKey{HypGroup: "g", ChatID: 1}
+
+	if _, err := tb.onSet(&tele.Message{Chat: chat, Payload: "digest  daily"}, []string{"digest", "daily"}); err != nil {
+		t.Fatalf("onSet() returned err=%v", err)
+	}
+	opts, err := s.SubscriptionOptions(key)
+	if err != nil {
+		t.Fatalf("SubscriptionOptions() returned err=%v", err)
+	}
+	if opts[poller.OptionDigest] != "daily" {
+		t.Errorf("digest=%q; want \"daily\"", opts[poller.OptionDigest])
+	}
+
+	// Invalid values aren't set
+	if _, err := tb.onSet(&tele.Message{Chat: chat, Payload: "g digest weekly"}, []string{"g", "digest", "weekly"}); err != nil {
+		t.Fatalf("onSet() returned err=%v", err)
+	}
+	opts, err = s.SubscriptionOptions(key)
+	if err != nil {
+		t.Fatalf("SubscriptionOptions() returned err=%v", err)
+	}
+	if opts[poller.OptionDigest] != "daily" {
+		t.Errorf("digest=%q; want \"daily\"", opts[poller.OptionDigest])
+	}
+
+	// Options can be unset
+	if _, err := tb.onSet(&tele.Message{Chat: chat, Payload: "g digest"}, []string{"g", "digest"}); err != nil {
+		t.Fatalf("onSet() returned err=%v", err)
+	}
+	opts, err = s.SubscriptionOptions(key)
+	if err != nil {
+		t.Fatalf("SubscriptionOptions() returned err=%v", err)
+	}
+	if _, ok := opts[poller.OptionDigest]; ok {
+		t.Errorf("digest=%q; want unset", opts[poller.OptionDigest])
+	}
+}
+
+func TestSkipFields(t *testing.T) {
+	for _, tt := range []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{"a b c", 1, " b c"},
+		{"  a \n b\nc d", 2, "\nc d"},
+		{"a", 1, ""},
+		{"a", 2, ""},
+		{"a b", 0, "a b"},
+	} {
+		if got := skipFields(tt.s, tt.n); got != tt.want {
+			t.Errorf("skipFields(%q, %d)=%q; want %q", tt.s, tt.n, got, tt.want)
+		}
+	}
+}
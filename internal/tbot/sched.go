@@ -0,0 +1,168 @@
+package tbot
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	tele "gopkg.in/telebot.v3"
+)
+
+// Telegram's documented limits are about 30 messages per second overall, one
+// message per second in a chat, and 20 messages per minute in a group.
+const (
+	defaultGlobalInterval = time.Second / 30
+	defaultChatInterval   = time.Second
+	defaultGroupInterval  = time.Minute / 20
+	defaultMaxRetries     = 5
+)
+
+// A Scheduler sends messages subject to Telegram's rate limits. Messages to
+// the same chat are sent in the order they were scheduled.
+type Scheduler struct {
+	// Minimum time between any two sends
+	GlobalInterval time.Duration
+	// Minimum time between sends to a private chat
+	ChatInterval time.Duration
+	// Minimum time between sends to a group chat
+	GroupInterval time.Duration
+	// How many times to retry a send which failed with a FloodError
+	MaxRetries int
+
+	mut        sync.Mutex
+	nextGlobal time.Time
+	chats      map[int64]*chatQueue
+}
+
+type chatQueue struct {
+	jobs    []*sendJob
+	running bool
+	// Earliest time of the next send to this chat
+	next time.Time
+}
+
+type sendJob struct {
+	send func() (int, error)
+	done chan sendResult
+}
+
+type sendResult struct {
+	messageID int
+	err       error
+}
+
+func NewScheduler() *Scheduler {
+	return &Scheduler{
+		GlobalInterval: defaultGlobalInterval,
+		ChatInterval:   defaultChatInterval,
+		GroupInterval:  defaultGroupInterval,
+		MaxRetries:     defaultMaxRetries,
+	}
+}
+
+// Send queues send to be called once the rate limits for chatID allow it,
+// and waits for it to return. If send returns a FloodError, it is retried
+// after the delay Telegram asked for.
+func (s *Scheduler) Send(chatID int64, send func() (int, error)) (int, error) {
+	job := &sendJob{send, make(chan sendResult, 1)}
+	s.mut.Lock()
+	if s.chats == nil {
+		s.chats = make(map[int64]*chatQueue)
+	}
+	q, ok := s.chats[chatID]
+	if !ok {
+		q = &chatQueue{}
+		s.chats[chatID] = q
+	}
+	q.jobs = append(q.jobs, job)
+	if !q.running {
+		q.running = true
+		go s.run(chatID, q)
+	}
+	s.mut.Unlock()
+
+	res := <-job.done
+	return res.messageID, res.err
+}
+
+// queued returns the number of jobs waiting to be sent to chatID.
+func (s *Scheduler) queued(chatID int64) int {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if q, ok := s.chats[chatID]; ok {
+		return len(q.jobs)
+	}
+	return 0
+}
+
+// run sends the jobs queued for one chat until there are none left, then
+// removes the chat's queue. It first waits out the chat's limit, since a new
+// queue wouldn't know about it.
+func (s *Scheduler) run(chatID int64, q *chatQueue) {
+	for {
+		s.mut.Lock()
+		if len(q.jobs) == 0 {
+			if next := q.next; time.Now().Before(next) {
+				s.mut.Unlock()
+				time.Sleep(time.Until(next))
+				continue
+			}
+			q.running = false
+			delete(s.chats, chatID)
+			s.mut.Unlock()
+			return
+		}
+		job := q.jobs[0]
+		q.jobs = q.jobs[1:]
+		s.mut.Unlock()
+
+		messageID, err := s.attempt(chatID, q, job.send)
+		job.done <- sendResult{messageID, err}
+	}
+}
+
+func (s *Scheduler) attempt(chatID int64, q *chatQueue, send func() (int, error)) (int, error) {
+	for retries := 0; ; retries++ {
+		s.wait(chatID, q)
+		messageID, err := send()
+		var flood tele.FloodError
+		if errors.As(err, &flood) && retries < s.MaxRetries {
+			delay := time.Duration(flood.RetryAfter) * time.Second
+			log.Printf("Flood control in chat %d; retrying after %v", chatID, delay)
+			s.mut.Lock()
+			q.next = later(q.next, time.Now().Add(delay))
+			s.mut.Unlock()
+			continue
+		}
+		return messageID, err
+	}
+}
+
+// wait blocks until a message may be sent to the chat.
+func (s *Scheduler) wait(chatID int64, q *chatQueue) {
+	// Wait for the chat's own limit first, so a chat which is being throttled
+	// doesn't hold up the global limit for other chats.
+	s.mut.Lock()
+	next := q.next
+	s.mut.Unlock()
+	time.Sleep(time.Until(next))
+
+	interval := s.ChatInterval
+	if chatID < 0 {
+		interval = s.GroupInterval
+	}
+	s.mut.Lock()
+	t := later(time.Now(), s.nextGlobal)
+	s.nextGlobal = t.Add(s.GlobalInterval)
+	q.next = t.Add(interval)
+	s.mut.Unlock()
+	time.Sleep(time.Until(t))
+}
+
+func later(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
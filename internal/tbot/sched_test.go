@@ -0,0 +1,133 @@
+package tbot
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	tele "gopkg.in/telebot.v3"
+)
+
+func TestScheduler_SameChatInOrder(t *testing.T) {
+	s := &Scheduler{}
+	const chatID = 1
+	const n = 5
+	var order []int
+	var mut sync.Mutex
+	block := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer wg.Done()
+			s.Send(chatID, func() (int, error) {
+				if i == 0 {
+					<-block
+				}
+				mut.Lock()
+				order = append(order, i)
+				mut.Unlock()
+				return i, nil
+			})
+		}()
+		// Wait until the send is queued (or, for the first, started) before scheduling the next.
+		for i > 0 && s.queued(chatID) != i {
+			time.Sleep(time.Millisecond)
+		}
+		if i == 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	close(block)
+	wg.Wait()
+	for i, got := range order {
+		if got != i {
+			t.Fatalf("Sends happened in order %v; want ascending", order)
+		}
+	}
+}
+
+func TestScheduler_ChatInterval(t *testing.T) {
+	const interval = 20 * time.Millisecond
+	s := &Scheduler{ChatInterval: interval, GroupInterval: time.Hour}
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if _, err := s.Send(1, func() (int, error) { return 0, nil }); err != nil {
+			t.Fatalf("Send() returned err=%v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 2*interval {
+		t.Errorf("3 sends took %v; want at least %v", elapsed, 2*interval)
+	}
+}
+
+func TestScheduler_GlobalInterval(t *testing.T) {
+	const interval = 20 * time.Millisecond
+	s := &Scheduler{GlobalInterval: interval}
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		// Different chats, so only the global limit applies.
+		if _, err := s.Send(int64(i), func() (int, error) { return 0, nil }); err != nil {
+			t.Fatalf("Send() returned err=%v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed < 2*interval {
+		t.Errorf("3 sends took %v; want at least %v", elapsed, 2*interval)
+	}
+}
+
+func TestScheduler_FloodRetry(t *testing.T) {
+	s := &Scheduler{MaxRetries: 1}
+	calls := 0
+	messageID, err := s.Send(1, func() (int, error) {
+		calls++
+		if calls == 1 {
+			return -1, tele.FloodError{RetryAfter: 0}
+		}
+		return 7, nil
+	})
+	if err != nil {
+		t.Fatalf("Send() returned err=%v", err)
+	}
+	if messageID != 7 {
+		t.Errorf("Send() returned %d; want 7", messageID)
+	}
+	if calls != 2 {
+		t.Errorf("send called %d times; want 2", calls)
+	}
+}
+
+func TestScheduler_FloodRetriesExhausted(t *testing.T) {
+	s := &Scheduler{MaxRetries: 2}
+	calls := 0
+	_, err := s.Send(1, func() (int, error) {
+		calls++
+		return -1, tele.FloodError{RetryAfter: 0}
+	})
+	var flood tele.FloodError
+	if !errors.As(err, &flood) {
+		t.Fatalf("Send() returned err=%#v; want FloodError", err)
+	}
+	if calls != 3 {
+		t.Errorf("send called %d times; want 3", calls)
+	}
+}
+
+func TestScheduler_DrainedQueueRemoved(t *testing.T) {
+	s := &Scheduler{ChatInterval: time.Millisecond}
+	if _, err := s.Send(1, func() (int, error) { return 0, nil }); err != nil {
+		t.Fatalf("Send() returned err=%v", err)
+	}
+	for start := time.Now(); ; time.Sleep(time.Millisecond) {
+		s.mut.Lock()
+		n := len(s.chats)
+		s.mut.Unlock()
+		if n == 0 {
+			break
+		}
+		if time.Since(start) > time.Second {
+			t.Fatalf("%d chat queues left after the queue drained; want 0", n)
+		}
+	}
+}
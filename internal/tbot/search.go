@@ -0,0 +1,165 @@
+package tbot
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"strconv"
+	"strings"
+	"time"
+
+	tele "gopkg.in/telebot.v3"
+
+	"github.com/objectiveryan/irsal/internal/common"
+	"github.com/objectiveryan/irsal/internal/hyp"
+	"github.com/objectiveryan/irsal/internal/markup"
+	"github.com/objectiveryan/irsal/internal/poller"
+)
+
+const (
+	// How many results each page of /search shows
+	searchPageSize = 5
+	// How long the results of /search can be paged through
+	searchLifetime = time.Hour
+	// How much of each result's text is shown
+	searchTextLength = 100
+)
+
+// A search is a /search whose results can be paged through.
+type search struct {
+	sub   *common.Subscription
+	query *hyp.SearchQuery
+	// The arguments it was given
+	args    string
+	created time.Time
+}
+
+// A messageKey identifies a message the bot sent.
+type messageKey struct {
+	chatID    int64
+	messageID int
+}
+
+// parseSearchQuery parses the arguments of /search. Words are looked for in
+// annotations' text, and words starting with user:, tag: or uri: narrow the
+// search.
+func parseSearchQuery(args []string) *hyp.SearchQuery {
+	q := &hyp.SearchQuery{Limit: searchPageSize}
+	var words []string
+	for _, arg := range args {
+		name, value, _ := strings.Cut(arg, ":")
+		switch {
+		case name == "user" && value != "":
+			q.User = value
+		case name == "tag" && value != "":
+			q.Tag = value
+		case name == "uri" && value != "":
+			q.URI = value
+		default:
+			words = append(words, arg)
+		}
+	}
+	q.Text = strings.Join(words, " ")
+	return q
+}
+
+// newSearch starts a search, or returns a reply saying why it can't.
+func (tb *Bot) newSearch(msg *tele.Message, allArgs []string) (*search, string, error) {
+	sub, args, err := tb.chatSubscription(msg.Chat.ID, allArgs)
+	if err == errNoSubscription {
+		return nil, noSubscriptionText, nil
+	} else if err != nil {
+		return nil, "", err
+	}
+	if len(args) == 0 {
+		return nil, fmt.Sprintf("Send /search WORDS to search group %s's annotations. Narrow it down with user:NAME, tag:TAG or uri:URL.", sub.HypGroup), nil
+	}
+	return &search{sub, parseSearchQuery(args), strings.Join(args, " "), time.Now()}, "", nil
+}
+
+// saveSearch remembers the search whose results are in a message, so they
+// can be paged through, and forgets old ones.
+func (tb *Bot) saveSearch(key messageKey, s *search) {
+	tb.mut.Lock()
+	defer tb.mut.Unlock()
+	if tb.searches == nil {
+		tb.searches = make(map[messageKey]*search)
+	}
+	for k, old := range tb.searches {
+		if time.Since(old.created) > searchLifetime {
+			delete(tb.searches, k)
+		}
+	}
+	tb.searches[key] = s
+}
+
+func (tb *Bot) savedSearch(key messageKey) *search {
+	tb.mut.Lock()
+	defer tb.mut.Unlock()
+	s := tb.searches[key]
+	if s == nil || time.Since(s.created) > searchLifetime {
+		return nil
+	}
+	return s
+}
+
+// messageLink links to a message, if its chat is a supergroup or channel.
+func messageLink(chatID int64, messageID int) string {
+	const prefix = "-100"
+	id := strconv.FormatInt(chatID, 10)
+	if !strings.HasPrefix(id, prefix) {
+		return ""
+	}
+	return fmt.Sprintf("https://t.me/c/%s/%d", id[len(prefix):], messageID)
+}
+
+// searchPage returns the text and buttons of the page of results starting
+// at offset.
+func (tb *Bot) searchPage(ctxt context.Context, s *search, offset int) (string, *tele.ReplyMarkup, error) {
+	q := *s.query
+	q.Offset = offset
+	res, err := tb.Hyp.NewClient(s.sub.HypToken, s.sub.HypGroup).Search(ctxt, &q)
+	if err != nil {
+		return "", nil, err
+	}
+	var b strings.Builder
+	if len(res.Annotations) == 0 {
+		fmt.Fprintf(&b, "No annotations match <i>%s</i>.", html.EscapeString(s.args))
+		return b.String(), nil, nil
+	}
+	fmt.Fprintf(&b, "<b>Results %d–%d of %d</b> for <i>%s</i>\n", offset+1, offset+len(res.Annotations), res.Total, html.EscapeString(s.args))
+	for i, annot := range res.Annotations {
+		d := poller.LookupAnnotationData(tb.Storage, annot)
+		fmt.Fprintf(&b, "\n%d. <b>%s</b>", offset+i+1, html.EscapeString(d.DisplayName))
+		if d.Title != "" {
+			fmt.Fprintf(&b, " on <i>%s</i>", html.EscapeString(d.Title))
+		}
+		// The text is shortened, so leave out its formatting.
+		if text, _ := markup.FromMarkdown(annot.Text); text != "" {
+			fmt.Fprintf(&b, ": %s", html.EscapeString(poller.Truncate(text, searchTextLength)))
+		}
+		fmt.Fprintf(&b, " <a href=\"%s\">annotation</a>", html.EscapeString(d.Link))
+		messageID, err := tb.Storage.MessageID(annot.ID, s.sub.ChatID)
+		if err == nil {
+			if link := messageLink(s.sub.ChatID, messageID); link != "" {
+				fmt.Fprintf(&b, " · <a href=\"%s\">message</a>", link)
+			}
+		} else if err != common.ErrNotFound {
+			return "", nil, fmt.Errorf("failed to look up message for %q: %v", annot.ID, err)
+		}
+	}
+
+	keyboard := &tele.ReplyMarkup{}
+	var row []tele.Btn
+	if offset > 0 {
+		row = append(row, keyboard.Data("« Previous", "search", strconv.Itoa(max(offset-searchPageSize, 0))))
+	}
+	if offset+len(res.Annotations) < res.Total {
+		row = append(row, keyboard.Data("Next »", "search", strconv.Itoa(offset+len(res.Annotations))))
+	}
+	if len(row) == 0 {
+		return b.String(), nil, nil
+	}
+	keyboard.Inline(row)
+	return b.String(), keyboard, nil
+}
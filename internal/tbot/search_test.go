@@ -0,0 +1,95 @@
+package tbot
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	tele "gopkg.in/telebot.v3"
+
+	"github.com/objectiveryan/irsal/internal/common"
+	"github.com/objectiveryan/irsal/internal/db"
+	"github.com/objectiveryan/irsal/internal/fake"
+	"github.com/objectiveryan/irsal/internal/hyp"
+)
+
+func TestParseSearchQuery(t *testing.T) {
+	got := parseSearchQuery([]string{"climate", "user:alice", "tag:policy", "uri:https://example.test/a:b", "change", "note:"})
+	want := &hyp.SearchQuery{Text: "climate change note:", User: "alice", Tag: "policy", URI: "https://example.test/a:b", Limit: searchPageSize}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseSearchQuery()=%+v; want %+v", got, want)
+	}
+}
+
+// buttons returns the data of each inline button.
+func buttons(keyboard *tele.ReplyMarkup) []string {
+	if keyboard == nil {
+		return nil
+	}
+	var data []string
+	for _, row := range keyboard.InlineKeyboard {
+		for _, b := range row {
+			data = append(data, b.Text+"="+b.Data)
+		}
+	}
+	return data
+}
+
+func TestSearchPage(t *testing.T) {
+	const CHAT_ID = -1001234
+	var annots []*hyp.Annotation
+	for i := 1; i <= 7; i++ {
+		annots = append(annots, &hyp.Annotation{
+			ID:      fmt.Sprintf("a%d", i),
+			Group:   "g",
+			User:    "acct:alice@hypothes.is",
+			Text:    fmt.Sprintf("About **climate** %d", i),
+			Updated: hyp.ToTimestamp(time.Unix(int64(i), 0)),
+		})
+	}
+	annots = append(annots, &hyp.Annotation{ID: "other", Group: "g", Text: "Unrelated", Updated: hyp.ToTimestamp(time.Unix(8, 0))})
+	s := db.NewInMemoryStorage()
+	s.AddSubscription(&common.Subscription{"ht", "g", time.Now(), CHAT_ID})
+	s.SetMessageID("a7", common.AnnotationMetadata{HypGroup: "g"}, CHAT_ID, 42)
+	tb := &Bot{Token: "token", Storage: s, Hyp: fake.NewHypFactory(annots)}
+
+	srch, reply, err := tb.newSearch(&tele.Message{Chat: &tele.Chat{ID: CHAT_ID}}, []string{"climate"})
+	if err != nil || srch == nil {
+		t.Fatalf("newSearch() returned %v, %q, err=%v", srch, reply, err)
+	}
+	text, keyboard, err := tb.searchPage(context.TODO(), srch, 0)
+	if err != nil {
+		t.Fatalf("searchPage() returned err=%v", err)
+	}
+	for _, want := range []string{
+		"<b>Results 1–5 of 7</b> for <i>climate</i>",
+		"1. <b>alice</b>: About climate 7 <a href=\"https://hypothes.is/a/a7\">annotation</a> · <a href=\"https://t.me/c/1234/42\">message</a>\n",
+		"5. <b>alice</b>: About climate 3 <a href=\"https://hypothes.is/a/a3\">annotation</a>",
+	} {
+		if !strings.Contains(text, want) {
+			t.Errorf("First page %q doesn't contain %q", text, want)
+		}
+	}
+	if got, want := buttons(keyboard), []string{"Next »=5"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("First page has buttons %q; want %q", got, want)
+	}
+
+	text, keyboard, err = tb.searchPage(context.TODO(), srch, 5)
+	if err != nil {
+		t.Fatalf("searchPage() returned err=%v", err)
+	}
+	if !strings.Contains(text, "<b>Results 6–7 of 7</b>") || !strings.Contains(text, "7. <b>alice</b>: About climate 1") {
+		t.Errorf("Second page is %q", text)
+	}
+	if got, want := buttons(keyboard), []string{"« Previous=0"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Second page has buttons %q; want %q", got, want)
+	}
+
+	srch.query.Text = "nothing"
+	if text, keyboard, err := tb.searchPage(context.TODO(), srch, 0); err != nil || !strings.HasPrefix(text, "No annotations") || keyboard != nil {
+		t.Errorf("searchPage() with no results returned %q, %v, err=%v", text, keyboard, err)
+	}
+}
@@ -2,25 +2,53 @@ package tbot
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log"
+	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"text/template"
 	"time"
+	"unicode/utf16"
 
 	tele "gopkg.in/telebot.v3"
 	"gopkg.in/telebot.v3/middleware"
 
 	"github.com/objectiveryan/irsal/internal/common"
+	"github.com/objectiveryan/irsal/internal/crypt"
 	"github.com/objectiveryan/irsal/internal/hyp"
+	"github.com/objectiveryan/irsal/internal/markup"
+	"github.com/objectiveryan/irsal/internal/media"
+	"github.com/objectiveryan/irsal/internal/oauth"
+	"github.com/objectiveryan/irsal/internal/poller"
 )
 
 type Bot struct {
 	Token   string
 	Storage common.Storage
 	Hyp     hyp.ClientFactory
+	// Encrypts users' Hypothesis tokens. If nil, users can't log in.
+	Cipher *crypt.Cipher
+	// If set, users log in with Hypothesis instead of sending API tokens,
+	// and administrators can connect accounts to subscriptions.
+	OAuth *oauth.Linker
+	// Stores photos, files and other media sent in replies. If nil, only
+	// their captions are posted.
+	Media media.Store
+
+	mut sync.Mutex
+	// Users who sent /login and whose next message should be their token
+	awaitingToken map[int64]bool
+	// Searches by the message showing their results
+	searches map[messageKey]*search
 }
 
 func formatUser(user *tele.User) string {
+	if user == nil {
+		return "Someone"
+	}
 	var nameParts []string
 	if user.FirstName != "" {
 		nameParts = append(nameParts, user.FirstName)
@@ -44,8 +72,61 @@ func formatUser(user *tele.User) string {
 	return "Someone"
 }
 
-func MessageText(msg *tele.Message) string {
-	return fmt.Sprintf("%s wrote \"%s\"", formatUser(msg.Sender), msg.Text)
+// formatChat names a chat which a message was sent on behalf of.
+func formatChat(chat *tele.Chat) string {
+	if chat.Username != "" {
+		if chat.Title != "" {
+			return fmt.Sprintf("%s (%s)", chat.Title, chat.Username)
+		}
+		return chat.Username
+	}
+	if chat.Title != "" {
+		return chat.Title
+	}
+	return "Someone"
+}
+
+// sendingUser returns the user who sent a message, or nil if it was sent on
+// behalf of a chat: by an anonymous administrator, or in or from a channel.
+// Telegram sets placeholder users as the senders of those.
+func sendingUser(msg *tele.Message) *tele.User {
+	if msg.SenderChat != nil {
+		return nil
+	}
+	return msg.Sender
+}
+
+// formatSender names whoever a message was sent by or on behalf of.
+func formatSender(msg *tele.Message) string {
+	if msg.SenderChat != nil {
+		return formatChat(msg.SenderChat)
+	}
+	return formatUser(msg.Sender)
+}
+
+func senderData(msg *tele.Message) poller.SenderData {
+	d := poller.SenderData{Name: formatSender(msg)}
+	if chat := msg.SenderChat; chat != nil {
+		d.ID = chat.ID
+		d.FirstName = chat.Title
+		d.Username = chat.Username
+	} else if user := msg.Sender; user != nil {
+		d.ID = user.ID
+		d.FirstName = user.FirstName
+		d.LastName = user.LastName
+		d.Username = user.Username
+	}
+	return d
+}
+
+// MessageText renders the text of the annotation created for a chat message
+// from sender, whose text has already been converted to Markdown. If tmpl is
+// nil, the default template is used.
+func MessageText(tmpl *template.Template, sender poller.SenderData, text string, uri string) (string, error) {
+	if tmpl == nil {
+		tmpl = poller.ParseOptions(nil).ChatTemplate
+	}
+	return poller.Render(tmpl, &poller.ChatMessageData{Sender: sender, Text: text, URI: uri})
 }
 
 func (tb *Bot) onText(msg *tele.Message) error {
@@ -54,41 +135,84 @@ func (tb *Bot) onText(msg *tele.Message) error {
 		return nil
 	}
 	log.Printf("onText: ChatID=%d MessageID=%d Text=%q", msg.Chat.ID, msg.ID, msg.Text)
+	if msg.AutomaticForward {
+		return tb.recordForward(msg)
+	}
+	// Hypothesis annotations are Markdown, so keep the formatting of the message.
+	return tb.bridgeReply(msg, markup.ToMarkdown(msg.Text, msg.Entities), nil)
+}
+
+// bridgeReply posts a message replying to an annotation's message as a reply
+// to the annotation. If attach is given, it's called once the message is
+// known to be a reply, and returns Markdown to add to the body.
+func (tb *Bot) bridgeReply(msg *tele.Message, body string, attach func() (string, error)) error {
 	if msg.ReplyTo == nil {
-		log.Println("Ignoring OnText which is not a reply")
+		log.Println("Ignoring message which is not a reply")
+		return nil
+	}
+	if msg.TopicMessage && msg.ReplyTo.ID == msg.ThreadID {
+		// Messages in a forum topic which aren't replies to anything else
+		// reply to the message which created the topic.
+		log.Println("Ignoring message in topic which is not a reply")
 		return nil
 	}
 	if msg.ReplyTo.Chat.ID != msg.Chat.ID {
-		log.Println("Ignoring OnText reply in different chat from parent")
+		log.Println("Ignoring reply in different chat from parent")
 		return nil
 	}
 	parentAnnotID, parentMeta, err := tb.Storage.AnnotationID(msg.Chat.ID, msg.ReplyTo.ID)
 	if err == common.ErrNotFound {
-		log.Println("Ignoring OnText reply to non-annotation message")
+		// The text returned leaves out the item number.
+		parentAnnotID, parentMeta, body, err = tb.digestParent(msg.Chat.ID, msg.ReplyTo.ID, body)
+	}
+	if err == common.ErrNotFound {
+		log.Println("Ignoring reply to non-annotation message")
 		return nil
 	} else if err != nil {
 		return fmt.Errorf("failed to look up annotation for message: %v", err)
 	}
 
-	sub, err := tb.Storage.Subscription(msg.Chat.ID, parentMeta.HypGroup)
+	sub, err := tb.replySubscription(msg.Chat.ID, parentMeta.HypGroup)
 	if err == common.ErrNotFound {
 		// This seems unlikely given that there's an annotation associated with the parent message.
 		// But it can happen if we delete a subscription.
-		log.Println("Ignoring OnText reply to chat without subscription")
+		log.Println("Ignoring reply to chat without subscription")
 		return nil
 	} else if err != nil {
 		return fmt.Errorf("failed to look up subscription for chat: %v", err)
 	}
 
+	raw, err := tb.Storage.SubscriptionOptions(sub.Key())
+	if err != nil {
+		return fmt.Errorf("failed to get options: %v", err)
+	}
+	if msg.Quote != nil && msg.Quote.Text != "" {
+		// Show which part of the message replied to the reply is about.
+		body = strings.TrimSpace(quoteMarkdown(msg.Quote) + "\n\n" + body)
+	}
+	if attach != nil {
+		attachment, err := attach()
+		if err != nil {
+			return err
+		}
+		body = strings.TrimSpace(body + "\n\n" + attachment)
+		if body == "" {
+			log.Println("Ignoring media reply with no caption or stored media")
+			return nil
+		}
+	}
+
 	refs := append(parentMeta.References, parentAnnotID)
 	// Lock the storage so the poller can't try to look up the message ID for the annotation before we record it.
 	tb.Storage.Lock()
 	defer tb.Storage.Unlock()
-	annotID, err := tb.Hyp.NewClient(sub.HypToken, sub.HypGroup).Reply(context.TODO(), MessageText(msg), refs, parentMeta.URI)
+	opts := poller.ParseOptions(raw)
+	annotID, text, err := tb.postReply(context.TODO(), sub, opts, msg, body, refs, parentMeta.URI, messageTags(msg, opts.TagRules))
 	if err != nil {
 		log.Printf("Failed to post annotation reply to %v: %v", parentAnnotID, err)
 		return err
 	}
+	tb.recordOrigin(annotID, msg, text, body)
 	err = tb.Storage.SetMessageID(annotID, common.AnnotationMetadata{refs, sub.HypGroup, parentMeta.URI}, msg.Chat.ID, msg.ID)
 	if err != nil {
 		log.Printf("Failed to record annotation for chat reply: %v", err)
@@ -98,35 +222,302 @@ func (tb *Bot) onText(msg *tele.Message) error {
 	return err
 }
 
+// messageTags returns the tags for the hashtags in a message or its caption.
+func messageTags(msg *tele.Message, rules poller.TagRules) []string {
+	text, ents := msg.Text, msg.Entities
+	if text == "" {
+		text, ents = msg.Caption, msg.CaptionEntities
+	}
+	u := utf16.Encode([]rune(text))
+	var tags []string
+	seen := make(map[string]bool)
+	for _, ent := range ents {
+		if ent.Type != tele.EntityHashtag || ent.Offset < 0 || ent.Offset+ent.Length > len(u) {
+			continue
+		}
+		tag := rules.Tag(string(utf16.Decode(u[ent.Offset : ent.Offset+ent.Length])))
+		if tag != "" && !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// postReply posts a reply as the sender if they have logged in, or else with
+// the subscription's token, saying who it's from. It returns the
+// annotation's ID and text.
+func (tb *Bot) postReply(ctxt context.Context, sub *common.Subscription, opts *poller.Options, msg *tele.Message, body string, refs []string, uri string, tags []string) (string, string, error) {
+	sender := sendingUser(msg)
+	client, hypUser, err := tb.userClient(sender, sub.HypGroup)
+	if err != nil {
+		log.Printf("Failed to get Hypothesis client for user %d: %v", sender.ID, err)
+	} else if client != nil {
+		annotID, err := client.Reply(ctxt, body, refs, uri, tags)
+		if err == nil {
+			tb.linkUser(sender, hypUser)
+			return annotID, body, nil
+		}
+		log.Printf("Failed to post reply as user %d, so posting it with the subscription's token: %v", sender.ID, err)
+	}
+	text, err := MessageText(opts.ChatTemplate, senderData(msg), body, uri)
+	if err != nil {
+		return "", "", err
+	}
+	annotID, err := tb.Hyp.NewClient(sub.HypToken, sub.HypGroup).Reply(ctxt, text, refs, uri, tags)
+	return annotID, text, err
+}
+
+// recordOrigin records the message an annotation was posted from, so the
+// poller doesn't echo it back and shows who sent it elsewhere.
+func (tb *Bot) recordOrigin(annotID string, msg *tele.Message, text, body string) {
+	o := &common.AnnotationOrigin{AnnotID: annotID, ChatID: msg.Chat.ID, MessageID: msg.ID, Name: formatSender(msg), Text: text, Body: body}
+	if user := sendingUser(msg); user != nil {
+		o.UserID = user.ID
+	}
+	if err := tb.Storage.AddAnnotationOrigin(o); err != nil {
+		log.Printf("Failed to record origin of annotation %q: %v", annotID, err)
+	}
+}
+
+// quoteMarkdown formats the part of a message quoted by a reply as a Markdown
+// blockquote.
+func quoteMarkdown(q *tele.TextQuote) string {
+	ents := append(tele.Entities{{Type: tele.EntityBlockquote, Length: markup.Length(q.Text)}}, q.Entities...)
+	return markup.ToMarkdown(q.Text, ents)
+}
+
+// The brackets may be escaped, since the text is Markdown.
+var digestItemRegexp = regexp.MustCompile(`^\s*(?:#|\\?\[)?(\d+)(?:\\?\]|[.:)])?\s+`)
+
+// digestParent finds the annotation that a reply to a digest message refers
+// to. Unless the digest has only one item, the reply must start with the item's
+// number, which is removed from the returned text.
+func (tb *Bot) digestParent(chatID int64, messageID int, text string) (string, common.AnnotationMetadata, string, error) {
+	var noMeta common.AnnotationMetadata
+	items, err := tb.Storage.DigestMessageItems(chatID, messageID)
+	if err != nil {
+		return "", noMeta, "", err
+	}
+	if len(items) == 0 {
+		return "", noMeta, "", common.ErrNotFound
+	}
+	if m := digestItemRegexp.FindStringSubmatchIndex(text); m != nil {
+		n, err := strconv.Atoi(text[m[2]:m[3]])
+		if err == nil && n >= 1 && n <= len(items) {
+			return items[n-1].AnnotID, items[n-1].Meta, text[m[1]:], nil
+		}
+	}
+	if len(items) == 1 {
+		return items[0].AnnotID, items[0].Meta, text, nil
+	}
+	log.Println("Reply to digest message doesn't start with an item number")
+	return "", noMeta, "", common.ErrNotFound
+}
+
+var errNoSubscription = errors.New("no matching subscription")
+
+const noSubscriptionText = "This chat has no matching subscription. If it has several, give the Hypothesis group ID first."
+
+// chatSubscription finds the subscription a command in chatID refers to. If
+// the chat has more than one, the first argument must name the group.
+func (tb *Bot) chatSubscription(chatID int64, args []string) (*common.Subscription, []string, error) {
+	subs, err := tb.Storage.Subscriptions()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get subscriptions: %v", err)
+	}
+	var chatSubs []*common.Subscription
+	for _, sub := range subs {
+		if sub.ChatID == chatID {
+			chatSubs = append(chatSubs, sub)
+		}
+	}
+	if len(args) > 0 {
+		for _, sub := range chatSubs {
+			if sub.HypGroup == args[0] {
+				return sub, args[1:], nil
+			}
+		}
+	}
+	if len(chatSubs) == 1 {
+		return chatSubs[0], args, nil
+	}
+	return nil, nil, errNoSubscription
+}
+
 type BotRunner struct {
 	b       *Bot
 	tb      *tele.Bot
 	tbReady chan struct{}
+	sched   *Scheduler
+
+	mut sync.Mutex
+	// Whether users are members of chats, by chat and user ID
+	members map[[2]int64]membership
 }
 
 func NewBotRunner(b *Bot) *BotRunner {
-	return &BotRunner{b, nil, make(chan struct{})}
+	return &BotRunner{b: b, tbReady: make(chan struct{}), sched: NewScheduler()}
 }
 
 // for poller.MessageSender
-func (r *BotRunner) Send(chatID int64, parentMessageID int, text string) (messageID int, err error) {
+func (r *BotRunner) Send(chatID int64, parentMessageID int, msg *common.Message) (messageID int, err error) {
 	<-r.tbReady
-	var msg *tele.Message
-	if parentMessageID == 0 {
-		msg, err = r.tb.Send(&tele.Chat{ID: chatID}, text)
-	} else {
-		msg, err = r.tb.Reply(&tele.Message{ID: parentMessageID, Chat: &tele.Chat{ID: chatID}}, text)
+	opts := &tele.SendOptions{DisableWebPagePreview: msg.NoPreview}
+	if msg.HTML {
+		opts.ParseMode = tele.ModeHTML
+	}
+	if parentMessageID != 0 {
+		opts.ReplyTo = &tele.Message{ID: parentMessageID, Chat: &tele.Chat{ID: chatID}}
+	}
+	opts.ThreadID = msg.ThreadID
+	opts.ReplyMarkup = replyMarkup(msg.Buttons)
+	return r.sched.Send(chatID, func() (int, error) {
+		sent, err := r.tb.Send(&tele.Chat{ID: chatID}, msg.Text, opts)
+		if err != nil {
+			return -1, err
+		}
+		return sent.ID, nil
+	})
+}
+
+// for poller.MessageSender
+func (r *BotRunner) Edit(chatID int64, messageID int, msg *common.Message) error {
+	<-r.tbReady
+	opts := &tele.SendOptions{DisableWebPagePreview: msg.NoPreview}
+	if msg.HTML {
+		opts.ParseMode = tele.ModeHTML
+	}
+	_, err := r.sched.Send(chatID, func() (int, error) {
+		edited, err := r.tb.Edit(&tele.StoredMessage{MessageID: strconv.Itoa(messageID), ChatID: chatID}, msg.Text, opts)
+		if err != nil {
+			return -1, err
+		}
+		return edited.ID, nil
+	})
+	return err
+}
+
+// for poller.MessageSender
+func (r *BotRunner) CreateTopic(chatID int64, name string) (int, error) {
+	<-r.tbReady
+	return r.sched.Send(chatID, func() (int, error) {
+		topic, err := r.tb.CreateTopic(&tele.Chat{ID: chatID}, &tele.Topic{Name: name})
+		if err != nil {
+			return -1, err
+		}
+		return topic.ThreadID, nil
+	})
+}
+
+// command adapts a command handler which returns the text to reply with.
+func (r *BotRunner) command(fn func(msg *tele.Message, args []string) (string, error)) tele.HandlerFunc {
+	return func(c tele.Context) error {
+		reply, err := fn(c.Message(), c.Args())
+		if err != nil {
+			return err
+		}
+		return c.Reply(reply)
+	}
+}
+
+// adminOnly is middleware restricting commands in group chats to administrators.
+func (r *BotRunner) adminOnly(next tele.HandlerFunc) tele.HandlerFunc {
+	return func(c tele.Context) error {
+		chat := c.Chat()
+		if chat.Type == tele.ChatPrivate {
+			return next(c)
+		}
+		// Anonymous administrators send messages on behalf of the group.
+		if msg := c.Message(); msg != nil && msg.SenderChat != nil && msg.SenderChat.ID == chat.ID {
+			return next(c)
+		}
+		member, err := r.tb.ChatMemberOf(chat, c.Sender())
+		if err != nil {
+			return fmt.Errorf("failed to look up chat member: %v", err)
+		}
+		if member.Role != tele.Administrator && member.Role != tele.Creator {
+			return c.Reply("Only chat administrators can do that.")
+		}
+		return next(c)
 	}
+}
+
+// onConnect sends the login link to the sender privately, since whoever
+// follows it chooses the account the subscription reads with.
+func (r *BotRunner) onConnect(c tele.Context) error {
+	link, reply, err := r.b.onConnect(c.Message(), c.Args())
 	if err != nil {
-		return -1, err
+		return err
+	}
+	if link != "" {
+		if _, err := r.tb.Send(c.Sender(), link, &tele.SendOptions{DisableWebPagePreview: true}); err != nil {
+			log.Printf("Failed to send login link to user %d: %v", c.Sender().ID, err)
+			return c.Reply("I can't message you. Please start a private chat with me, then send /connect again.")
+		}
 	}
-	return msg.ID, nil
+	if reply == "" {
+		return nil
+	}
+	return c.Reply(reply)
+}
+
+func (r *BotRunner) onSearch(c tele.Context) error {
+	s, reply, err := r.b.newSearch(c.Message(), c.Args())
+	if err != nil {
+		return err
+	} else if s == nil {
+		return c.Reply(reply)
+	}
+	text, keyboard, err := r.b.searchPage(context.TODO(), s, 0)
+	if err != nil {
+		log.Printf("Failed to search %v: %v", s.sub.Key(), err)
+		return c.Reply("The search failed. Please try again later.")
+	}
+	opts := &tele.SendOptions{ParseMode: tele.ModeHTML, DisableWebPagePreview: true, ReplyTo: c.Message(), ReplyMarkup: keyboard}
+	if c.Message().TopicMessage {
+		opts.ThreadID = c.Message().ThreadID
+	}
+	sent, err := r.tb.Send(c.Chat(), text, opts)
+	if err != nil {
+		return err
+	}
+	if keyboard != nil {
+		r.b.saveSearch(messageKey{sent.Chat.ID, sent.ID}, s)
+	}
+	return nil
+}
+
+// onSearchPage shows another page of results when a button under them is
+// pressed.
+func (r *BotRunner) onSearchPage(c tele.Context) error {
+	msg := c.Callback().Message
+	if msg == nil {
+		return c.Respond()
+	}
+	s := r.b.savedSearch(messageKey{msg.Chat.ID, msg.ID})
+	if s == nil {
+		return c.Respond(&tele.CallbackResponse{Text: "This search has expired. Please send /search again."})
+	}
+	offset, err := strconv.Atoi(c.Data())
+	if err != nil || offset < 0 {
+		return c.Respond(&tele.CallbackResponse{Text: "Invalid page"})
+	}
+	text, keyboard, err := r.b.searchPage(context.TODO(), s, offset)
+	if err != nil {
+		log.Printf("Failed to search %v: %v", s.sub.Key(), err)
+		return c.Respond(&tele.CallbackResponse{Text: "The search failed. Please try again later."})
+	}
+	if err := c.Edit(text, &tele.SendOptions{ParseMode: tele.ModeHTML, DisableWebPagePreview: true, ReplyMarkup: keyboard}); err != nil {
+		return err
+	}
+	return c.Respond()
 }
 
 func (r *BotRunner) Run(ctxt context.Context) error {
 	pref := tele.Settings{
 		Token:  r.b.Token,
-		Poller: &tele.LongPoller{Timeout: 10 * time.Second},
+		Poller: r.migrationPoller(&tele.LongPoller{Timeout: 10 * time.Second}),
 	}
 
 	tb, err := tele.NewBot(pref)
@@ -139,8 +530,40 @@ func (r *BotRunner) Run(ctxt context.Context) error {
 
 	tb.Handle(tele.OnText, func(c tele.Context) error {
 		log.Println("tele.OnText")
-		return r.b.onText(c.Message())
+		reply, err := r.b.onLoginToken(c.Message())
+		if err != nil {
+			return err
+		} else if reply != "" {
+			return c.Reply(reply)
+		}
+		if err := r.b.onText(c.Message()); err != nil {
+			return err
+		}
+		return r.onLinks(c)
+	})
+	for _, event := range mediaEvents {
+		tb.Handle(event, func(c tele.Context) error {
+			return r.b.onMedia(context.TODO(), c.Message(), r.tb.File)
+		})
+	}
+	tb.Handle(tele.OnChannelPost, r.onChannelPost)
+	tb.Handle(tele.OnMigration, func(c tele.Context) error {
+		return r.b.onMigration(c.Message())
 	})
+	tb.Handle("/login", r.command(r.b.onLogin))
+	tb.Handle("/logout", r.command(r.b.onLogout))
+	tb.Handle("/connect", r.onConnect, r.adminOnly)
+	tb.Handle("/search", r.onSearch)
+	tb.Handle(&tele.Btn{Unique: "search"}, r.onSearchPage)
+	tb.Handle(tele.OnQuery, r.onQuery)
+	tb.Handle("/thread", r.onThread)
+	tb.Handle(&tele.Btn{Unique: common.ActionMute}, r.onMuteButton)
+	tb.Handle(&tele.Btn{Unique: common.ActionThread}, r.onThreadButton)
+	tb.Handle("/notify", r.command(r.b.onNotify))
+	tb.Handle("/mute", r.command(r.b.onMute))
+	tb.Handle("/unmute", r.command(r.b.onUnmute))
+	tb.Handle("/filter", r.command(r.b.onFilter), r.adminOnly)
+	tb.Handle("/set", r.command(r.b.onSet), r.adminOnly)
 
 	go func() {
 		<-ctxt.Done()
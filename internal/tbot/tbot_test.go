@@ -2,7 +2,6 @@ package tbot
 
 import (
 	"context"
-	"log"
 	"reflect"
 	"testing"
 	"time"
@@ -19,7 +18,7 @@ import (
 func TestOnText_NonReplyIsIgnored(t *testing.T) {
 	s := db.NewInMemoryStorage()
 	h := &fake.HypFactory{}
-	tb := &Bot{"token", s, h}
+	tb := &Bot{Token: "token", Storage: s, Hyp: h}
 
 	err := tb.onText(&tele.Message{
 		ID:   2,
@@ -38,7 +37,7 @@ func TestOnText_NonReplyIsIgnored(t *testing.T) {
 func TestOnText_ReplyNotToBotIsIgnored(t *testing.T) {
 	s := db.NewInMemoryStorage()
 	h := &fake.HypFactory{}
-	tb := &Bot{"token", s, h}
+	tb := &Bot{Token: "token", Storage: s, Hyp: h}
 
 	chat := &tele.Chat{ID: 1}
 	err := tb.onText(&tele.Message{
@@ -64,7 +63,7 @@ func TestOnText_ReplyToBot(t *testing.T) {
 	s := db.NewInMemoryStorage()
 	s.AddSubscription(&common.Subscription{"ht", "g", time.Now(), 1})
 	h := &fake.HypFactory{}
-	tb := &Bot{"token", s, h}
+	tb := &Bot{Token: "token", Storage: s, Hyp: h}
 	// Record a past annotation a0 posted as message 1:2
 	err := s.SetMessageID("a0", common.AnnotationMetadata{HypGroup: "g"}, 1, 2)
 	if err != nil {
@@ -101,7 +100,7 @@ func TestOnText_ReplyToReply(t *testing.T) {
 	s := db.NewInMemoryStorage()
 	s.AddSubscription(&common.Subscription{"ht", "g", time.Now(), 1})
 	h := &fake.HypFactory{}
-	tb := &Bot{"token", s, h}
+	tb := &Bot{Token: "token", Storage: s, Hyp: h}
 	// Record a past annotation a0, which has several ancestors, posted as message 1:2
 	err := s.SetMessageID("a0", common.AnnotationMetadata{References: []string{"x", "y", "z"}, HypGroup: "g"}, 1, 2)
 	if err != nil {
@@ -134,24 +133,31 @@ func TestOnText_ReplyToReply(t *testing.T) {
 	check.AnnotationMessage(t, s, annot.ID, common.AnnotationMetadata{References: expectedRefs, HypGroup: "g"}, 1, 3)
 }
 
-type SentMessage struct {
-	ChatID          int64
-	MessageID       int
-	ParentMessageID int
-	Text            string
-}
-
-type FakeTg struct {
-	NextMessageID int
-	SentMessages  []*SentMessage
-}
+func TestOnText_RecordsOrigin(t *testing.T) {
+	s := db.NewInMemoryStorage()
+	s.AddSubscription(&common.Subscription{"ht", "g", time.Now(), 1})
+	h := &fake.HypFactory{}
+	tb := &Bot{Token: "token", Storage: s, Hyp: h}
+	if err := s.SetMessageID("a0", common.AnnotationMetadata{HypGroup: "g"}, 1, 2); err != nil {
+		t.Fatalf("Failed to initialize storage: %v", err)
+	}
 
-func (tg *FakeTg) Send(chatID int64, parentMessageID int, text string) (int, error) {
-	tg.NextMessageID++
-	log.Printf("Sending messageID=%d in chatID=%d with parent %d: %q", tg.NextMessageID, chatID, parentMessageID, text)
-	msg := &SentMessage{chatID, tg.NextMessageID, parentMessageID, text}
-	tg.SentMessages = append(tg.SentMessages, msg)
-	return msg.MessageID, nil
+	chat := &tele.Chat{ID: 1}
+	alice := &tele.User{ID: 7, FirstName: "Alice"}
+	if err := tb.onText(&tele.Message{ID: 3, Chat: chat, Sender: alice, Text: "hi", ReplyTo: &tele.Message{ID: 2, Chat: chat}}); err != nil {
+		t.Fatalf("Failed to handle message: %v", err)
+	}
+	if len(h.Annots) != 1 {
+		t.Fatalf("onText() created %d annotations; expected 1", len(h.Annots))
+	}
+	got, err := s.AnnotationOrigin(h.Annots[0].ID)
+	if err != nil {
+		t.Fatalf("AnnotationOrigin() returned err=%v", err)
+	}
+	want := &common.AnnotationOrigin{AnnotID: h.Annots[0].ID, ChatID: 1, MessageID: 3, UserID: 7, Name: "Alice", Text: h.Annots[0].Text, Body: "hi"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("AnnotationOrigin() returned %+v; want %+v", got, want)
+	}
 }
 
 func TestPollerAfterBot(t *testing.T) {
@@ -162,7 +168,7 @@ func TestPollerAfterBot(t *testing.T) {
 		{ID: "a2", Group: "g", Updated: hyp.ToTimestamp(LAST_UPDATED), Text: "Parent"},
 	})
 	s := db.NewInMemoryStorage()
-	tg := &FakeTg{}
+	tg := &fake.Tg{}
 	p := &poller.Poller{h, s, tg}
 	err := s.AddSubscription(sub0)
 	if err != nil {
@@ -199,7 +205,7 @@ func TestPollerAfterBot(t *testing.T) {
 		}
 	}()
 
-	tb := &Bot{"tgtoken", s, h}
+	tb := &Bot{Token: "tgtoken", Storage: s, Hyp: h}
 	// Record a past annotation a1, posted as message 1:2
 	err = s.SetMessageID("a0", common.AnnotationMetadata{HypGroup: "g"}, 1, 2)
 	if err != nil {
@@ -229,3 +235,210 @@ func TestPollerAfterBot(t *testing.T) {
 	// Wait for poller to finish
 	<-afterPoll
 }
+
+func TestOnText_ReplyToDigest(t *testing.T) {
+	s := db.NewInMemoryStorage()
+	s.AddSubscription(&common.Subscription{"ht", "g", time.Now(), 1})
+	h := &fake.HypFactory{}
+	tb := &Bot{Token: "token", Storage: s, Hyp: h}
+	key := common.SubKey{HypGroup: "g", ChatID: 1}
+	// Record a past digest of a0 and a1 posted as message 1:2
+	items := []*common.DigestItem{
+		{AnnotID: "a0", Meta: common.AnnotationMetadata{HypGroup: "g"}},
+		{AnnotID: "a1", Meta: common.AnnotationMetadata{References: []string{"x"}, HypGroup: "g"}},
+	}
+	if err := s.CompleteDigest(key, 2, items); err != nil {
+		t.Fatalf("Failed to initialize storage: %v", err)
+	}
+
+	chat := &tele.Chat{ID: 1}
+	sender := &tele.User{FirstName: "Alice"}
+	// A reply without an item number is ignored
+	err := tb.onText(&tele.Message{ID: 3, Chat: chat, Sender: sender, Text: "hello", ReplyTo: &tele.Message{ID: 2, Chat: chat}})
+	if err != nil {
+		t.Fatalf("Failed to handle message: %v", err)
+	}
+	if len(h.Annots) != 0 {
+		t.Fatalf("onText() created %d annotations; expected 0", len(h.Annots))
+	}
+
+	// A reply starting with an item number replies to that item
+	err = tb.onText(&tele.Message{ID: 4, Chat: chat, Sender: sender, Text: "2. hello", ReplyTo: &tele.Message{ID: 2, Chat: chat}})
+	if err != nil {
+		t.Fatalf("Failed to handle message: %v", err)
+	}
+	if len(h.Annots) != 1 {
+		t.Fatalf("onText() created %d annotations; expected 1", len(h.Annots))
+	}
+	annot := h.Annots[0]
+	expectedRefs := []string{"x", "a1"}
+	if !reflect.DeepEqual(annot.References, expectedRefs) {
+		t.Errorf("annot.References=%q; expected %q", annot.References, expectedRefs)
+	}
+	if want := "Alice wrote \"hello\""; annot.Text != want {
+		t.Errorf("annot.Text=%q; expected %q", annot.Text, want)
+	}
+	check.AnnotationMessage(t, s, annot.ID, common.AnnotationMetadata{References: expectedRefs, HypGroup: "g"}, 1, 4)
+}
+
+func TestOnText_ChatTemplate(t *testing.T) {
+	s := db.NewInMemoryStorage()
+	sub := &common.Subscription{"ht", "g", time.Now(), 1}
+	s.AddSubscription(sub)
+	s.SetSubscriptionOption(sub.Key(), poller.OptionChatTemplate, "{{.Sender.Username}} via Telegram: {{.Text}}")
+	h := &fake.HypFactory{}
+	tb := &Bot{Token: "token", Storage: s, Hyp: h}
+	if err := s.SetMessageID("a0", common.AnnotationMetadata{HypGroup: "g"}, 1, 2); err != nil {
+		t.Fatalf("Failed to initialize storage: %v", err)
+	}
+
+	chat := &tele.Chat{ID: 1}
+	err := tb.onText(&tele.Message{
+		ID:      3,
+		Chat:    chat,
+		Sender:  &tele.User{FirstName: "Alice", Username: "alice"},
+		Text:    "hello",
+		ReplyTo: &tele.Message{ID: 2, Chat: chat},
+	})
+	if err != nil {
+		t.Fatalf("Failed to handle message: %v", err)
+	}
+	if len(h.Annots) != 1 {
+		t.Fatalf("onText() created %d annotations; expected 1", len(h.Annots))
+	}
+	if got, want := h.Annots[0].Text, "alice via Telegram: hello"; got != want {
+		t.Errorf("annot.Text=%q; want %q", got, want)
+	}
+}
+
+func TestOnText_Entities(t *testing.T) {
+	s := db.NewInMemoryStorage()
+	sub := &common.Subscription{"ht", "g", time.Now(), 1}
+	s.AddSubscription(sub)
+	s.SetSubscriptionOption(sub.Key(), poller.OptionChatTemplate, "{{.Text}}")
+	h := &fake.HypFactory{}
+	tb := &Bot{Token: "token", Storage: s, Hyp: h}
+	if err := s.SetMessageID("a0", common.AnnotationMetadata{HypGroup: "g"}, 1, 2); err != nil {
+		t.Fatalf("Failed to initialize storage: %v", err)
+	}
+
+	chat := &tele.Chat{ID: 1}
+	err := tb.onText(&tele.Message{
+		ID:     3,
+		Chat:   chat,
+		Sender: &tele.User{FirstName: "Alice"},
+		Text:   "see the docs, *really*",
+		Entities: tele.Entities{
+			{Type: tele.EntityTextLink, Offset: 4, Length: 8, URL: "https://example.test/"},
+			{Type: tele.EntityBold, Offset: 14, Length: 8},
+		},
+		ReplyTo: &tele.Message{ID: 2, Chat: chat},
+	})
+	if err != nil {
+		t.Fatalf("Failed to handle message: %v", err)
+	}
+	if len(h.Annots) != 1 {
+		t.Fatalf("onText() created %d annotations; expected 1", len(h.Annots))
+	}
+	if got, want := h.Annots[0].Text, `see [the docs](https://example.test/), **\*really\***`; got != want {
+		t.Errorf("annot.Text=%q; want %q", got, want)
+	}
+}
+
+func TestOnText_Quote(t *testing.T) {
+	s := db.NewInMemoryStorage()
+	sub := &common.Subscription{"ht", "g", time.Now(), 1}
+	s.AddSubscription(sub)
+	s.SetSubscriptionOption(sub.Key(), poller.OptionChatTemplate, "{{.Text}}")
+	h := &fake.HypFactory{}
+	tb := &Bot{Token: "token", Storage: s, Hyp: h}
+	if err := s.SetMessageID("a0", common.AnnotationMetadata{HypGroup: "g"}, 1, 2); err != nil {
+		t.Fatalf("Failed to initialize storage: %v", err)
+	}
+
+	chat := &tele.Chat{ID: 1}
+	err := tb.onText(&tele.Message{
+		ID:      3,
+		Chat:    chat,
+		Sender:  &tele.User{FirstName: "Alice"},
+		Text:    "I disagree",
+		ReplyTo: &tele.Message{ID: 2, Chat: chat},
+		Quote: &tele.TextQuote{
+			Text:     "the first line\nand *the* second",
+			Entities: tele.Entities{{Type: tele.EntityItalic, Offset: 19, Length: 5}},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to handle message: %v", err)
+	}
+	if len(h.Annots) != 1 {
+		t.Fatalf("onText() created %d annotations; expected 1", len(h.Annots))
+	}
+	if got, want := h.Annots[0].Text, "> the first line\n> and _\\*the\\*_ second\n\nI disagree"; got != want {
+		t.Errorf("annot.Text=%q; want %q", got, want)
+	}
+}
+
+func TestOnText_Hashtags(t *testing.T) {
+	s := db.NewInMemoryStorage()
+	sub := &common.Subscription{"ht", "g", time.Now(), 1}
+	s.AddSubscription(sub)
+	s.SetSubscriptionOption(sub.Key(), poller.OptionTagRules, "lower,spaces")
+	h := &fake.HypFactory{}
+	tb := &Bot{Token: "token", Storage: s, Hyp: h}
+	if err := s.SetMessageID("a0", common.AnnotationMetadata{HypGroup: "g"}, 1, 2); err != nil {
+		t.Fatalf("Failed to initialize storage: %v", err)
+	}
+
+	chat := &tele.Chat{ID: 1}
+	err := tb.onText(&tele.Message{
+		ID:   3,
+		Chat: chat,
+		Text: "Agreed #Climate_Change 👍 #policy #POLICY",
+		Entities: tele.Entities{
+			{Type: tele.EntityHashtag, Offset: 7, Length: 15},
+			{Type: tele.EntityHashtag, Offset: 26, Length: 7},
+			{Type: tele.EntityHashtag, Offset: 34, Length: 7},
+		},
+		ReplyTo: &tele.Message{ID: 2, Chat: chat},
+	})
+	if err != nil {
+		t.Fatalf("Failed to handle message: %v", err)
+	}
+	if len(h.Annots) != 1 {
+		t.Fatalf("onText() created %d annotations; expected 1", len(h.Annots))
+	}
+	if got, want := h.Annots[0].Tags, []string{"climate change", "policy"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("annot.Tags=%q; want %q", got, want)
+	}
+}
+
+func TestOnText_Topic(t *testing.T) {
+	s := db.NewInMemoryStorage()
+	s.AddSubscription(&common.Subscription{"ht", "g", time.Now(), 1})
+	h := &fake.HypFactory{}
+	tb := &Bot{Token: "token", Storage: s, Hyp: h}
+	// The annotation was posted in topic 2.
+	if err := s.SetMessageID("a0", common.AnnotationMetadata{HypGroup: "g"}, 1, 5); err != nil {
+		t.Fatalf("Failed to initialize storage: %v", err)
+	}
+	chat := &tele.Chat{ID: 1}
+
+	// Messages in the topic which aren't replies refer to the topic's first message.
+	err := tb.onText(&tele.Message{ID: 6, Chat: chat, Text: "hello", ThreadID: 2, TopicMessage: true, ReplyTo: &tele.Message{ID: 2, Chat: chat}})
+	if err != nil {
+		t.Fatalf("Failed to handle message: %v", err)
+	}
+	if len(h.Annots) != 0 {
+		t.Fatalf("onText() created annotations %+v for a message which isn't a reply", h.Annots)
+	}
+
+	err = tb.onText(&tele.Message{ID: 7, Chat: chat, Text: "hello", ThreadID: 2, TopicMessage: true, ReplyTo: &tele.Message{ID: 5, Chat: chat, ThreadID: 2}})
+	if err != nil {
+		t.Fatalf("Failed to handle message: %v", err)
+	}
+	if len(h.Annots) != 1 {
+		t.Fatalf("onText() created %d annotations; expected 1", len(h.Annots))
+	}
+	check.AnnotationMessage(t, s, h.Annots[0].ID, common.AnnotationMetadata{References: []string{"a0"}, HypGroup: "g"}, 1, 7)
+}
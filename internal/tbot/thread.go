@@ -0,0 +1,207 @@
+package tbot
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"sort"
+	"strings"
+	"time"
+
+	tele "gopkg.in/telebot.v3"
+
+	"github.com/objectiveryan/irsal/internal/common"
+	"github.com/objectiveryan/irsal/internal/hyp"
+	"github.com/objectiveryan/irsal/internal/markup"
+	"github.com/objectiveryan/irsal/internal/poller"
+)
+
+// The most replies Hypothesis returns from one search
+const threadLimit = 200
+
+const threadTimeFormat = "2 Jan 2006 15:04 MST"
+
+const threadUsageText = "Reply to a message about an annotation with /thread to see its whole discussion."
+
+// A threadEntry is an annotation in a thread's transcript.
+type threadEntry struct {
+	annot *hyp.Annotation
+	data  *poller.AnnotationData
+	// How many replies deep it is; the root is 0
+	depth int
+}
+
+// A transcript is a whole thread, formatted as a Telegram message and as a
+// Markdown document.
+type transcript struct {
+	HTML     string
+	Markdown string
+}
+
+// threadClient returns a client for group which the sender of msg may read
+// with: the chat's subscription, or else their own login.
+func (tb *Bot) threadClient(msg *tele.Message, group string) (hyp.Client, error) {
+	sub, _, err := tb.chatSubscription(msg.Chat.ID, []string{group})
+	if err == nil && sub.HypGroup == group {
+		return tb.Hyp.NewClient(sub.HypToken, group), nil
+	} else if err != nil && err != errNoSubscription {
+		return nil, err
+	}
+	client, _, err := tb.userClient(sendingUser(msg), group)
+	return client, err
+}
+
+// threadEntries fetches the thread of the annotation msg replies to, or
+// returns a reply saying why it can't.
+func (tb *Bot) threadEntries(ctxt context.Context, msg *tele.Message) ([]*threadEntry, string, error) {
+	if msg.ReplyTo == nil {
+		return nil, threadUsageText, nil
+	}
+	annotID, meta, err := tb.Storage.AnnotationID(msg.Chat.ID, msg.ReplyTo.ID)
+	if err == common.ErrNotFound {
+		return nil, threadUsageText, nil
+	} else if err != nil {
+		return nil, "", fmt.Errorf("failed to look up annotation: %v", err)
+	}
+	rootID := annotID
+	if len(meta.References) > 0 {
+		rootID = meta.References[0]
+	}
+	client, err := tb.threadClient(msg, meta.HypGroup)
+	if err != nil {
+		return nil, "", err
+	} else if client == nil {
+		return nil, "Send /login to me in a private chat first, so I can read this group.", nil
+	}
+	root, err := client.Annotation(ctxt, rootID)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to fetch annotation %q: %v", rootID, err)
+	}
+	res, err := client.Search(ctxt, &hyp.SearchQuery{References: rootID, Limit: threadLimit})
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to fetch replies to %q: %v", rootID, err)
+	}
+	return tb.orderThread(root, res.Annotations), "", nil
+}
+
+// created returns when an annotation was created, or else last updated.
+func created(annot *hyp.Annotation) time.Time {
+	if annot.Created != nil {
+		return time.Time(*annot.Created)
+	}
+	if annot.Updated != nil {
+		return time.Time(*annot.Updated)
+	}
+	return time.Time{}
+}
+
+// orderThread orders a thread so that each annotation is followed by its
+// replies, oldest first. Replies to deleted annotations are shown as
+// replies to their closest remaining ancestor.
+func (tb *Bot) orderThread(root *hyp.Annotation, replies []*hyp.Annotation) []*threadEntry {
+	present := map[string]bool{root.ID: true}
+	for _, annot := range replies {
+		present[annot.ID] = true
+	}
+	children := make(map[string][]*hyp.Annotation)
+	for _, annot := range replies {
+		parent := root.ID
+		for i := len(annot.References) - 1; i >= 0; i-- {
+			if present[annot.References[i]] {
+				parent = annot.References[i]
+				break
+			}
+		}
+		children[parent] = append(children[parent], annot)
+	}
+	var entries []*threadEntry
+	var visit func(annot *hyp.Annotation, depth int)
+	visit = func(annot *hyp.Annotation, depth int) {
+		entries = append(entries, &threadEntry{annot, poller.LookupAnnotationData(tb.Storage, annot), depth})
+		replies := children[annot.ID]
+		sort.SliceStable(replies, func(i, j int) bool {
+			return created(replies[i]).Before(created(replies[j]))
+		})
+		for _, reply := range replies {
+			visit(reply, depth+1)
+		}
+	}
+	visit(root, 0)
+	return entries
+}
+
+// newTranscript formats a thread.
+func newTranscript(entries []*threadEntry) *transcript {
+	root := entries[0].data
+	var h, md strings.Builder
+	h.WriteString("<b>Thread</b>")
+	md.WriteString("# Thread")
+	if root.Title != "" {
+		fmt.Fprintf(&h, " on <a href=\"%s\">%s</a>", html.EscapeString(root.URI), html.EscapeString(root.Title))
+		fmt.Fprintf(&md, " on [%s](%s)", root.Title, root.URI)
+	} else if root.URI != "" {
+		fmt.Fprintf(&h, " on %s", html.EscapeString(root.URI))
+		fmt.Fprintf(&md, " on <%s>", root.URI)
+	}
+	fmt.Fprintf(&h, " (%d annotations)\n", len(entries))
+	md.WriteString("\n")
+	if root.Quote != "" {
+		fmt.Fprintf(&h, "<blockquote>%s</blockquote>\n", html.EscapeString(root.Quote))
+		fmt.Fprintf(&md, "\n%s\n", quoteLines(root.Quote, 1))
+	}
+	for _, e := range entries {
+		when := created(e.annot).UTC().Format(threadTimeFormat)
+		fmt.Fprintf(&h, "\n%s<b>%s</b> · <a href=\"%s\">%s</a>\n%s\n", strings.Repeat("↳ ", e.depth), e.data.Mention(), html.EscapeString(e.data.Link), when, e.data.TextHTML)
+		fmt.Fprintf(&md, "\n%s\n", quoteLines(fmt.Sprintf("**%s** · [%s](%s)\n\n%s", e.data.DisplayName, when, e.data.Link, e.data.Text), e.depth))
+	}
+	return &transcript{HTML: h.String(), Markdown: md.String()}
+}
+
+// quoteLines nests Markdown text depth blockquotes deep.
+func quoteLines(text string, depth int) string {
+	if depth == 0 {
+		return text
+	}
+	prefix := strings.Repeat(">", depth) + " "
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(prefix+line, " ")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// sendThread posts the whole thread of the annotation msg replies to, or
+// sends it as a Markdown document if it's too long for a message. It
+// returns a reply instead if it can't.
+func (r *BotRunner) sendThread(msg *tele.Message) (string, error) {
+	entries, reply, err := r.b.threadEntries(context.TODO(), msg)
+	if err != nil || entries == nil {
+		return reply, err
+	}
+	t := newTranscript(entries)
+	opts := &tele.SendOptions{ParseMode: tele.ModeHTML, DisableWebPagePreview: true, ReplyTo: msg}
+	if msg.TopicMessage {
+		opts.ThreadID = msg.ThreadID
+	}
+	if plain, _ := markup.FromHTML(t.HTML); markup.Length(plain) <= maxMessageLength {
+		_, err := r.tb.Send(msg.Chat, t.HTML, opts)
+		return "", err
+	}
+	doc := &tele.Document{
+		File:     tele.FromReader(strings.NewReader(t.Markdown)),
+		FileName: "thread.md",
+		MIME:     "text/markdown",
+		Caption:  fmt.Sprintf("The thread has %d annotations.", len(entries)),
+	}
+	opts.ParseMode = tele.ModeDefault
+	_, err = r.tb.Send(msg.Chat, doc, opts)
+	return "", err
+}
+
+func (r *BotRunner) onThread(c tele.Context) error {
+	reply, err := r.sendThread(c.Message())
+	if err != nil || reply == "" {
+		return err
+	}
+	return c.Reply(reply)
+}
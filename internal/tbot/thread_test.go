@@ -0,0 +1,82 @@
+package tbot
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	tele "gopkg.in/telebot.v3"
+
+	"github.com/objectiveryan/irsal/internal/common"
+	"github.com/objectiveryan/irsal/internal/db"
+	"github.com/objectiveryan/irsal/internal/fake"
+	"github.com/objectiveryan/irsal/internal/hyp"
+)
+
+func TestThreadEntries(t *testing.T) {
+	const CHAT_ID = -1
+	annot := func(id, user string, created int64, refs ...string) *hyp.Annotation {
+		return &hyp.Annotation{
+			ID:         id,
+			Group:      "g",
+			User:       "acct:" + user + "@hypothes.is",
+			Text:       "Text of " + id,
+			References: refs,
+			Created:    hyp.ToTimestamp(time.Unix(created, 0)),
+			Updated:    hyp.ToTimestamp(time.Unix(created, 0)),
+		}
+	}
+	h := fake.NewHypFactory([]*hyp.Annotation{
+		annot("a1", "alice", 1),
+		annot("a2", "bob", 3, "a1"),
+		annot("a3", "carol", 2, "a1"),
+		annot("a4", "alice", 4, "a1", "a2"),
+		// A reply to a deleted reply
+		annot("a5", "dave", 5, "a1", "deleted"),
+		annot("other", "bob", 6),
+	})
+	h.Annots[0].Document = &hyp.Document{Title: []string{"Doc"}}
+	h.Annots[0].URI = "https://example.test/doc"
+	s := db.NewInMemoryStorage()
+	s.AddSubscription(&common.Subscription{"ht", "g", time.Now(), CHAT_ID})
+	s.SetMessageID("a4", common.AnnotationMetadata{References: []string{"a1", "a2"}, HypGroup: "g"}, CHAT_ID, 10)
+	tb := &Bot{Token: "token", Storage: s, Hyp: h}
+	chat := &tele.Chat{ID: CHAT_ID}
+
+	entries, reply, err := tb.threadEntries(context.TODO(), &tele.Message{Chat: chat})
+	if err != nil || entries != nil || !strings.Contains(reply, "Reply to") {
+		t.Errorf("threadEntries() without a reply returned %v, %q, err=%v", entries, reply, err)
+	}
+
+	entries, reply, err = tb.threadEntries(context.TODO(), &tele.Message{Chat: chat, ReplyTo: &tele.Message{ID: 10, Chat: chat}})
+	if err != nil || entries == nil {
+		t.Fatalf("threadEntries() returned %v, %q, err=%v", entries, reply, err)
+	}
+	var got []string
+	for _, e := range entries {
+		got = append(got, strings.Repeat(">", e.depth)+e.annot.ID)
+	}
+	if want := []string{"a1", ">a3", ">a2", ">>a4", ">a5"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("threadEntries() returned %q; want %q", got, want)
+	}
+
+	tr := newTranscript(entries)
+	for _, want := range []string{
+		"<b>Thread</b> on <a href=\"https://example.test/doc\">Doc</a> (5 annotations)\n",
+		"\n↳ ↳ <b>alice</b> · <a href=\"https://hypothes.is/a/a4\">1 Jan 1970 00:00 UTC</a>\nText of a4\n",
+	} {
+		if !strings.Contains(tr.HTML, want) {
+			t.Errorf("Transcript HTML %q doesn't contain %q", tr.HTML, want)
+		}
+	}
+	for _, want := range []string{
+		"# Thread on [Doc](https://example.test/doc)\n",
+		"\n>> **alice** · [1 Jan 1970 00:00 UTC](https://hypothes.is/a/a4)\n>>\n>> Text of a4\n",
+	} {
+		if !strings.Contains(tr.Markdown, want) {
+			t.Errorf("Transcript Markdown %q doesn't contain %q", tr.Markdown, want)
+		}
+	}
+}